@@ -2,8 +2,10 @@ package config
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"strconv"
+	"strings"
 )
 
 type Config struct {
@@ -11,15 +13,221 @@ type Config struct {
 	Location     string
 	TempLocation string
 	Interval     int
-	Backups      int
+	// Backups is the number of most recent generations kept, on top of those kept by Retention
+	Backups     int
+	Concurrency int
+	MaxRetries  int
+	// VerifyInterval is how often, in seconds, every generation is checked against its manifest, and is 0 to never
+	// check them
+	VerifyInterval int
+	// ExportMetadata enables backing up issues, pull requests and their comments next to each bundle
+	ExportMetadata bool
+	// ExportReleases enables backing up releases and their assets
+	ExportReleases bool
+	// BackupGists enables backing up the user's gists, and BackupStarredGists the gists they have starred
+	BackupGists        bool
+	BackupStarredGists bool
+	// BackupStarredRepos enables backing up the repos the user has starred below starred/, keeping them in the most
+	// recent StarredBackups generations and those kept by StarredRetention, or in every generation when neither is set
+	BackupStarredRepos bool
+	StarredBackups     int
+	StarredRetention   Retention
+	// GitHubURL and GitHubAPIURL point at a GitHub Enterprise Server, and are empty when backing up github.com
+	GitHubURL    string
+	GitHubAPIURL string
+	// GitHubAppID and GitHubAppPrivateKeyFile authenticate as a GitHub App, backing up the repos of every installation
+	GitHubAppID             int64
+	GitHubAppPrivateKeyFile string
+	// GitLabToken enables backing up the projects of a GitLab user and their groups, from the instance at GitLabURL
+	GitLabToken string
+	GitLabURL   string
+	// GiteaToken enables backing up the repos of a Gitea or Forgejo user and their orgs, from the instance at GiteaURL
+	GiteaToken string
+	GiteaURL   string
+	// BitbucketToken is the app password, personal token or access token used for Bitbucket
+	BitbucketToken    string
+	BitbucketUsername string
+	BitbucketURL      string
+	// SSHClone clones repos over ssh, authenticating with the key in SSHKeyFile or the ssh agent when it is empty,
+	// and checking host keys against SSHKnownHostsFile
+	SSHClone          bool
+	SSHKeyFile        string
+	SSHKnownHostsFile string
+	// RepoFilter selects which repos of the single account sources are backed up
+	RepoFilter RepoFilter
+	// Sources are further accounts to back up, each with its own credentials, on top of those configured by the
+	// single account variables above
+	Sources []Source
+	// Overrides change how the repos matching their glob are backed up, and are only set by the config file
+	Overrides []Override
+	// GitRemotes are plain git repositories backed up from a fixed url, without a forge to discover them
+	GitRemotes []GitRemote
+	// Storage is where the generations are kept, with Location only holding the state of the backup when they are
+	// kept in S3
+	Storage Storage
+
+	// AgeRecipients are the age or ssh public keys the backup is encrypted to, AgeIdentityFile the key to decrypt it
+	AgeRecipients   []string
+	AgeIdentityFile string
+
+	// Retention keeps daily, weekly, monthly and yearly generations on top of the most recent Backups generations
+	Retention Retention
+}
+
+// GitRemote is a git repository which is backed up to FullName.bundle in each generation, cloned from URL
+type GitRemote struct {
+	FullName string
+	URL      string
+}
+
+// lookup returns the value of the setting with the environment variable name, or an empty string when it is unset
+type lookup func(name string) string
+
+// optionalInt parses the setting name as an int, returning def when it is unset
+func (get lookup) optionalInt(name string, def int) (int, error) {
+	value := get(name)
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// optionalBool parses the setting name as a bool, returning def when it is unset
+func (get lookup) optionalBool(name string, def bool) (bool, error) {
+	value := get(name)
+	if value == "" {
+		return def, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// optionalURL parses the setting name as an http or https url, returning an empty string when it is unset
+func (get lookup) optionalURL(name string) (string, error) {
+	value := get(name)
+	if value == "" {
+		return "", nil
+	}
+	err := checkURL(value)
+	if err != nil {
+		return "", err
+	}
+	return value, nil
 }
 
+// parseGitRemotes parses whitespace separated owner/name=url entries, such as
+// "tools/dotfiles=git@example.com:me/dotfiles.git mirrors/git=https://git.kernel.org/pub/scm/git/git.git"
+func parseGitRemotes(value string) ([]GitRemote, error) {
+	remotes := make([]GitRemote, 0)
+	seen := make(map[string]bool)
+	for _, entry := range strings.Fields(value) {
+		fullName, remoteURL, ok := strings.Cut(entry, "=")
+		if !ok || !strings.Contains(fullName, "/") || remoteURL == "" {
+			return nil, fmt.Errorf("%q is not of the form owner/name=url", entry)
+		}
+		if seen[fullName] {
+			return nil, fmt.Errorf("%s is listed more than once", fullName)
+		}
+		seen[fullName] = true
+		remotes = append(remotes, GitRemote{FullName: fullName, URL: remoteURL})
+	}
+	return remotes, nil
+}
+
+// NewConfig loads the config from the environment, and from the config file at CONFIG_FILE when it is set
 func NewConfig() (*Config, error) {
-	token := os.Getenv("GITHUB_TOKEN")
-	location := os.Getenv("LOCATION")
-	interval := os.Getenv("INTERVAL")
-	backups := os.Getenv("BACKUPS")
-	tmp_location := os.Getenv("TEMP_LOCATION")
+	file, err := loadFile()
+	if err != nil {
+		return nil, err
+	}
+	return newConfig(file)
+}
+
+// LoadStorage loads only the storage settings from the environment and the config file, for the commands which
+// read the generations without backing anything up
+func LoadStorage() (Storage, error) {
+	file, err := loadFile()
+	if err != nil {
+		return Storage{}, err
+	}
+	get, err := newLookup(file)
+	if err != nil {
+		return Storage{}, err
+	}
+	storage, err := parseStorage(get)
+	if err != nil {
+		return Storage{}, fmt.Errorf("invalid storage: %v", err)
+	}
+	return storage, nil
+}
+
+// LoadAgeRecipients loads only AGE_RECIPIENTS from the environment and the config file, for the commands which
+// rewrite encrypted files without backing anything up
+func LoadAgeRecipients() ([]string, error) {
+	file, err := loadFile()
+	if err != nil {
+		return nil, err
+	}
+	get, err := newLookup(file)
+	if err != nil {
+		return nil, err
+	}
+	return get.optionalList("AGE_RECIPIENTS"), nil
+}
+
+// loadFile reads the config file at CONFIG_FILE, returning an empty file when it is unset
+func loadFile() (*File, error) {
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return &File{}, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file due to error %w", err)
+	}
+	defer func() { _ = f.Close() }()
+	file, err := parseFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file: %v", err)
+	}
+	return file, nil
+}
+
+// LoadConfig loads the config from the config file read from r, with environment variables taking precedence over
+// the settings in the file
+func LoadConfig(r io.Reader) (*Config, error) {
+	file, err := parseFile(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file: %v", err)
+	}
+	return newConfig(file)
+}
+
+// newLookup returns the settings of the environment, falling back to the settings in file
+func newLookup(file *File) (lookup, error) {
+	values, err := file.values()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file: %v", err)
+	}
+	return lookup(func(name string) string {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+		return values[name]
+	}), nil
+}
+
+// newConfig loads the config from the environment, falling back to the settings in file
+func newConfig(file *File) (*Config, error) {
+	get, err := newLookup(file)
+	if err != nil {
+		return nil, err
+	}
+
+	token := get("GITHUB_TOKEN")
+	location := get("LOCATION")
+	interval := get("INTERVAL")
+	tmp_location := get("TEMP_LOCATION")
 
 	// ensure tmp_location exists on the filesystem
 	if _, err := os.Stat(tmp_location); os.IsNotExist(err) {
@@ -32,17 +240,216 @@ func NewConfig() (*Config, error) {
 		return nil, fmt.Errorf("invalid interval: %v", err)
 	}
 
-	// parse backups as int
-	backups_int, err := strconv.Atoi(backups)
+	// parse backups and the retention, at least one of which keeps a generation
+	backups_int, retention, err := parseRetention(get)
 	if err != nil {
-		return nil, fmt.Errorf("invalid backups: %v", err)
+		return nil, err
+	}
+
+	// parse verify interval as int, defaulting to never verifying the backups
+	verify_interval, err := get.optionalInt("VERIFY_INTERVAL", 0)
+	if err != nil || verify_interval < 0 {
+		return nil, fmt.Errorf("invalid verify interval: %v", get("VERIFY_INTERVAL"))
+	}
+
+	// parse concurrency as int, defaulting to 4 parallel downloads
+	concurrency, err := get.optionalInt("CONCURRENCY", 4)
+	if err != nil || concurrency < 1 {
+		return nil, fmt.Errorf("invalid concurrency: %v", get("CONCURRENCY"))
+	}
+
+	// parse max retries as int, defaulting to 10 retries per repo
+	max_retries, err := get.optionalInt("MAX_RETRIES", 10)
+	if err != nil || max_retries < 0 {
+		return nil, fmt.Errorf("invalid max retries: %v", get("MAX_RETRIES"))
+	}
+
+	// parse export metadata as bool, defaulting to off
+	export_metadata, err := get.optionalBool("EXPORT_METADATA", false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid export metadata: %v", err)
+	}
+
+	// parse export releases as bool, defaulting to off
+	export_releases, err := get.optionalBool("EXPORT_RELEASES", false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid export releases: %v", err)
+	}
+
+	// parse backup gists and backup starred gists as bools, defaulting to off
+	backup_gists, err := get.optionalBool("BACKUP_GISTS", false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup gists: %v", err)
+	}
+	backup_starred_gists, err := get.optionalBool("BACKUP_STARRED_GISTS", false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup starred gists: %v", err)
+	}
+
+	// parse backup starred repos as bool, defaulting to off, and their retention, defaulting to every generation
+	backup_starred_repos, err := get.optionalBool("BACKUP_STARRED_REPOS", false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup starred repos: %v", err)
+	}
+	starred_backups, starred_retention, err := parsePrefixedRetention(get, "STARRED_")
+	if err != nil {
+		return nil, err
+	}
+
+	// parse the github enterprise urls, defaulting the api to /api/v3/ on the same host
+	github_url, err := get.optionalURL("GITHUB_URL")
+	if err != nil {
+		return nil, fmt.Errorf("invalid github url: %v", err)
+	}
+	github_api_url, err := get.optionalURL("GITHUB_API_URL")
+	if err != nil {
+		return nil, fmt.Errorf("invalid github api url: %v", err)
+	}
+	if github_api_url != "" && github_url == "" {
+		return nil, fmt.Errorf("GITHUB_URL must be set when GITHUB_API_URL is set")
+	}
+	if github_url != "" && github_api_url == "" {
+		github_api_url = strings.TrimSuffix(github_url, "/") + "/api/v3/"
+	}
+
+	// parse the github app id, which needs the app's private key to sign requests
+	github_app_id, err := get.optionalInt("GITHUB_APP_ID", 0)
+	if err != nil || github_app_id < 0 {
+		return nil, fmt.Errorf("invalid github app id: %v", get("GITHUB_APP_ID"))
+	}
+	github_app_private_key_file := get("GITHUB_APP_PRIVATE_KEY_FILE")
+	if (github_app_id == 0) != (github_app_private_key_file == "") {
+		return nil, fmt.Errorf("GITHUB_APP_ID and GITHUB_APP_PRIVATE_KEY_FILE must be set together")
+	}
+	if github_app_private_key_file != "" {
+		if _, err := os.Stat(github_app_private_key_file); err != nil {
+			return nil, fmt.Errorf("invalid github app private key file: %v", err)
+		}
+	}
+
+	// parse the gitlab url, defaulting to gitlab.com
+	gitlab_token := get("GITLAB_TOKEN")
+	gitlab_url, err := get.optionalURL("GITLAB_URL")
+	if err != nil {
+		return nil, fmt.Errorf("invalid gitlab url: %v", err)
+	}
+	if gitlab_url == "" {
+		gitlab_url = "https://gitlab.com"
+	}
+
+	// parse the gitea url, which has no default as there is no main instance
+	gitea_token := get("GITEA_TOKEN")
+	gitea_url, err := get.optionalURL("GITEA_URL")
+	if err != nil {
+		return nil, fmt.Errorf("invalid gitea url: %v", err)
+	}
+	if gitea_token != "" && gitea_url == "" {
+		return nil, fmt.Errorf("GITEA_URL must be set when GITEA_TOKEN is set")
+	}
+
+	// parse the bitbucket url, which is only set for bitbucket server
+	bitbucket_token := get("BITBUCKET_TOKEN")
+	bitbucket_username := get("BITBUCKET_USERNAME")
+	bitbucket_url, err := get.optionalURL("BITBUCKET_URL")
+	if err != nil {
+		return nil, fmt.Errorf("invalid bitbucket url: %v", err)
+	}
+
+	// parse the plain git remotes
+	git_remotes, err := parseGitRemotes(get("GIT_REMOTES"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid git remotes: %v", err)
+	}
+
+	// parse the ssh clone mode, which needs a key file or an ssh agent to authenticate with
+	ssh_clone, err := get.optionalBool("SSH_CLONE", false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ssh clone: %v", err)
+	}
+	ssh_key_file := get("SSH_KEY_FILE")
+	ssh_known_hosts_file := get("SSH_KNOWN_HOSTS_FILE")
+	if ssh_clone {
+		if ssh_key_file == "" && os.Getenv("SSH_AUTH_SOCK") == "" {
+			return nil, fmt.Errorf("SSH_KEY_FILE or SSH_AUTH_SOCK must be set when SSH_CLONE is set")
+		}
+		for _, file := range []string{ssh_key_file, ssh_known_hosts_file} {
+			if _, err := os.Stat(file); file != "" && err != nil {
+				return nil, fmt.Errorf("invalid ssh file: %v", err)
+			}
+		}
+	}
+
+	// parse the filter of the single account sources
+	repo_filter, err := parseRepoFilter(get)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repo filter: %v", err)
+	}
+
+	// parse the list of further sources
+	sources, err := parseSources(get("SOURCES"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid sources: %v", err)
+	}
+
+	// parse where the generations are kept
+	storage, err := parseStorage(get)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage: %v", err)
+	}
+
+	// parse the encryption recipients, which need an identity to read back what was encrypted
+	age_recipients := get.optionalList("AGE_RECIPIENTS")
+	age_identity_file := get("AGE_IDENTITY_FILE")
+	if len(age_recipients) > 0 && age_identity_file == "" {
+		return nil, fmt.Errorf("AGE_IDENTITY_FILE must be set when AGE_RECIPIENTS is set")
+	}
+	if age_identity_file != "" {
+		if _, err := os.Stat(age_identity_file); err != nil {
+			return nil, fmt.Errorf("invalid age identity file: %v", err)
+		}
+	}
+
+	if token == "" && github_app_id == 0 && gitlab_token == "" && gitea_token == "" && bitbucket_token == "" && len(sources) == 0 && len(git_remotes) == 0 {
+		return nil, fmt.Errorf("at least one of GITHUB_TOKEN, GITHUB_APP_ID, GITLAB_TOKEN, GITEA_TOKEN, BITBUCKET_TOKEN, SOURCES or GIT_REMOTES must be set")
 	}
 
 	return &Config{
-		Token:        token,
-		Location:     location,
-		Interval:     interval_int,
-		Backups:      backups_int,
-		TempLocation: tmp_location,
+		Token:                   token,
+		Location:                location,
+		Interval:                interval_int,
+		Backups:                 backups_int,
+		VerifyInterval:          verify_interval,
+		TempLocation:            tmp_location,
+		Concurrency:             concurrency,
+		MaxRetries:              max_retries,
+		ExportMetadata:          export_metadata,
+		ExportReleases:          export_releases,
+		BackupGists:             backup_gists,
+		BackupStarredGists:      backup_starred_gists,
+		BackupStarredRepos:      backup_starred_repos,
+		StarredBackups:          starred_backups,
+		StarredRetention:        starred_retention,
+		GitHubURL:               github_url,
+		GitHubAPIURL:            github_api_url,
+		GitHubAppID:             int64(github_app_id),
+		GitHubAppPrivateKeyFile: github_app_private_key_file,
+		GitLabToken:             gitlab_token,
+		GitLabURL:               gitlab_url,
+		GiteaToken:              gitea_token,
+		GiteaURL:                gitea_url,
+		BitbucketToken:          bitbucket_token,
+		BitbucketUsername:       bitbucket_username,
+		BitbucketURL:            bitbucket_url,
+		SSHClone:                ssh_clone,
+		SSHKeyFile:              ssh_key_file,
+		SSHKnownHostsFile:       ssh_known_hosts_file,
+		RepoFilter:              repo_filter,
+		Sources:                 sources,
+		Overrides:               file.Overrides,
+		GitRemotes:              git_remotes,
+		Storage:                 storage,
+		AgeRecipients:           age_recipients,
+		AgeIdentityFile:         age_identity_file,
+		Retention:               retention,
 	}, nil
 }
@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -67,6 +68,39 @@ func TestNewConfig_InvalidBackups(t *testing.T) {
 	}
 }
 
+func TestNewConfig_Retention(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	t.Setenv("GITHUB_TOKEN", "tok")
+	t.Setenv("LOCATION", "/loc")
+	t.Setenv("INTERVAL", "86400")
+	t.Setenv("BACKUPS", "")
+	t.Setenv("TEMP_LOCATION", tmpDir)
+
+	if _, err := NewConfig(); err == nil {
+		t.Error("expected error when neither BACKUPS nor a KEEP_ setting is set")
+	}
+
+	// BACKUPS may be left out once a KEEP_ setting keeps generations
+	t.Setenv("KEEP_DAILY", "7")
+	t.Setenv("KEEP_WEEKLY", "4")
+	t.Setenv("KEEP_MONTHLY", "12")
+	t.Setenv("KEEP_YEARLY", "3")
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := Retention{Daily: 7, Weekly: 4, Monthly: 12, Yearly: 3}
+	if cfg.Backups != 0 || cfg.Retention != want {
+		t.Errorf("Backups, Retention = %d, %+v, want 0, %+v", cfg.Backups, cfg.Retention, want)
+	}
+
+	t.Setenv("KEEP_WEEKLY", "-1")
+	if _, err := NewConfig(); err == nil {
+		t.Error("expected error for a negative KEEP_WEEKLY")
+	}
+}
+
 func TestNewConfig_TempLocationNotExist(t *testing.T) {
 	t.Setenv("GITHUB_TOKEN", "tok")
 	t.Setenv("LOCATION", "/loc")
@@ -94,3 +128,712 @@ func TestNewConfig_EmptyInterval(t *testing.T) {
 		t.Fatal("expected error for empty INTERVAL, got nil")
 	}
 }
+
+func TestNewConfig_ConcurrencyDefaults(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	t.Setenv("GITHUB_TOKEN", "tok")
+	t.Setenv("LOCATION", "/loc")
+	t.Setenv("INTERVAL", "100")
+	t.Setenv("BACKUPS", "5")
+	t.Setenv("TEMP_LOCATION", tmpDir)
+	t.Setenv("CONCURRENCY", "")
+	t.Setenv("MAX_RETRIES", "")
+
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Concurrency != 4 {
+		t.Errorf("Concurrency = %d, want 4", cfg.Concurrency)
+	}
+	if cfg.MaxRetries != 10 {
+		t.Errorf("MaxRetries = %d, want 10", cfg.MaxRetries)
+	}
+
+	t.Setenv("CONCURRENCY", "16")
+	t.Setenv("MAX_RETRIES", "0")
+	cfg, err = NewConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Concurrency != 16 || cfg.MaxRetries != 0 {
+		t.Errorf("Concurrency, MaxRetries = %d, %d, want 16, 0", cfg.Concurrency, cfg.MaxRetries)
+	}
+}
+
+func TestNewConfig_InvalidConcurrency(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	t.Setenv("GITHUB_TOKEN", "tok")
+	t.Setenv("LOCATION", "/loc")
+	t.Setenv("INTERVAL", "100")
+	t.Setenv("BACKUPS", "5")
+	t.Setenv("TEMP_LOCATION", tmpDir)
+
+	for _, value := range []string{"0", "-1", "many"} {
+		t.Setenv("CONCURRENCY", value)
+		if _, err := NewConfig(); err == nil {
+			t.Errorf("expected error for CONCURRENCY=%q", value)
+		}
+	}
+}
+
+func TestNewConfig_ExportMetadata(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	t.Setenv("GITHUB_TOKEN", "tok")
+	t.Setenv("LOCATION", "/loc")
+	t.Setenv("INTERVAL", "100")
+	t.Setenv("BACKUPS", "5")
+	t.Setenv("TEMP_LOCATION", tmpDir)
+	t.Setenv("EXPORT_METADATA", "true")
+
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.ExportMetadata {
+		t.Error("ExportMetadata = false, want true")
+	}
+
+	t.Setenv("EXPORT_METADATA", "sometimes")
+	if _, err := NewConfig(); err == nil {
+		t.Error("expected error for invalid EXPORT_METADATA")
+	}
+}
+
+func TestNewConfig_GitHubURL(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	t.Setenv("GITHUB_TOKEN", "tok")
+	t.Setenv("LOCATION", "/loc")
+	t.Setenv("INTERVAL", "100")
+	t.Setenv("BACKUPS", "5")
+	t.Setenv("TEMP_LOCATION", tmpDir)
+
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.GitHubURL != "" || cfg.GitHubAPIURL != "" {
+		t.Errorf("GitHubURL, GitHubAPIURL = %q, %q, want empty", cfg.GitHubURL, cfg.GitHubAPIURL)
+	}
+
+	t.Setenv("GITHUB_URL", "https://github.example.com/")
+	cfg, err = NewConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.GitHubAPIURL != "https://github.example.com/api/v3/" {
+		t.Errorf("GitHubAPIURL = %q, want default api url", cfg.GitHubAPIURL)
+	}
+
+	t.Setenv("GITHUB_API_URL", "https://api.example.com/")
+	cfg, err = NewConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.GitHubAPIURL != "https://api.example.com/" {
+		t.Errorf("GitHubAPIURL = %q, want %q", cfg.GitHubAPIURL, "https://api.example.com/")
+	}
+
+	t.Setenv("GITHUB_URL", "")
+	if _, err := NewConfig(); err == nil {
+		t.Error("expected error for GITHUB_API_URL without GITHUB_URL")
+	}
+
+	t.Setenv("GITHUB_URL", "github.example.com")
+	if _, err := NewConfig(); err == nil {
+		t.Error("expected error for GITHUB_URL without a scheme")
+	}
+}
+
+func TestNewConfig_GitHubApp(t *testing.T) {
+	tmpDir := t.TempDir()
+	keyFile := filepath.Join(tmpDir, "app.pem")
+	if err := os.WriteFile(keyFile, []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("GITHUB_TOKEN", "")
+	t.Setenv("LOCATION", "/loc")
+	t.Setenv("INTERVAL", "100")
+	t.Setenv("BACKUPS", "5")
+	t.Setenv("TEMP_LOCATION", tmpDir)
+	t.Setenv("GITHUB_APP_ID", "12345")
+
+	if _, err := NewConfig(); err == nil {
+		t.Error("expected error for GITHUB_APP_ID without GITHUB_APP_PRIVATE_KEY_FILE")
+	}
+
+	t.Setenv("GITHUB_APP_PRIVATE_KEY_FILE", filepath.Join(tmpDir, "missing.pem"))
+	if _, err := NewConfig(); err == nil {
+		t.Error("expected error for a missing private key file")
+	}
+
+	t.Setenv("GITHUB_APP_PRIVATE_KEY_FILE", keyFile)
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.GitHubAppID != 12345 || cfg.GitHubAppPrivateKeyFile != keyFile {
+		t.Errorf("GitHubAppID, GitHubAppPrivateKeyFile = %d, %q", cfg.GitHubAppID, cfg.GitHubAppPrivateKeyFile)
+	}
+}
+
+func TestNewConfig_GitLab(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	t.Setenv("GITHUB_TOKEN", "")
+	t.Setenv("LOCATION", "/loc")
+	t.Setenv("INTERVAL", "100")
+	t.Setenv("BACKUPS", "5")
+	t.Setenv("TEMP_LOCATION", tmpDir)
+
+	if _, err := NewConfig(); err == nil {
+		t.Error("expected error when neither GITHUB_TOKEN nor GITLAB_TOKEN is set")
+	}
+
+	t.Setenv("GITLAB_TOKEN", "glpat-test")
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.GitLabToken != "glpat-test" || cfg.GitLabURL != "https://gitlab.com" {
+		t.Errorf("GitLabToken, GitLabURL = %q, %q, want token and gitlab.com", cfg.GitLabToken, cfg.GitLabURL)
+	}
+
+	t.Setenv("GITLAB_URL", "https://gitlab.example.com")
+	cfg, err = NewConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.GitLabURL != "https://gitlab.example.com" {
+		t.Errorf("GitLabURL = %q, want %q", cfg.GitLabURL, "https://gitlab.example.com")
+	}
+}
+
+func TestNewConfig_Gitea(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	t.Setenv("GITHUB_TOKEN", "")
+	t.Setenv("LOCATION", "/loc")
+	t.Setenv("INTERVAL", "100")
+	t.Setenv("BACKUPS", "5")
+	t.Setenv("TEMP_LOCATION", tmpDir)
+	t.Setenv("GITEA_TOKEN", "gitea-token")
+
+	if _, err := NewConfig(); err == nil {
+		t.Error("expected error for GITEA_TOKEN without GITEA_URL")
+	}
+
+	t.Setenv("GITEA_URL", "https://codeberg.org")
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.GiteaToken != "gitea-token" || cfg.GiteaURL != "https://codeberg.org" {
+		t.Errorf("GiteaToken, GiteaURL = %q, %q", cfg.GiteaToken, cfg.GiteaURL)
+	}
+}
+
+func TestNewConfig_Bitbucket(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	t.Setenv("GITHUB_TOKEN", "")
+	t.Setenv("LOCATION", "/loc")
+	t.Setenv("INTERVAL", "100")
+	t.Setenv("BACKUPS", "5")
+	t.Setenv("TEMP_LOCATION", tmpDir)
+	t.Setenv("BITBUCKET_TOKEN", "app-password")
+	t.Setenv("BITBUCKET_USERNAME", "alice")
+
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.BitbucketToken != "app-password" || cfg.BitbucketUsername != "alice" || cfg.BitbucketURL != "" {
+		t.Errorf("unexpected bitbucket config %+v", cfg)
+	}
+
+	t.Setenv("BITBUCKET_URL", "bitbucket.example.com")
+	if _, err := NewConfig(); err == nil {
+		t.Error("expected error for BITBUCKET_URL without a scheme")
+	}
+}
+
+func TestNewConfig_SSHClone(t *testing.T) {
+	tmpDir := t.TempDir()
+	keyFile := filepath.Join(tmpDir, "id_ed25519")
+	if err := os.WriteFile(keyFile, []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("GITHUB_TOKEN", "tok")
+	t.Setenv("LOCATION", "/loc")
+	t.Setenv("INTERVAL", "100")
+	t.Setenv("BACKUPS", "5")
+	t.Setenv("TEMP_LOCATION", tmpDir)
+	t.Setenv("SSH_CLONE", "true")
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	if _, err := NewConfig(); err == nil {
+		t.Error("expected error for SSH_CLONE without a key or agent")
+	}
+
+	t.Setenv("SSH_KEY_FILE", keyFile)
+	t.Setenv("SSH_KNOWN_HOSTS_FILE", filepath.Join(tmpDir, "missing"))
+	if _, err := NewConfig(); err == nil {
+		t.Error("expected error for a missing known hosts file")
+	}
+
+	t.Setenv("SSH_KNOWN_HOSTS_FILE", "")
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.SSHClone || cfg.SSHKeyFile != keyFile {
+		t.Errorf("SSHClone, SSHKeyFile = %v, %q", cfg.SSHClone, cfg.SSHKeyFile)
+	}
+}
+
+func TestParseGitRemotes(t *testing.T) {
+	remotes, err := parseGitRemotes("tools/dotfiles=git@example.com:me/dotfiles.git\n  mirrors/search=https://example.com/search.git?ref=a")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []GitRemote{
+		{FullName: "tools/dotfiles", URL: "git@example.com:me/dotfiles.git"},
+		{FullName: "mirrors/search", URL: "https://example.com/search.git?ref=a"},
+	}
+	if len(remotes) != len(want) || remotes[0] != want[0] || remotes[1] != want[1] {
+		t.Errorf("parseGitRemotes() = %v, want %v", remotes, want)
+	}
+
+	for _, value := range []string{"dotfiles=/srv/dotfiles.git", "tools/dotfiles", "tools/dotfiles=", "a/b=/x a/b=/y"} {
+		if _, err := parseGitRemotes(value); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+}
+
+func TestNewConfig_Sources(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	t.Setenv("GITHUB_TOKEN", "ghp_personal")
+	t.Setenv("LOCATION", "/loc")
+	t.Setenv("INTERVAL", "100")
+	t.Setenv("BACKUPS", "5")
+	t.Setenv("TEMP_LOCATION", tmpDir)
+	t.Setenv("SOURCES", `[
+		{"type": "github", "token": "github_pat_acme", "owners": ["acme"]},
+		{"type": "github", "token": "github_pat_widgets", "url": "https://github.example.com", "owners": ["widgets"]},
+		{"type": "gitlab", "token": "glpat-work"}
+	]`)
+
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sources := cfg.AllSources()
+	if len(sources) != 4 {
+		t.Fatalf("expected GITHUB_TOKEN and 3 listed sources, got %+v", sources)
+	}
+	if sources[0].Type != SourceGitHub || sources[0].Token != "ghp_personal" || len(sources[0].Owners) != 0 {
+		t.Errorf("first source = %+v, want the GITHUB_TOKEN account", sources[0])
+	}
+	if sources[1].Token != "github_pat_acme" || len(sources[1].Owners) != 1 || sources[1].Owners[0] != "acme" {
+		t.Errorf("second source = %+v", sources[1])
+	}
+	if sources[2].APIURL != "https://github.example.com/api/v3/" {
+		t.Errorf("enterprise source api url = %q, want the default", sources[2].APIURL)
+	}
+	if sources[3].URL != "https://gitlab.com" {
+		t.Errorf("gitlab source url = %q, want gitlab.com", sources[3].URL)
+	}
+
+	// the listed sources are enough on their own
+	t.Setenv("GITHUB_TOKEN", "")
+	if _, err := NewConfig(); err != nil {
+		t.Errorf("unexpected error without GITHUB_TOKEN: %v", err)
+	}
+
+	for _, invalid := range []string{
+		`{"type": "github"}`,
+		`[{"type": "github"}]`,
+		`[{"type": "svn", "token": "tok"}]`,
+		`[{"type": "gitea", "token": "tok"}]`,
+		`[{"type": "github", "token": "tok", "tokn": "typo"}]`,
+	} {
+		t.Setenv("SOURCES", invalid)
+		if _, err := NewConfig(); err == nil {
+			t.Errorf("expected error for SOURCES=%s", invalid)
+		}
+	}
+}
+
+func TestNewConfig_StarredRepos(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	t.Setenv("GITHUB_TOKEN", "ghp_personal")
+	t.Setenv("LOCATION", "/loc")
+	t.Setenv("INTERVAL", "100")
+	t.Setenv("BACKUPS", "30")
+	t.Setenv("TEMP_LOCATION", tmpDir)
+	t.Setenv("BACKUP_STARRED_REPOS", "true")
+	t.Setenv("STARRED_BACKUPS", "7")
+	t.Setenv("STARRED_KEEP_MONTHLY", "6")
+
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.BackupStarredRepos || cfg.StarredBackups != 7 || cfg.StarredRetention != (Retention{Monthly: 6}) {
+		t.Errorf("BackupStarredRepos, StarredBackups, StarredRetention = %v, %d, %+v", cfg.BackupStarredRepos, cfg.StarredBackups, cfg.StarredRetention)
+	}
+	if sources := cfg.AllSources(); !sources[0].Starred {
+		t.Errorf("GITHUB_TOKEN source = %+v, want its starred repos", sources[0])
+	}
+
+	t.Setenv("STARRED_BACKUPS", "-1")
+	if _, err := NewConfig(); err == nil {
+		t.Error("expected error for negative STARRED_BACKUPS")
+	}
+	t.Setenv("STARRED_BACKUPS", "")
+	t.Setenv("STARRED_KEEP_MONTHLY", "-1")
+	if _, err := NewConfig(); err == nil {
+		t.Error("expected error for negative STARRED_KEEP_MONTHLY")
+	}
+	t.Setenv("STARRED_KEEP_MONTHLY", "")
+	t.Setenv("SOURCES", `[{"type": "gitlab", "token": "glpat-work", "starred": true}]`)
+	if _, err := NewConfig(); err == nil {
+		t.Error("expected error for starred repos of a gitlab source")
+	}
+}
+
+func TestNewConfig_RepoFilter(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	t.Setenv("GITHUB_TOKEN", "ghp_personal")
+	t.Setenv("LOCATION", "/loc")
+	t.Setenv("INTERVAL", "100")
+	t.Setenv("BACKUPS", "5")
+	t.Setenv("TEMP_LOCATION", tmpDir)
+	t.Setenv("REPO_EXCLUDE", "acme/legacy-*, */scratch")
+	t.Setenv("REPO_VISIBILITY", "private,internal")
+	t.Setenv("REPO_FORKS", "false")
+	t.Setenv("REPO_MAX_SIZE_MB", "500")
+	t.Setenv("SOURCES", `[{"type": "gitlab", "token": "glpat-work", "topics": ["backup"], "archived": true}]`)
+
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sources := cfg.AllSources()
+	if len(sources) != 2 {
+		t.Fatalf("expected 2 sources, got %+v", sources)
+	}
+
+	// the REPO_ variables filter the single account sources only
+	filter := sources[0].RepoFilter
+	if len(filter.Exclude) != 2 || filter.Exclude[1] != "*/scratch" || len(filter.Visibility) != 2 {
+		t.Errorf("exclude, visibility = %q, %q", filter.Exclude, filter.Visibility)
+	}
+	if filter.Forks == nil || *filter.Forks || filter.Archived != nil || filter.MaxSizeMB != 500 {
+		t.Errorf("unexpected filter %+v", filter)
+	}
+	filter = sources[1].RepoFilter
+	if len(filter.Topics) != 1 || filter.Archived == nil || !*filter.Archived || len(filter.Exclude) != 0 {
+		t.Errorf("gitlab source filter = %+v, want its own settings", filter)
+	}
+
+	for name, invalid := range map[string]string{
+		"REPO_VISIBILITY":  "secret",
+		"REPO_FORKS":       "sometimes",
+		"REPO_MAX_SIZE_MB": "-1",
+		"REPO_INCLUDE":     "acme/[",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, invalid)
+			if _, err := NewConfig(); err == nil {
+				t.Errorf("expected error for %s=%s", name, invalid)
+			}
+		})
+	}
+	t.Setenv("SOURCES", `[{"type": "gitlab", "token": "glpat-work", "visibility": ["hidden"]}]`)
+	if _, err := NewConfig(); err == nil {
+		t.Error("expected error for a source with an invalid visibility")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("GITHUB_TOKEN", "")
+	t.Setenv("LOCATION", "")
+	t.Setenv("INTERVAL", "")
+	t.Setenv("BACKUPS", "")
+	t.Setenv("TEMP_LOCATION", "")
+
+	file := `
+location: /repository
+temp_location: ` + tmpDir + `
+interval: 3600
+backups: 14
+keep_monthly: 12
+export_metadata: true
+repo_exclude: [acme/scratch]
+repo_forks: false
+sources:
+  - type: github
+    token: github_pat_acme
+    owners: [acme]
+    include: [acme/api-*]
+    max_size_mb: 100
+git_remotes:
+  tools/dotfiles: git@example.com:me/dotfiles.git
+overrides:
+  - match: acme/*
+    backups: 3
+  - match: acme/huge
+    skip: true
+    export_metadata: false
+`
+	cfg, err := LoadConfig(strings.NewReader(file))
+	if err != nil {
+		t.Fatalf("LoadConfig() error: %v", err)
+	}
+	if cfg.Location != "/repository" || cfg.Interval != 3600 || cfg.Backups != 14 || cfg.Retention.Monthly != 12 || !cfg.ExportMetadata {
+		t.Errorf("unexpected settings %+v", cfg)
+	}
+	if len(cfg.Sources) != 1 || cfg.Sources[0].Owners[0] != "acme" || cfg.Sources[0].Include[0] != "acme/api-*" || cfg.Sources[0].MaxSizeMB != 100 {
+		t.Errorf("Sources = %+v", cfg.Sources)
+	}
+	if len(cfg.RepoFilter.Exclude) != 1 || cfg.RepoFilter.Forks == nil || *cfg.RepoFilter.Forks {
+		t.Errorf("RepoFilter = %+v", cfg.RepoFilter)
+	}
+	if len(cfg.GitRemotes) != 1 || cfg.GitRemotes[0].FullName != "tools/dotfiles" {
+		t.Errorf("GitRemotes = %+v", cfg.GitRemotes)
+	}
+	if len(cfg.Overrides) != 2 || cfg.Overrides[0].Backups != 3 || !cfg.Overrides[1].Skip || *cfg.Overrides[1].ExportMetadata {
+		t.Errorf("Overrides = %+v", cfg.Overrides)
+	}
+
+	// environment variables take precedence over the file
+	t.Setenv("BACKUPS", "30")
+	t.Setenv("EXPORT_METADATA", "false")
+	cfg, err = LoadConfig(strings.NewReader(file))
+	if err != nil {
+		t.Fatalf("LoadConfig() error: %v", err)
+	}
+	if cfg.Backups != 30 || cfg.ExportMetadata || cfg.Interval != 3600 {
+		t.Errorf("Backups, ExportMetadata, Interval = %d, %v, %d, want the environment to win", cfg.Backups, cfg.ExportMetadata, cfg.Interval)
+	}
+}
+
+func TestLoadConfig_Invalid(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("GITHUB_TOKEN", "tok")
+	t.Setenv("LOCATION", "/loc")
+	t.Setenv("INTERVAL", "100")
+	t.Setenv("BACKUPS", "5")
+	t.Setenv("TEMP_LOCATION", tmpDir)
+
+	for _, tc := range []struct {
+		file string
+		want string
+	}{
+		{"locaton: /typo", "line 1: field locaton not found"},
+		{"backups: many", "line 1: cannot unmarshal"},
+		{"concurrency: 0", "invalid concurrency"},
+		{"overrides:\n  - backups: 3", "overrides[0]: match must be set"},
+		{"overrides:\n  - match: '[acme'", "overrides[0]: invalid match"},
+		{"sources:\n  - type: gitea\n    token: tok", "source 1: gitea sources need a token and url"},
+	} {
+		_, err := LoadConfig(strings.NewReader(tc.file))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("LoadConfig(%q) error = %v, want it to contain %q", tc.file, err, tc.want)
+		}
+	}
+}
+
+func TestNewConfig_ConfigFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "gubber.yaml")
+	if err := os.WriteFile(path, []byte("github_token: ghp_fromfile\nlocation: /loc\ninterval: 100\nbackups: 5\ntemp_location: "+tmpDir+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GITHUB_TOKEN", "")
+	t.Setenv("LOCATION", "")
+	t.Setenv("INTERVAL", "")
+	t.Setenv("BACKUPS", "")
+	t.Setenv("TEMP_LOCATION", "")
+	t.Setenv("CONFIG_FILE", path)
+
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Token != "ghp_fromfile" || cfg.Backups != 5 {
+		t.Errorf("Token, Backups = %q, %d, want those of the file", cfg.Token, cfg.Backups)
+	}
+
+	t.Setenv("CONFIG_FILE", filepath.Join(tmpDir, "missing.yaml"))
+	if _, err := NewConfig(); err == nil {
+		t.Error("expected error for a missing config file")
+	}
+}
+
+func TestNewConfig_VerifyInterval(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	t.Setenv("GITHUB_TOKEN", "ghp_personal")
+	t.Setenv("LOCATION", "/loc")
+	t.Setenv("INTERVAL", "100")
+	t.Setenv("BACKUPS", "30")
+	t.Setenv("TEMP_LOCATION", tmpDir)
+
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.VerifyInterval != 0 {
+		t.Errorf("VerifyInterval = %d, want verification off by default", cfg.VerifyInterval)
+	}
+
+	t.Setenv("VERIFY_INTERVAL", "604800")
+	cfg, err = NewConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.VerifyInterval != 604800 {
+		t.Errorf("VerifyInterval = %d, want %d", cfg.VerifyInterval, 604800)
+	}
+
+	t.Setenv("VERIFY_INTERVAL", "-1")
+	if _, err := NewConfig(); err == nil {
+		t.Error("expected error for negative VERIFY_INTERVAL")
+	}
+}
+
+func TestNewConfig_Storage(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	t.Setenv("GITHUB_TOKEN", "ghp_personal")
+	t.Setenv("LOCATION", "/loc")
+	t.Setenv("INTERVAL", "100")
+	t.Setenv("BACKUPS", "30")
+	t.Setenv("TEMP_LOCATION", tmpDir)
+
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Storage.Type != "local" {
+		t.Errorf("Storage.Type = %q, want local by default", cfg.Storage.Type)
+	}
+
+	t.Setenv("STORAGE", "s3")
+	if _, err := NewConfig(); err == nil || !strings.Contains(err.Error(), "S3_BUCKET") {
+		t.Errorf("expected error for s3 storage without a bucket, got %v", err)
+	}
+
+	t.Setenv("S3_BUCKET", "backups")
+	t.Setenv("S3_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("S3_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("S3_REGION", "eu-west-2")
+	cfg, err = NewConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := S3{
+		Endpoint:        "https://s3.eu-west-2.amazonaws.com",
+		Region:          "eu-west-2",
+		Bucket:          "backups",
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "secret",
+		PathStyle:       true,
+		PartSizeMB:      64,
+	}
+	if cfg.Storage.Type != "s3" || cfg.Storage.S3 != want {
+		t.Errorf("Storage = %+v, want s3 with %+v", cfg.Storage, want)
+	}
+
+	t.Setenv("S3_ENDPOINT", "http://minio:9000/")
+	t.Setenv("S3_PATH_STYLE", "false")
+	t.Setenv("S3_PART_SIZE_MB", "16")
+	cfg, err = NewConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Storage.S3.Endpoint != "http://minio:9000" || cfg.Storage.S3.PathStyle || cfg.Storage.S3.PartSizeMB != 16 {
+		t.Errorf("S3 = %+v, want the configured endpoint, path style and part size", cfg.Storage.S3)
+	}
+
+	for name, value := range map[string]string{"S3_PART_SIZE_MB": "4", "S3_ENDPOINT": "minio:9000", "STORAGE": "ftp"} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := NewConfig(); err == nil {
+				t.Errorf("expected error for %s=%s", name, value)
+			}
+		})
+	}
+}
+
+func TestLoadStorage(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "gubber.yaml")
+	if err := os.WriteFile(path, []byte("storage: s3\ns3_bucket: from-file\ns3_access_key_id: AKIDEXAMPLE\ns3_secret_access_key: secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("S3_BUCKET", "from-env")
+
+	// no source or location is needed to read the generations
+	storage, err := LoadStorage()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if storage.Type != "s3" || storage.S3.Bucket != "from-env" || storage.S3.Endpoint != "https://s3.us-east-1.amazonaws.com" {
+		t.Errorf("LoadStorage() = %+v, want s3 in the bucket of the environment", storage)
+	}
+}
+
+func TestNewConfig_Encryption(t *testing.T) {
+	tmpDir := t.TempDir()
+	identity := filepath.Join(tmpDir, "identity.txt")
+	if err := os.WriteFile(identity, []byte("AGE-SECRET-KEY-1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("GITHUB_TOKEN", "ghp_personal")
+	t.Setenv("LOCATION", "/loc")
+	t.Setenv("INTERVAL", "100")
+	t.Setenv("BACKUPS", "30")
+	t.Setenv("TEMP_LOCATION", tmpDir)
+
+	file := "age_recipients:\n  - age1first\n  - ssh-ed25519 AAAAC3 backup@nas\n"
+	if _, err := LoadConfig(strings.NewReader(file)); err == nil || !strings.Contains(err.Error(), "AGE_IDENTITY_FILE") {
+		t.Errorf("expected error for recipients without an identity file, got %v", err)
+	}
+
+	t.Setenv("AGE_IDENTITY_FILE", identity)
+	cfg, err := LoadConfig(strings.NewReader(file))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.AgeRecipients) != 2 || cfg.AgeRecipients[1] != "ssh-ed25519 AAAAC3 backup@nas" || cfg.AgeIdentityFile != identity {
+		t.Errorf("AgeRecipients = %q, AgeIdentityFile = %q, want both recipients of the file and the identity", cfg.AgeRecipients, cfg.AgeIdentityFile)
+	}
+
+	// release assets are encrypted like the rest of the backup
+	t.Setenv("EXPORT_RELEASES", "true")
+	if cfg, err := LoadConfig(strings.NewReader(file)); err != nil || !cfg.ExportReleases {
+		t.Errorf("LoadConfig() with EXPORT_RELEASES = %v, want releases exported while encrypting", err)
+	}
+
+	t.Setenv("AGE_IDENTITY_FILE", filepath.Join(tmpDir, "missing.txt"))
+	if _, err := LoadConfig(strings.NewReader(file)); err == nil {
+		t.Errorf("expected error for a missing identity file")
+	}
+}
@@ -0,0 +1,232 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// File is the schema of the optional YAML config file, whose settings the environment variables override
+type File struct {
+	Location     *string `yaml:"location"`
+	TempLocation *string `yaml:"temp_location"`
+	Interval     *int    `yaml:"interval"`
+	Backups      *int    `yaml:"backups"`
+	Concurrency  *int    `yaml:"concurrency"`
+	MaxRetries   *int    `yaml:"max_retries"`
+
+	VerifyInterval *int `yaml:"verify_interval"`
+
+	ExportMetadata     *bool `yaml:"export_metadata"`
+	ExportReleases     *bool `yaml:"export_releases"`
+	BackupGists        *bool `yaml:"backup_gists"`
+	BackupStarredGists *bool `yaml:"backup_starred_gists"`
+	BackupStarredRepos *bool `yaml:"backup_starred_repos"`
+	StarredBackups     *int  `yaml:"starred_backups"`
+	StarredKeepDaily   *int  `yaml:"starred_keep_daily"`
+	StarredKeepWeekly  *int  `yaml:"starred_keep_weekly"`
+	StarredKeepMonthly *int  `yaml:"starred_keep_monthly"`
+	StarredKeepYearly  *int  `yaml:"starred_keep_yearly"`
+
+	GitHubToken             *string `yaml:"github_token"`
+	GitHubURL               *string `yaml:"github_url"`
+	GitHubAPIURL            *string `yaml:"github_api_url"`
+	GitHubAppID             *int64  `yaml:"github_app_id"`
+	GitHubAppPrivateKeyFile *string `yaml:"github_app_private_key_file"`
+	GitLabToken             *string `yaml:"gitlab_token"`
+	GitLabURL               *string `yaml:"gitlab_url"`
+	GiteaToken              *string `yaml:"gitea_token"`
+	GiteaURL                *string `yaml:"gitea_url"`
+	BitbucketToken          *string `yaml:"bitbucket_token"`
+	BitbucketUsername       *string `yaml:"bitbucket_username"`
+	BitbucketURL            *string `yaml:"bitbucket_url"`
+
+	SSHClone          *bool   `yaml:"ssh_clone"`
+	SSHKeyFile        *string `yaml:"ssh_key_file"`
+	SSHKnownHostsFile *string `yaml:"ssh_known_hosts_file"`
+
+	RepoInclude    []string `yaml:"repo_include"`
+	RepoExclude    []string `yaml:"repo_exclude"`
+	RepoTopics     []string `yaml:"repo_topics"`
+	RepoVisibility []string `yaml:"repo_visibility"`
+	RepoForks      *bool    `yaml:"repo_forks"`
+	RepoArchived   *bool    `yaml:"repo_archived"`
+	RepoMaxSizeMB  *int     `yaml:"repo_max_size_mb"`
+
+	Storage           *string `yaml:"storage"`
+	S3Endpoint        *string `yaml:"s3_endpoint"`
+	S3Region          *string `yaml:"s3_region"`
+	S3Bucket          *string `yaml:"s3_bucket"`
+	S3Prefix          *string `yaml:"s3_prefix"`
+	S3AccessKeyID     *string `yaml:"s3_access_key_id"`
+	S3SecretAccessKey *string `yaml:"s3_secret_access_key"`
+	S3PathStyle       *bool   `yaml:"s3_path_style"`
+	S3PartSizeMB      *int    `yaml:"s3_part_size_mb"`
+
+	AgeRecipients   []string `yaml:"age_recipients"`
+	AgeIdentityFile *string  `yaml:"age_identity_file"`
+
+	KeepDaily   *int `yaml:"keep_daily"`
+	KeepWeekly  *int `yaml:"keep_weekly"`
+	KeepMonthly *int `yaml:"keep_monthly"`
+	KeepYearly  *int `yaml:"keep_yearly"`
+
+	// Sources and GitRemotes are replaced as a whole by the SOURCES and GIT_REMOTES environment variables
+	Sources    []Source          `yaml:"sources"`
+	GitRemotes map[string]string `yaml:"git_remotes"`
+
+	// Overrides have no environment variable, and are only read from the file
+	Overrides []Override `yaml:"overrides"`
+}
+
+// Override changes how the repos whose full name matches a glob are backed up, later overrides taking precedence
+type Override struct {
+	// Match is a glob matched against the full name of each repo, such as acme/* or acme/api
+	Match string `yaml:"match"`
+	// Skip leaves matching repos out of the backup
+	Skip bool `yaml:"skip"`
+	// Backups keeps matching repos in fewer generations than BACKUPS, and is 0 to keep them in all of them
+	Backups int `yaml:"backups"`
+	// ExportMetadata turns the metadata export on or off for matching repos, and is unset to follow EXPORT_METADATA
+	ExportMetadata *bool `yaml:"export_metadata"`
+}
+
+// validate checks that the override has a valid glob and backup count
+func (o *Override) validate() error {
+	if o.Match == "" {
+		return errors.New("match must be set")
+	}
+	if _, err := path.Match(o.Match, ""); err != nil {
+		return fmt.Errorf("invalid match %q: %v", o.Match, err)
+	}
+	if o.Backups < 0 {
+		return fmt.Errorf("backups must not be negative, got %d", o.Backups)
+	}
+	return nil
+}
+
+// parseFile reads and validates a config file
+func parseFile(r io.Reader) (*File, error) {
+	file := &File{}
+	decoder := yaml.NewDecoder(r)
+	// misspelt settings are reported rather than silently ignored
+	decoder.KnownFields(true)
+	err := decoder.Decode(file)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	for i := range file.Overrides {
+		if err := file.Overrides[i].validate(); err != nil {
+			return nil, fmt.Errorf("overrides[%d]: %v", i, err)
+		}
+	}
+	return file, nil
+}
+
+// values returns the settings of the file keyed by the name of their environment variable, formatted the way the
+// variable would be
+func (f *File) values() (map[string]string, error) {
+	values := make(map[string]string)
+	setString := func(name string, value *string) {
+		if value != nil {
+			values[name] = *value
+		}
+	}
+	setInt := func(name string, value *int) {
+		if value != nil {
+			values[name] = strconv.Itoa(*value)
+		}
+	}
+	setBool := func(name string, value *bool) {
+		if value != nil {
+			values[name] = strconv.FormatBool(*value)
+		}
+	}
+	setList := func(name string, value []string) {
+		if len(value) > 0 {
+			values[name] = strings.Join(value, ",")
+		}
+	}
+
+	setString("LOCATION", f.Location)
+	setString("TEMP_LOCATION", f.TempLocation)
+	setInt("INTERVAL", f.Interval)
+	setInt("BACKUPS", f.Backups)
+	setInt("CONCURRENCY", f.Concurrency)
+	setInt("MAX_RETRIES", f.MaxRetries)
+	setInt("VERIFY_INTERVAL", f.VerifyInterval)
+	setBool("EXPORT_METADATA", f.ExportMetadata)
+	setBool("EXPORT_RELEASES", f.ExportReleases)
+	setBool("BACKUP_GISTS", f.BackupGists)
+	setBool("BACKUP_STARRED_GISTS", f.BackupStarredGists)
+	setBool("BACKUP_STARRED_REPOS", f.BackupStarredRepos)
+	setInt("STARRED_BACKUPS", f.StarredBackups)
+	setInt("STARRED_KEEP_DAILY", f.StarredKeepDaily)
+	setInt("STARRED_KEEP_WEEKLY", f.StarredKeepWeekly)
+	setInt("STARRED_KEEP_MONTHLY", f.StarredKeepMonthly)
+	setInt("STARRED_KEEP_YEARLY", f.StarredKeepYearly)
+	setString("GITHUB_TOKEN", f.GitHubToken)
+	setString("GITHUB_URL", f.GitHubURL)
+	setString("GITHUB_API_URL", f.GitHubAPIURL)
+	if f.GitHubAppID != nil {
+		values["GITHUB_APP_ID"] = strconv.FormatInt(*f.GitHubAppID, 10)
+	}
+	setString("GITHUB_APP_PRIVATE_KEY_FILE", f.GitHubAppPrivateKeyFile)
+	setString("GITLAB_TOKEN", f.GitLabToken)
+	setString("GITLAB_URL", f.GitLabURL)
+	setString("GITEA_TOKEN", f.GiteaToken)
+	setString("GITEA_URL", f.GiteaURL)
+	setString("BITBUCKET_TOKEN", f.BitbucketToken)
+	setString("BITBUCKET_USERNAME", f.BitbucketUsername)
+	setString("BITBUCKET_URL", f.BitbucketURL)
+	setBool("SSH_CLONE", f.SSHClone)
+	setString("SSH_KEY_FILE", f.SSHKeyFile)
+	setString("SSH_KNOWN_HOSTS_FILE", f.SSHKnownHostsFile)
+	setList("REPO_INCLUDE", f.RepoInclude)
+	setList("REPO_EXCLUDE", f.RepoExclude)
+	setList("REPO_TOPICS", f.RepoTopics)
+	setList("REPO_VISIBILITY", f.RepoVisibility)
+	setBool("REPO_FORKS", f.RepoForks)
+	setBool("REPO_ARCHIVED", f.RepoArchived)
+	setInt("REPO_MAX_SIZE_MB", f.RepoMaxSizeMB)
+	setString("STORAGE", f.Storage)
+	setString("S3_ENDPOINT", f.S3Endpoint)
+	setString("S3_REGION", f.S3Region)
+	setString("S3_BUCKET", f.S3Bucket)
+	setString("S3_PREFIX", f.S3Prefix)
+	setString("S3_ACCESS_KEY_ID", f.S3AccessKeyID)
+	setString("S3_SECRET_ACCESS_KEY", f.S3SecretAccessKey)
+	setBool("S3_PATH_STYLE", f.S3PathStyle)
+	setInt("S3_PART_SIZE_MB", f.S3PartSizeMB)
+	setList("AGE_RECIPIENTS", f.AgeRecipients)
+	setString("AGE_IDENTITY_FILE", f.AgeIdentityFile)
+	setInt("KEEP_DAILY", f.KeepDaily)
+	setInt("KEEP_WEEKLY", f.KeepWeekly)
+	setInt("KEEP_MONTHLY", f.KeepMonthly)
+	setInt("KEEP_YEARLY", f.KeepYearly)
+
+	if len(f.Sources) > 0 {
+		sources, err := json.Marshal(f.Sources)
+		if err != nil {
+			return nil, err
+		}
+		values["SOURCES"] = string(sources)
+	}
+	if len(f.GitRemotes) > 0 {
+		remotes := make([]string, 0, len(f.GitRemotes))
+		for fullName, remoteURL := range f.GitRemotes {
+			remotes = append(remotes, fullName+"="+remoteURL)
+		}
+		sort.Strings(remotes)
+		values["GIT_REMOTES"] = strings.Join(remotes, " ")
+	}
+	return values, nil
+}
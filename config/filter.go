@@ -0,0 +1,96 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// RepoFilter selects which of the repos discovered by a source are backed up
+type RepoFilter struct {
+	// include and exclude are globs matched against the owner and name of each repo, such as acme/* or */legacy-*
+	Include []string `json:"include" yaml:"include"`
+	Exclude []string `json:"exclude" yaml:"exclude"`
+	// Topics backs up only the repos tagged with one of these topics
+	Topics []string `json:"topics" yaml:"topics"`
+	// Visibility backs up only the repos that are public, private or internal
+	Visibility []string `json:"visibility" yaml:"visibility"`
+	// Forks and Archived back up only forks or archived repos when true and leave them out when false, and back up
+	// both when unset
+	Forks    *bool `json:"forks" yaml:"forks"`
+	Archived *bool `json:"archived" yaml:"archived"`
+	// MaxSizeMB leaves out repos larger than this many megabytes, and is 0 to back up repos of any size
+	MaxSizeMB int64 `json:"max_size_mb" yaml:"max_size_mb"`
+}
+
+// validate checks that the globs and visibilities of the filter are valid
+func (f *RepoFilter) validate() error {
+	for _, glob := range append(append([]string{}, f.Include...), f.Exclude...) {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("invalid glob %q: %v", glob, err)
+		}
+	}
+	for _, visibility := range f.Visibility {
+		switch visibility {
+		case "public", "private", "internal":
+		default:
+			return fmt.Errorf("visibility must be public, private or internal, got %q", visibility)
+		}
+	}
+	if f.MaxSizeMB < 0 {
+		return fmt.Errorf("max size must not be negative, got %d", f.MaxSizeMB)
+	}
+	return nil
+}
+
+// optionalList splits the setting name into its comma separated values, returning nil when it is unset
+func (get lookup) optionalList(name string) []string {
+	var values []string
+	for _, value := range strings.Split(get(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// optionalTristate parses the setting name as a bool, returning nil when it is unset
+func (get lookup) optionalTristate(name string) (*bool, error) {
+	value := get(name)
+	if value == "" {
+		return nil, nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, err
+	}
+	return &parsed, nil
+}
+
+// parseRepoFilter parses the REPO_ settings, which filter the repos of the single account sources
+func parseRepoFilter(get lookup) (RepoFilter, error) {
+	filter := RepoFilter{
+		Include:    get.optionalList("REPO_INCLUDE"),
+		Exclude:    get.optionalList("REPO_EXCLUDE"),
+		Topics:     get.optionalList("REPO_TOPICS"),
+		Visibility: get.optionalList("REPO_VISIBILITY"),
+	}
+
+	var err error
+	filter.Forks, err = get.optionalTristate("REPO_FORKS")
+	if err != nil {
+		return filter, fmt.Errorf("invalid forks: %v", err)
+	}
+	filter.Archived, err = get.optionalTristate("REPO_ARCHIVED")
+	if err != nil {
+		return filter, fmt.Errorf("invalid archived: %v", err)
+	}
+	max_size, err := get.optionalInt("REPO_MAX_SIZE_MB", 0)
+	if err != nil {
+		return filter, fmt.Errorf("invalid max size: %v", err)
+	}
+	filter.MaxSizeMB = int64(max_size)
+
+	return filter, filter.validate()
+}
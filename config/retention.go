@@ -0,0 +1,63 @@
+package config
+
+import "fmt"
+
+// Retention keeps the newest generation of each of the most recent days, weeks, months and years
+type Retention struct {
+	Daily   int
+	Weekly  int
+	Monthly int
+	Yearly  int
+}
+
+// parseRetention parses BACKUPS and the KEEP_ settings into the number of recent generations kept and the retention
+func parseRetention(get lookup) (int, Retention, error) {
+	backups, retention, err := parsePrefixedRetention(get, "")
+	if err != nil {
+		return 0, Retention{}, err
+	}
+	if backups == 0 && retention == (Retention{}) {
+		return 0, Retention{}, fmt.Errorf("BACKUPS or one of KEEP_DAILY, KEEP_WEEKLY, KEEP_MONTHLY and KEEP_YEARLY must be set")
+	}
+	return backups, retention, nil
+}
+
+// parsePrefixedRetention parses the BACKUPS and KEEP_ settings whose names start with prefix, such as STARRED_BACKUPS,
+// each defaulting to 0
+func parsePrefixedRetention(get lookup, prefix string) (int, Retention, error) {
+	backups, err := get.optionalInt(prefix+"BACKUPS", 0)
+	if err != nil || backups < 0 {
+		return 0, Retention{}, fmt.Errorf("invalid %s: %v", prefix+"BACKUPS", get(prefix+"BACKUPS"))
+	}
+
+	retention := Retention{}
+	for _, setting := range []struct {
+		name  string
+		value *int
+	}{
+		{prefix + "KEEP_DAILY", &retention.Daily},
+		{prefix + "KEEP_WEEKLY", &retention.Weekly},
+		{prefix + "KEEP_MONTHLY", &retention.Monthly},
+		{prefix + "KEEP_YEARLY", &retention.Yearly},
+	} {
+		*setting.value, err = get.optionalInt(setting.name, 0)
+		if err != nil || *setting.value < 0 {
+			return 0, Retention{}, fmt.Errorf("invalid %s: %v", setting.name, get(setting.name))
+		}
+	}
+	return backups, retention, nil
+}
+
+// LoadRetention loads only BACKUPS and the KEEP_ settings from the environment and the config file, for the commands
+// which prune or check the generations without backing anything up
+func LoadRetention() (int, Retention, error) {
+	file, err := loadFile()
+	if err != nil {
+		return 0, Retention{}, err
+	}
+	get, err := newLookup(file)
+	if err != nil {
+		return 0, Retention{}, err
+	}
+	return parseRetention(get)
+}
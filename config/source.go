@@ -0,0 +1,181 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// SourceType is the kind of forge account a Source backs up
+type SourceType string
+
+const (
+	SourceGitHub    SourceType = "github"
+	SourceGitHubApp SourceType = "github-app"
+	SourceGitLab    SourceType = "gitlab"
+	SourceGitea     SourceType = "gitea"
+	SourceBitbucket SourceType = "bitbucket"
+)
+
+// Source is an account on a forge whose repositories are backed up, with its own credentials
+type Source struct {
+	Type SourceType `json:"type" yaml:"type"`
+	// Token is the access token of the account, and Username the user it belongs to where the forge needs one
+	Token    string `json:"token" yaml:"token"`
+	Username string `json:"username" yaml:"username"`
+	// URL is the address of a self-hosted forge, and APIURL the api of a GitHub Enterprise Server when it is not at
+	// URL/api/v3/
+	URL    string `json:"url" yaml:"url"`
+	APIURL string `json:"api_url" yaml:"api_url"`
+	// AppID and PrivateKeyFile authenticate a github-app source
+	AppID          int64  `json:"app_id" yaml:"app_id"`
+	PrivateKeyFile string `json:"private_key_file" yaml:"private_key_file"`
+	// Gists and StarredGists back up the gists of a github source, and Starred the repos its user has starred
+	Gists        bool `json:"gists" yaml:"gists"`
+	StarredGists bool `json:"starred_gists" yaml:"starred_gists"`
+	Starred      bool `json:"starred" yaml:"starred"`
+	// Owners limits the source to the repositories of these users, orgs, workspaces or groups, and is empty to back
+	// up every repository the account can access
+	Owners []string `json:"owners" yaml:"owners"`
+	// RepoFilter further limits which of the repositories of the source are backed up
+	RepoFilter `yaml:",inline"`
+}
+
+// checkURL returns an error unless value is an http or https url
+func checkURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s is not an http or https url", value)
+	}
+	return nil
+}
+
+// validate checks that the source has the settings its type needs, filling in the default urls
+func (s *Source) validate() error {
+	if err := s.RepoFilter.validate(); err != nil {
+		return err
+	}
+	if s.URL != "" {
+		if err := checkURL(s.URL); err != nil {
+			return fmt.Errorf("invalid url: %v", err)
+		}
+	}
+	if s.APIURL != "" {
+		if err := checkURL(s.APIURL); err != nil {
+			return fmt.Errorf("invalid api url: %v", err)
+		}
+	}
+
+	// github apps act for their installations rather than a user, so have no starred repos
+	if s.Starred && s.Type != SourceGitHub {
+		return fmt.Errorf("starred repos can only be backed up from github sources")
+	}
+
+	switch s.Type {
+	case SourceGitHub, SourceGitHubApp:
+		if s.APIURL != "" && s.URL == "" {
+			return fmt.Errorf("url must be set when api_url is set")
+		}
+		if s.URL != "" && s.APIURL == "" {
+			s.APIURL = strings.TrimSuffix(s.URL, "/") + "/api/v3/"
+		}
+		if s.Type == SourceGitHub && s.Token == "" {
+			return fmt.Errorf("github sources need a token")
+		}
+		if s.Type == SourceGitHubApp {
+			if s.AppID <= 0 || s.PrivateKeyFile == "" {
+				return fmt.Errorf("github-app sources need an app_id and private_key_file")
+			}
+			if _, err := os.Stat(s.PrivateKeyFile); err != nil {
+				return fmt.Errorf("invalid private key file: %v", err)
+			}
+		}
+	case SourceGitLab:
+		if s.Token == "" {
+			return fmt.Errorf("gitlab sources need a token")
+		}
+		if s.URL == "" {
+			s.URL = "https://gitlab.com"
+		}
+	case SourceGitea:
+		if s.Token == "" || s.URL == "" {
+			return fmt.Errorf("gitea sources need a token and url")
+		}
+	case SourceBitbucket:
+		if s.Token == "" {
+			return fmt.Errorf("bitbucket sources need a token")
+		}
+	default:
+		return fmt.Errorf("unknown source type %q", s.Type)
+	}
+	return nil
+}
+
+// parseSources parses a JSON list of sources, such as
+// [{"type": "github", "token": "ghp_..."}, {"type": "github", "token": "github_pat_...", "owners": ["acme"]}]
+func parseSources(value string) ([]Source, error) {
+	sources := make([]Source, 0)
+	if strings.TrimSpace(value) == "" {
+		return sources, nil
+	}
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&sources); err != nil {
+		return nil, err
+	}
+	for i := range sources {
+		if err := sources[i].validate(); err != nil {
+			return nil, fmt.Errorf("source %d: %v", i+1, err)
+		}
+	}
+	return sources, nil
+}
+
+// AllSources returns the source configured by each of the single account variables, such as GITHUB_TOKEN, filtered by
+// the REPO_ variables, followed by those listed in SOURCES
+func (c *Config) AllSources() []Source {
+	sources := make([]Source, 0, len(c.Sources)+5)
+	if c.Token != "" {
+		sources = append(sources, Source{
+			Type:         SourceGitHub,
+			Token:        c.Token,
+			URL:          c.GitHubURL,
+			APIURL:       c.GitHubAPIURL,
+			Gists:        c.BackupGists,
+			StarredGists: c.BackupStarredGists,
+			Starred:      c.BackupStarredRepos,
+			RepoFilter:   c.RepoFilter,
+		})
+	}
+	if c.GitHubAppID != 0 {
+		sources = append(sources, Source{
+			Type:           SourceGitHubApp,
+			URL:            c.GitHubURL,
+			APIURL:         c.GitHubAPIURL,
+			AppID:          c.GitHubAppID,
+			PrivateKeyFile: c.GitHubAppPrivateKeyFile,
+			RepoFilter:     c.RepoFilter,
+		})
+	}
+	if c.GitLabToken != "" {
+		sources = append(sources, Source{Type: SourceGitLab, Token: c.GitLabToken, URL: c.GitLabURL, RepoFilter: c.RepoFilter})
+	}
+	if c.GiteaToken != "" {
+		sources = append(sources, Source{Type: SourceGitea, Token: c.GiteaToken, URL: c.GiteaURL, RepoFilter: c.RepoFilter})
+	}
+	if c.BitbucketToken != "" {
+		sources = append(sources, Source{
+			Type:       SourceBitbucket,
+			Token:      c.BitbucketToken,
+			Username:   c.BitbucketUsername,
+			URL:        c.BitbucketURL,
+			RepoFilter: c.RepoFilter,
+		})
+	}
+	return append(sources, c.Sources...)
+}
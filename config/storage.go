@@ -0,0 +1,77 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Storage selects where the generations of the backup are kept
+type Storage struct {
+	// Type is local to keep the generations in LOCATION, or s3 to keep them in a bucket of an S3 compatible store
+	Type string
+	S3   S3
+}
+
+// S3 configures the bucket holding the generations when Storage.Type is s3
+type S3 struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// PathStyle addresses the bucket as a path of the endpoint rather than as its subdomain
+	PathStyle bool
+	// PartSizeMB is the size of each part of a multipart upload
+	PartSizeMB int
+}
+
+// parseStorage parses the STORAGE and S3_ settings, defaulting to keeping the generations on the local disk
+func parseStorage(get lookup) (Storage, error) {
+	storage := Storage{Type: get("STORAGE")}
+	switch storage.Type {
+	case "", "local":
+		storage.Type = "local"
+		return storage, nil
+	case "s3":
+	default:
+		return storage, fmt.Errorf("storage must be local or s3, got %q", storage.Type)
+	}
+
+	storage.S3 = S3{
+		Region:          get("S3_REGION"),
+		Bucket:          get("S3_BUCKET"),
+		Prefix:          get("S3_PREFIX"),
+		AccessKeyID:     get("S3_ACCESS_KEY_ID"),
+		SecretAccessKey: get("S3_SECRET_ACCESS_KEY"),
+	}
+	if storage.S3.Region == "" {
+		storage.S3.Region = "us-east-1"
+	}
+	if storage.S3.Bucket == "" || storage.S3.AccessKeyID == "" || storage.S3.SecretAccessKey == "" {
+		return storage, fmt.Errorf("S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY must be set when STORAGE is s3")
+	}
+
+	// parse the endpoint, defaulting to the AWS endpoint of the region
+	endpoint, err := get.optionalURL("S3_ENDPOINT")
+	if err != nil {
+		return storage, fmt.Errorf("invalid s3 endpoint: %v", err)
+	}
+	if endpoint == "" {
+		endpoint = "https://s3." + storage.S3.Region + ".amazonaws.com"
+	}
+	storage.S3.Endpoint = strings.TrimSuffix(endpoint, "/")
+
+	// parse path style as bool, defaulting to on as most self-hosted stores expect
+	storage.S3.PathStyle, err = get.optionalBool("S3_PATH_STYLE", true)
+	if err != nil {
+		return storage, fmt.Errorf("invalid s3 path style: %v", err)
+	}
+
+	// parse the part size, which S3 requires to be at least 5MB
+	storage.S3.PartSizeMB, err = get.optionalInt("S3_PART_SIZE_MB", 64)
+	if err != nil || storage.S3.PartSizeMB < 5 {
+		return storage, fmt.Errorf("invalid s3 part size: %v", get("S3_PART_SIZE_MB"))
+	}
+	return storage, nil
+}
@@ -0,0 +1,404 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// bitbucketCloudAPIURL is the REST API of bitbucket.org
+const bitbucketCloudAPIURL = "https://api.bitbucket.org/2.0"
+
+// bitbucketAuth authenticates requests to Bitbucket with basic auth, or with a bearer token when there is no username
+type bitbucketAuth struct {
+	username string
+	token    string
+}
+
+// credentials returns the credentials for cloning, using the x-token-auth user for access tokens
+func (a bitbucketAuth) credentials() Credentials {
+	if a.username == "" {
+		return &StaticCredentials{Username: "x-token-auth", Password: a.token}
+	}
+	return &StaticCredentials{Username: a.username, Password: a.token}
+}
+
+// get requests u and decodes the json response into v, returning the status code of any status in allowed
+func (a bitbucketAuth) get(ctx context.Context, client *http.Client, u string, v any, allowed ...int) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	if a.username == "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	} else {
+		req.SetBasicAuth(a.username, a.token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	for _, status := range allowed {
+		if resp.StatusCode == status {
+			return resp.StatusCode, nil
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return resp.StatusCode, fmt.Errorf("unexpected status %s from %s: %s", resp.Status, req.URL.Path, strings.TrimSpace(string(body)))
+	}
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return resp.StatusCode, fmt.Errorf("failed to decode response from %s due to error %w", req.URL.Path, err)
+	}
+	return resp.StatusCode, nil
+}
+
+// bitbucketLink is a link to a resource, such as a clone url
+type bitbucketLink struct {
+	Name string `json:"name"`
+	Href string `json:"href"`
+}
+
+// httpCloneURL returns the http or https clone url from links without any username in it
+func httpCloneURL(links []bitbucketLink) string {
+	for _, link := range links {
+		if link.Name != "https" && link.Name != "http" {
+			continue
+		}
+		u, err := url.Parse(link.Href)
+		if err != nil {
+			continue
+		}
+		u.User = nil
+		return u.String()
+	}
+	return ""
+}
+
+// sshCloneURL returns the ssh clone url from links, or an empty string when there is none
+func sshCloneURL(links []bitbucketLink) string {
+	for _, link := range links {
+		if link.Name == "ssh" {
+			return link.Href
+		}
+	}
+	return ""
+}
+
+// BitbucketWorkspace is a Bitbucket Cloud workspace that the user is a member of
+type BitbucketWorkspace struct {
+	Slug string `json:"slug"`
+}
+
+// BitbucketCloudRepo is a repository as returned by the Bitbucket Cloud API
+type BitbucketCloudRepo struct {
+	Slug      string `json:"slug"`
+	FullName  string `json:"full_name"`
+	SCM       string `json:"scm"`
+	HasWiki   bool   `json:"has_wiki"`
+	IsPrivate bool   `json:"is_private"`
+	Size      int64  `json:"size"`
+	// Parent is the repository a fork was forked from, and is null for other repositories
+	Parent *struct {
+		FullName string `json:"full_name"`
+	} `json:"parent"`
+	// MainBranch is null for repositories without any commits
+	MainBranch *struct {
+		Name string `json:"name"`
+	} `json:"mainbranch"`
+	Links struct {
+		Clone []bitbucketLink `json:"clone"`
+	} `json:"links"`
+}
+
+// BitbucketCloudAPI lists the repositories in every workspace of a bitbucket.org user
+type BitbucketCloudAPI struct {
+	ctx    context.Context
+	client *http.Client
+	apiURL string
+	auth   bitbucketAuth
+}
+
+// NewBitbucketCloudAPI returns a BitbucketCloudAPI authenticating with an app password or API token when username
+// is set, or with a workspace, project or repository access token otherwise
+func NewBitbucketCloudAPI(ctx context.Context, username string, token *string) *BitbucketCloudAPI {
+	return &BitbucketCloudAPI{
+		ctx:    ctx,
+		client: http.DefaultClient,
+		apiURL: bitbucketCloudAPIURL,
+		auth:   bitbucketAuth{username: username, token: *token},
+	}
+}
+
+// Host returns bitbucket.org, which repositories are cloned from
+func (b *BitbucketCloudAPI) Host() string {
+	return "bitbucket.org"
+}
+
+// bitbucketCloudListAll requests every page of u, following the next link of each page
+func bitbucketCloudListAll[T any](b *BitbucketCloudAPI, u string) ([]T, error) {
+	items := make([]T, 0)
+	for u != "" {
+		var page struct {
+			Values []T    `json:"values"`
+			Next   string `json:"next"`
+		}
+		_, err := b.auth.get(b.ctx, b.client, u, &page)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, page.Values...)
+		u = page.Next
+	}
+	return items, nil
+}
+
+// GetWorkspaces returns the workspaces that the user is a member of
+func (b *BitbucketCloudAPI) GetWorkspaces() ([]*BitbucketWorkspace, error) {
+	permissions, err := bitbucketCloudListAll[struct {
+		Workspace *BitbucketWorkspace `json:"workspace"`
+	}](b, b.apiURL+"/user/permissions/workspaces?pagelen=100")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get workspaces: %w", err)
+	}
+
+	workspaces := make([]*BitbucketWorkspace, 0, len(permissions))
+	for _, permission := range permissions {
+		if permission.Workspace != nil {
+			workspaces = append(workspaces, permission.Workspace)
+		}
+	}
+	return workspaces, nil
+}
+
+// GetWorkspaceRepos returns the repositories of the provided workspace that the user can access
+func (b *BitbucketCloudAPI) GetWorkspaceRepos(workspace *BitbucketWorkspace) ([]*BitbucketCloudRepo, error) {
+	repos, err := bitbucketCloudListAll[*BitbucketCloudRepo](b, b.apiURL+"/repositories/"+url.PathEscape(workspace.Slug)+"?pagelen=100")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get repos for workspace: %w", err)
+	}
+	return repos, nil
+}
+
+// repository converts a Bitbucket Cloud repository into a Repository owned by its workspace
+func (b *BitbucketCloudAPI) repository(repo *BitbucketCloudRepo) *Repository {
+	owner, _, _ := strings.Cut(repo.FullName, "/")
+	r := &Repository{
+		Forge:       ForgeBitbucket,
+		Owner:       owner,
+		Name:        repo.Slug,
+		CloneURL:    httpCloneURL(repo.Links.Clone),
+		SSHURL:      sshCloneURL(repo.Links.Clone),
+		Credentials: b.auth.credentials(),
+		Visibility:  VisibilityPublic,
+		Fork:        repo.Parent != nil,
+		Size:        repo.Size,
+	}
+	if repo.IsPrivate {
+		r.Visibility = VisibilityPrivate
+	}
+	// bitbucket serves the wiki of a repository as a git repository below its clone url
+	if repo.HasWiki {
+		r.WikiURL = r.CloneURL + "/wiki"
+	}
+	return r
+}
+
+// ListRepos returns every non-empty git repository in the workspaces of the user
+func (b *BitbucketCloudAPI) ListRepos() ([]*Repository, error) {
+	workspaces, err := b.GetWorkspaces()
+	if err != nil {
+		return nil, err
+	}
+
+	repos := make([]*Repository, 0)
+	for _, workspace := range workspaces {
+		fmt.Printf("Loading repos for workspace %s\n", workspace.Slug)
+		workspaceRepos, err := b.GetWorkspaceRepos(workspace)
+		if err != nil {
+			fmt.Printf("failed to get workspace repos due to error %v for workspace %s\n", err, workspace.Slug)
+			continue
+		}
+		for _, repo := range workspaceRepos {
+			if repo.SCM != "git" || repo.MainBranch == nil {
+				continue
+			}
+			repos = append(repos, b.repository(repo))
+		}
+	}
+
+	fmt.Printf("Found %d bitbucket repositories\n", len(repos))
+	return repos, nil
+}
+
+// BitbucketProject is a project on a Bitbucket Server or Data Center instance
+type BitbucketProject struct {
+	Key string `json:"key"`
+}
+
+// BitbucketServerRepo is a repository as returned by the Bitbucket Server API
+type BitbucketServerRepo struct {
+	Slug    string           `json:"slug"`
+	Project BitbucketProject `json:"project"`
+	Public  bool             `json:"public"`
+	// Origin is the repository a fork was forked from, and is null for other repositories
+	Origin *struct {
+		Slug string `json:"slug"`
+	} `json:"origin"`
+	Links struct {
+		Clone []bitbucketLink `json:"clone"`
+	} `json:"links"`
+}
+
+// BitbucketServerAPI lists the repositories in every project of a Bitbucket Server or Data Center instance that the
+// user can access
+type BitbucketServerAPI struct {
+	ctx    context.Context
+	client *http.Client
+	apiURL string
+	auth   bitbucketAuth
+}
+
+// NewBitbucketServerAPI returns a BitbucketServerAPI for the instance at baseURL, authenticating with a password or
+// personal access token when username is set, or with a project or repository access token otherwise
+func NewBitbucketServerAPI(ctx context.Context, username string, token *string, baseURL string) (*BitbucketServerAPI, error) {
+	_, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bitbucket url %s due to error %w", baseURL, err)
+	}
+
+	return &BitbucketServerAPI{
+		ctx:    ctx,
+		client: http.DefaultClient,
+		apiURL: strings.TrimSuffix(baseURL, "/") + "/rest/api/1.0",
+		auth:   bitbucketAuth{username: username, token: *token},
+	}, nil
+}
+
+// Host returns the host of the Bitbucket Server instance
+func (b *BitbucketServerAPI) Host() string {
+	u, err := url.Parse(b.apiURL)
+	if err != nil {
+		return b.apiURL
+	}
+	return u.Host
+}
+
+// bitbucketServerListAll requests every page of apiPath, starting each page where the previous one ended
+func bitbucketServerListAll[T any](b *BitbucketServerAPI, apiPath string) ([]T, error) {
+	items := make([]T, 0)
+	start := 0
+	for {
+		var page struct {
+			Values        []T  `json:"values"`
+			IsLastPage    bool `json:"isLastPage"`
+			NextPageStart int  `json:"nextPageStart"`
+		}
+		_, err := b.auth.get(b.ctx, b.client, b.apiURL+apiPath+"?limit=100&start="+strconv.Itoa(start), &page)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, page.Values...)
+		if page.IsLastPage || page.NextPageStart <= start {
+			return items, nil
+		}
+		start = page.NextPageStart
+	}
+}
+
+// GetProjects returns the projects that the user can access
+func (b *BitbucketServerAPI) GetProjects() ([]*BitbucketProject, error) {
+	projects, err := bitbucketServerListAll[*BitbucketProject](b, "/projects")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get projects: %w", err)
+	}
+	return projects, nil
+}
+
+// GetProjectRepos returns the repositories of the provided project that the user can access
+func (b *BitbucketServerAPI) GetProjectRepos(project *BitbucketProject) ([]*BitbucketServerRepo, error) {
+	repos, err := bitbucketServerListAll[*BitbucketServerRepo](b, "/projects/"+url.PathEscape(project.Key)+"/repos")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get repos for project: %w", err)
+	}
+	return repos, nil
+}
+
+// isEmpty reports whether repo has no commits, in which case it has no default branch
+func (b *BitbucketServerAPI) isEmpty(repo *BitbucketServerRepo) (bool, error) {
+	u := b.apiURL + "/projects/" + url.PathEscape(repo.Project.Key) + "/repos/" + url.PathEscape(repo.Slug) + "/branches/default"
+	var branch struct{}
+	status, err := b.auth.get(b.ctx, b.client, u, &branch, http.StatusNoContent, http.StatusNotFound)
+	if err != nil {
+		return false, err
+	}
+	return status != http.StatusOK, nil
+}
+
+// repository converts a Bitbucket Server repository into a Repository owned by its lowercased project key
+func (b *BitbucketServerAPI) repository(repo *BitbucketServerRepo) *Repository {
+	r := &Repository{
+		Forge:       ForgeBitbucket,
+		Owner:       strings.ToLower(repo.Project.Key),
+		Name:        repo.Slug,
+		CloneURL:    httpCloneURL(repo.Links.Clone),
+		SSHURL:      sshCloneURL(repo.Links.Clone),
+		Credentials: b.auth.credentials(),
+		Visibility:  VisibilityPrivate,
+		Fork:        repo.Origin != nil,
+	}
+	if repo.Public {
+		r.Visibility = VisibilityPublic
+	}
+	return r
+}
+
+// ListRepos returns every non-empty repository in the projects that the user can access
+func (b *BitbucketServerAPI) ListRepos() ([]*Repository, error) {
+	return b.listRepos(nil)
+}
+
+// listRepos lists the repositories like ListRepos, leaving out those that filter drops before checking which are
+// empty
+func (b *BitbucketServerAPI) listRepos(filter *Filter) ([]*Repository, error) {
+	projects, err := b.GetProjects()
+	if err != nil {
+		return nil, err
+	}
+
+	repos := make([]*Repository, 0)
+	for _, project := range projects {
+		fmt.Printf("Loading repos for project %s\n", project.Key)
+		projectRepos, err := b.GetProjectRepos(project)
+		if err != nil {
+			fmt.Printf("failed to get project repos due to error %v for project %s\n", err, project.Key)
+			continue
+		}
+		for _, repo := range projectRepos {
+			r := b.repository(repo)
+			if !filter.keep(r) {
+				continue
+			}
+			// a repo whose default branch cannot be checked is still listed, and no bundle is made of it if it is empty
+			empty, err := b.isEmpty(repo)
+			if err != nil {
+				fmt.Printf("failed to get default branch due to error %v for repo %s, backing it up anyway\n", err, r.FullName())
+			}
+			if !empty {
+				repos = append(repos, r)
+			}
+		}
+	}
+
+	fmt.Printf("Found %d bitbucket repositories\n", len(repos))
+	return repos, nil
+}
@@ -0,0 +1,172 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestBitbucketCloudAPI_ListRepos(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	mux.HandleFunc("/user/permissions/workspaces", func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "alice" || password != "app-password" {
+			t.Errorf("basic auth = %q, %q, want alice and her app password", user, password)
+		}
+		_, _ = fmt.Fprint(w, `{"values": [{"workspace": {"slug": "acme"}}]}`)
+	})
+	mux.HandleFunc("/repositories/acme", func(w http.ResponseWriter, r *http.Request) {
+		// the workspace's repos are split over two pages
+		if r.URL.Query().Get("page") == "" {
+			_, _ = fmt.Fprintf(w, `{"values": [
+				{"slug": "api", "full_name": "acme/api", "scm": "git", "has_wiki": true, "mainbranch": {"name": "main"},
+				 "links": {"clone": [{"name": "ssh", "href": "git@bitbucket.org:acme/api.git"}, {"name": "https", "href": "https://alice@bitbucket.org/acme/api.git"}]}}
+			], "next": "%s/repositories/acme?pagelen=100&page=2"}`, server.URL)
+			return
+		}
+		_, _ = fmt.Fprint(w, `{"values": [
+			{"slug": "empty", "full_name": "acme/empty", "scm": "git", "mainbranch": null,
+			 "links": {"clone": [{"name": "https", "href": "https://alice@bitbucket.org/acme/empty.git"}]}}
+		]}`)
+	})
+
+	api := NewBitbucketCloudAPI(context.Background(), "alice", strPtr("app-password"))
+	api.apiURL = server.URL
+
+	repos, err := api.ListRepos()
+	if err != nil {
+		t.Fatalf("ListRepos() error: %v", err)
+	}
+	if len(repos) != 1 {
+		t.Fatalf("expected 1 repo without the empty repo, got %v", repos)
+	}
+	repo := repos[0]
+	if repo.FullName() != "acme/api" || repo.Forge != ForgeBitbucket {
+		t.Errorf("unexpected repo %+v", repo)
+	}
+	if repo.CloneURL != "https://bitbucket.org/acme/api.git" || repo.WikiURL != "https://bitbucket.org/acme/api.git/wiki" {
+		t.Errorf("CloneURL, WikiURL = %q, %q", repo.CloneURL, repo.WikiURL)
+	}
+
+	username, password, err := repo.Credentials.Credentials()
+	if err != nil || username != "alice" || password != "app-password" {
+		t.Errorf("clone credentials = %q, %q, %v", username, password, err)
+	}
+}
+
+func TestBitbucketCloudAPI_AccessToken(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/user/permissions/workspaces", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer access-token" {
+			t.Errorf("Authorization = %q, want the access token", got)
+		}
+		http.Error(w, `{"error": {"message": "Unauthorized"}}`, http.StatusUnauthorized)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	api := NewBitbucketCloudAPI(context.Background(), "", strPtr("access-token"))
+	api.apiURL = server.URL
+
+	if _, err := api.ListRepos(); err == nil {
+		t.Error("expected error for unauthorized token")
+	}
+	username, _, _ := api.auth.credentials().Credentials()
+	if username != "x-token-auth" {
+		t.Errorf("clone username = %q, want x-token-auth", username)
+	}
+}
+
+func TestBitbucketServerAPI_KeepsReposWhoseDefaultBranchFails(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rest/api/1.0/projects", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `{"values": [{"key": "PROJ"}], "isLastPage": true}`)
+	})
+	mux.HandleFunc("/rest/api/1.0/projects/PROJ/repos", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `{"values": [
+			{"slug": "flaky", "project": {"key": "PROJ"}},
+			{"slug": "new", "project": {"key": "PROJ"}}
+		], "isLastPage": true}`)
+	})
+	mux.HandleFunc("/rest/api/1.0/projects/PROJ/repos/flaky/branches/default", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	mux.HandleFunc("/rest/api/1.0/projects/PROJ/repos/new/branches/default", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	api, err := NewBitbucketServerAPI(context.Background(), "alice", strPtr("token"), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repos, err := api.ListRepos()
+	if err != nil {
+		t.Fatalf("ListRepos() error: %v", err)
+	}
+	if len(repos) != 1 || repos[0].FullName() != "proj/flaky" {
+		t.Errorf("repos = %v, want only proj/flaky kept", repos)
+	}
+}
+
+func TestMigrateRepos_BitbucketServer(t *testing.T) {
+	work := newWorkRepo(t)
+	root := t.TempDir()
+	testGit(t, root, "clone", "--bare", work, filepath.Join(root, "scm", "proj", "service.git"))
+	gitServer := newGitHTTPServer(t, root)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rest/api/1.0/projects", func(w http.ResponseWriter, r *http.Request) {
+		// the projects are split over two pages
+		if r.URL.Query().Get("start") == "0" {
+			_, _ = fmt.Fprint(w, `{"values": [{"key": "PROJ"}], "isLastPage": false, "nextPageStart": 1}`)
+			return
+		}
+		_, _ = fmt.Fprint(w, `{"values": [{"key": "EMPTY"}], "isLastPage": true}`)
+	})
+	mux.HandleFunc("/rest/api/1.0/projects/PROJ/repos", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, `{"values": [
+			{"slug": "service", "project": {"key": "PROJ"}, "links": {"clone": [{"name": "http", "href": "%[1]s/scm/proj/service.git"}]}},
+			{"slug": "new", "project": {"key": "PROJ"}, "links": {"clone": [{"name": "http", "href": "%[1]s/scm/proj/new.git"}]}}
+		], "isLastPage": true}`, gitServer.URL)
+	})
+	mux.HandleFunc("/rest/api/1.0/projects/EMPTY/repos", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `{"values": [], "isLastPage": true}`)
+	})
+	mux.HandleFunc("/rest/api/1.0/projects/PROJ/repos/service/branches/default", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `{"id": "refs/heads/main", "displayId": "main"}`)
+	})
+	mux.HandleFunc("/rest/api/1.0/projects/PROJ/repos/new/branches/default", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	apiServer := httptest.NewServer(mux)
+	defer apiServer.Close()
+
+	api, err := NewBitbucketServerAPI(context.Background(), "alice", strPtr("token"), apiServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repos, err := ListAllRepos(api)
+	if err != nil {
+		t.Fatalf("ListAllRepos() error: %v", err)
+	}
+	if len(repos) != 1 || repos[0].FullName() != "proj/service" {
+		t.Fatalf("expected only proj/service, got %v", repos)
+	}
+
+	location := t.TempDir()
+	tmp := t.TempDir()
+	d := NewDownloader(context.Background())
+	if err := d.MigrateRepos(repos, &location, Retention{Last: 3}, &tmp); err != nil {
+		t.Fatalf("MigrateRepos() error: %v", err)
+	}
+	if !Exists(BundlePath(location, "proj/service", generationAt(location, 0))) {
+		t.Error("bundle of the bitbucket repo was not created in the newest generation")
+	}
+}
@@ -0,0 +1,315 @@
+package download
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// bundleSignature is the first line of every v2 git bundle, which is the format `git bundle create` writes for sha1
+// repos
+const bundleSignature = "# v2 git bundle"
+
+// bundleRef is a ref advertised by a bundle
+type bundleRef struct {
+	id   string
+	name string
+}
+
+// bundleHeader is the parsed header of a git bundle
+type bundleHeader struct {
+	// prerequisites are the commits which must already exist in a repo before the bundle can be fetched into it
+	prerequisites []string
+	refs          []bundleRef
+}
+
+// readBundleHeader parses the header of the bundle at path
+func readBundleHeader(path string) (*bundleHeader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	reader := bufio.NewReader(file)
+	signature, err := reader.ReadString('\n')
+	if err != nil || strings.TrimRight(signature, "\n") != bundleSignature {
+		return nil, fmt.Errorf("%w: %s is not a v2 git bundle", ErrBundleCorrupt, path)
+	}
+
+	header := &bundleHeader{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s has a truncated header", ErrBundleCorrupt, path)
+		}
+		line = strings.TrimRight(line, "\n")
+		if line == "" {
+			return header, nil
+		}
+
+		if strings.HasPrefix(line, "-") {
+			id, _, _ := strings.Cut(line[1:], " ")
+			header.prerequisites = append(header.prerequisites, id)
+			continue
+		}
+
+		id, name, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("%w: %s has an invalid ref line %q", ErrBundleCorrupt, path, line)
+		}
+		header.refs = append(header.refs, bundleRef{id: id, name: name})
+	}
+}
+
+// IsThinBundle reports whether the bundle at path depends on objects stored in a newer generation
+func IsThinBundle(path string) (bool, error) {
+	header, err := readBundleHeader(path)
+	if err != nil {
+		return false, err
+	}
+	return len(header.prerequisites) > 0, nil
+}
+
+// runGit runs git with the provided arguments in dir, returning stdout
+func runGit(ctx context.Context, dir string, stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Stdin = stdin
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s failed due to error %w\nstderr: %s", args[0], err, stderr.String())
+	}
+	return output, nil
+}
+
+// newScratchRepo creates an empty bare repo in a temporary folder, which the caller must remove
+func newScratchRepo(ctx context.Context) (string, error) {
+	scratch, err := os.MkdirTemp("", "gubber-scratch-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create scratch repo due to error %w", err)
+	}
+	_, err = runGit(ctx, scratch, nil, "init", "--bare", "--quiet", ".")
+	if err != nil {
+		_ = os.RemoveAll(scratch)
+		return "", fmt.Errorf("failed to create scratch repo due to error %w", err)
+	}
+	return scratch, nil
+}
+
+// fetchBundle fetches every ref of the bundle into the scratch repo under the provided ref prefix
+func fetchBundle(ctx context.Context, scratch string, bundle string, prefix string) error {
+	absBundle, err := filepath.Abs(bundle)
+	if err != nil {
+		return err
+	}
+	_, err = runGit(ctx, scratch, nil, "fetch", "--quiet", "--no-tags", absBundle, "+refs/*:"+prefix+"*")
+	if err != nil {
+		return fmt.Errorf("%w: failed to fetch %s due to error %v", ErrBundleCorrupt, bundle, err)
+	}
+	return nil
+}
+
+// CreateThinBundle writes a bundle to out holding the refs of older, but only the objects not already in newer
+func CreateThinBundle(ctx context.Context, older, newer, out string) error {
+	olderHeader, err := readBundleHeader(older)
+	if err != nil {
+		return err
+	}
+	newerHeader, err := readBundleHeader(newer)
+	if err != nil {
+		return err
+	}
+	if len(newerHeader.prerequisites) > 0 {
+		return fmt.Errorf("cannot create a thin bundle against %s as it is itself a thin bundle", newer)
+	}
+
+	scratch, err := newScratchRepo(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(scratch) }()
+
+	err = fetchBundle(ctx, scratch, newer, "refs/gubber/newer/")
+	if err != nil {
+		return err
+	}
+	err = fetchBundle(ctx, scratch, older, "refs/gubber/older/")
+	if err != nil {
+		return err
+	}
+
+	// prerequisites must be commits, so peel any tags in the newer bundle
+	output, err := runGit(ctx, scratch, nil, "for-each-ref", "--format=%(objectname) %(objecttype) %(*objectname) %(*objecttype)", "refs/gubber/newer/")
+	if err != nil {
+		return fmt.Errorf("failed to list refs of %s due to error %w", newer, err)
+	}
+	prerequisites := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Fields(line)
+		id := ""
+		if len(fields) >= 2 && fields[1] == "commit" {
+			id = fields[0]
+		} else if len(fields) == 4 && fields[3] == "commit" {
+			id = fields[2]
+		}
+		if id != "" && !seen[id] {
+			seen[id] = true
+			prerequisites = append(prerequisites, id)
+		}
+	}
+
+	var revs strings.Builder
+	for _, ref := range olderHeader.refs {
+		revs.WriteString(ref.id + "\n")
+	}
+	for _, ref := range newerHeader.refs {
+		revs.WriteString("^" + ref.id + "\n")
+	}
+
+	file, err := os.Create(out)
+	if err != nil {
+		return fmt.Errorf("failed to create thin bundle due to error %w", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	writer := bufio.NewWriter(file)
+	_, _ = writer.WriteString(bundleSignature + "\n")
+	for _, id := range prerequisites {
+		_, _ = writer.WriteString("-" + id + "\n")
+	}
+	for _, ref := range olderHeader.refs {
+		_, _ = writer.WriteString(ref.id + " " + ref.name + "\n")
+	}
+	_, _ = writer.WriteString("\n")
+
+	cmd := exec.CommandContext(ctx, "git", "pack-objects", "--stdout", "--thin", "--delta-base-offset", "--revs", "--quiet")
+	cmd.Dir = scratch
+	cmd.Stdin = strings.NewReader(revs.String())
+	cmd.Stdout = writer
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("failed to pack thin bundle due to error %w\nstderr: %s", err, stderr.String())
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to write thin bundle due to error %w", err)
+	}
+	return file.Close()
+}
+
+// ThinBundle replaces the full bundle older with a thin bundle against newer, keeping its modification time
+func ThinBundle(ctx context.Context, older, newer string) error {
+	thin, err := IsThinBundle(older)
+	if err != nil {
+		return err
+	}
+	if thin {
+		return nil
+	}
+
+	info, err := os.Stat(older)
+	if err != nil {
+		return err
+	}
+
+	tmp := older + ".thin"
+	err = CreateThinBundle(ctx, older, newer, tmp)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	err = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, older)
+}
+
+// materializeBundle fetches a chain of bundles, ordered from the full bundle to the thin bundle being restored,
+// and writes a full bundle holding exactly the refs of the last one into out
+func materializeBundle(ctx context.Context, chain []string, out string) error {
+	if len(chain) == 0 {
+		return errors.New("no bundles to materialize")
+	}
+	target, err := readBundleHeader(chain[len(chain)-1])
+	if err != nil {
+		return err
+	}
+
+	scratch, err := newScratchRepo(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(scratch) }()
+
+	for i, bundle := range chain {
+		err = fetchBundle(ctx, scratch, bundle, fmt.Sprintf("refs/gubber/%d/", i))
+		if err != nil {
+			return err
+		}
+	}
+
+	// replace the intermediate refs with the refs of the target bundle
+	var updates strings.Builder
+	head := ""
+	for _, ref := range target.refs {
+		if ref.name == "HEAD" {
+			head = ref.id
+			continue
+		}
+		updates.WriteString("update " + ref.name + " " + ref.id + "\n")
+	}
+	output, err := runGit(ctx, scratch, nil, "for-each-ref", "--format=delete %(refname)", "refs/gubber/")
+	if err != nil {
+		return err
+	}
+	updates.Write(output)
+	_, err = runGit(ctx, scratch, strings.NewReader(updates.String()), "update-ref", "--stdin")
+	if err != nil {
+		return fmt.Errorf("failed to set refs of restored repo due to error %w", err)
+	}
+
+	// point HEAD at the branch the bundle's HEAD resolved to, preferring the conventional default branches
+	if head != "" {
+		branch := ""
+		for _, ref := range target.refs {
+			if ref.id != head || !strings.HasPrefix(ref.name, "refs/heads/") {
+				continue
+			}
+			if branch == "" || ref.name == "refs/heads/main" || ref.name == "refs/heads/master" {
+				branch = ref.name
+			}
+		}
+		if branch != "" {
+			_, err = runGit(ctx, scratch, nil, "symbolic-ref", "HEAD", branch)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	absOut, err := filepath.Abs(out)
+	if err != nil {
+		return err
+	}
+	_, err = runGit(ctx, scratch, nil, "bundle", "create", "--quiet", absOut, "--all")
+	if err != nil {
+		return fmt.Errorf("failed to bundle restored repo due to error %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package download
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// gitDownloader bundles a local work repo for every repo it is asked to download
+type gitDownloader struct {
+	t    *testing.T
+	work string
+}
+
+func (g *gitDownloader) DownloadRepos(repos []*Repository, location *string) error {
+	for _, repo := range repos {
+		writeBundle(g.t, g.work, filepath.Join(*location, repo.FullName()+".bundle"))
+	}
+	return nil
+}
+
+func TestCreateThinBundle_RoundTrip(t *testing.T) {
+	work := newWorkRepo(t)
+	dir := t.TempDir()
+
+	// the old state has a feature branch which is deleted before the new state is taken
+	testGit(t, work, "checkout", "-b", "feature")
+	featureHead := commitFile(t, work, "feature.txt", "feature work")
+	testGit(t, work, "checkout", "main")
+	oldHead := testGit(t, work, "rev-parse", "HEAD")
+	older := filepath.Join(dir, "older.bundle")
+	writeBundle(t, work, older)
+
+	testGit(t, work, "branch", "-D", "feature")
+	commitFile(t, work, "README.md", "# changed")
+	newer := filepath.Join(dir, "newer.bundle")
+	writeBundle(t, work, newer)
+
+	thin := filepath.Join(dir, "thin.bundle")
+	if err := CreateThinBundle(context.Background(), older, newer, thin); err != nil {
+		t.Fatalf("CreateThinBundle() error: %v", err)
+	}
+	if isThin, err := IsThinBundle(thin); err != nil || !isThin {
+		t.Fatalf("IsThinBundle() = %v, %v, want true", isThin, err)
+	}
+
+	full := filepath.Join(dir, "full.bundle")
+	if err := materializeBundle(context.Background(), []string{newer, thin}, full); err != nil {
+		t.Fatalf("materializeBundle() error: %v", err)
+	}
+
+	dest := filepath.Join(dir, "restored")
+	testGit(t, dir, "clone", full, dest)
+	if got := testGit(t, dest, "rev-parse", "HEAD"); got != oldHead {
+		t.Errorf("restored HEAD = %s, want %s", got, oldHead)
+	}
+	if got := testGit(t, dest, "rev-parse", "origin/feature"); got != featureHead {
+		t.Errorf("restored feature branch = %s, want %s", got, featureHead)
+	}
+}
+
+func TestCreateThinBundle_NoNewObjects(t *testing.T) {
+	work := newWorkRepo(t)
+	dir := t.TempDir()
+
+	older := filepath.Join(dir, "older.bundle")
+	writeBundle(t, work, older)
+	commitFile(t, work, "second.txt", "second")
+	newer := filepath.Join(dir, "newer.bundle")
+	writeBundle(t, work, newer)
+
+	// every object of the older bundle is in the newer one, which `git bundle create` refuses to write
+	thin := filepath.Join(dir, "thin.bundle")
+	if err := CreateThinBundle(context.Background(), older, newer, thin); err != nil {
+		t.Fatalf("CreateThinBundle() error: %v", err)
+	}
+
+	thinInfo, _ := os.Stat(thin)
+	olderInfo, _ := os.Stat(older)
+	if thinInfo.Size() >= olderInfo.Size() {
+		t.Errorf("thin bundle is %d bytes, expected less than the full %d bytes", thinInfo.Size(), olderInfo.Size())
+	}
+}
+
+func TestCreateThinBundle_RejectsThinBase(t *testing.T) {
+	work := newWorkRepo(t)
+	dir := t.TempDir()
+
+	older := filepath.Join(dir, "older.bundle")
+	writeBundle(t, work, older)
+	commitFile(t, work, "second.txt", "second")
+	newer := filepath.Join(dir, "newer.bundle")
+	writeBundle(t, work, newer)
+	thin := filepath.Join(dir, "thin.bundle")
+	if err := CreateThinBundle(context.Background(), older, newer, thin); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CreateThinBundle(context.Background(), older, thin, filepath.Join(dir, "out.bundle")); err == nil {
+		t.Error("expected error creating a thin bundle against a thin bundle")
+	}
+}
+
+func TestMigrateRepos_StoresOlderGenerationsIncrementally(t *testing.T) {
+	work := newWorkRepo(t)
+	existingPath := filepath.Join(t.TempDir(), "backups")
+	tmpDir := t.TempDir()
+	dl := &gitDownloader{t: t, work: work}
+	repos := []*Repository{makeRepo("org", "repo")}
+
+	heads := make([]string, 0)
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			commitFile(t, work, "file.txt", string(rune('a'+i)))
+		}
+		heads = append(heads, testGit(t, work, "rev-parse", "HEAD"))
+		if err := MigrateReposWithDownloader(dl, repos, &existingPath, Retention{Last: 5}, &tmpDir); err != nil {
+			t.Fatalf("MigrateRepos() run %d error: %v", i, err)
+		}
+	}
+
+	for gen, wantThin := range map[int]bool{0: false, 1: true, 2: true} {
+		isThin, err := IsThinBundle(BundlePath(existingPath, "org/repo", generationAt(existingPath, gen)))
+		if err != nil {
+			t.Fatalf("IsThinBundle(generation %d) error: %v", gen, err)
+		}
+		if isThin != wantThin {
+			t.Errorf("generation %d thin = %v, want %v", gen, isThin, wantThin)
+		}
+	}
+
+	// the oldest generation is restored by chaining the two newer ones
+	for gen := 0; gen < 3; gen++ {
+		dest := filepath.Join(t.TempDir(), "restored")
+		if err := RestoreBundle(context.Background(), NewLocalStorage(existingPath), BundleName("org/repo", generationAt(existingPath, gen)), dest, nil); err != nil {
+			t.Fatalf("RestoreBundle(generation %d) error: %v", gen, err)
+		}
+		want := heads[len(heads)-1-gen]
+		if got := testGit(t, dest, "rev-parse", "HEAD"); got != want {
+			t.Errorf("generation %d restored HEAD = %s, want %s", gen, got, want)
+		}
+	}
+}
+
+func TestRestoreBundle_ThinWithoutBase(t *testing.T) {
+	work := newWorkRepo(t)
+	dir := t.TempDir()
+	older := filepath.Join(dir, "older.bundle")
+	writeBundle(t, work, older)
+	commitFile(t, work, "second.txt", "second")
+	newer := filepath.Join(dir, "newer.bundle")
+	writeBundle(t, work, newer)
+
+	location := t.TempDir()
+	thin := BundlePath(location, "org/repo", testGeneration(1))
+	if err := os.MkdirAll(filepath.Dir(thin), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateThinBundle(context.Background(), older, newer, thin); err != nil {
+		t.Fatal(err)
+	}
+
+	err := RestoreBundle(context.Background(), NewLocalStorage(location), BundleName("org/repo", testGeneration(1)), filepath.Join(t.TempDir(), "restored"), nil)
+	if err == nil {
+		t.Error("expected error restoring a thin bundle whose base is missing")
+	}
+}
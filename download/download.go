@@ -5,237 +5,631 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strconv"
+	"sort"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
-
-	"github.com/google/go-github/github"
 )
 
 type Downloader struct {
-	ctx          context.Context
-	token        string
-	cloneBaseURL string
+	ctx         context.Context
+	concurrency int
+	maxRetries  int
+	retryDelay  time.Duration
+	exporters   []RepoExporter
+	// exportOnly holds the unchanged repos added by WithUnchangedExports, for which only the exporters are run
+	exportOnly map[string]bool
+	// ssh is set when repos are cloned over ssh rather than https
+	ssh *sshOptions
+	// storage holds the generations, and is nil to keep them in the backup location on the local disk
+	storage Storage
+	// encryption encrypts the new generations and repos.json, and is nil to write them unencrypted
+	encryption *Encryption
+	// overrides change which exporters run for the repos they match
+	overrides Overrides
+}
+
+// sshOptions configure how ssh authenticates clones, defaulting to the ssh agent and the user's known hosts
+type sshOptions struct {
+	keyFile        string
+	knownHostsFile string
 }
 
-func NewDownloader(ctx context.Context, token *string) *Downloader {
-	return &Downloader{
-		ctx:          ctx,
-		token:        *token,
-		cloneBaseURL: "https://%s@github.com/%s.git",
+// DownloaderOption configures optional behaviour of a Downloader
+type DownloaderOption func(*Downloader)
+
+// WithConcurrency sets how many repos are downloaded at the same time
+func WithConcurrency(n int) DownloaderOption {
+	return func(d *Downloader) {
+		if n > 0 {
+			d.concurrency = n
+		}
 	}
 }
 
-// DownloadRepo will download a repo from github, saving it in the preconfigured location, under org/repo-name
-func (d *Downloader) DownloadRepo(repo *github.Repository, location *string) error {
-	if repo.GetFullName() == "" {
-		return errors.New("repo name is empty")
+// WithRetries sets how many times a failed repo is retried, and the delay before the first retry, which then doubles
+func WithRetries(maxRetries int, delay time.Duration) DownloaderOption {
+	return func(d *Downloader) {
+		if maxRetries >= 0 {
+			d.maxRetries = maxRetries
+		}
+		if delay > 0 {
+			d.retryDelay = delay
+		}
 	}
+}
 
-	// create the org folder if it doesn't exist
-	fmt.Println("Creating folder:", *location+"/"+repo.GetFullName())
-	org_folder := *location + "/" + repo.GetOwner().GetLogin()
+// WithExporters adds exporters which are run for every repo after it has been bundled
+func WithExporters(exporters ...RepoExporter) DownloaderOption {
+	return func(d *Downloader) {
+		d.exporters = append(d.exporters, exporters...)
+	}
+}
+
+// WithSSH clones repos over ssh with the private key in keyFile or the ssh agent, trusting only known hosts
+func WithSSH(keyFile string, knownHostsFile string) DownloaderOption {
+	return func(d *Downloader) {
+		d.ssh = &sshOptions{keyFile: keyFile, knownHostsFile: knownHostsFile}
+	}
+}
+
+// WithStorage keeps the generations in storage rather than in the backup location, which then only holds repos.json
+// and the journal of the rotation in progress
+func WithStorage(storage Storage) DownloaderOption {
+	return func(d *Downloader) {
+		d.storage = storage
+	}
+}
+
+// WithEncryption encrypts every file written to the generations, and repos.json, to the recipients of encryption
+func WithEncryption(encryption *Encryption) DownloaderOption {
+	return func(d *Downloader) {
+		d.encryption = encryption
+	}
+}
+
+func NewDownloader(ctx context.Context, opts ...DownloaderOption) *Downloader {
+	d := &Downloader{
+		ctx:         ctx,
+		concurrency: 1,
+		maxRetries:  10,
+		retryDelay:  5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
 
-	err := os.MkdirAll(org_folder, 0755)
+// errRemoteMissing is returned by mirrorAndBundle when git reports that the path of the remote repository does not exist
+var errRemoteMissing = errors.New("remote repository does not exist")
+
+// errRemoteNotFound is returned by mirrorAndBundle when the server answers that the remote repository was not found
+var errRemoteNotFound = errors.New("remote repository was not found")
+
+// errEmptyRepo is returned by DownloadRepo when the repo has no refs, so there is nothing to bundle
+var errEmptyRepo = errors.New("repo has no refs to bundle")
+
+// missingRemoteError returns errRemoteMissing or errRemoteNotFound for the output of a failed git command, or nil
+func missingRemoteError(output []byte) error {
+	out := string(output)
+	switch {
+	case strings.Contains(out, "does not appear to be a git repository"),
+		strings.Contains(out, "fatal: repository '") && strings.Contains(out, "' does not exist"):
+		return errRemoteMissing
+	case strings.Contains(out, "Repository not found."),
+		strings.Contains(out, "fatal: repository '") && strings.Contains(out, "' not found"):
+		return errRemoteNotFound
+	}
+	return nil
+}
+
+// ErrHostKeyVerification is returned when the host key of an ssh server is unknown or has changed
+var ErrHostKeyVerification = errors.New("host key verification failed")
+
+// isHostKeyFailure reports whether the output of a failed git command means ssh rejected the host key of the server
+func isHostKeyFailure(output []byte) bool {
+	out := string(output)
+	return strings.Contains(out, "Host key verification failed") ||
+		strings.Contains(out, "REMOTE HOST IDENTIFICATION HAS CHANGED")
+}
+
+// cloneURLs returns the urls that repo and its wiki are cloned from, which are ssh urls in ssh mode
+func (d *Downloader) cloneURLs(repo *Repository) (string, string) {
+	if d.ssh == nil {
+		return repo.CloneURL, repo.WikiURL
+	}
+	cloneURL := repo.SSHURL
+	if cloneURL == "" {
+		cloneURL = sshURL(repo.CloneURL)
+	}
+	wikiURL := ""
+	if repo.WikiURL != "" {
+		wikiURL = sshWikiURL(repo, cloneURL)
+	}
+	return cloneURL, wikiURL
+}
+
+// sshWikiURL returns the ssh url the wiki of repo is cloned from, derived from the ssh cloneURL of the repo
+func sshWikiURL(repo *Repository, cloneURL string) string {
+	base := strings.TrimSuffix(repo.CloneURL, ".git")
+	if !strings.HasPrefix(repo.WikiURL, base) {
+		return sshURL(repo.WikiURL)
+	}
+	return strings.TrimSuffix(cloneURL, ".git") + strings.TrimPrefix(repo.WikiURL, base)
+}
+
+// sshCommand returns the ssh command git runs in ssh mode, which never prompts or trusts unknown hosts
+func (o *sshOptions) sshCommand() string {
+	command := []string{"ssh", "-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=yes"}
+	if o.keyFile != "" {
+		command = append(command, "-i", shellQuote(o.keyFile), "-o", "IdentitiesOnly=yes")
+	}
+	if o.knownHostsFile != "" {
+		command = append(command, "-o", "UserKnownHostsFile="+shellQuote(o.knownHostsFile))
+	}
+	return strings.Join(command, " ")
+}
+
+// shellQuote quotes s for use as a single word in a shell command
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// remoteGit returns a git command run against a remote which never prompts for credentials
+func (d *Downloader) remoteGit(credentials Credentials, args ...string) (*exec.Cmd, error) {
+	if d.ssh != nil {
+		cmd := exec.CommandContext(d.ctx, "git", args...)
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_SSH_COMMAND="+d.ssh.sshCommand())
+		return cmd, nil
+	}
+
+	credentialArgs, env, err := gitCredentials(credentials)
 	if err != nil {
-		return fmt.Errorf("failed to create org folder due to error %w", err)
+		return nil, err
 	}
+	cmd := exec.CommandContext(d.ctx, "git", append(credentialArgs, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Env = append(cmd.Env, env...)
+	return cmd, nil
+}
 
-	// download the repo
-	fmt.Println("Downloading:", repo.GetFullName())
+// mirrorAndBundle clones remoteURL as a mirror and bundles it to <name>.bundle, returning false if it has no refs
+func (d *Downloader) mirrorAndBundle(remoteURL string, credentials Credentials, org_folder string, name string) (bool, error) {
+	mirror := org_folder + "/" + name + ".git"
 
 	// if output file exists, delete it
-	if Exists(org_folder + "/" + repo.GetName() + ".git") {
-		err := os.RemoveAll(org_folder + "/" + repo.GetName() + ".git")
+	if Exists(mirror) {
+		err := os.RemoveAll(mirror)
 		if err != nil {
-			return fmt.Errorf("failed to remove existing repo folder due to error %w", err)
+			return false, fmt.Errorf("failed to remove existing repo folder due to error %w", err)
 		}
 	}
+	// delete the .git repo once bundled
+	defer func() { _ = os.RemoveAll(mirror) }()
 
-	cloneURL := fmt.Sprintf(d.cloneBaseURL, d.token, repo.GetFullName())
-	cmd := exec.CommandContext(d.ctx, "git", "clone", "--mirror", cloneURL, org_folder+"/"+repo.GetName()+".git")
+	cmd, err := d.remoteGit(credentials, "clone", "--mirror", remoteURL, mirror)
+	if err != nil {
+		return false, err
+	}
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("failed to download repo due to error %w\nstdout + stderr: %s", err, output)
+		if isHostKeyFailure(output) {
+			return false, fmt.Errorf("failed to download repo from %s due to error %w", remoteURL, ErrHostKeyVerification)
+		}
+		if missing := missingRemoteError(output); missing != nil {
+			return false, fmt.Errorf("%w\nstdout + stderr: %s", missing, Redact(string(output)))
+		}
+		return false, fmt.Errorf("failed to download repo due to error %w\nstdout + stderr: %s", err, Redact(string(output)))
 	}
 
-	// bundle the repo
-	// This is a security measure to prevent command injection.
-	if strings.ContainsAny(repo.GetName(), ";|&") {
-		return fmt.Errorf("repo name contains invalid characters: %s", repo.GetName())
+	refs, err := runGit(d.ctx, mirror, nil, "for-each-ref", "--count=1")
+	if err != nil {
+		return false, fmt.Errorf("failed to list refs of repo due to error %w", err)
 	}
-	fmt.Println("Bundling:", repo.GetFullName())
-	cmd = exec.CommandContext(d.ctx, "git", "bundle", "create", repo.GetName()+".bundle", "--all")
-	cmd.Dir = org_folder + "/" + repo.GetName() + ".git"
+	if len(refs) == 0 {
+		return false, nil
+	}
+
+	fmt.Println("Bundling:", name)
+	cmd = exec.CommandContext(d.ctx, "git", "bundle", "create", name+".bundle", "--all")
+	cmd.Dir = mirror
 
 	// run command getting stdout and stderr
 	output, err = cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("failed to bundle repo due to error %w\nstdout + stderr: %s", err, output)
+		return false, fmt.Errorf("failed to bundle repo due to error %w\nstdout + stderr: %s", err, output)
+	}
+
+	// check the bundle can be read back before it replaces anything, so a bad bundle is retried like a failed clone
+	_, err = runGit(d.ctx, mirror, nil, "bundle", "verify", "--quiet", name+".bundle")
+	if err != nil {
+		return false, fmt.Errorf("%w: bundle of %s failed verification due to error %v", ErrBundleCorrupt, name, err)
 	}
 
 	// move the bundle to the download location
-	fmt.Println("Moving:", repo.GetFullName())
-	err = os.Rename(org_folder+"/"+repo.GetName()+".git/"+repo.GetName()+".bundle", org_folder+"/"+repo.GetName()+".bundle")
+	err = os.Rename(mirror+"/"+name+".bundle", org_folder+"/"+name+".bundle")
 	if err != nil {
-		return fmt.Errorf("failed to move bundle to download location due to error %w", err)
+		return false, fmt.Errorf("failed to move bundle to download location due to error %w", err)
 	}
+	return true, nil
+}
 
-	// delete the .git repo
-	fmt.Println("Cleaning:", repo.GetFullName())
-	err = os.RemoveAll(org_folder + "/" + repo.GetName() + ".git")
+// DownloadRepo will download a repo and its wiki, saving them in the preconfigured location, under owner/repo-name
+func (d *Downloader) DownloadRepo(repo *Repository, location *string) error {
+	if repo.Owner == "" || repo.Name == "" {
+		return errors.New("repo name is empty")
+	}
+	// This is a security measure to prevent command injection.
+	if strings.ContainsAny(repo.Name, ";|&") {
+		return fmt.Errorf("repo name contains invalid characters: %s", repo.Name)
+	}
+	// owners may be nested groups, but must stay within the location
+	err := validateFullName(repo.FullName())
 	if err != nil {
-		return fmt.Errorf("failed to clean repo due to error %w", err)
+		return err
+	}
+
+	if d.exportOnly[repo.FullName()] {
+		return d.exportRepo(repo, location)
+	}
+
+	// create the org folder if it doesn't exist
+	fmt.Println("Creating folder:", *location+"/"+repo.FullName())
+	org_folder := *location + "/" + filepath.Dir(repo.FullName())
+
+	err = os.MkdirAll(org_folder, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create org folder due to error %w", err)
+	}
+
+	cloneURL, wikiURL := d.cloneURLs(repo)
+
+	// download and bundle the repo
+	fmt.Println("Downloading:", repo.FullName())
+	bundled, err := d.mirrorAndBundle(cloneURL, repo.Credentials, org_folder, repo.Name)
+	if errors.Is(err, errRemoteMissing) || errors.Is(err, errRemoteNotFound) {
+		return fmt.Errorf("failed to download repo %s due to error %w", repo.FullName(), err)
+	}
+	if err != nil {
+		return err
+	}
+	if !bundled {
+		return fmt.Errorf("failed to download repo %s due to error %w", repo.FullName(), errEmptyRepo)
+	}
+
+	if wikiURL != "" {
+		fmt.Println("Downloading wiki:", repo.FullName())
+		_, err = d.mirrorAndBundle(wikiURL, repo.Credentials, org_folder, repo.Name+".wiki")
+		// the repo was just cloned with the same credentials, so a wiki which was not found has no pages yet
+		if errors.Is(err, errRemoteMissing) || errors.Is(err, errRemoteNotFound) {
+			fmt.Println("No wiki:", repo.FullName())
+		} else if err != nil {
+			return fmt.Errorf("failed to download wiki due to error %w", err)
+		}
+	}
+
+	for _, exporter := range d.repoExporters(repo) {
+		err = exporter.ExportRepo(repo, org_folder)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-// DownloadRepos will download all repos from github, saving them in the preconfigured location, under org/repo-name
-func (d *Downloader) DownloadRepos(repos []*github.Repository, location *string) error {
-	const maxRetryTimes = 10
+// exportRepo runs the exporters of a repo whose refs are unchanged, without cloning it
+func (d *Downloader) exportRepo(repo *Repository, location *string) error {
+	export_folder, err := os.MkdirTemp(*location, ".export-")
+	if err != nil {
+		return fmt.Errorf("failed to create export folder due to error %w", err)
+	}
+	defer func() { _ = os.RemoveAll(export_folder) }()
 
-	if len(repos) == 0 {
-		return errors.New("no repos to download")
+	for _, exporter := range d.repoExporters(repo) {
+		err = exporter.ExportRepo(repo, export_folder)
+		if err != nil {
+			return err
+		}
+	}
+
+	entries, err := os.ReadDir(export_folder)
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+	org_folder := *location + "/" + filepath.Dir(repo.FullName())
+	err = os.MkdirAll(org_folder, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create org folder due to error %w", err)
+	}
+	for _, entry := range entries {
+		err = os.Rename(filepath.Join(export_folder, entry.Name()), filepath.Join(org_folder, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to move export of repo %s due to error %w", repo.FullName(), err)
+		}
+	}
+	return nil
+}
+
+// WithUnchangedExports adds the unchanged repos whose exports changed to the changed repos, so only their exporters run
+func (d *Downloader) WithUnchangedExports(location string, repos []*Repository, changed []*Repository) ([]*Repository, error) {
+	d.exportOnly = make(map[string]bool)
+	if len(d.exporters) == 0 && len(d.overrides) == 0 {
+		return changed, nil
 	}
-	for _, repo := range repos {
-		errCount := 0
-		for {
-			err := d.DownloadRepo(repo, location)
+
+	isChanged := make(map[string]bool, len(changed))
+	for _, repo := range changed {
+		isChanged[repo.FullName()] = true
+	}
+
+	jsonRepos := loadJsonRepos(location, d.encryption)
+	versions := make([]RepoRefs, len(repos))
+	unknown := make([]bool, len(repos))
+	d.parallel(len(repos), func(i int) {
+		name := repos[i].FullName()
+		previous := jsonRepos.Repos[name]
+		exporters := d.repoExporters(repos[i])
+		versions[i] = make(RepoRefs, len(exporters))
+		for _, exporter := range exporters {
+			version, err := exporter.ExportVersion(repos[i], previous[exportKey(exporter)])
 			if err != nil {
-				errCount++
-				// if error count is greater than 4, fail out
-				fmt.Println("Error downloading repo:", repo.GetFullName(), "due to error:", err)
-				if errCount > maxRetryTimes {
-					return fmt.Errorf("failed to download repo %s due to error %w", repo.GetFullName(), err)
-				}
-				// wait 10 seconds before trying again
-				time.Sleep(10 * time.Second)
+				fmt.Println("Error checking export:", name, "due to error:", err)
+				unknown[i] = true
+				continue
+			}
+			if version != "" {
+				versions[i][exportKey(exporter)] = version
+			}
+		}
+	})
+
+	result := append([]*Repository{}, changed...)
+	for i, repo := range repos {
+		name := repo.FullName()
+		pending, ok := jsonRepos.Pending[name]
+		if !isChanged[name] {
+			// an export which could not be checked is treated as changed
+			previous := jsonRepos.Repos[name]
+			exportChanged := unknown[i]
+			for key, version := range versions[i] {
+				exportChanged = exportChanged || version != previous[key]
+			}
+			if !exportChanged {
 				continue
 			}
-			break
+			pending, ok = maps.Clone(previous), true
+			d.exportOnly[name] = true
+			result = append(result, repo)
+		}
+		// the refs of a changed repo could not be listed, so its versions are not recorded either
+		if !ok {
+			continue
+		}
+		maps.Copy(pending, versions[i])
+		jsonRepos.Pending[name] = pending
+	}
+
+	err := saveJsonRepos(location, jsonRepos, d.encryption)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// maxRetryDelay caps the exponential backoff between attempts to download a repo
+const maxRetryDelay = 5 * time.Minute
+
+// DownloadError is returned by DownloadRepos when some repos could not be downloaded, even after retrying
+type DownloadError struct {
+	// Failed maps the full name of each repo that failed to the error from its last attempt
+	Failed map[string]error
+}
+
+func (e *DownloadError) Error() string {
+	names := make([]string, 0, len(e.Failed))
+	for name := range e.Failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "failed to download %d repos:", len(e.Failed))
+	for _, name := range names {
+		fmt.Fprintf(&b, "\n%s: %v", name, e.Failed[name])
+	}
+	return b.String()
+}
+
+func (e *DownloadError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failed))
+	for _, err := range e.Failed {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// backoff returns how long to wait before retrying after the given number of failed attempts
+func (d *Downloader) backoff(attempt int) time.Duration {
+	delay := d.retryDelay
+	for i := 1; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryDelay)
+}
+
+// downloadWithRetry downloads a single repo, retrying with exponential backoff on failure
+func (d *Downloader) downloadWithRetry(repo *Repository, location *string) error {
+	attempt := 0
+	for {
+		// errors may quote git's output or a remote's url, so are redacted before being logged or returned
+		err := RedactError(d.DownloadRepo(repo, location))
+		if err == nil || errors.Is(err, errEmptyRepo) {
+			return err
+		}
+		attempt++
+		fmt.Println("Error downloading repo:", repo.FullName(), "due to error:", err)
+		// a missing remote or rejected host key fails again, while a remote which was not found may be an expired token
+		if attempt > d.maxRetries || errors.Is(err, errRemoteMissing) || errors.Is(err, ErrHostKeyVerification) {
+			return err
+		}
+
+		delay := d.backoff(attempt)
+		fmt.Printf("Retrying %s in %v (attempt %d of %d)\n", repo.FullName(), delay, attempt+1, d.maxRetries+1)
+		select {
+		case <-d.ctx.Done():
+			return d.ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// parallel calls fn for every index up to n, running at most d.concurrency calls at the same time
+func (d *Downloader) parallel(n int, fn func(i int)) {
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(d.concurrency, n); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// DownloadRepos will download all repos concurrently, reporting every repo that kept failing in a *DownloadError
+func (d *Downloader) DownloadRepos(repos []*Repository, location *string) error {
+	if len(repos) == 0 {
+		return errors.New("no repos to download")
+	}
+
+	var mu sync.Mutex
+	failed := make(map[string]error)
+	d.parallel(len(repos), func(i int) {
+		err := d.downloadWithRetry(repos[i], location)
+		if errors.Is(err, errEmptyRepo) {
+			fmt.Println("Skipping empty repo:", repos[i].FullName())
+			return
 		}
+		if err != nil {
+			mu.Lock()
+			failed[repos[i].FullName()] = err
+			mu.Unlock()
+		}
+	})
+
+	if len(failed) > 0 {
+		return &DownloadError{Failed: failed}
 	}
 	return nil
 }
 
-func (d *Downloader) MigrateRepos(new_repos []*github.Repository, existing_path *string, backups_limit int, temp_location *string) error {
-	return MigrateReposWithDownloader(d, new_repos, existing_path, backups_limit, temp_location)
+func (d *Downloader) MigrateRepos(new_repos []*Repository, existing_path *string, retention Retention, temp_location *string) error {
+	storage := d.storage
+	if storage == nil {
+		storage = NewLocalStorage(*existing_path)
+	}
+	return MigrateReposToStorage(d, storage, d.encryption, new_repos, existing_path, retention, temp_location)
+}
+
+// MigrateReposWithDownloader downloads the repos with dl and rotates them into the generations of the backup location
+func MigrateReposWithDownloader(dl RepoDownloader, new_repos []*Repository, existing_path *string, retention Retention, temp_location *string) error {
+	return MigrateReposToStorage(dl, NewLocalStorage(*existing_path), nil, new_repos, existing_path, retention, temp_location)
 }
 
-func MigrateReposWithDownloader(dl RepoDownloader, new_repos []*github.Repository, existing_path *string, backups_limit int, temp_location *string) error {
+// MigrateReposToStorage downloads the repos with dl and rotates them into the generations in storage
+func MigrateReposToStorage(dl RepoDownloader, storage Storage, encryption *Encryption, new_repos []*Repository, existing_path *string, retention Retention, temp_location *string) error {
+	// an interrupted rotation may still need the repos in the temp folder, so is recovered before it is cleared
+	err := RecoverRotation(*existing_path, storage, encryption, 0)
+	if err != nil {
+		return fmt.Errorf("failed to recover interrupted rotation due to error %w", err)
+	}
+
 	// create temporary location to download repos
 	temp_path := *temp_location + "/temp"
 	// if any files exist in the temp location, delete them
 	if Exists(temp_path) {
-		err := os.RemoveAll(temp_path)
+		err = os.RemoveAll(temp_path)
 		if err != nil {
 			return fmt.Errorf("failed to remove existing temp folder due to error %w", err)
 		}
 	}
-	err := os.MkdirAll(temp_path, 0755)
+	err = os.MkdirAll(temp_path, 0755)
 	if err != nil {
 		return fmt.Errorf("failed to create temp folder due to error %w", err)
 	}
 	defer func() { _ = os.RemoveAll(temp_path) }()
 
-	// download all new repos
-	err = dl.DownloadRepos(new_repos, &temp_path)
-	if err != nil {
-		return fmt.Errorf("failed to download new repos due to error %w", err)
-	}
-
-	// increment all backups by one, starting from T-backup_limit and working down
-	for i := backups_limit; i >= 0; i-- {
-		// if the backup exists, increment it
-		if Exists(*existing_path + "/T-" + strconv.Itoa(i)) {
-			err = os.Rename(*existing_path+"/T-"+strconv.Itoa(i), *existing_path+"/T-"+strconv.Itoa(i+1))
-			if err != nil {
-				return fmt.Errorf("failed to increment backup %d due to error %w", i, err)
-			}
+	// download all new repos, carrying on with the ones that succeeded if only some failed
+	downloadErr := dl.DownloadRepos(new_repos, &temp_path)
+	var partial *DownloadError
+	if downloadErr != nil {
+		if !errors.As(downloadErr, &partial) || len(partial.Failed) >= len(new_repos) {
+			return fmt.Errorf("failed to download new repos due to error %w", downloadErr)
 		}
+		fmt.Printf("Failed to download %d of %d repos, migrating the rest\n", len(partial.Failed), len(new_repos))
 	}
 
-	// move the new repos to the existing path at T-0
-	err = MoveFolder(temp_path, *existing_path+"/T-0")
+	// the bundles were verified as they were downloaded, so only their ciphertext is written to the generations
+	err = encryption.encryptFolder(temp_path)
 	if err != nil {
-		return fmt.Errorf("failed to move new repos to existing path due to error %w", err)
+		return err
 	}
 
-	// if a file exists in the older backup, but not the newer backup, move it to the newer backup
-	// if a file exists in both, generate a diff and replace the older backup with a .patch file
-	for i := backups_limit + 1; i >= 1; i-- {
-		// if the backup exists, increment it
-		if Exists(*existing_path + "/T-" + strconv.Itoa(i)) {
-			//location will contain folders, with items. Recurse into each folder one at a time
-			orgfiles, err := os.ReadDir(*existing_path + "/T-" + strconv.Itoa(i))
-			if err != nil {
-				return fmt.Errorf("failed to read directory %s due to error %w", *existing_path+"/T-"+strconv.Itoa(i), err)
-			}
-
-			for _, orgfile := range orgfiles {
-				// if the file is a directory, recurse into it
-				if orgfile.IsDir() {
-					// get a list of all files in the directory
-					files, err := os.ReadDir(*existing_path + "/T-" + strconv.Itoa(i) + "/" + orgfile.Name())
-					if err != nil {
-						return fmt.Errorf("failed to read directory %s due to error %w", *existing_path+"/T-"+strconv.Itoa(i)+"/"+orgfile.Name(), err)
-					}
-
-					// for each file, check if it exists in the newer backup
-					for _, file := range files {
-						if !Exists(*existing_path + "/T-" + strconv.Itoa(i-1) + "/" + orgfile.Name() + "/" + file.Name()) {
-							// if it doesn't, move it to the newer backup
-							// check if the org exists in the new backup, if it doesn't create the directory
-							if !Exists(*existing_path + "/T-" + strconv.Itoa(i-1) + "/" + orgfile.Name()) {
-								err = os.Mkdir(*existing_path+"/T-"+strconv.Itoa(i-1)+"/"+orgfile.Name(), 0755)
-								if err != nil {
-									return fmt.Errorf("failed to create directory %s due to error %w", *existing_path+"/T-"+strconv.Itoa(i-1)+"/"+orgfile.Name(), err)
-								}
-							}
-
-							err = os.Rename(*existing_path+"/T-"+strconv.Itoa(i)+"/"+orgfile.Name()+"/"+file.Name(), *existing_path+"/T-"+strconv.Itoa(i-1)+"/"+orgfile.Name()+"/"+file.Name())
-							if err != nil {
-								return fmt.Errorf("failed to move file %s from backup %d to backup %d due to error %w", file.Name(), i, i-1, err)
-							}
-						}
-					}
-				}
-			}
+	// record the rotation before carrying it out, so it can be finished or undone if it is interrupted
+	generations, err := listGenerations(storage)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	journal := &rotationJournal{
+		Phase:      phaseMove,
+		Generation: newGenerationName(generations, now),
+		Retention:  retention,
+		Temp:       temp_path,
+		Repos:      make([]string, 0, len(new_repos)),
+		StartedAt:  now,
+		encryption: encryption,
+	}
+	for _, repo := range new_repos {
+		journal.Repos = append(journal.Repos, repo.FullName())
+	}
+	err = journal.save(*existing_path)
+	if err != nil {
+		return err
+	}
 
-			// if any of the orgFiles are empty folders, remove them
-			for _, orgfile := range orgfiles {
-				if orgfile.IsDir() {
-					// get a list of all files in the directory
-					files, err := os.ReadDir(*existing_path + "/T-" + strconv.Itoa(i) + "/" + orgfile.Name())
-					if err != nil {
-						return fmt.Errorf("failed to read directory %s due to error %w", *existing_path+"/T-"+strconv.Itoa(i)+"/"+orgfile.Name(), err)
-					}
-
-					if len(files) == 0 {
-						err = os.Remove(*existing_path + "/T-" + strconv.Itoa(i) + "/" + orgfile.Name())
-						if err != nil {
-							return fmt.Errorf("failed to remove directory %s due to error %w", *existing_path+"/T-"+strconv.Itoa(i)+"/"+orgfile.Name(), err)
-						}
-					}
-				}
-			}
-		}
+	err = journal.run(*existing_path, storage, encryption)
+	if err != nil {
+		return err
 	}
 
-	// try to delete T-backup_limit if it exists
-	if Exists(*existing_path + "/T-" + strconv.Itoa(backups_limit)) {
-		err = os.RemoveAll(*existing_path + "/T-" + strconv.Itoa(backups_limit))
-		if err != nil {
-			return fmt.Errorf("failed to delete backup %d due to error %w", backups_limit, err)
+	// the refs of a repo are only recorded once its bundle is in a generation, so a failed repo is downloaded again
+	backedUp := make([]*Repository, 0, len(new_repos))
+	for _, repo := range new_repos {
+		if partial == nil || partial.Failed[repo.FullName()] == nil {
+			backedUp = append(backedUp, repo)
 		}
 	}
+	err = recordRepos(*existing_path, backedUp, encryption)
+	if err != nil {
+		return err
+	}
 
-	return nil
+	return downloadErr
 }
 
 func MoveFolder(sourcePath, destPath string) error {
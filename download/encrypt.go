@@ -0,0 +1,337 @@
+package download
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"golang.org/x/crypto/ssh"
+)
+
+// ageHeader is the first line of every file encrypted with age
+const ageHeader = "age-encryption.org/v1\n"
+
+// pgpArmor starts every armored OpenPGP key, which age cannot encrypt to or decrypt with
+const pgpArmor = "-----BEGIN PGP"
+
+// ErrGPGUnsupported is returned when a GPG key is configured, as only age and ssh keys are supported
+var ErrGPGUnsupported = errors.New("GPG keys are not supported, use an age or ssh key")
+
+// ErrNoIdentity is returned when an encrypted file is read without an identity to decrypt it
+var ErrNoIdentity = errors.New("file is encrypted and no identity was provided")
+
+// Encryption encrypts the files gubber writes to age recipients, and a nil Encryption neither encrypts nor decrypts
+type Encryption struct {
+	recipients []age.Recipient
+	identities []age.Identity
+	// nameKey keys the names of encrypted release assets, and is derived from the secret keys of the identities
+	nameKey []byte
+}
+
+// NewEncryption encrypts to the age or ssh recipients, and decrypts with the identities in identityFile
+func NewEncryption(recipients []string, identityFile string) (*Encryption, error) {
+	e := &Encryption{}
+	for _, value := range recipients {
+		var recipient age.Recipient
+		var err error
+		if strings.HasPrefix(value, pgpArmor) {
+			return nil, ErrGPGUnsupported
+		}
+		if strings.HasPrefix(value, "ssh-") {
+			recipient, err = agessh.ParseRecipient(value)
+		} else {
+			recipient, err = age.ParseX25519Recipient(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid age recipient %q due to error %w", value, err)
+		}
+		e.recipients = append(e.recipients, recipient)
+	}
+
+	if identityFile != "" {
+		data, err := os.ReadFile(identityFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read identity file due to error %w", err)
+		}
+		if bytes.HasPrefix(bytes.TrimSpace(data), []byte(pgpArmor)) {
+			return nil, ErrGPGUnsupported
+		}
+		if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+			identity, err := agessh.ParseIdentity(data)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse ssh identity file due to error %w", err)
+			}
+			e.identities = append(e.identities, identity)
+		} else {
+			e.identities, err = age.ParseIdentities(bytes.NewReader(data))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse age identity file due to error %w", err)
+			}
+		}
+		e.nameKey, err = assetNameKey(data, e.identities)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// files gubber cannot read back would turn off thinning and the detection of unchanged repos
+	if len(e.recipients) > 0 && len(e.identities) > 0 {
+		var ciphertext bytes.Buffer
+		err := e.encrypt(&ciphertext, strings.NewReader("gubber"))
+		if err == nil {
+			_, err = e.decrypt(&ciphertext)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("none of the identities can decrypt files encrypted to the recipients: %w", err)
+		}
+	}
+	return e, nil
+}
+
+// Encrypts reports whether files are encrypted as they are written
+func (e *Encryption) Encrypts() bool {
+	return e != nil && len(e.recipients) > 0
+}
+
+// Decrypts reports whether encrypted files can be read
+func (e *Encryption) Decrypts() bool {
+	return e != nil && len(e.identities) > 0
+}
+
+// encrypt writes the content of src to dst, encrypted to the recipients
+func (e *Encryption) encrypt(dst io.Writer, src io.Reader) error {
+	writer, err := age.Encrypt(dst, e.recipients...)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, src)
+	if cerr := writer.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// assetNameKey derives the key naming encrypted release assets from the secret keys in the identity file, so
+// comments, whitespace and the order of the keys do not change it
+func assetNameKey(data []byte, identities []age.Identity) ([]byte, error) {
+	keys := make([]string, 0, len(identities))
+	for _, identity := range identities {
+		if x25519, ok := identity.(*age.X25519Identity); ok {
+			keys = append(keys, x25519.String())
+		}
+	}
+	if len(keys) == 0 {
+		// ssh identities do not expose their key, so the private key is parsed again to encode it the same way
+		// whichever format the file is in
+		key, err := ssh.ParseRawPrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ssh identity file due to error %w", err)
+		}
+		if ed, ok := key.(*ed25519.PrivateKey); ok {
+			key = *ed
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode ssh identity due to error %w", err)
+		}
+		keys = append(keys, hex.EncodeToString(der))
+	}
+	slices.Sort(keys)
+	key := sha256.Sum256([]byte("gubber release asset names\n" + strings.Join(keys, "\n")))
+	return key[:], nil
+}
+
+// assetName returns the name an asset with the plaintext checksum sum is stored under, keyed with the identity, or
+// the checksum of the encrypted file when there is no identity to key it with
+func (e *Encryption) assetName(sum string, file string) (string, error) {
+	if !e.Encrypts() {
+		return sum, nil
+	}
+	if len(e.nameKey) > 0 {
+		mac := hmac.New(sha256.New, e.nameKey)
+		mac.Write([]byte(sum))
+		return hex.EncodeToString(mac.Sum(nil)), nil
+	}
+	entry, err := hashFile(file)
+	return entry.SHA256, err
+}
+
+// decrypt returns the content of the encrypted src
+func (e *Encryption) decrypt(src io.Reader) (io.Reader, error) {
+	if !e.Decrypts() {
+		return nil, ErrNoIdentity
+	}
+	return age.Decrypt(src, e.identities...)
+}
+
+// isEncrypted reports whether the content read by reader starts with the header of an age encrypted file
+func isEncrypted(reader *bufio.Reader) bool {
+	header, _ := reader.Peek(len(ageHeader))
+	return string(header) == ageHeader
+}
+
+// isEncryptedFile reports whether the file at path is encrypted with age
+func isEncryptedFile(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = file.Close() }()
+	return isEncrypted(bufio.NewReader(file)), nil
+}
+
+// encryptFile encrypts the file at path in place, keeping its mode and modification time
+func (e *Encryption) encryptFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = src.Close() }()
+
+	tmp := path + ".age"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return err
+	}
+	err = e.encrypt(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to encrypt %s due to error %w", path, err)
+	}
+	return nil
+}
+
+// encryptFolder encrypts every file below the folder in place, unless it is already encrypted
+func (e *Encryption) encryptFolder(folder string) error {
+	if !e.Encrypts() {
+		return nil
+	}
+	return filepath.WalkDir(folder, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		encrypted, err := isEncryptedFile(path)
+		if err != nil || encrypted {
+			return err
+		}
+		return e.encryptFile(path)
+	})
+}
+
+// readFile returns the content of the file at path, decrypting it when it is encrypted
+func (e *Encryption) readFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	reader := bufio.NewReader(file)
+	if !isEncrypted(reader) {
+		return io.ReadAll(reader)
+	}
+	plaintext, err := e.decrypt(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s due to error %w", path, err)
+	}
+	return io.ReadAll(plaintext)
+}
+
+// writeFile writes data to the file at path, encrypted when there are recipients
+func (e *Encryption) writeFile(path string, data []byte, perm os.FileMode) error {
+	if !e.Encrypts() {
+		return os.WriteFile(path, data, perm)
+	}
+	var ciphertext bytes.Buffer
+	err := e.encrypt(&ciphertext, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt %s due to error %w", path, err)
+	}
+	return os.WriteFile(path, ciphertext.Bytes(), perm)
+}
+
+// decryptTo returns the path of the plaintext of the file at path, decrypting it into the scratch folder dir once
+func (e *Encryption) decryptTo(path string, dir string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = file.Close() }()
+	reader := bufio.NewReader(file)
+	if !isEncrypted(reader) {
+		return path, nil
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(abs))
+	dst := filepath.Join(dir, hex.EncodeToString(sum[:8])+filepath.Ext(path))
+	if Exists(dst) {
+		return dst, nil
+	}
+
+	plaintext, err := e.decrypt(reader)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt %s due to error %w", path, err)
+	}
+	out, err := os.CreateTemp(dir, "decrypt-")
+	if err != nil {
+		return "", err
+	}
+	tmp := out.Name()
+	_, err = io.Copy(out, plaintext)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	// the plaintext keeps the modification time of the encrypted file, which dates the backup it belongs to
+	if info, serr := file.Stat(); err == nil && serr == nil {
+		err = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return "", fmt.Errorf("failed to decrypt %s due to error %w", path, err)
+	}
+	return dst, nil
+}
+
+// checkDecrypts reads the whole of the encrypted content of reader, failing when it cannot be decrypted or has been
+// tampered with
+func (e *Encryption) checkDecrypts(reader io.Reader) error {
+	plaintext, err := e.decrypt(reader)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, plaintext)
+	return err
+}
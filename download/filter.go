@@ -0,0 +1,209 @@
+package download
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Visibility is who can see a repository on its forge
+type Visibility string
+
+const (
+	VisibilityPublic  Visibility = "public"
+	VisibilityPrivate Visibility = "private"
+	// VisibilityInternal repos are visible to every member of an enterprise or instance, but not to the public
+	VisibilityInternal Visibility = "internal"
+)
+
+// FilterRules select which of the repos discovered by a lister are backed up
+type FilterRules struct {
+	// Owners keeps the repos of these users, orgs, workspaces or groups, including those in nested groups below them
+	Owners []string
+	// Include keeps the repos whose owner and name match one of these path.Match globs, such as acme/*, and Exclude drops them
+	Include []string
+	Exclude []string
+	// Topics keeps the repos tagged with at least one of these topics
+	Topics []string
+	// Visibility keeps the repos with one of these visibilities
+	Visibility []Visibility
+	// Forks and Archived keep only forks or archived repos when true and drop them when false, and keep both when
+	// nil
+	Forks    *bool
+	Archived *bool
+	// MaxSize drops repos larger than this many bytes, and is 0 to keep repos of any size
+	MaxSize int64
+}
+
+// matchesAny reports whether fullName matches one of globs, ignoring case as forges do
+func matchesAny(globs []string, fullName string) bool {
+	for _, glob := range globs {
+		if matched, _ := path.Match(strings.ToLower(glob), strings.ToLower(fullName)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// hasOwner reports whether repo belongs to one of owners or to a group nested below one of them
+func hasOwner(owners []string, repo *Repository) bool {
+	owner := strings.ToLower(repo.Owner)
+	for _, want := range owners {
+		want = strings.ToLower(strings.Trim(want, "/"))
+		if owner == want || strings.HasPrefix(owner, want+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// hasTopic reports whether repo is tagged with one of topics
+func hasTopic(topics []string, repo *Repository) bool {
+	for _, topic := range repo.Topics {
+		for _, want := range topics {
+			if strings.EqualFold(topic, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reason returns the rule which filters out repo, or an empty string when repo is kept
+func (r *FilterRules) reason(repo *Repository) string {
+	// the folder of the host is left out, so the rules of a source match its repos whichever sources come before it
+	name := repo.Owner + "/" + repo.Name
+	switch {
+	case len(r.Owners) > 0 && !hasOwner(r.Owners, repo):
+		return "owner"
+	case len(r.Include) > 0 && !matchesAny(r.Include, name):
+		return "not included"
+	case matchesAny(r.Exclude, name):
+		return "excluded"
+	case len(r.Visibility) > 0 && repo.Visibility != "" && !slices.Contains(r.Visibility, repo.Visibility):
+		return "visibility " + string(repo.Visibility)
+	case r.Forks != nil && *r.Forks != repo.Fork:
+		if repo.Fork {
+			return "fork"
+		}
+		return "not a fork"
+	case r.Archived != nil && *r.Archived != repo.Archived:
+		if repo.Archived {
+			return "archived"
+		}
+		return "not archived"
+	case len(r.Topics) > 0 && !hasTopic(r.Topics, repo):
+		return "topics"
+	case r.MaxSize > 0 && repo.Size > r.MaxSize:
+		return fmt.Sprintf("size %d MB", repo.Size/1024/1024)
+	}
+	return ""
+}
+
+// FilteredRepo is a repo left out of the backup by a Filter
+type FilteredRepo struct {
+	FullName string
+	// Reason is the rule which left the repo out, such as fork or excluded
+	Reason string
+}
+
+// Filter lists the repos of another lister which pass a set of rules, remembering the repos it left out
+type Filter struct {
+	lister   RepoLister
+	rules    FilterRules
+	filtered []FilteredRepo
+}
+
+// NewFilter returns a lister of the repos of lister which pass rules
+func NewFilter(lister RepoLister, rules FilterRules) *Filter {
+	return &Filter{
+		lister: lister,
+		rules:  rules,
+	}
+}
+
+// filteredLister is a lister which applies a Filter itself, before the requests it makes to find empty repos
+type filteredLister interface {
+	listRepos(filter *Filter) ([]*Repository, error)
+}
+
+// keep reports whether repo passes the rules, remembering it as filtered out otherwise
+func (f *Filter) keep(repo *Repository) bool {
+	if f == nil {
+		return true
+	}
+	reason := f.rules.reason(repo)
+	if reason == "" {
+		return true
+	}
+	f.filtered = append(f.filtered, FilteredRepo{FullName: repo.Owner + "/" + repo.Name, Reason: reason})
+	return false
+}
+
+// checksVisibility reports whether the rules depend on the visibility of repos, so listers which need further
+// requests to tell internal repos apart from private ones know to make them
+func (f *Filter) checksVisibility() bool {
+	return f != nil && len(f.rules.Visibility) > 0
+}
+
+func (f *Filter) Host() string {
+	return f.lister.Host()
+}
+
+func (f *Filter) ListRepos() ([]*Repository, error) {
+	f.filtered = nil
+	if lister, ok := f.lister.(filteredLister); ok {
+		return lister.listRepos(f)
+	}
+
+	repos, err := f.lister.ListRepos()
+	if err != nil {
+		return nil, err
+	}
+
+	kept := make([]*Repository, 0, len(repos))
+	for _, repo := range repos {
+		if f.keep(repo) {
+			kept = append(kept, repo)
+		}
+	}
+	return kept, nil
+}
+
+// Filtered returns the repos left out by the last call to ListRepos
+func (f *Filter) Filtered() []FilteredRepo {
+	return f.filtered
+}
+
+// filteringLister is a lister which remembers the repos it left out of its last listing
+type filteringLister interface {
+	Filtered() []FilteredRepo
+}
+
+// FilteredRepos returns the repos left out by the filters of listers which no other lister kept, below the folder
+// their lister stores them in
+func FilteredRepos(repos []*Repository, listers ...RepoLister) []FilteredRepo {
+	seen := make(map[string]bool)
+	for _, repo := range repos {
+		seen[repo.FullName()] = true
+	}
+	filtered := make([]FilteredRepo, 0)
+	for _, lister := range listers {
+		filter, ok := lister.(filteringLister)
+		if !ok {
+			continue
+		}
+		folder := listerFolder(lister, listers[0])
+		for _, repo := range filter.Filtered() {
+			if folder != "" {
+				repo.FullName = folder + "/" + repo.FullName
+			}
+			if !seen[repo.FullName] {
+				seen[repo.FullName] = true
+				filtered = append(filtered, repo)
+			}
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,153 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func boolPtr(b bool) *bool { return &b }
+
+func TestFilter_Owners(t *testing.T) {
+	lister := &staticLister{repos: []*Repository{
+		makeRepo("Acme", "api"),
+		makeRepo("acme/platform", "infra"),
+		makeRepo("acme-labs", "toy"),
+		makeRepo("someone", "dotfiles"),
+	}}
+
+	filter := NewFilter(lister, FilterRules{Owners: []string{"acme"}})
+	repos, err := filter.ListRepos()
+	if err != nil {
+		t.Fatalf("ListRepos() error: %v", err)
+	}
+	if len(repos) != 2 || repos[0].FullName() != "Acme/api" || repos[1].FullName() != "acme/platform/infra" {
+		t.Errorf("unexpected repos %v, want those of acme and its subgroups", repos)
+	}
+	if filtered := filter.Filtered(); len(filtered) != 2 || filtered[0].FullName != "acme-labs/toy" || filtered[0].Reason != "owner" {
+		t.Errorf("Filtered() = %v, want the repos of the other owners", filtered)
+	}
+
+	// without rules every repo is listed
+	if repos, _ := NewFilter(lister, FilterRules{}).ListRepos(); len(repos) != 4 {
+		t.Errorf("expected every repo without rules, got %v", repos)
+	}
+
+	failing := &staticLister{err: errors.New("api down")}
+	if _, err := NewFilter(failing, FilterRules{Owners: []string{"acme"}}).ListRepos(); err == nil {
+		t.Error("expected the lister's error")
+	}
+}
+
+func TestFilterRules(t *testing.T) {
+	repo := func(modify func(r *Repository)) *Repository {
+		r := makeRepo("acme", "api")
+		r.Visibility = VisibilityPrivate
+		r.Topics = []string{"Backend", "go"}
+		r.Size = 10 * 1024 * 1024
+		modify(r)
+		return r
+	}
+	keep := func(r *Repository) {}
+
+	tests := []struct {
+		name   string
+		rules  FilterRules
+		repo   *Repository
+		reason string
+	}{
+		{"no rules", FilterRules{}, repo(keep), ""},
+		{"included", FilterRules{Include: []string{"acme/*"}}, repo(keep), ""},
+		{"not included", FilterRules{Include: []string{"acme/web-*"}}, repo(keep), "not included"},
+		{"excluded", FilterRules{Exclude: []string{"ACME/api"}}, repo(keep), "excluded"},
+		{"exclude wins", FilterRules{Include: []string{"acme/*"}, Exclude: []string{"*/api"}}, repo(keep), "excluded"},
+		{"visibility", FilterRules{Visibility: []Visibility{VisibilityPrivate, VisibilityInternal}}, repo(keep), ""},
+		{"wrong visibility", FilterRules{Visibility: []Visibility{VisibilityPublic}}, repo(keep), "visibility private"},
+		{"unknown visibility", FilterRules{Visibility: []Visibility{VisibilityPublic}}, repo(func(r *Repository) { r.Visibility = "" }), ""},
+		{"fork dropped", FilterRules{Forks: boolPtr(false)}, repo(func(r *Repository) { r.Fork = true }), "fork"},
+		{"only forks", FilterRules{Forks: boolPtr(true)}, repo(keep), "not a fork"},
+		{"archived dropped", FilterRules{Archived: boolPtr(false)}, repo(func(r *Repository) { r.Archived = true }), "archived"},
+		{"archived kept", FilterRules{Archived: boolPtr(false)}, repo(keep), ""},
+		{"topic", FilterRules{Topics: []string{"backend"}}, repo(keep), ""},
+		{"missing topic", FilterRules{Topics: []string{"frontend"}}, repo(keep), "topics"},
+		{"too large", FilterRules{MaxSize: 1024 * 1024}, repo(keep), "size 10 MB"},
+		{"small enough", FilterRules{MaxSize: 20 * 1024 * 1024}, repo(keep), ""},
+		{"unknown size", FilterRules{MaxSize: 1024 * 1024}, repo(func(r *Repository) { r.Size = 0 }), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rules.reason(tt.repo); got != tt.reason {
+				t.Errorf("reason() = %q, want %q", got, tt.reason)
+			}
+		})
+	}
+}
+
+func TestFilter_GitHubBeforeRemovingEmptyRepos(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/user/orgs", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `[]`)
+	})
+	mux.HandleFunc("/user/repos", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `[
+			{"name": "api", "full_name": "acme/api", "owner": {"login": "acme"}, "private": true},
+			{"name": "portal", "full_name": "acme/portal", "owner": {"login": "acme"}, "private": true},
+			{"name": "linux", "full_name": "acme/linux", "owner": {"login": "acme"}, "private": true, "fork": true},
+			{"name": "dotfiles", "full_name": "someone/dotfiles", "owner": {"login": "someone"}, "private": true}
+		]`)
+	})
+	// internal repos are reported as private, and only the orgs listing them by type tell them apart
+	mux.HandleFunc("/orgs/acme/repos", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("type") != "internal" {
+			t.Errorf("org repos type = %q, want internal", r.URL.Query().Get("type"))
+		}
+		_, _ = fmt.Fprint(w, `[{"name": "portal", "full_name": "acme/portal", "owner": {"login": "acme"}, "private": true}]`)
+	})
+	mux.HandleFunc("/orgs/someone/repos", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+	})
+	checked := make(map[string]bool)
+	mux.HandleFunc("/repos/", func(w http.ResponseWriter, r *http.Request) {
+		checked[r.URL.Path] = true
+		_, _ = fmt.Fprint(w, `[]`)
+	})
+	api := newTestGitHubAPI(t, mux)
+
+	filter := NewFilter(api, FilterRules{Visibility: []Visibility{VisibilityPrivate}, Forks: boolPtr(false)})
+	repos, err := filter.ListRepos()
+	if err != nil {
+		t.Fatalf("ListRepos() error: %v", err)
+	}
+	if len(repos) != 2 || repos[0].FullName() != "acme/api" || repos[1].FullName() != "someone/dotfiles" {
+		t.Fatalf("unexpected repos %v, want the private repos which are not forks", repos)
+	}
+
+	filtered := FilteredRepos(repos, filter, &staticLister{})
+	if len(filtered) != 2 || filtered[0].Reason != "visibility internal" || filtered[1].Reason != "fork" {
+		t.Errorf("FilteredRepos() = %v, want the internal repo and the fork", filtered)
+	}
+	// repos that were filtered out are not checked for content
+	if len(checked) != 2 || checked["/repos/acme/linux/contents/"] || checked["/repos/acme/portal/contents/"] {
+		t.Errorf("checked the contents of %v, want only the kept repos", checked)
+	}
+}
+
+func TestFilteredRepos_CountsEachRepoOnce(t *testing.T) {
+	fork := &Repository{Forge: ForgeGitHub, Owner: "acme", Name: "fork", Fork: true}
+	archived := &Repository{Forge: ForgeGitHub, Owner: "acme", Name: "old", Archived: true}
+	strict := NewFilter(&staticLister{host: "github.com", repos: []*Repository{fork, archived}}, FilterRules{Forks: boolPtr(false), Archived: boolPtr(false)})
+	archivedOnly := NewFilter(&staticLister{host: "github.com", repos: []*Repository{fork, archived}}, FilterRules{Archived: boolPtr(false)})
+	mirror := &Repository{Forge: ForgeGitLab, Owner: "acme", Name: "old", Archived: true}
+	gitlab := NameLister("gitlab", NewFilter(&staticLister{host: "gitlab.com", repos: []*Repository{mirror}}, FilterRules{Archived: boolPtr(false)}))
+
+	repos, err := ListAllRepos(strict, archivedOnly, gitlab)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the fork is kept by the second source, the archived repo is left out by both, and the gitlab repo is below its host
+	filtered := FilteredRepos(repos, strict, archivedOnly, gitlab)
+	if len(repos) != 1 || len(filtered) != 2 || filtered[0].FullName != "acme/old" || filtered[1].FullName != "gitlab.com/acme/old" {
+		t.Errorf("repos = %v, filtered = %v, want the fork kept and the archived repos filtered out", repos, filtered)
+	}
+}
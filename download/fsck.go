@@ -0,0 +1,172 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FsckProblem is an inconsistency in a backup location, such as one left behind by an interrupted rotation
+type FsckProblem struct {
+	Path    string
+	Problem string
+}
+
+func (p FsckProblem) String() string {
+	return p.Path + ": " + p.Problem
+}
+
+// Fsck checks the generations for interrupted rotations and bundles which cannot be restored, returning every problem
+func Fsck(location string, storage Storage, retention *Retention, encryption *Encryption) ([]FsckProblem, error) {
+	problems := make([]FsckProblem, 0)
+
+	if location != "" {
+		journal, err := loadJournal(location)
+		if err != nil {
+			problems = append(problems, FsckProblem{Path: journalPath(location), Problem: err.Error()})
+		} else if journal != nil {
+			problems = append(problems, FsckProblem{
+				Path:    journalPath(location),
+				Problem: fmt.Sprintf("rotation started at %s was interrupted during the %s phase, and is recovered when gubber next runs", journal.StartedAt.Format("2006-01-02 15:04:05"), journal.Phase),
+			})
+		}
+	}
+
+	legacy, err := listLegacyGenerations(storage)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range legacy {
+		problems = append(problems, FsckProblem{Path: displayPath(storage, legacyGenerationName(n)), Problem: "generation is numbered by an older version of gubber, and is renamed when gubber next runs"})
+	}
+
+	generations, err := listGenerations(storage)
+	if err != nil {
+		return nil, err
+	}
+	if len(generations) == 0 {
+		return problems, nil
+	}
+	if retention != nil {
+		for _, plan := range retention.Plan(generations) {
+			if !plan.Keep() {
+				problems = append(problems, FsckProblem{Path: displayPath(storage, plan.Name), Problem: "generation is not kept by the retention policy, and is pruned by the next rotation"})
+			}
+		}
+	}
+
+	scratch, err := os.MkdirTemp("", "gubber-fsck-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create scratch directory due to error %w", err)
+	}
+	defer func() { _ = os.RemoveAll(scratch) }()
+
+	for k, generation := range generations {
+		newer := ""
+		if k > 0 {
+			newer = generations[k-1]
+		}
+		generationProblems, err := fsckGeneration(storage, generation, newer, encryption, scratch)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, generationProblems...)
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Path < problems[j].Path })
+	return problems, nil
+}
+
+// fsckGeneration checks the bundles of a generation, and that its files were promoted into the newer one
+func fsckGeneration(storage Storage, name string, newer string, encryption *Encryption, scratch string) ([]FsckProblem, error) {
+	problems := make([]FsckProblem, 0)
+	files, err := listFiles(storage, name)
+	if err != nil {
+		return nil, err
+	}
+	// release assets are promoted as a whole, so are not checked file by file
+	releases := make(map[string]bool)
+	checked := 0
+
+	for _, rel := range files {
+		if folder, _, ok := strings.Cut(rel, ".releases/"); ok {
+			if !releases[folder] {
+				releases[folder] = true
+				checked++
+			}
+			continue
+		}
+		if rel == ManifestFile {
+			continue
+		}
+		checked++
+		path := name + "/" + rel
+
+		switch {
+		case strings.HasSuffix(rel, ".bundle.thin"):
+			problems = append(problems, FsckProblem{Path: displayPath(storage, path), Problem: "incomplete thin bundle left by an interrupted rotation"})
+			continue
+		case !strings.HasSuffix(rel, ".bundle"):
+			continue
+		}
+
+		bundleProblems, err := fsckBundle(storage, path, encryption, scratch)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check generation %s due to error %w", name, err)
+		}
+		problems = append(problems, bundleProblems...)
+
+		if newer != "" {
+			exists, err := storage.Exists(newer + "/" + rel)
+			if err != nil {
+				return nil, fmt.Errorf("failed to check generation %s due to error %w", name, err)
+			}
+			if !exists {
+				problems = append(problems, FsckProblem{Path: displayPath(storage, path), Problem: "missing from the newer generation " + newer})
+			}
+		}
+	}
+
+	if checked == 0 {
+		problems = append(problems, FsckProblem{Path: displayPath(storage, name), Problem: "generation is empty"})
+	}
+	return problems, nil
+}
+
+// fsckBundle checks that the bundle at name can be read and restored, unless it cannot be decrypted
+func fsckBundle(storage Storage, name string, encryption *Encryption, scratch string) ([]FsckProblem, error) {
+	dir, err := os.MkdirTemp(scratch, "bundle-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	unreadable := []FsckProblem{{Path: displayPath(storage, name), Problem: "unreadable bundle: "}}
+	fetched, err := fetchFile(storage, name, filepath.Join(dir, "fetched"))
+	if err != nil {
+		unreadable[0].Problem += err.Error()
+		return unreadable, nil
+	}
+	encrypted, err := isEncryptedFile(fetched)
+	if err != nil {
+		return nil, err
+	}
+	if encrypted && !encryption.Decrypts() {
+		return nil, nil
+	}
+	plain, err := encryption.decryptTo(fetched, dir)
+	if err == nil {
+		_, err = readBundleHeader(plain)
+	}
+	if err != nil {
+		unreadable[0].Problem += err.Error()
+		return unreadable, nil
+	}
+	if _, err := bundleChain(storage, name, encryption, dir); err != nil && !errors.Is(err, ErrNoIdentity) {
+		return []FsckProblem{{Path: displayPath(storage, name), Problem: "cannot be restored: " + err.Error()}}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,121 @@
+package download
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newFsckLocation backs up org/repo and org/other twice, returning a location with a full newest generation and a
+// thin older one
+func newFsckLocation(t *testing.T) string {
+	t.Helper()
+	work := newWorkRepo(t)
+	location := filepath.Join(t.TempDir(), "backups")
+	tmpDir := t.TempDir()
+	dl := &gitDownloader{t: t, work: work}
+	repos := []*Repository{makeRepo("org", "repo"), makeRepo("org", "other")}
+
+	for i := 0; i < 2; i++ {
+		commitFile(t, work, "file.txt", string(rune('a'+i)))
+		if err := MigrateReposWithDownloader(dl, repos, &location, Retention{Last: 5}, &tmpDir); err != nil {
+			t.Fatalf("MigrateRepos() run %d error: %v", i, err)
+		}
+	}
+	return location
+}
+
+// expectProblem fails the test unless a problem was found for path containing want
+func expectProblem(t *testing.T, problems []FsckProblem, path, want string) {
+	t.Helper()
+	for _, problem := range problems {
+		if problem.Path == path && strings.Contains(problem.Problem, want) {
+			return
+		}
+	}
+	t.Errorf("expected problem %q for %s, got %v", want, path, problems)
+}
+
+func TestFsck_Clean(t *testing.T) {
+	location := newFsckLocation(t)
+
+	problems, err := Fsck(location, NewLocalStorage(location), &Retention{Last: 5}, nil)
+	if err != nil {
+		t.Fatalf("Fsck() error: %v", err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("expected no problems, got %v", problems)
+	}
+}
+
+func TestFsck_Empty(t *testing.T) {
+	problems, err := Fsck("", NewLocalStorage(t.TempDir()), &Retention{Last: 5}, nil)
+	if err != nil {
+		t.Fatalf("Fsck() error: %v", err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("expected no problems, got %v", problems)
+	}
+}
+
+func TestFsck_InterruptedRotation(t *testing.T) {
+	location := newFsckLocation(t)
+	journal := &rotationJournal{Phase: phaseThin, Generation: generationAt(location, 0), Retention: Retention{Last: 5}}
+	if err := journal.save(location); err != nil {
+		t.Fatal(err)
+	}
+	thin := BundlePath(location, "org/repo", generationAt(location, 1)) + ".thin"
+	if err := os.WriteFile(thin, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := Fsck(location, NewLocalStorage(location), &Retention{Last: 5}, nil)
+	if err != nil {
+		t.Fatalf("Fsck() error: %v", err)
+	}
+	expectProblem(t, problems, journalPath(location), "thin phase")
+	expectProblem(t, problems, thin, "incomplete thin bundle")
+}
+
+func TestFsck_GenerationProblems(t *testing.T) {
+	location := newFsckLocation(t)
+
+	// a generation left numbered by an older version of gubber, and an older generation beyond the 1 backup kept
+	legacy := GenerationPath(location, legacyGenerationName(0))
+	if err := os.MkdirAll(legacy, 0755); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := Fsck(location, NewLocalStorage(location), &Retention{Last: 1}, nil)
+	if err != nil {
+		t.Fatalf("Fsck() error: %v", err)
+	}
+	expectProblem(t, problems, legacy, "numbered by an older version")
+	expectProblem(t, problems, GenerationPath(location, generationAt(location, 1)), "not kept by the retention policy")
+
+	// without a retention policy every generation is kept
+	problems, err = Fsck(location, NewLocalStorage(location), nil, nil)
+	if err != nil || len(problems) != 1 {
+		t.Errorf("Fsck() without a retention = %v, %v, want only the legacy generation", problems, err)
+	}
+}
+
+func TestFsck_BundleProblems(t *testing.T) {
+	location := newFsckLocation(t)
+
+	if err := os.Remove(BundlePath(location, "org/other", generationAt(location, 0))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(BundlePath(location, "org/repo", generationAt(location, 0)), []byte("not a bundle"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := Fsck(location, NewLocalStorage(location), &Retention{Last: 5}, nil)
+	if err != nil {
+		t.Fatalf("Fsck() error: %v", err)
+	}
+	expectProblem(t, problems, BundlePath(location, "org/repo", generationAt(location, 0)), "unreadable bundle")
+	expectProblem(t, problems, BundlePath(location, "org/other", generationAt(location, 1)), "missing from the newer generation "+generationAt(location, 0))
+	// the thin bundle in the older generation cannot be restored without its base in the newest
+	expectProblem(t, problems, BundlePath(location, "org/other", generationAt(location, 1)), "cannot be restored")
+}
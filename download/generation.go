@@ -0,0 +1,58 @@
+package download
+
+import (
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// GenerationLayout is the layout of the name of every generation folder, the UTC time it was backed up
+const GenerationLayout = "2006-01-02T150405Z"
+
+// GenerationName returns the name of the generation backed up at t
+func GenerationName(t time.Time) string {
+	return t.UTC().Format(GenerationLayout)
+}
+
+// GenerationTime returns the time the generation called name was backed up, and false when name is not the name of a
+// generation
+func GenerationTime(name string) (time.Time, bool) {
+	t, err := time.Parse(GenerationLayout, name)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// GenerationPath returns the folder holding the generation called name in the backup location
+func GenerationPath(location string, name string) string {
+	return filepath.Join(location, name)
+}
+
+// ListGenerations returns the names of the generations present in the backup location, newest first
+func ListGenerations(location string) ([]string, error) {
+	return listGenerations(NewLocalStorage(location))
+}
+
+// sortGenerations keeps the names of the generations among folders, sorted newest first
+func sortGenerations(folders []string) []string {
+	generations := make([]string, 0)
+	for _, folder := range folders {
+		if _, ok := GenerationTime(folder); ok {
+			generations = append(generations, folder)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(generations)))
+	return generations
+}
+
+// newGenerationName returns the name of a generation backed up at now, which is newer than every one of generations
+// even when the clock has gone backwards
+func newGenerationName(generations []string, now time.Time) string {
+	name := GenerationName(now)
+	if len(generations) > 0 && name <= generations[0] {
+		newest, _ := GenerationTime(generations[0])
+		name = GenerationName(newest.Add(time.Second))
+	}
+	return name
+}
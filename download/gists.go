@@ -0,0 +1,88 @@
+package download
+
+import (
+	"fmt"
+
+	"github.com/google/go-github/github"
+)
+
+// GistOwner is the folder of each generation holding gist bundles, which are named by gist ID
+const GistOwner = "gists"
+
+// IsGist reports whether repo was created by GetGists
+func IsGist(repo *Repository) bool {
+	return repo.Forge == ForgeGitHubGist
+}
+
+// gistRepository represents a gist as a repository under GistOwner, so it is backed up like any other repo
+func (g *GitHubAPI) gistRepository(gist *github.Gist) *Repository {
+	return &Repository{
+		Forge:       ForgeGitHubGist,
+		Owner:       GistOwner,
+		Name:        gist.GetID(),
+		CloneURL:    g.gistURL + "/" + gist.GetID() + ".git",
+		Credentials: g.credentials,
+	}
+}
+
+// GistLister lists the gists of the authenticated user, so they can be backed up alongside their repositories
+type GistLister struct {
+	api     *GitHubAPI
+	starred bool
+}
+
+// NewGistLister returns a GistLister for the user of api, optionally including the gists they have starred
+func NewGistLister(api *GitHubAPI, starred bool) *GistLister {
+	return &GistLister{
+		api:     api,
+		starred: starred,
+	}
+}
+
+// Host returns the host of the GitHub server, so gists are stored next to its repos rather than below its gist host
+func (l *GistLister) Host() string {
+	return l.api.Host()
+}
+
+func (l *GistLister) ListRepos() ([]*Repository, error) {
+	fmt.Println("Loading gists")
+	gists, err := l.api.GetGists(l.starred)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Found %d gists\n", len(gists))
+	return gists, nil
+}
+
+// GetGists returns the gists of the authenticated user as repositories under GistOwner, optionally including the
+// gists they have starred
+func (g *GitHubAPI) GetGists(starred bool) ([]*Repository, error) {
+	gists, err := listAll(func(opts github.ListOptions) ([]*github.Gist, *github.Response, error) {
+		return g.client.Gists.List(g.ctx, "", &github.GistListOptions{ListOptions: opts})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gists: %w", err)
+	}
+
+	if starred {
+		starredGists, err := listAll(func(opts github.ListOptions) ([]*github.Gist, *github.Response, error) {
+			return g.client.Gists.ListStarred(g.ctx, &github.GistListOptions{ListOptions: opts})
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get starred gists: %w", err)
+		}
+		gists = append(gists, starredGists...)
+	}
+
+	// a user's own gists can also be starred, so avoid duplicates
+	seen := make(map[string]bool)
+	repos := make([]*Repository, 0, len(gists))
+	for _, gist := range gists {
+		if gist.GetID() == "" || seen[gist.GetID()] {
+			continue
+		}
+		seen[gist.GetID()] = true
+		repos = append(repos, g.gistRepository(gist))
+	}
+	return repos, nil
+}
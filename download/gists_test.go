@@ -0,0 +1,83 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetGists(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/gists", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `[{"id": "aaa111", "git_pull_url": "https://gist.github.com/aaa111.git"}]`)
+	})
+	mux.HandleFunc("/gists/starred", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `[{"id": "aaa111"}, {"id": "bbb222"}]`)
+	})
+	api := newTestGitHubAPI(t, mux)
+
+	gists, err := api.GetGists(false)
+	if err != nil {
+		t.Fatalf("GetGists() error: %v", err)
+	}
+	if len(gists) != 1 {
+		t.Fatalf("expected 1 gist, got %d", len(gists))
+	}
+	gist := gists[0]
+	if gist.FullName() != "gists/aaa111" || gist.Name != "aaa111" || !IsGist(gist) {
+		t.Errorf("unexpected gist repository %v", gist)
+	}
+
+	// starred gists are added without duplicating the user's own
+	gists, err = api.GetGists(true)
+	if err != nil {
+		t.Fatalf("GetGists(true) error: %v", err)
+	}
+	if len(gists) != 2 {
+		t.Errorf("expected 2 gists including starred, got %d", len(gists))
+	}
+}
+
+func TestIsGist(t *testing.T) {
+	if IsGist(makeRepo(GistOwner, "repo")) {
+		t.Error("a real account named gists should not be treated as a gist")
+	}
+}
+
+func TestDownloadRepo_Gist(t *testing.T) {
+	work := newWorkRepo(t)
+	srcDir := t.TempDir()
+	testGit(t, srcDir, "clone", "--bare", work, filepath.Join(srcDir, "gist", "aaa111.git"))
+
+	// the metadata exporter fails the download if it calls the api for the gist
+	d := NewDownloader(context.Background(), WithExporters(NewMetadataExporter()))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/gists", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `[{"id": "aaa111"}]`)
+	})
+	api := newTestGitHubAPI(t, mux)
+	api.gistURL = filepath.Join(srcDir, "gist")
+	gists, err := api.GetGists(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	destDir := t.TempDir()
+	if err := d.DownloadRepo(gists[0], &destDir); err != nil {
+		t.Fatalf("DownloadRepo() error: %v", err)
+	}
+	if !Exists(filepath.Join(destDir, GistOwner, "aaa111.bundle")) {
+		t.Error("gist bundle was not created under the gists folder")
+	}
+	if repos, err := d.WithUnchangedExports(destDir, gists, nil); err != nil || len(repos) != 0 {
+		t.Errorf("WithUnchangedExports() = %v, %v, want gists never to be exported", repos, err)
+	}
+
+	refs, err := d.ListRefs(gists[0])
+	if err != nil || len(refs) != 1 {
+		t.Errorf("ListRefs() = %v, %v, want the gist's main branch", refs, err)
+	}
+}
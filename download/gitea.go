@@ -0,0 +1,217 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// giteaPageSize is the number of results requested per page, which is the default maximum of Gitea and Forgejo
+const giteaPageSize = 50
+
+// GiteaOrg is an organization that the user is a member of
+type GiteaOrg struct {
+	ID       int64  `json:"id"`
+	UserName string `json:"username"`
+}
+
+// GiteaRepo is a repository as returned by the Gitea API
+type GiteaRepo struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	FullName string `json:"full_name"`
+	Owner    struct {
+		Login string `json:"login"`
+	} `json:"owner"`
+	CloneURL string `json:"clone_url"`
+	SSHURL   string `json:"ssh_url"`
+	HasWiki  bool   `json:"has_wiki"`
+	Empty    bool   `json:"empty"`
+	Private  bool   `json:"private"`
+	// Internal repos are visible to every user of the instance
+	Internal bool     `json:"internal"`
+	Fork     bool     `json:"fork"`
+	Archived bool     `json:"archived"`
+	Topics   []string `json:"topics"`
+	// Size is in kilobytes
+	Size int64 `json:"size"`
+}
+
+// GiteaAPI lists the repos of a Gitea or Forgejo user and their organizations
+type GiteaAPI struct {
+	ctx         context.Context
+	client      *http.Client
+	apiURL      *url.URL
+	token       string
+	credentials Credentials
+}
+
+// NewGiteaAPI returns a GiteaAPI for the Gitea or Forgejo instance at baseURL, such as https://codeberg.org
+func NewGiteaAPI(ctx context.Context, token *string, baseURL string) (*GiteaAPI, error) {
+	apiURL, err := url.Parse(strings.TrimSuffix(baseURL, "/") + "/api/v1/")
+	if err != nil {
+		return nil, fmt.Errorf("invalid gitea url %s due to error %w", baseURL, err)
+	}
+
+	return &GiteaAPI{
+		ctx:    ctx,
+		client: http.DefaultClient,
+		apiURL: apiURL,
+		token:  *token,
+		// gitea accepts a token as the password of any username, which git redacts unlike the username
+		credentials: &StaticCredentials{Username: "oauth2", Password: *token},
+	}, nil
+}
+
+// Host returns the host of the Gitea or Forgejo instance, such as codeberg.org
+func (g *GiteaAPI) Host() string {
+	return g.apiURL.Host
+}
+
+// get requests apiPath from the api and decodes the json response into v, returning the headers of the response
+func (g *GiteaAPI) get(apiPath string, query url.Values, v any) (http.Header, error) {
+	u := g.apiURL.JoinPath(apiPath)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(g.ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "token "+g.token)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("unexpected status %s from %s: %s", resp.Status, u.Path, strings.TrimSpace(string(body)))
+	}
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode response from %s due to error %w", u.Path, err)
+	}
+	return resp.Header, nil
+}
+
+// giteaListAll requests every page of apiPath, returning all of the results
+func giteaListAll[T any](g *GiteaAPI, apiPath string) ([]T, error) {
+	items := make([]T, 0)
+	for page := 1; ; page++ {
+		query := url.Values{
+			"page":  {strconv.Itoa(page)},
+			"limit": {strconv.Itoa(giteaPageSize)},
+		}
+		var new_items []T
+		header, err := g.get(apiPath, query, &new_items)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, new_items...)
+		if len(new_items) == 0 {
+			return items, nil
+		}
+		total, err := strconv.Atoi(header.Get("X-Total-Count"))
+		if err == nil && len(items) >= total {
+			return items, nil
+		}
+	}
+}
+
+// GetOrgs returns the organizations that the user is a member of
+func (g *GiteaAPI) GetOrgs() ([]*GiteaOrg, error) {
+	orgs, err := giteaListAll[*GiteaOrg](g, "user/orgs")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get orgs: %w", err)
+	}
+	return orgs, nil
+}
+
+// GetRepos returns the repos that the user owns or collaborates on
+func (g *GiteaAPI) GetRepos() ([]*GiteaRepo, error) {
+	repos, err := giteaListAll[*GiteaRepo](g, "user/repos")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get repos: %w", err)
+	}
+	return repos, nil
+}
+
+// GetOrgRepos returns the repos of the provided org that the user can access
+func (g *GiteaAPI) GetOrgRepos(org *GiteaOrg) ([]*GiteaRepo, error) {
+	repos, err := giteaListAll[*GiteaRepo](g, "orgs/"+url.PathEscape(org.UserName)+"/repos")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get repos for org: %w", err)
+	}
+	return repos, nil
+}
+
+// repository converts a Gitea repo into a Repository
+func (g *GiteaAPI) repository(repo *GiteaRepo) *Repository {
+	r := &Repository{
+		Forge:       ForgeGitea,
+		Owner:       repo.Owner.Login,
+		Name:        repo.Name,
+		CloneURL:    repo.CloneURL,
+		SSHURL:      repo.SSHURL,
+		Credentials: g.credentials,
+		Visibility:  VisibilityPublic,
+		Topics:      repo.Topics,
+		Fork:        repo.Fork,
+		Archived:    repo.Archived,
+		Size:        repo.Size * 1024,
+	}
+	switch {
+	case repo.Internal:
+		r.Visibility = VisibilityInternal
+	case repo.Private:
+		r.Visibility = VisibilityPrivate
+	}
+	if repo.HasWiki {
+		r.WikiURL = strings.TrimSuffix(repo.CloneURL, ".git") + ".wiki.git"
+	}
+	return r
+}
+
+// ListRepos returns every non-empty repo that the user can access, either directly or through their orgs
+func (g *GiteaAPI) ListRepos() ([]*Repository, error) {
+	orgs, err := g.GetOrgs()
+	if err != nil {
+		return nil, err
+	}
+
+	repos, err := g.GetRepos()
+	if err != nil {
+		return nil, err
+	}
+
+	// load all the repos from the orgs
+	for _, org := range orgs {
+		fmt.Printf("Loading repos for org %s\n", org.UserName)
+		orgRepos, err := g.GetOrgRepos(org)
+		if err != nil {
+			fmt.Printf("failed to get org repos due to error %v for org %s\n", err, org.UserName)
+			continue
+		}
+		repos = append(repos, orgRepos...)
+	}
+
+	// org repos the user collaborates on are listed twice, and empty repos have nothing to bundle
+	seen := make(map[int64]bool)
+	converted := make([]*Repository, 0, len(repos))
+	for _, repo := range repos {
+		if seen[repo.ID] || repo.Empty {
+			continue
+		}
+		seen[repo.ID] = true
+		converted = append(converted, g.repository(repo))
+	}
+
+	fmt.Printf("Found %d gitea repositories\n", len(converted))
+	return converted, nil
+}
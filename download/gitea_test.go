@@ -0,0 +1,150 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newTestGiteaAPI returns a GiteaAPI for a fake instance serving mux below /api/v1/
+func newTestGiteaAPI(t *testing.T, mux *http.ServeMux) *GiteaAPI {
+	t.Helper()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	api, err := NewGiteaAPI(context.Background(), strPtr("gitea-token"), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return api
+}
+
+// writeGiteaPage writes the json array items as the first page, and an empty array as every later page, as Gitea
+// versions which do not send X-Total-Count do
+func writeGiteaPage(w http.ResponseWriter, r *http.Request, items string) {
+	if r.URL.Query().Get("page") != "1" {
+		items = `[]`
+	}
+	_, _ = fmt.Fprint(w, items)
+}
+
+func TestGiteaAPI_ListRepos(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/user/orgs", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "token gitea-token" {
+			t.Errorf("Authorization = %q, want token gitea-token", got)
+		}
+		writeGiteaPage(w, r, `[{"id": 10, "username": "club"}]`)
+	})
+	all := make([]map[string]any, 0)
+	for i := 0; i < giteaPageSize; i++ {
+		all = append(all, map[string]any{
+			"id": i + 1, "name": fmt.Sprintf("repo%d", i), "owner": map[string]string{"login": "user"},
+			"clone_url": fmt.Sprintf("https://git.example.com/user/repo%d.git", i),
+		})
+	}
+	all = append(all, map[string]any{"id": 100, "name": "empty", "owner": map[string]string{"login": "user"}, "empty": true})
+	mux.HandleFunc("/api/v1/user/repos", func(w http.ResponseWriter, r *http.Request) {
+		// the instance caps pages at MAX_RESPONSE_ITEMS = 20, below the requested limit, so every page is short
+		if r.URL.Query().Get("limit") != strconv.Itoa(giteaPageSize) {
+			t.Errorf("limit = %s, want %d", r.URL.Query().Get("limit"), giteaPageSize)
+		}
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		start := min((page-1)*20, len(all))
+		w.Header().Set("X-Total-Count", strconv.Itoa(len(all)))
+		_ = json.NewEncoder(w).Encode(all[start:min(start+20, len(all))])
+	})
+	mux.HandleFunc("/api/v1/orgs/club/repos", func(w http.ResponseWriter, r *http.Request) {
+		writeGiteaPage(w, r, `[
+			{"id": 1, "name": "repo0", "owner": {"login": "user"}, "clone_url": "https://git.example.com/user/repo0.git"},
+			{"id": 200, "name": "site", "owner": {"login": "club"}, "clone_url": "https://git.example.com/club/site.git", "has_wiki": true,
+			 "private": true, "fork": true, "size": 3, "topics": ["web"]}
+		]`)
+	})
+	api := newTestGiteaAPI(t, mux)
+
+	repos, err := api.ListRepos()
+	if err != nil {
+		t.Fatalf("ListRepos() error: %v", err)
+	}
+	if len(repos) != giteaPageSize+1 {
+		t.Fatalf("expected %d repos without the empty or duplicate repos, got %d", giteaPageSize+1, len(repos))
+	}
+	site := repos[len(repos)-1]
+	if site.FullName() != "club/site" || site.Forge != ForgeGitea {
+		t.Errorf("unexpected repo %+v", site)
+	}
+	if site.WikiURL != "https://git.example.com/club/site.wiki.git" {
+		t.Errorf("WikiURL = %q, want the repo's wiki", site.WikiURL)
+	}
+	if site.Visibility != VisibilityPrivate || !site.Fork || site.Archived || site.Size != 3*1024 || site.Topics[0] != "web" {
+		t.Errorf("unexpected attributes %+v", site)
+	}
+
+	username, password, err := site.Credentials.Credentials()
+	if err != nil || username != "oauth2" || password != "gitea-token" {
+		t.Errorf("clone credentials = %q, %q, %v", username, password, err)
+	}
+	// gitea tokens are plain hex, so are only redacted once they are handed to git
+	if _, _, err := gitCredentials(site.Credentials); err != nil {
+		t.Fatal(err)
+	}
+	if got := Redact("fatal: authentication failed for gitea-token"); strings.Contains(got, "gitea-token") {
+		t.Errorf("Redact() = %q, want the token removed", got)
+	}
+}
+
+func TestGiteaAPI_Error(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/user/orgs", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message": "token is required"}`, http.StatusUnauthorized)
+	})
+	api := newTestGiteaAPI(t, mux)
+
+	if _, err := api.ListRepos(); err == nil {
+		t.Error("expected error for unauthorized token")
+	}
+}
+
+func TestMigrateRepos_Gitea(t *testing.T) {
+	work := newWorkRepo(t)
+	root := t.TempDir()
+	testGit(t, root, "clone", "--bare", work, filepath.Join(root, "club", "site.git"))
+	gitServer := newGitHTTPServer(t, root)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/user/orgs", func(w http.ResponseWriter, r *http.Request) {
+		writeGiteaPage(w, r, `[]`)
+	})
+	mux.HandleFunc("/api/v1/user/repos", func(w http.ResponseWriter, r *http.Request) {
+		writeGiteaPage(w, r, fmt.Sprintf(`[{"id": 1, "name": "site", "owner": {"login": "club"}, "clone_url": "%s/club/site.git"}]`, gitServer.URL))
+	})
+	api := newTestGiteaAPI(t, mux)
+
+	repos, err := ListAllRepos(api)
+	if err != nil {
+		t.Fatalf("ListAllRepos() error: %v", err)
+	}
+
+	location := t.TempDir()
+	tmp := t.TempDir()
+	d := NewDownloader(context.Background())
+	if err := d.MigrateRepos(repos, &location, Retention{Last: 3}, &tmp); err != nil {
+		t.Fatalf("MigrateRepos() error: %v", err)
+	}
+
+	bundle, err := FindBundle(NewLocalStorage(location), "club/site", 0)
+	if err != nil {
+		t.Fatalf("FindBundle() error: %v", err)
+	}
+	restored := filepath.Join(t.TempDir(), "site")
+	if err := RestoreBundle(context.Background(), NewLocalStorage(location), bundle, restored, nil); err != nil {
+		t.Fatalf("RestoreBundle() error: %v", err)
+	}
+}
@@ -2,8 +2,11 @@ package download
 
 import (
 	"context"
-	"crypto/sha256"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/google/go-github/github"
@@ -13,6 +16,13 @@ import (
 type GitHubAPI struct {
 	ctx    context.Context
 	client *github.Client
+	// webURL and gistURL are the servers repos and gists are cloned from
+	webURL      string
+	gistURL     string
+	credentials Credentials
+	// installation is set when authenticated as a GitHub App installation, which lists the repos it was granted
+	// rather than those of a user
+	installation bool
 }
 
 func NewGitHubAPI(ctx context.Context, token *string) *GitHubAPI {
@@ -20,13 +30,165 @@ func NewGitHubAPI(ctx context.Context, token *string) *GitHubAPI {
 	ts := oauth2.StaticTokenSource(
 		&oauth2.Token{AccessToken: *token},
 	)
-	tc := oauth2.NewClient(ctx, ts)
-	client := github.NewClient(tc)
+	g, _ := newGitHubAPI(ctx, ts, "", "")
+	return g
+}
+
+// NewEnterpriseGitHubAPI returns a GitHubAPI for the GitHub Enterprise Server at webURL, such as
+// https://github.example.com, whose REST API is served at apiURL, usually https://github.example.com/api/v3/
+func NewEnterpriseGitHubAPI(ctx context.Context, token *string, apiURL string, webURL string) (*GitHubAPI, error) {
+	ts := oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: *token},
+	)
+	return newGitHubAPI(ctx, ts, apiURL, webURL)
+}
+
+// newGitHubAPI returns a GitHubAPI authenticated with the tokens of ts, for github.com when apiURL is empty and for
+// a GitHub Enterprise Server otherwise
+func newGitHubAPI(ctx context.Context, ts oauth2.TokenSource, apiURL string, webURL string) (*GitHubAPI, error) {
+	client, err := newGitHubClient(oauth2.NewClient(ctx, ts), apiURL)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &GitHubAPI{
+		ctx:         ctx,
+		client:      client,
+		webURL:      "https://github.com",
+		gistURL:     "https://gist.github.com",
+		credentials: &tokenCredentials{ts: ts},
+	}
+	if apiURL != "" {
+		g.webURL = strings.TrimSuffix(webURL, "/")
+		// enterprise servers without subdomain isolation serve gists from /gist
+		g.gistURL = g.webURL + "/gist"
+	}
+	return g, nil
+}
+
+// newGitHubClient returns a client for github.com when apiURL is empty, and for a GitHub Enterprise Server otherwise
+func newGitHubClient(httpClient *http.Client, apiURL string) (*github.Client, error) {
+	if apiURL == "" {
+		return github.NewClient(httpClient), nil
+	}
+	client, err := github.NewEnterpriseClient(apiURL, enterpriseUploadURL(apiURL), httpClient)
+	if err != nil {
+		return nil, fmt.Errorf("invalid github api url %s due to error %w", apiURL, err)
+	}
+	return client, nil
+}
+
+// Host returns the host repos are cloned from, such as github.com
+func (g *GitHubAPI) Host() string {
+	u, err := url.Parse(g.webURL)
+	if err != nil {
+		return g.webURL
+	}
+	return u.Host
+}
+
+// tokenCredentials clones with the current token of a token source, which GitHub accepts as the password of any
+// username
+type tokenCredentials struct {
+	ts oauth2.TokenSource
+}
+
+func (c *tokenCredentials) Credentials() (string, string, error) {
+	token, err := c.ts.Token()
+	if err != nil {
+		return "", "", err
+	}
+	return "x-access-token", token.AccessToken, nil
+}
+
+// enterpriseUploadURL returns the /api/uploads/ url next to an /api/v3/ url, and any other api url as is
+func enterpriseUploadURL(apiURL string) string {
+	trimmed := strings.TrimSuffix(apiURL, "/")
+	if strings.HasSuffix(trimmed, "/api/v3") {
+		return strings.TrimSuffix(trimmed, "/api/v3") + "/api/uploads/"
+	}
+	return apiURL
+}
+
+// repository converts a GitHub repository into a Repository cloned from the server of g
+func (g *GitHubAPI) repository(repo *github.Repository) *Repository {
+	r := &Repository{
+		Forge:       ForgeGitHub,
+		Owner:       repo.GetOwner().GetLogin(),
+		Name:        repo.GetName(),
+		CloneURL:    g.webURL + "/" + repo.GetFullName() + ".git",
+		Credentials: g.credentials,
+		Visibility:  VisibilityPublic,
+		Topics:      repo.Topics,
+		Fork:        repo.GetFork(),
+		Archived:    repo.GetArchived(),
+		// github reports sizes in kilobytes
+		Size:   int64(repo.GetSize()) * 1024,
+		github: g,
+	}
+	if repo.GetPrivate() {
+		r.Visibility = VisibilityPrivate
+	}
+	if repo.GetHasWiki() {
+		r.WikiURL = g.webURL + "/" + repo.GetFullName() + ".wiki.git"
+	}
+	return r
+}
+
+// waitForRateLimit sleeps until the rate limit resets once fewer than 500 requests remain
+func waitForRateLimit(resp *github.Response) {
+	if resp == nil || resp.Limit == 0 || resp.Remaining >= 500 {
+		return
+	}
+	fmt.Printf("Rate limit reached, sleeping for %v seconds\n", time.Until(resp.Reset.Time).Seconds())
+
+	time.Sleep(time.Until(resp.Reset.Time))
+}
+
+// etag returns the etag of url, sending previous so an unchanged response is a 304, which costs no rate limit
+func (g *GitHubAPI) etag(url string, previous string) (string, error) {
+	req, err := g.client.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	if previous != "" {
+		req.Header.Set("If-None-Match", previous)
+	}
+
+	resp, err := g.client.Do(g.ctx, req, nil)
+	if resp != nil && resp.StatusCode == http.StatusNotModified {
+		return previous, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	waitForRateLimit(resp)
+	if resp.Header.Get("ETag") == "" {
+		return "", fmt.Errorf("response to %s has no etag", url)
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+// listAll calls list for every page of results, returning all of them
+func listAll[T any](list func(opts github.ListOptions) ([]T, *github.Response, error)) ([]T, error) {
+	opts := github.ListOptions{
+		PerPage: 100,
+	}
+	items := make([]T, 0)
+	for {
+		page, resp, err := list(opts)
+		if err != nil {
+			return nil, err
+		}
+		waitForRateLimit(resp)
 
-	return &GitHubAPI{
-		ctx:    ctx,
-		client: client,
+		items = append(items, page...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
 	}
+	return items, nil
 }
 
 // GetOrgs returns a list of organizations that the user can access
@@ -41,11 +203,7 @@ func (g *GitHubAPI) GetOrgs() ([]*github.Organization, error) {
 			return nil, fmt.Errorf("failed to get orgs: %w", err)
 		}
 
-		if resp.Remaining < 500 {
-			fmt.Printf("Rate limit reached, sleeping for %v seconds\n", time.Until(resp.Reset.Time).Seconds())
-
-			time.Sleep(time.Until(resp.Reset.Time))
-		}
+		waitForRateLimit(resp)
 
 		orgs = append(orgs, new_orgs...)
 		if resp.NextPage == 0 {
@@ -71,11 +229,7 @@ func (g *GitHubAPI) GetRepos() ([]*github.Repository, error) {
 			return nil, fmt.Errorf("failed to get repos: %w", err)
 		}
 
-		if resp.Remaining < 500 {
-			fmt.Printf("Rate limit reached, sleeping for %v seconds\n", time.Until(resp.Reset.Time).Seconds())
-
-			time.Sleep(time.Until(resp.Reset.Time))
-		}
+		waitForRateLimit(resp)
 
 		repos = append(repos, new_repos...)
 		if resp.NextPage == 0 {
@@ -101,11 +255,7 @@ func (g *GitHubAPI) GetOrgRepos(org *github.Organization) ([]*github.Repository,
 			return nil, fmt.Errorf("failed to get repos for org: %w", err)
 		}
 
-		if resp.Remaining < 500 {
-			fmt.Printf("Rate limit reached, sleeping for %v seconds\n", time.Until(resp.Reset.Time).Seconds())
-
-			time.Sleep(time.Until(resp.Reset.Time))
-		}
+		waitForRateLimit(resp)
 
 		repos = append(repos, new_repos...)
 		if resp.NextPage == 0 {
@@ -124,13 +274,9 @@ func (g *GitHubAPI) RemoveEmptyRepos(repos []*github.Repository) ([]*github.Repo
 
 		// will return 404 error if the repo is empty
 		if err != nil {
-			if resp.Remaining < 500 {
-				fmt.Printf("Rate limit reached, sleeping for %v seconds\n", time.Until(resp.Reset.Time).Seconds())
+			waitForRateLimit(resp)
 
-				time.Sleep(time.Until(resp.Reset.Time))
-			}
-
-			if resp.StatusCode == 404 {
+			if resp != nil && resp.StatusCode == 404 {
 				continue
 			} else {
 				return nil, fmt.Errorf("failed to get contents of repo: %w", err)
@@ -142,53 +288,147 @@ func (g *GitHubAPI) RemoveEmptyRepos(repos []*github.Repository) ([]*github.Repo
 	return filtered_repos, nil
 }
 
-// get the most recent commit for a repo
-func (g *GitHubAPI) GetLastCommit(repo *github.Repository) (*string, error) {
-
-	// access the /events endpoint to get the most recent 100 events, hash them and create our own commit signature
-	// this is a workaround for the fact that the github api does not provide a way to get the most recent commit
-	// for a repo without using the /commits endpoint, which is paginated and requires a lot of requests to get the
-	// most recent commit
+// GetInstallationRepos returns the repositories that the GitHub App installation has been granted access to
+func (g *GitHubAPI) GetInstallationRepos() ([]*github.Repository, error) {
+	repos, err := listAll(func(opts github.ListOptions) ([]*github.Repository, *github.Response, error) {
+		return g.client.Apps.ListRepos(g.ctx, &opts)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get installation repos: %w", err)
+	}
+	return repos, nil
+}
 
-	opt := github.ListOptions{
-		PerPage: 100,
-		Page:    1,
+// GetInternalRepos returns the internal repositories of the provided org, which the API otherwise reports as private
+func (g *GitHubAPI) GetInternalRepos(owner string) ([]*github.Repository, error) {
+	repos, err := listAll(func(opts github.ListOptions) ([]*github.Repository, *github.Response, error) {
+		return g.client.Repositories.ListByOrg(g.ctx, owner, &github.RepositoryListByOrgOptions{Type: "internal", ListOptions: opts})
+	})
+	var errResp *github.ErrorResponse
+	if errors.As(err, &errResp) && errResp.Response.StatusCode == 404 {
+		return nil, nil
 	}
-	event, resp, err := g.client.Activity.ListRepositoryEvents(g.ctx, repo.GetOwner().GetLogin(), repo.GetName(), &opt)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get events for repo: %w", err)
+		return nil, fmt.Errorf("failed to get internal repos for org: %w", err)
 	}
+	return repos, nil
+}
 
-	if resp.Remaining < 500 {
-		fmt.Printf("Rate limit reached, sleeping for %v seconds\n", time.Until(resp.Reset.Time).Seconds())
+// ListRepos returns every non-empty repository that the user, or the app installation, can access
+func (g *GitHubAPI) ListRepos() ([]*Repository, error) {
+	return g.listRepos(nil)
+}
 
-		time.Sleep(time.Until(resp.Reset.Time))
+// listRepos lists the repositories like ListRepos, leaving out those that filter drops before checking which are
+// empty
+func (g *GitHubAPI) listRepos(filter *Filter) ([]*Repository, error) {
+	if g.installation {
+		repos, err := g.GetInstallationRepos()
+		if err != nil {
+			return nil, err
+		}
+		return g.convertRepos(repos, filter)
 	}
 
-	// sha256 hash of resp body
+	orgs, err := g.GetOrgs()
+	if err != nil {
+		return nil, err
+	}
 
-	// print each event as a string and merge into one, feeding it into a hash
-	var hash_string = ""
-	for _, e := range event {
-		hash_string += fmt.Sprintf("%v", e)
+	repos, err := g.GetRepos()
+	if err != nil {
+		return nil, err
 	}
 
-	// hash the string
-	hash := sha256.Sum256([]byte(hash_string))
-	// convert hash to hex string
-	commit := fmt.Sprintf("%x", hash)
+	// load all the repos from the orgs
+	for _, org := range orgs {
+		fmt.Printf("Loading repos for org %s\n", org.GetLogin())
+		orgRepos, err := g.GetOrgRepos(org)
+		if err != nil {
+			fmt.Printf("failed to get org repos due to error %v for org %s\n", err, org.GetLogin())
+			continue
+		}
 
-	return &commit, nil
+		// avoid duplicates by only adding repos that are not already in the list
+		for _, orgRepo := range orgRepos {
+			found := false
+			for _, repo := range repos {
+				if repo.GetFullName() == orgRepo.GetFullName() {
+					found = true
+					break
+				}
+			}
+			if !found {
+				repos = append(repos, orgRepo)
+			}
+		}
+	}
+
+	return g.convertRepos(repos, filter)
 }
 
-func (g *GitHubAPI) GetLastCommits(repo []*github.Repository) ([]*string, error) {
-	commits := make([]*string, 0)
-	for _, repo := range repo {
-		commit, err := g.GetLastCommit(repo)
+// internalRepos returns the full names of the internal repositories among the private repos, asking each org
+// owning a private repo for its internal repositories
+func (g *GitHubAPI) internalRepos(repos []*github.Repository) map[string]bool {
+	internal := make(map[string]bool)
+	checked := make(map[string]bool)
+	for _, repo := range repos {
+		owner := repo.GetOwner().GetLogin()
+		if !repo.GetPrivate() || checked[owner] {
+			continue
+		}
+		checked[owner] = true
+
+		internalRepos, err := g.GetInternalRepos(owner)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get last commit for repo: %w", err)
+			fmt.Printf("failed to get internal repos due to error %v for org %s\n", err, owner)
+			continue
 		}
-		commits = append(commits, commit)
+		for _, internalRepo := range internalRepos {
+			internal[internalRepo.GetFullName()] = true
+		}
+	}
+	return internal
+}
+
+// convertRepos converts repos into Repositories, leaving out those that filter drops and then those that are empty
+func (g *GitHubAPI) convertRepos(repos []*github.Repository, filter *Filter) ([]*Repository, error) {
+	fmt.Printf("Found %d repositories\n", len(repos))
+
+	// telling internal repos apart from private ones takes a request per org, so is only done when filtering on it
+	internal := make(map[string]bool)
+	if filter.checksVisibility() {
+		internal = g.internalRepos(repos)
+	}
+
+	converted := make(map[*github.Repository]*Repository, len(repos))
+	kept := make([]*github.Repository, 0, len(repos))
+	for _, repo := range repos {
+		r := g.repository(repo)
+		if internal[repo.GetFullName()] {
+			r.Visibility = VisibilityInternal
+		}
+		if filter.keep(r) {
+			converted[repo] = r
+			kept = append(kept, repo)
+		}
+	}
+	if len(kept) < len(repos) {
+		fmt.Printf("Filtered out %d repositories\n", len(repos)-len(kept))
+	}
+
+	fmt.Println("Removing empty repositories")
+
+	kept, err := g.RemoveEmptyRepos(kept)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Found %d repositories\n", len(kept))
+
+	result := make([]*Repository, 0, len(kept))
+	for _, repo := range kept {
+		result = append(result, converted[repo])
 	}
-	return commits, nil
+	return result, nil
 }
@@ -23,6 +23,48 @@ func TestNewGitHubAPI(t *testing.T) {
 	}
 }
 
+func TestNewEnterpriseGitHubAPI(t *testing.T) {
+	name := "test-repo"
+	fullName := "user/test-repo"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v3/user/repos", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer test-token" {
+			t.Errorf("Authorization = %q, want bearer token", got)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode([]*github.Repository{
+			{Name: &name, FullName: &fullName},
+		})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	token := "test-token"
+	api, err := NewEnterpriseGitHubAPI(context.Background(), &token, server.URL+"/api/v3", server.URL)
+	if err != nil {
+		t.Fatalf("NewEnterpriseGitHubAPI() error: %v", err)
+	}
+	if got := api.client.UploadURL.String(); got != server.URL+"/api/uploads/" {
+		t.Errorf("UploadURL = %q, want %q", got, server.URL+"/api/uploads/")
+	}
+
+	repos, err := api.GetRepos()
+	if err != nil {
+		t.Fatalf("GetRepos() error: %v", err)
+	}
+	if len(repos) != 1 || repos[0].GetFullName() != fullName {
+		t.Errorf("GetRepos() = %v, want %s", repos, fullName)
+	}
+}
+
+func TestNewEnterpriseGitHubAPI_InvalidURL(t *testing.T) {
+	token := "test-token"
+	if _, err := NewEnterpriseGitHubAPI(context.Background(), &token, "://nope", "https://github.example.com"); err == nil {
+		t.Error("expected error for invalid api url")
+	}
+}
+
 func TestGetOrgs_Empty(t *testing.T) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/user/orgs", func(w http.ResponseWriter, r *http.Request) {
@@ -75,59 +117,6 @@ func TestGetRepos_SinglePage(t *testing.T) {
 	}
 }
 
-func TestGetLastCommit_HashesEvents(t *testing.T) {
-	owner := "org"
-	name := "repo"
-	fullName := "org/repo"
-	login := "org"
-
-	mux := http.NewServeMux()
-	mux.HandleFunc("/repos/org/repo/events", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		id := "12345"
-		eventType := "PushEvent"
-		_ = json.NewEncoder(w).Encode([]*github.Event{
-			{ID: &id, Type: &eventType},
-		})
-	})
-	server := httptest.NewServer(mux)
-	defer server.Close()
-
-	client := github.NewClient(nil)
-	client.BaseURL, _ = client.BaseURL.Parse(server.URL + "/")
-
-	api := &GitHubAPI{ctx: context.Background(), client: client}
-	repo := &github.Repository{
-		Name:     &name,
-		FullName: &fullName,
-		Owner:    &github.User{Login: &login},
-	}
-
-	commit, err := api.GetLastCommit(repo)
-	if err != nil {
-		t.Fatalf("GetLastCommit() error: %v", err)
-	}
-	if commit == nil || *commit == "" {
-		t.Error("expected non-empty commit hash")
-	}
-
-	// Same events should produce same hash (deterministic)
-	commit2, err := api.GetLastCommit(repo)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if *commit != *commit2 {
-		t.Errorf("non-deterministic hash: %q != %q", *commit, *commit2)
-	}
-
-	// Verify it's a hex-encoded sha256 (64 chars)
-	if len(*commit) != 64 {
-		t.Errorf("hash length = %d, want 64", len(*commit))
-	}
-
-	_ = owner
-}
-
 func TestGetOrgRepos_SinglePage(t *testing.T) {
 	orgLogin := "myorg"
 	repoName := "org-repo"
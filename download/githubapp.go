@@ -0,0 +1,217 @@
+package download
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/oauth2"
+)
+
+// installationTokenMargin is how long before expiry an installation token is replaced, so that clones started just
+// before it expires still have time to authenticate
+const installationTokenMargin = 5 * time.Minute
+
+// GitHubApp lists the repositories of every installation of a GitHub App, authenticating each installation with
+// its own installation token
+type GitHubApp struct {
+	ctx    context.Context
+	appID  int64
+	key    *rsa.PrivateKey
+	client *github.Client
+	apiURL string
+	webURL string
+	// installations are kept across runs so their tokens are reused until they expire
+	installations map[int64]*GitHubAPI
+}
+
+// NewGitHubApp returns a GitHubApp for the app with appID, signing its requests with the PEM encoded privateKey
+func NewGitHubApp(ctx context.Context, appID int64, privateKey []byte, apiURL string, webURL string) (*GitHubApp, error) {
+	key, err := parsePrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid github app private key due to error %w", err)
+	}
+
+	app := &GitHubApp{
+		ctx:           ctx,
+		appID:         appID,
+		key:           key,
+		apiURL:        apiURL,
+		webURL:        webURL,
+		installations: make(map[int64]*GitHubAPI),
+	}
+	ts := oauth2.ReuseTokenSource(nil, &appTokenSource{app: app})
+	app.client, err = newGitHubClient(oauth2.NewClient(ctx, ts), apiURL)
+	if err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+// Host returns the host repos are cloned from, such as github.com
+func (a *GitHubApp) Host() string {
+	if a.apiURL == "" {
+		return "github.com"
+	}
+	u, err := url.Parse(a.webURL)
+	if err != nil {
+		return a.webURL
+	}
+	return u.Host
+}
+
+// parsePrivateKey parses a PEM encoded PKCS#1 or PKCS#8 RSA private key, as downloaded from the app's settings
+func parsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA private key")
+	}
+	return rsaKey, nil
+}
+
+// appJWT returns a JSON web token authenticating as the app itself, valid until expiry
+func (a *GitHubApp) appJWT(now time.Time, expiry time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	// the issue time is backdated to allow for clock drift between us and github
+	claims, err := json.Marshal(map[string]any{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": expiry.Unix(),
+		"iss": strconv.FormatInt(a.appID, 10),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// appTokenSource mints JSON web tokens for the app, which github accepts for at most 10 minutes
+type appTokenSource struct {
+	app *GitHubApp
+}
+
+func (s *appTokenSource) Token() (*oauth2.Token, error) {
+	now := time.Now()
+	expiry := now.Add(9 * time.Minute)
+	jwt, err := s.app.appJWT(now, expiry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign github app token due to error %w", err)
+	}
+	return &oauth2.Token{AccessToken: jwt, TokenType: "Bearer", Expiry: expiry.Add(-time.Minute)}, nil
+}
+
+// installationTokenSource mints installation tokens for one installation of the app
+type installationTokenSource struct {
+	app *GitHubApp
+	id  int64
+}
+
+func (s *installationTokenSource) Token() (*oauth2.Token, error) {
+	// go-github posts to the /installations/ endpoint that github has since removed, so the request is made here
+	req, err := s.app.client.NewRequest("POST", fmt.Sprintf("app/installations/%d/access_tokens", s.id), nil)
+	if err != nil {
+		return nil, err
+	}
+	token := new(github.InstallationToken)
+	_, err = s.app.client.Do(s.app.ctx, req, token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create token for installation %d due to error %w", s.id, err)
+	}
+	// the token is replaced early, so it does not expire in the middle of a download
+	return &oauth2.Token{
+		AccessToken: token.GetToken(),
+		TokenType:   "Bearer",
+		Expiry:      token.GetExpiresAt().Add(-installationTokenMargin),
+	}, nil
+}
+
+// GetInstallations returns every installation of the app, one for each user or org it was installed on
+func (a *GitHubApp) GetInstallations() ([]*github.Installation, error) {
+	installations, err := listAll(func(opts github.ListOptions) ([]*github.Installation, *github.Response, error) {
+		return a.client.Apps.ListInstallations(a.ctx, &opts)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get installations: %w", err)
+	}
+	return installations, nil
+}
+
+// installation returns the GitHubAPI of an installation, authenticated with tokens that are refreshed before they
+// expire
+func (a *GitHubApp) installation(id int64) (*GitHubAPI, error) {
+	if api, ok := a.installations[id]; ok {
+		return api, nil
+	}
+
+	ts := oauth2.ReuseTokenSource(nil, &installationTokenSource{app: a, id: id})
+	api, err := newGitHubAPI(a.ctx, ts, a.apiURL, a.webURL)
+	if err != nil {
+		return nil, err
+	}
+	api.installation = true
+	a.installations[id] = api
+	return api, nil
+}
+
+// ListRepos returns every non-empty repository that the installations of the app have been granted
+func (a *GitHubApp) ListRepos() ([]*Repository, error) {
+	return a.listRepos(nil)
+}
+
+// listRepos lists the repositories like ListRepos, leaving out those that filter drops before checking which are
+// empty
+func (a *GitHubApp) listRepos(filter *Filter) ([]*Repository, error) {
+	installations, err := a.GetInstallations()
+	if err != nil {
+		return nil, err
+	}
+
+	repos := make([]*Repository, 0)
+	for _, installation := range installations {
+		account := installation.GetAccount().GetLogin()
+		fmt.Printf("Loading repos for installation on %s\n", account)
+		api, err := a.installation(installation.GetID())
+		if err != nil {
+			return nil, err
+		}
+		installationRepos, err := api.listRepos(filter)
+		if err != nil {
+			fmt.Printf("failed to get installation repos due to error %v for %s\n", err, account)
+			continue
+		}
+		repos = append(repos, installationRepos...)
+	}
+	return repos, nil
+}
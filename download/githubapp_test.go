@@ -0,0 +1,185 @@
+package download
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// verifyAppJWT checks that the request is authenticated with a JSON web token for app 42 signed by key
+func verifyAppJWT(t *testing.T, r *http.Request, key *rsa.PrivateKey) {
+	t.Helper()
+	jwt, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	parts := strings.Split(jwt, ".")
+	if !ok || len(parts) != 3 {
+		t.Errorf("Authorization = %q, want a bearer JWT", r.Header.Get("Authorization"))
+		return
+	}
+
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], signature); err != nil {
+		t.Errorf("JWT signature is invalid: %v", err)
+	}
+
+	data, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var claims struct {
+		Iss string `json:"iss"`
+		Iat int64  `json:"iat"`
+		Exp int64  `json:"exp"`
+	}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		t.Errorf("JWT claims are not valid JSON: %v", err)
+	}
+	if claims.Iss != "42" || claims.Exp-claims.Iat > 600 {
+		t.Errorf("unexpected JWT claims %+v", claims)
+	}
+}
+
+// newTestGitHubApp returns a GitHubApp with id 42 talking to a test server serving mux, and the key it signs with
+func newTestGitHubApp(t *testing.T, mux *http.ServeMux) (*GitHubApp, *rsa.PrivateKey) {
+	t.Helper()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	app, err := NewGitHubApp(context.Background(), 42, privateKey, server.URL+"/api/v3/", "https://github.example.com")
+	if err != nil {
+		t.Fatalf("NewGitHubApp() error: %v", err)
+	}
+	return app, key
+}
+
+func TestGitHubApp_ListRepos(t *testing.T) {
+	mux := http.NewServeMux()
+	var key *rsa.PrivateKey
+	mux.HandleFunc("/api/v3/app/installations", func(w http.ResponseWriter, r *http.Request) {
+		verifyAppJWT(t, r, key)
+		_, _ = fmt.Fprint(w, `[{"id": 1, "account": {"login": "acme"}}, {"id": 2, "account": {"login": "widgets"}}]`)
+	})
+	for _, id := range []int{1, 2} {
+		mux.HandleFunc(fmt.Sprintf("/api/v3/app/installations/%d/access_tokens", id), func(w http.ResponseWriter, r *http.Request) {
+			verifyAppJWT(t, r, key)
+			_, _ = fmt.Fprintf(w, `{"token": "installation-%d", "expires_at": %q}`, id, time.Now().Add(time.Hour).Format(time.RFC3339))
+		})
+	}
+	mux.HandleFunc("/api/v3/installation/repositories", func(w http.ResponseWriter, r *http.Request) {
+		// each installation only sees the repos of its own org
+		switch r.Header.Get("Authorization") {
+		case "Bearer installation-1":
+			_, _ = fmt.Fprint(w, `{"total_count": 1, "repositories": [{"name": "api", "full_name": "acme/api", "owner": {"login": "acme"}, "has_wiki": true}]}`)
+		case "Bearer installation-2":
+			_, _ = fmt.Fprint(w, `{"total_count": 1, "repositories": [{"name": "gears", "full_name": "widgets/gears", "owner": {"login": "widgets"}}]}`)
+		default:
+			t.Errorf("Authorization = %q, want an installation token", r.Header.Get("Authorization"))
+		}
+	})
+	mux.HandleFunc("/api/v3/repos/", func(w http.ResponseWriter, r *http.Request) {
+		// every repo has content, so none are removed as empty
+		_, _ = fmt.Fprint(w, `[]`)
+	})
+	app, appKey := newTestGitHubApp(t, mux)
+	key = appKey
+
+	repos, err := app.ListRepos()
+	if err != nil {
+		t.Fatalf("ListRepos() error: %v", err)
+	}
+	if len(repos) != 2 || repos[0].FullName() != "acme/api" || repos[1].FullName() != "widgets/gears" {
+		t.Fatalf("unexpected repos %v", repos)
+	}
+	if repos[0].CloneURL != "https://github.example.com/acme/api.git" || repos[0].WikiURL != "https://github.example.com/acme/api.wiki.git" {
+		t.Errorf("CloneURL, WikiURL = %q, %q", repos[0].CloneURL, repos[0].WikiURL)
+	}
+	if repos[0].github == nil {
+		t.Error("repos should keep the installation api for the exporters")
+	}
+
+	username, password, err := repos[1].Credentials.Credentials()
+	if err != nil || username != "x-access-token" || password != "installation-2" {
+		t.Errorf("clone credentials = %q, %q, %v", username, password, err)
+	}
+}
+
+func TestGitHubApp_RefreshesInstallationToken(t *testing.T) {
+	mux := http.NewServeMux()
+	tokens := 0
+	expiresIn := time.Hour
+	mux.HandleFunc("/api/v3/app/installations/1/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		tokens++
+		_, _ = fmt.Fprintf(w, `{"token": "installation-%d", "expires_at": %q}`, tokens, time.Now().Add(expiresIn).Format(time.RFC3339))
+	})
+	app, _ := newTestGitHubApp(t, mux)
+
+	api, err := app.installation(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if _, password, err := api.credentials.Credentials(); err != nil || password != "installation-1" {
+			t.Fatalf("Credentials() = %q, %v, want the first token to be reused", password, err)
+		}
+	}
+
+	// a token close to expiry is replaced before it is used again
+	api, err = app.installation(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.HandleFunc("/api/v3/app/installations/2/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		tokens++
+		_, _ = fmt.Fprintf(w, `{"token": "installation-%d", "expires_at": %q}`, tokens, time.Now().Add(installationTokenMargin).Format(time.RFC3339))
+	})
+	_, first, _ := api.credentials.Credentials()
+	_, second, err := api.credentials.Credentials()
+	if err != nil || first == second {
+		t.Errorf("tokens %q and %q, %v, want the expiring token to be refreshed", first, second, err)
+	}
+	if tokens != 3 {
+		t.Errorf("minted %d tokens, want 3", tokens)
+	}
+
+	// installations are cached, so their tokens are reused across runs
+	cached, err := app.installation(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, password, _ := cached.credentials.Credentials(); password != "installation-1" {
+		t.Errorf("cached installation token = %q, want installation-1", password)
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if parsed, err := parsePrivateKey(pkcs1); err != nil || !parsed.Equal(key) {
+		t.Errorf("parsePrivateKey(pkcs1) = %v, want the key", err)
+	}
+	if _, err := parsePrivateKey([]byte("not a key")); err == nil {
+		t.Error("expected error for data without a PEM block")
+	}
+}
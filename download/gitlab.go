@@ -0,0 +1,233 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GitLabGroup is a group, or subgroup, that the user is a member of
+type GitLabGroup struct {
+	ID       int64  `json:"id"`
+	FullPath string `json:"full_path"`
+}
+
+// GitLabProject is a project as returned by the GitLab API
+type GitLabProject struct {
+	ID                int64  `json:"id"`
+	PathWithNamespace string `json:"path_with_namespace"`
+	HTTPURLToRepo     string `json:"http_url_to_repo"`
+	SSHURLToRepo      string `json:"ssh_url_to_repo"`
+	WikiEnabled       bool   `json:"wiki_enabled"`
+	EmptyRepo         bool   `json:"empty_repo"`
+	// Visibility is public, internal or private
+	Visibility string   `json:"visibility"`
+	Topics     []string `json:"topics"`
+	Archived   bool     `json:"archived"`
+	// ForkedFromProject is the project a fork was forked from, and is null for other projects
+	ForkedFromProject *struct {
+		ID int64 `json:"id"`
+	} `json:"forked_from_project"`
+	// Statistics are only returned to members who can see them, and hold the size of the repository in bytes
+	Statistics *struct {
+		RepositorySize int64 `json:"repository_size"`
+	} `json:"statistics"`
+}
+
+// GitLabAPI lists the projects of a GitLab user and their groups, from gitlab.com or a self-hosted instance
+type GitLabAPI struct {
+	ctx         context.Context
+	client      *http.Client
+	apiURL      *url.URL
+	token       string
+	credentials Credentials
+}
+
+// NewGitLabAPI returns a GitLabAPI for the instance at baseURL, such as https://gitlab.com
+func NewGitLabAPI(ctx context.Context, token *string, baseURL string) (*GitLabAPI, error) {
+	apiURL, err := url.Parse(strings.TrimSuffix(baseURL, "/") + "/api/v4/")
+	if err != nil {
+		return nil, fmt.Errorf("invalid gitlab url %s due to error %w", baseURL, err)
+	}
+
+	return &GitLabAPI{
+		ctx:    ctx,
+		client: http.DefaultClient,
+		apiURL: apiURL,
+		token:  *token,
+		// gitlab accepts any token as the password of the oauth2 user
+		credentials: &StaticCredentials{Username: "oauth2", Password: *token},
+	}, nil
+}
+
+// Host returns the host of the GitLab instance, such as gitlab.com
+func (g *GitLabAPI) Host() string {
+	return g.apiURL.Host
+}
+
+// gitlabRetryAfter returns how long GitLab asked to wait before retrying a rate limited request
+func gitlabRetryAfter(header http.Header) time.Duration {
+	seconds, err := strconv.Atoi(header.Get("Retry-After"))
+	if err != nil || seconds <= 0 {
+		return time.Minute
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// get requests apiPath from the api and decodes the json response into v, returning the response headers
+func (g *GitLabAPI) get(apiPath string, query url.Values, v any) (http.Header, error) {
+	u := g.apiURL.JoinPath(apiPath)
+	u.RawQuery = query.Encode()
+	for {
+		req, err := http.NewRequestWithContext(g.ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("PRIVATE-TOKEN", g.token)
+
+		resp, err := g.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests {
+			_ = resp.Body.Close()
+			delay := gitlabRetryAfter(resp.Header)
+			fmt.Printf("Rate limit reached, sleeping for %v seconds\n", delay.Seconds())
+			select {
+			case <-g.ctx.Done():
+				return nil, g.ctx.Err()
+			case <-time.After(delay):
+			}
+			continue
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			_ = resp.Body.Close()
+			return nil, fmt.Errorf("unexpected status %s from %s: %s", resp.Status, u.Path, strings.TrimSpace(string(body)))
+		}
+
+		err = json.NewDecoder(resp.Body).Decode(v)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode response from %s due to error %w", u.Path, err)
+		}
+		return resp.Header, nil
+	}
+}
+
+// gitlabListAll requests every page of apiPath, returning all of the results
+func gitlabListAll[T any](g *GitLabAPI, apiPath string, query url.Values) ([]T, error) {
+	query.Set("per_page", "100")
+	items := make([]T, 0)
+	page := "1"
+	for page != "" {
+		query.Set("page", page)
+		var new_items []T
+		header, err := g.get(apiPath, query, &new_items)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, new_items...)
+		page = header.Get("X-Next-Page")
+	}
+	return items, nil
+}
+
+// GetGroups returns the groups, including subgroups, that the user is a member of
+func (g *GitLabAPI) GetGroups() ([]*GitLabGroup, error) {
+	groups, err := gitlabListAll[*GitLabGroup](g, "groups", url.Values{"min_access_level": {"10"}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get groups: %w", err)
+	}
+	return groups, nil
+}
+
+// GetProjects returns the projects that the user is a member of, with their statistics where the user may see them
+func (g *GitLabAPI) GetProjects() ([]*GitLabProject, error) {
+	projects, err := gitlabListAll[*GitLabProject](g, "projects", url.Values{"membership": {"true"}, "statistics": {"true"}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get projects: %w", err)
+	}
+	return projects, nil
+}
+
+// GetGroupProjects returns the projects of the provided group and its subgroups
+func (g *GitLabAPI) GetGroupProjects(group *GitLabGroup) ([]*GitLabProject, error) {
+	apiPath := "groups/" + strconv.FormatInt(group.ID, 10) + "/projects"
+	projects, err := gitlabListAll[*GitLabProject](g, apiPath, url.Values{"include_subgroups": {"true"}, "statistics": {"true"}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get projects for group: %w", err)
+	}
+	return projects, nil
+}
+
+// repository converts a GitLab project into a Repository owned by the full path of its group
+func (g *GitLabAPI) repository(project *GitLabProject) *Repository {
+	r := &Repository{
+		Forge:       ForgeGitLab,
+		Owner:       path.Dir(project.PathWithNamespace),
+		Name:        path.Base(project.PathWithNamespace),
+		CloneURL:    project.HTTPURLToRepo,
+		SSHURL:      project.SSHURLToRepo,
+		Credentials: g.credentials,
+		Visibility:  Visibility(project.Visibility),
+		Topics:      project.Topics,
+		Fork:        project.ForkedFromProject != nil,
+		Archived:    project.Archived,
+	}
+	if project.Statistics != nil {
+		r.Size = project.Statistics.RepositorySize
+	}
+	if project.WikiEnabled {
+		r.WikiURL = strings.TrimSuffix(project.HTTPURLToRepo, ".git") + ".wiki.git"
+	}
+	return r
+}
+
+// ListRepos returns every non-empty project that the user can access, either directly or through their groups
+func (g *GitLabAPI) ListRepos() ([]*Repository, error) {
+	projects, err := g.GetProjects()
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := g.GetGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	// load all the projects from the groups
+	for _, group := range groups {
+		fmt.Printf("Loading projects for group %s\n", group.FullPath)
+		groupProjects, err := g.GetGroupProjects(group)
+		if err != nil {
+			fmt.Printf("failed to get group projects due to error %v for group %s\n", err, group.FullPath)
+			continue
+		}
+		projects = append(projects, groupProjects...)
+	}
+
+	// projects are listed once for the user and again for each group above them, and empty projects have nothing
+	// to bundle
+	seen := make(map[int64]bool)
+	repos := make([]*Repository, 0, len(projects))
+	for _, project := range projects {
+		if seen[project.ID] || project.EmptyRepo {
+			continue
+		}
+		seen[project.ID] = true
+		repos = append(repos, g.repository(project))
+	}
+
+	fmt.Printf("Found %d gitlab projects\n", len(repos))
+	return repos, nil
+}
@@ -0,0 +1,143 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestGitLabAPI returns a GitLabAPI for a fake instance serving mux below /api/v4/
+func newTestGitLabAPI(t *testing.T, mux *http.ServeMux) *GitLabAPI {
+	t.Helper()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	api, err := NewGitLabAPI(context.Background(), strPtr("glpat-test"), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return api
+}
+
+func TestGitLabAPI_ListRepos(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/projects", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("PRIVATE-TOKEN"); got != "glpat-test" {
+			t.Errorf("PRIVATE-TOKEN = %q, want glpat-test", got)
+		}
+		if r.URL.Query().Get("membership") != "true" {
+			t.Errorf("projects membership = %q, want true", r.URL.Query().Get("membership"))
+		}
+		// the user's projects are split over two pages
+		if r.URL.Query().Get("page") == "1" {
+			w.Header().Set("X-Next-Page", "2")
+			_, _ = fmt.Fprint(w, `[{"id": 1, "path_with_namespace": "user/dotfiles", "http_url_to_repo": "https://gitlab.example.com/user/dotfiles.git"}]`)
+			return
+		}
+		_, _ = fmt.Fprint(w, `[{"id": 2, "path_with_namespace": "user/empty", "empty_repo": true}]`)
+	})
+	mux.HandleFunc("/api/v4/groups", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `[{"id": 7, "full_path": "group"}]`)
+	})
+	mux.HandleFunc("/api/v4/groups/7/projects", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("include_subgroups") != "true" {
+			t.Errorf("group projects include_subgroups = %q, want true", r.URL.Query().Get("include_subgroups"))
+		}
+		_, _ = fmt.Fprint(w, `[
+			{"id": 1, "path_with_namespace": "user/dotfiles", "http_url_to_repo": "https://gitlab.example.com/user/dotfiles.git"},
+			{"id": 3, "path_with_namespace": "group/sub/service", "http_url_to_repo": "https://gitlab.example.com/group/sub/service.git", "wiki_enabled": true,
+			 "visibility": "internal", "topics": ["go"], "archived": true, "forked_from_project": {"id": 9}, "statistics": {"repository_size": 2048}}
+		]`)
+	})
+	api := newTestGitLabAPI(t, mux)
+
+	repos, err := api.ListRepos()
+	if err != nil {
+		t.Fatalf("ListRepos() error: %v", err)
+	}
+	if len(repos) != 2 {
+		t.Fatalf("expected 2 repos without the empty or duplicate projects, got %v", repos)
+	}
+	if repos[0].FullName() != "user/dotfiles" || repos[0].WikiURL != "" {
+		t.Errorf("unexpected repo %+v", repos[0])
+	}
+	service := repos[1]
+	if service.Owner != "group/sub" || service.Name != "service" || service.Forge != ForgeGitLab {
+		t.Errorf("unexpected repo %+v", service)
+	}
+	if service.WikiURL != "https://gitlab.example.com/group/sub/service.wiki.git" {
+		t.Errorf("WikiURL = %q, want the project's wiki", service.WikiURL)
+	}
+	if service.Visibility != VisibilityInternal || len(service.Topics) != 1 || !service.Archived || !service.Fork || service.Size != 2048 {
+		t.Errorf("unexpected attributes %+v", service)
+	}
+
+	username, password, err := service.Credentials.Credentials()
+	if err != nil || username != "oauth2" || password != "glpat-test" {
+		t.Errorf("clone credentials = %q, %q, %v", username, password, err)
+	}
+}
+
+func TestGitLabAPI_Error(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/projects", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message": "401 Unauthorized"}`, http.StatusUnauthorized)
+	})
+	api := newTestGitLabAPI(t, mux)
+
+	if _, err := api.ListRepos(); err == nil {
+		t.Error("expected error for unauthorized token")
+	}
+}
+
+func TestGitLabRetryAfter(t *testing.T) {
+	header := http.Header{}
+	if got := gitlabRetryAfter(header); got != time.Minute {
+		t.Errorf("gitlabRetryAfter() without header = %v, want 1m", got)
+	}
+	header.Set("Retry-After", "30")
+	if got := gitlabRetryAfter(header); got != 30*time.Second {
+		t.Errorf("gitlabRetryAfter() = %v, want 30s", got)
+	}
+}
+
+func TestMigrateRepos_GitLab(t *testing.T) {
+	work := newWorkRepo(t)
+	root := t.TempDir()
+	testGit(t, root, "clone", "--bare", work, filepath.Join(root, "group", "sub", "service.git"))
+	gitServer := newGitHTTPServer(t, root)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/projects", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, `[{"id": 3, "path_with_namespace": "group/sub/service", "http_url_to_repo": "%s/group/sub/service.git"}]`, gitServer.URL)
+	})
+	mux.HandleFunc("/api/v4/groups", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `[]`)
+	})
+	api := newTestGitLabAPI(t, mux)
+
+	repos, err := ListAllRepos(api)
+	if err != nil {
+		t.Fatalf("ListAllRepos() error: %v", err)
+	}
+
+	location := t.TempDir()
+	tmp := t.TempDir()
+	d := NewDownloader(context.Background())
+	if err := d.MigrateRepos(repos, &location, Retention{Last: 3}, &tmp); err != nil {
+		t.Fatalf("MigrateRepos() error: %v", err)
+	}
+
+	bundle := BundlePath(location, "group/sub/service", generationAt(location, 0))
+	if !Exists(bundle) {
+		t.Fatal("bundle of the gitlab project was not created in the newest generation")
+	}
+	restored := filepath.Join(t.TempDir(), "service")
+	if err := RestoreBundle(context.Background(), NewLocalStorage(location), BundleName("group/sub/service", generationAt(location, 0)), restored, nil); err != nil {
+		t.Fatalf("RestoreBundle() error: %v", err)
+	}
+}
@@ -2,28 +2,28 @@ package download
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
-
-	"github.com/google/go-github/github"
+	"time"
 )
 
 func TestDownloadRepo_CommandInjectionGuard(t *testing.T) {
-	d := NewDownloader(context.Background(), strPtr("fake-token"))
+	d := NewDownloader(context.Background())
 	loc := t.TempDir()
 
 	badNames := []string{"repo;rm -rf /", "repo|cat /etc/passwd", "repo&echo pwned"}
 	for _, name := range badNames {
-		owner := "org"
-		fullName := owner + "/" + name
-		repo := &github.Repository{
-			Name:     &name,
-			FullName: &fullName,
-			Owner:    &github.User{Login: &owner},
-		}
-		err := d.DownloadRepo(repo, &loc)
+		err := d.DownloadRepo(makeRepo("org", name), &loc)
 		if err == nil {
 			t.Errorf("expected error for repo name %q, got nil", name)
 		}
@@ -31,24 +31,26 @@ func TestDownloadRepo_CommandInjectionGuard(t *testing.T) {
 }
 
 func TestDownloadRepo_EmptyName(t *testing.T) {
-	d := NewDownloader(context.Background(), strPtr("fake-token"))
+	d := NewDownloader(context.Background())
 	loc := t.TempDir()
 
-	name := ""
-	fullName := ""
-	owner := "org"
-	repo := &github.Repository{
-		Name:     &name,
-		FullName: &fullName,
-		Owner:    &github.User{Login: &owner},
-	}
-
-	err := d.DownloadRepo(repo, &loc)
+	err := d.DownloadRepo(makeRepo("org", ""), &loc)
 	if err == nil {
 		t.Error("expected error for empty repo name")
 	}
 }
 
+func TestDownloadRepo_PathTraversal(t *testing.T) {
+	d := NewDownloader(context.Background())
+	loc := t.TempDir()
+
+	for _, owner := range []string{"..", "org/../..", "/org"} {
+		if err := d.DownloadRepo(makeRepo(owner, "repo"), &loc); err == nil {
+			t.Errorf("expected error for owner %q, got nil", owner)
+		}
+	}
+}
+
 func TestDownloadRepo_Success(t *testing.T) {
 	// Skip if git is not available
 	if _, err := exec.LookPath("git"); err != nil {
@@ -59,13 +61,9 @@ func TestDownloadRepo_Success(t *testing.T) {
 	srcDir := t.TempDir()
 	workDir := filepath.Join(srcDir, "work")
 
-	// We will create the bare repo at a path that matches the format string:
-	// fmt.Sprintf(cloneBaseURL, token, fullName) should resolve to the bare repo path.
-	// token = "", fullName = "org/repo", cloneBaseURL = srcDir + "/%s%s.git"
-	// Result: srcDir + "/" + "" + "org/repo" + ".git" = srcDir + "/org/repo.git"
+	// The repo is cloned from the bare repo at srcDir/org/repo.git
 	owner := "org"
 	name := "repo"
-	fullName := owner + "/" + name
 	bareDir := filepath.Join(srcDir, owner, name+".git")
 
 	run := func(dir string, args ...string) {
@@ -99,19 +97,16 @@ func TestDownloadRepo_Success(t *testing.T) {
 	run(workDir, "git", "commit", "-m", "initial")
 	run(srcDir, "git", "clone", "--bare", workDir, bareDir)
 
-	// Build a Downloader that points at the local bare repo
-	token := ""
+	// Build a Downloader and a repo that points at the local bare repo
 	d := &Downloader{
-		ctx:          context.Background(),
-		token:        token,
-		cloneBaseURL: srcDir + "/%s%s.git",
+		ctx: context.Background(),
 	}
 
 	destDir := t.TempDir()
-	repo := &github.Repository{
-		Name:     &name,
-		FullName: &fullName,
-		Owner:    &github.User{Login: &owner},
+	repo := &Repository{
+		Owner:    owner,
+		Name:     name,
+		CloneURL: bareDir,
 	}
 
 	err := d.DownloadRepo(repo, &destDir)
@@ -146,21 +141,11 @@ func TestDownloadRepo_CloneFailure(t *testing.T) {
 		t.Skip("git not found in PATH")
 	}
 
-	token := ""
 	d := &Downloader{
-		ctx:          context.Background(),
-		token:        token,
-		cloneBaseURL: "/nonexistent/%s%s.git",
+		ctx: context.Background(),
 	}
 
-	owner := "org"
-	name := "repo"
-	fullName := owner + "/" + name
-	repo := &github.Repository{
-		Name:     &name,
-		FullName: &fullName,
-		Owner:    &github.User{Login: &owner},
-	}
+	repo := makeLocalRepo("/nonexistent", "org", "repo")
 
 	destDir := t.TempDir()
 	err := d.DownloadRepo(repo, &destDir)
@@ -170,10 +155,412 @@ func TestDownloadRepo_CloneFailure(t *testing.T) {
 }
 
 func TestDownloadRepos_EmptyList(t *testing.T) {
-	d := NewDownloader(context.Background(), strPtr("fake"))
+	d := NewDownloader(context.Background())
 	loc := t.TempDir()
-	err := d.DownloadRepos([]*github.Repository{}, &loc)
+	err := d.DownloadRepos([]*Repository{}, &loc)
 	if err == nil {
 		t.Error("expected error for empty repo list")
 	}
 }
+
+func TestDownloadRepos_PartialFailure(t *testing.T) {
+	work := newWorkRepo(t)
+	srcDir := t.TempDir()
+	testGit(t, srcDir, "clone", "--bare", work, filepath.Join(srcDir, "org", "good.git"))
+
+	d := NewDownloader(context.Background(), WithConcurrency(2), WithRetries(1, time.Millisecond))
+
+	destDir := t.TempDir()
+	repos := []*Repository{makeLocalRepo(srcDir, "org", "missing"), makeLocalRepo(srcDir, "org", "good")}
+	err := d.DownloadRepos(repos, &destDir)
+
+	var downloadErr *DownloadError
+	if !errors.As(err, &downloadErr) {
+		t.Fatalf("expected *DownloadError, got %v", err)
+	}
+	if len(downloadErr.Failed) != 1 || downloadErr.Failed["org/missing"] == nil {
+		t.Errorf("Failed = %v, want only org/missing", downloadErr.Failed)
+	}
+	if !Exists(filepath.Join(destDir, "org", "good.bundle")) {
+		t.Error("good repo was not downloaded after another repo failed")
+	}
+}
+
+func TestDownloadRepos_MissingAndEmptyReposAreNotRetried(t *testing.T) {
+	srcDir := t.TempDir()
+	testGit(t, srcDir, "init", "--bare", filepath.Join(srcDir, "org", "empty.git"))
+
+	// a retry would wait for an hour, so outlive the context and fail with its error instead
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	d := NewDownloader(ctx, WithConcurrency(2), WithRetries(3, time.Hour))
+
+	destDir := t.TempDir()
+	repos := []*Repository{makeLocalRepo(srcDir, "org", "missing"), makeLocalRepo(srcDir, "org", "empty")}
+	err := d.DownloadRepos(repos, &destDir)
+
+	var downloadErr *DownloadError
+	if !errors.As(err, &downloadErr) {
+		t.Fatalf("expected *DownloadError, got %v", err)
+	}
+	if len(downloadErr.Failed) != 1 || !errors.Is(downloadErr.Failed["org/missing"], errRemoteMissing) {
+		t.Errorf("Failed = %v, want only org/missing with errRemoteMissing", downloadErr.Failed)
+	}
+}
+
+func TestDownloadRepos_RetriesRemotesNotFound(t *testing.T) {
+	// forges answer 404 for a repo the token cannot read, just as for one which does not exist
+	var attempts sync.Map
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count, _ := attempts.LoadOrStore(r.URL.Path, new(atomic.Int32))
+		count.(*atomic.Int32).Add(1)
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	d := NewDownloader(context.Background(), WithRetries(1, time.Millisecond))
+	destDir := t.TempDir()
+	repo := makeRepo("org", "private")
+	repo.CloneURL = server.URL + "/org/private.git"
+	err := d.DownloadRepos([]*Repository{repo}, &destDir)
+
+	var downloadErr *DownloadError
+	if !errors.As(err, &downloadErr) || !errors.Is(downloadErr.Failed["org/private"], errRemoteNotFound) {
+		t.Fatalf("DownloadRepos() error = %v, want errRemoteNotFound", err)
+	}
+	if count, _ := attempts.Load("/org/private.git/info/refs"); count == nil || count.(*atomic.Int32).Load() != 2 {
+		t.Errorf("attempts = %v, want the clone retried once", count)
+	}
+}
+
+func TestMissingRemoteError(t *testing.T) {
+	tests := []struct {
+		output string
+		want   error
+	}{
+		{"fatal: repository '/srv/git/repo.git' does not exist\n", errRemoteMissing},
+		{"fatal: '/srv/git/repo.git' does not appear to be a git repository\nfatal: Could not read from remote repository.\n", errRemoteMissing},
+		{"remote: Repository not found.\nfatal: repository 'https://github.com/org/repo.git/' not found\n", errRemoteNotFound},
+		{"ERROR: Repository not found.\nfatal: Could not read from remote repository.\n", errRemoteNotFound},
+		{"fatal: unable to access 'https://github.com/org/repo.git/': The requested URL returned error: 403\n", nil},
+		{"fatal: Authentication failed for 'https://github.com/org/repo.git/'\n", nil},
+		{"error: file not found in the cache\n", nil},
+	}
+	for _, tt := range tests {
+		if got := missingRemoteError([]byte(tt.output)); got != tt.want {
+			t.Errorf("missingRemoteError(%q) = %v, want %v", tt.output, got, tt.want)
+		}
+	}
+}
+
+func TestDownloader_Backoff(t *testing.T) {
+	d := NewDownloader(context.Background(), WithRetries(3, time.Second))
+
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}
+	for i, w := range want {
+		if got := d.backoff(i + 1); got != w {
+			t.Errorf("backoff(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+	if got := d.backoff(100); got != maxRetryDelay {
+		t.Errorf("backoff(100) = %v, want cap of %v", got, maxRetryDelay)
+	}
+}
+
+// recordingExporter records the repos it is asked to export, writing a marker file for each
+type recordingExporter struct {
+	exported []string
+	// version and err are returned by ExportVersion for every repo
+	version string
+	err     error
+}
+
+func (r *recordingExporter) Name() string {
+	return "recording"
+}
+
+func (r *recordingExporter) ExportVersion(_ *Repository, _ string) (string, error) {
+	return r.version, r.err
+}
+
+func (r *recordingExporter) ExportRepo(repo *Repository, orgFolder string) error {
+	r.exported = append(r.exported, repo.FullName())
+	return os.WriteFile(filepath.Join(orgFolder, repo.Name+".export"), []byte("exported"), 0644)
+}
+
+func TestDownloadRepo_RunsExporters(t *testing.T) {
+	work := newWorkRepo(t)
+	srcDir := t.TempDir()
+	testGit(t, srcDir, "clone", "--bare", work, filepath.Join(srcDir, "org", "repo.git"))
+
+	exporter := &recordingExporter{}
+	d := NewDownloader(context.Background(), WithExporters(exporter))
+
+	destDir := t.TempDir()
+	if err := d.DownloadRepo(makeLocalRepo(srcDir, "org", "repo"), &destDir); err != nil {
+		t.Fatalf("DownloadRepo() error: %v", err)
+	}
+
+	if len(exporter.exported) != 1 || exporter.exported[0] != "org/repo" {
+		t.Errorf("exported = %v, want [org/repo]", exporter.exported)
+	}
+	if !Exists(filepath.Join(destDir, "org", "repo.export")) {
+		t.Error("exporter output not written next to the bundle")
+	}
+}
+
+func TestDownloadRepos_ExportsUnchangedRepos(t *testing.T) {
+	location := t.TempDir()
+	exporter := &recordingExporter{version: "v1"}
+	d := NewDownloader(context.Background(), WithExporters(exporter))
+	// the unchanged repo is never cloned, so its remote does not need to exist
+	unchanged := makeLocalRepo(t.TempDir(), "org", "unchanged")
+	backUp(t, &mockRefLister{refs: []RepoRefs{mainAt("abc")}}, location, []*Repository{unchanged}, nil)
+
+	// the version of the export was never recorded, so the unchanged repo is exported
+	repos, err := d.WithUnchangedExports(location, []*Repository{unchanged}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repos) != 1 || !d.exportOnly["org/unchanged"] {
+		t.Fatalf("WithUnchangedExports() = %v, want the unchanged repo to be exported", repos)
+	}
+	destDir := t.TempDir()
+	if err := d.DownloadRepos(repos, &destDir); err != nil {
+		t.Fatalf("DownloadRepos() error: %v", err)
+	}
+	if len(exporter.exported) != 1 || !Exists(filepath.Join(destDir, "org", "unchanged.export")) {
+		t.Errorf("exported = %v, want the export of org/unchanged next to where its bundle would be", exporter.exported)
+	}
+	if Exists(filepath.Join(destDir, "org", "unchanged.bundle")) {
+		t.Error("the unchanged repo was downloaded")
+	}
+	if entries, _ := os.ReadDir(destDir); len(entries) != 1 {
+		t.Errorf("download location holds %v, want only the org folder", entries)
+	}
+	if err := recordRepos(location, repos, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// once its version is recorded the repo is not exported again until the version changes
+	if repos, err := d.WithUnchangedExports(location, []*Repository{unchanged}, nil); err != nil || len(repos) != 0 {
+		t.Errorf("WithUnchangedExports() = %v, %v, want no repos while the export is unchanged", repos, err)
+	}
+	exporter.version = "v2"
+	if repos, err := d.WithUnchangedExports(location, []*Repository{unchanged}, nil); err != nil || len(repos) != 1 {
+		t.Errorf("WithUnchangedExports() = %v, %v, want the repo whose export changed", repos, err)
+	}
+
+	// an export which could not be checked is exported again, while one with nothing to export is not
+	exporter.version, exporter.err = "v1", errors.New("rate limited")
+	if repos, err := d.WithUnchangedExports(location, []*Repository{unchanged}, nil); err != nil || len(repos) != 1 {
+		t.Errorf("WithUnchangedExports() = %v, %v, want the repo whose export could not be checked", repos, err)
+	}
+	exporter.version, exporter.err = "", nil
+	if repos, err := d.WithUnchangedExports(location, []*Repository{unchanged}, nil); err != nil || len(repos) != 0 {
+		t.Errorf("WithUnchangedExports() = %v, %v, want no repos for an exporter with nothing to export", repos, err)
+	}
+
+	// the recorded version does not count as a change of the refs
+	changed, err := RemoveUnchangedRepos(&mockRefLister{refs: []RepoRefs{mainAt("abc")}}, location, []*Repository{unchanged}, nil)
+	if err != nil || len(changed) != 0 {
+		t.Errorf("RemoveUnchangedRepos() = %v, %v, want no changed repos", changed, err)
+	}
+
+	// a changed repo is downloaded rather than only exported
+	if repos, _ := d.WithUnchangedExports(location, []*Repository{unchanged}, []*Repository{unchanged}); len(repos) != 1 || d.exportOnly["org/unchanged"] {
+		t.Errorf("WithUnchangedExports() = %v, want the changed repo to be downloaded", repos)
+	}
+	if repos, _ := NewDownloader(context.Background()).WithUnchangedExports(location, []*Repository{unchanged}, nil); len(repos) != 0 {
+		t.Errorf("WithUnchangedExports() without exporters = %v, want no repos", repos)
+	}
+}
+
+// makeWikiRepo returns a repo cloned from srcDir with its wiki enabled
+func makeWikiRepo(srcDir, owner, name string) *Repository {
+	repo := makeLocalRepo(srcDir, owner, name)
+	repo.WikiURL = filepath.Join(srcDir, owner, name+".wiki.git")
+	return repo
+}
+
+func TestDownloadRepo_Wiki(t *testing.T) {
+	work := newWorkRepo(t)
+	wiki := newWorkRepo(t)
+	wikiHead := commitFile(t, wiki, "Home.md", "# runbook")
+	srcDir := t.TempDir()
+	testGit(t, srcDir, "clone", "--bare", work, filepath.Join(srcDir, "org", "repo.git"))
+	testGit(t, srcDir, "clone", "--bare", wiki, filepath.Join(srcDir, "org", "repo.wiki.git"))
+
+	d := NewDownloader(context.Background())
+
+	destDir := t.TempDir()
+	if err := d.DownloadRepo(makeWikiRepo(srcDir, "org", "repo"), &destDir); err != nil {
+		t.Fatalf("DownloadRepo() error: %v", err)
+	}
+
+	wikiBundle := filepath.Join(destDir, "org", "repo.wiki.bundle")
+	if !Exists(wikiBundle) {
+		t.Fatal("wiki bundle was not created")
+	}
+	restored := filepath.Join(t.TempDir(), "wiki")
+	testGit(t, srcDir, "clone", wikiBundle, restored)
+	if got := testGit(t, restored, "rev-parse", "HEAD"); got != wikiHead {
+		t.Errorf("wiki bundle HEAD = %s, want %s", got, wikiHead)
+	}
+	if Exists(filepath.Join(destDir, "org", "repo.wiki.git")) {
+		t.Error("cloned wiki .git directory was not cleaned up")
+	}
+
+	refs, err := d.ListRefs(makeWikiRepo(srcDir, "org", "repo"))
+	if err != nil {
+		t.Fatalf("ListRefs() error: %v", err)
+	}
+	if refs[WikiRefPrefix+"refs/heads/main"] != wikiHead {
+		t.Errorf("ListRefs() = %v, want wiki main at %s", refs, wikiHead)
+	}
+}
+
+func TestDownloadRepo_WikiEnabledButMissing(t *testing.T) {
+	work := newWorkRepo(t)
+	srcDir := t.TempDir()
+	testGit(t, srcDir, "clone", "--bare", work, filepath.Join(srcDir, "org", "repo.git"))
+
+	d := NewDownloader(context.Background())
+
+	destDir := t.TempDir()
+	if err := d.DownloadRepo(makeWikiRepo(srcDir, "org", "repo"), &destDir); err != nil {
+		t.Fatalf("DownloadRepo() error: %v", err)
+	}
+	if !Exists(filepath.Join(destDir, "org", "repo.bundle")) {
+		t.Error("repo bundle was not created")
+	}
+	if Exists(filepath.Join(destDir, "org", "repo.wiki.bundle")) {
+		t.Error("wiki bundle created for a repo without a wiki")
+	}
+
+	refs, err := d.ListRefs(makeWikiRepo(srcDir, "org", "repo"))
+	if err != nil {
+		t.Fatalf("ListRefs() error: %v", err)
+	}
+	if len(refs) != 1 {
+		t.Errorf("ListRefs() = %v, want only the repo's main branch", refs)
+	}
+}
+
+// newGitHTTPServer serves the bare repos below root over smart http using git http-backend
+func newGitHTTPServer(t *testing.T, root string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(gitHTTPBackend(t, root))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// gitHTTPBackend returns a handler serving the git repositories below root over http
+func gitHTTPBackend(t *testing.T, root string) http.Handler {
+	t.Helper()
+	git, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not found in PATH")
+	}
+	return &cgi.Handler{
+		Path: git,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	}
+}
+
+func TestDownloadRepos_CredentialHelper(t *testing.T) {
+	work := newWorkRepo(t)
+	root := t.TempDir()
+	testGit(t, root, "clone", "--bare", work, filepath.Join(root, "org", "private.git"))
+
+	backend := gitHTTPBackend(t, root)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.String(), "ghp_") {
+			t.Errorf("request url %q contains the token", r.URL)
+		}
+		if user, password, ok := r.BasicAuth(); !ok || user != "x-access-token" || password != "ghp_correctcorrectcorrectcorrect" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	repo := &Repository{
+		Forge:       ForgeGitHub,
+		Owner:       "org",
+		Name:        "private",
+		CloneURL:    server.URL + "/org/private.git",
+		Credentials: &StaticCredentials{Username: "x-access-token", Password: "ghp_correctcorrectcorrectcorrect"},
+	}
+	d := NewDownloader(context.Background(), WithRetries(0, time.Millisecond))
+	destDir := t.TempDir()
+	if err := d.DownloadRepos([]*Repository{repo}, &destDir); err != nil {
+		t.Fatalf("DownloadRepos() error: %v", err)
+	}
+	if !Exists(filepath.Join(destDir, "org", "private.bundle")) {
+		t.Error("bundle was not created with credentials from the helper")
+	}
+
+	// the rejected token is kept out of the error
+	repo.Credentials = &StaticCredentials{Username: "x-access-token", Password: "ghp_wrongwrongwrongwrongwrong"}
+	err := d.DownloadRepos([]*Repository{repo}, &destDir)
+	if err == nil {
+		t.Fatal("expected error for rejected credentials")
+	}
+	if strings.Contains(err.Error(), "ghp_wrong") {
+		t.Errorf("error %q contains the token", err)
+	}
+}
+
+func TestDownloadRepo_GitHubEnterprise(t *testing.T) {
+	work := newWorkRepo(t)
+	root := t.TempDir()
+	testGit(t, root, "clone", "--bare", work, filepath.Join(root, "ghe", "org", "repo.git"))
+	testGit(t, root, "clone", "--bare", work, filepath.Join(root, "ghe", "gist", "abc123.git"))
+	gitServer := newGitHTTPServer(t, root)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v3/user/orgs", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `[]`)
+	})
+	mux.HandleFunc("/api/v3/user/repos", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `[{"name": "repo", "full_name": "org/repo", "owner": {"login": "org"}}]`)
+	})
+	mux.HandleFunc("/api/v3/repos/org/repo/contents/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `[]`)
+	})
+	mux.HandleFunc("/api/v3/gists", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `[{"id": "abc123"}]`)
+	})
+	apiServer := httptest.NewServer(mux)
+	defer apiServer.Close()
+
+	api, err := NewEnterpriseGitHubAPI(context.Background(), strPtr("token"), apiServer.URL+"/api/v3/", gitServer.URL+"/ghe/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repos, err := ListAllRepos(api, NewGistLister(api, false))
+	if err != nil {
+		t.Fatalf("ListAllRepos() error: %v", err)
+	}
+	if len(repos) != 2 {
+		t.Fatalf("expected a repo and a gist, got %v", repos)
+	}
+
+	d := NewDownloader(context.Background())
+	dest := t.TempDir()
+	for _, repo := range repos {
+		if !strings.HasPrefix(repo.CloneURL, gitServer.URL+"/ghe/") {
+			t.Errorf("CloneURL = %q, want a url on the enterprise server", repo.CloneURL)
+		}
+		if err := d.DownloadRepo(repo, &dest); err != nil {
+			t.Fatalf("DownloadRepo(%s) error: %v", repo.FullName(), err)
+		}
+		if !Exists(filepath.Join(dest, repo.FullName()+".bundle")) {
+			t.Errorf("bundle of %s was not created", repo.FullName())
+		}
+	}
+}
@@ -1,17 +1,27 @@
 package download
 
-import "github.com/google/go-github/github"
-
-// RepoLister abstracts GitHub API operations for listing and inspecting repos.
+// RepoLister abstracts listing the repos of a source, such as a GitHub account or a GitLab instance.
 type RepoLister interface {
-	GetOrgs() ([]*github.Organization, error)
-	GetRepos() ([]*github.Repository, error)
-	GetOrgRepos(org *github.Organization) ([]*github.Repository, error)
-	RemoveEmptyRepos(repos []*github.Repository) ([]*github.Repository, error)
-	GetLastCommits(repos []*github.Repository) ([]*string, error)
+	ListRepos() ([]*Repository, error)
+	// Host is the server the repos are listed from, such as github.com, or empty when they are named by hand
+	Host() string
+}
+
+// RefLister abstracts reading the current branches and tags of repos, used to detect which repos have changed.
+type RefLister interface {
+	GetRepoRefs(repos []*Repository) ([]RepoRefs, error)
 }
 
 // RepoDownloader abstracts downloading repos from a remote source.
 type RepoDownloader interface {
-	DownloadRepos(repos []*github.Repository, location *string) error
+	DownloadRepos(repos []*Repository, location *string) error
+}
+
+// RepoExporter abstracts writing additional data about a repo into its org folder, alongside the repo's bundle.
+type RepoExporter interface {
+	// Name identifies the exporter in repos.json
+	Name() string
+	ExportRepo(repo *Repository, orgFolder string) error
+	// ExportVersion returns a version which changes with the exported data of repo, or "" if it exports nothing for repo
+	ExportVersion(repo *Repository, previous string) (string, error)
 }
@@ -0,0 +1,532 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// JournalFile is the file in the backup location recording the rotation in progress
+const JournalFile = "rotation.journal"
+
+// rotationPhase is a step of a rotation, carried out in the order they are declared
+type rotationPhase string
+
+const (
+	// phaseMove copies the newly downloaded repos from the temp folder to the new generation
+	phaseMove rotationPhase = "move"
+	// phasePromote moves the files missing from each generation up from the older one
+	phasePromote rotationPhase = "promote"
+	// phasePrune merges away the generations the retention does not keep, and removes the repos kept by a retention
+	// of their own from the generations it does not reach
+	phasePrune rotationPhase = "prune"
+	// phaseThin stores the previous newest generation as thin bundles against the new generation
+	phaseThin rotationPhase = "thin"
+)
+
+// rotationJournal records a rotation of the generations before it is carried out, so it can be recovered
+type rotationJournal struct {
+	// Phase is the phase being carried out, every earlier phase having completed
+	Phase rotationPhase `json:"phase"`
+	// Generation is the name of the new generation
+	Generation string    `json:"generation"`
+	Retention  Retention `json:"retention"`
+	// Temp is the folder holding the new generation until it has been copied to the backup location
+	Temp string `json:"temp"`
+	// Repos are the full names of the repos in the new generation, which are forgotten when the rotation is rolled
+	// back so they are downloaded again
+	Repos []string `json:"repos"`
+	// Thinned are the full bundles of the previous newest generation before phaseThin, whose checksums are recorded
+	// again once they are thin
+	Thinned   []string  `json:"thinned,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	// Sealed holds Repos, Thinned and the repos of Retention encrypted to the recipients when the backups are
+	// encrypted, so the journal does not name the repos next to an encrypted repos.json
+	Sealed []byte `json:"sealed,omitempty"`
+
+	// encryption seals the names of the repos whenever the journal is saved
+	encryption *Encryption
+}
+
+// journalNames are the fields of the journal naming repos, which are sealed when the backups are encrypted
+type journalNames struct {
+	Repos      []string             `json:"repos"`
+	Thinned    []string             `json:"thinned,omitempty"`
+	Retentions map[string]Retention `json:"retentions,omitempty"`
+}
+
+// journalPath returns the path of the journal in the backup location
+func journalPath(location string) string {
+	return filepath.Join(location, JournalFile)
+}
+
+// loadJournal reads the journal of an interrupted rotation from location, returning nil when there is none
+func loadJournal(location string) (*rotationJournal, error) {
+	data, err := os.ReadFile(journalPath(location))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rotation journal due to error %w", err)
+	}
+	journal := &rotationJournal{}
+	err = json.Unmarshal(data, journal)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse rotation journal due to error %w", err)
+	}
+	return journal, nil
+}
+
+// unseal decrypts the names of the repos sealed in the journal, which later saves seal again
+func (j *rotationJournal) unseal(encryption *Encryption) error {
+	j.encryption = encryption
+	if len(j.Sealed) == 0 {
+		return nil
+	}
+	plaintext, err := encryption.decrypt(bytes.NewReader(j.Sealed))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt rotation journal due to error %w", err)
+	}
+	data, err := io.ReadAll(plaintext)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt rotation journal due to error %w", err)
+	}
+	names := journalNames{}
+	err = json.Unmarshal(data, &names)
+	if err != nil {
+		return fmt.Errorf("failed to parse rotation journal due to error %w", err)
+	}
+	j.Repos, j.Thinned, j.Retention.Repos, j.Sealed = names.Repos, names.Thinned, names.Retentions, nil
+	return nil
+}
+
+// save writes the journal to location, replacing the previous journal only once the new one is safely on disk
+func (j *rotationJournal) save(location string) error {
+	journal := *j
+	if j.encryption.Encrypts() {
+		names, err := json.Marshal(journalNames{Repos: j.Repos, Thinned: j.Thinned, Retentions: j.Retention.Repos})
+		if err != nil {
+			return fmt.Errorf("failed to marshal rotation journal due to error %w", err)
+		}
+		var sealed bytes.Buffer
+		err = j.encryption.encrypt(&sealed, bytes.NewReader(names))
+		if err != nil {
+			return fmt.Errorf("failed to encrypt rotation journal due to error %w", err)
+		}
+		journal.Repos, journal.Thinned, journal.Retention.Repos, journal.Sealed = nil, nil, nil, sealed.Bytes()
+	}
+	data, err := json.Marshal(&journal)
+	if err != nil {
+		return fmt.Errorf("failed to marshal rotation journal due to error %w", err)
+	}
+
+	// the backup location does not exist yet on the first run
+	err = os.MkdirAll(location, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create backup location due to error %w", err)
+	}
+	tmp := journalPath(location) + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to write rotation journal due to error %w", err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to write rotation journal due to error %w", err)
+	}
+
+	err = os.Rename(tmp, journalPath(location))
+	if err != nil {
+		return fmt.Errorf("failed to write rotation journal due to error %w", err)
+	}
+	return syncDir(location)
+}
+
+// syncDir flushes the entries of dir to disk, so renames within it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = d.Close() }()
+	return d.Sync()
+}
+
+// advance records that the rotation has reached phase
+func (j *rotationJournal) advance(location string, phase rotationPhase) error {
+	j.Phase = phase
+	return j.save(location)
+}
+
+// finish removes the journal once the rotation is complete
+func (j *rotationJournal) finish(location string) error {
+	err := os.Remove(journalPath(location))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove rotation journal due to error %w", err)
+	}
+	return nil
+}
+
+// run carries out the rotation from its current phase to the end, removing the journal from location once done
+func (j *rotationJournal) run(location string, storage Storage, encryption *Encryption) error {
+	if j.Phase == phaseMove {
+		// the temp folder is only removed once the journal records that the generation is complete
+		manifest, err := hashFolder(j.Temp)
+		if err != nil {
+			return err
+		}
+		files, err := manifestFiles(j.Temp)
+		if err != nil {
+			return fmt.Errorf("failed to list new repos due to error %w", err)
+		}
+		for _, rel := range files {
+			err = storage.Put(filepath.Join(j.Temp, filepath.FromSlash(rel)), j.Generation+"/"+rel)
+			if err != nil {
+				return fmt.Errorf("failed to move new repos to existing path due to error %w", err)
+			}
+		}
+		if err := manifest.save(storage, j.Generation); err != nil {
+			return err
+		}
+		if err := j.advance(location, phasePromote); err != nil {
+			return err
+		}
+		_ = os.RemoveAll(j.Temp)
+	}
+
+	if j.Phase == phasePromote {
+		if err := promoteGenerations(storage); err != nil {
+			return err
+		}
+		if err := updateManifests(storage); err != nil {
+			return fmt.Errorf("failed to update manifests due to error %w", err)
+		}
+		if err := j.advance(location, phasePrune); err != nil {
+			return err
+		}
+	}
+
+	if j.Phase == phasePrune {
+		_, err := pruneGenerations(storage, j.Retention, encryption)
+		if err != nil {
+			return err
+		}
+		err = pruneRepos(storage, j.Retention.Repos)
+		if err != nil {
+			return err
+		}
+
+		// the previous newest generation only holds full bundles, those also in the new generation are stored
+		// against it
+		j.Thinned, err = thinCandidates(storage)
+		if err != nil {
+			return err
+		}
+		if err := j.advance(location, phaseThin); err != nil {
+			return err
+		}
+	}
+
+	if j.Phase == phaseThin {
+		err := thinGeneration(context.Background(), storage, encryption, j.Thinned)
+		if err != nil {
+			return fmt.Errorf("failed to store the previous backup incrementally due to error %w", err)
+		}
+	}
+
+	return j.finish(location)
+}
+
+// syncStorage flushes the renames of a LocalStorage to disk
+func syncStorage(storage Storage) error {
+	local, ok := storage.(*LocalStorage)
+	if !ok {
+		return nil
+	}
+	if err := syncDir(local.root); err != nil {
+		return fmt.Errorf("failed to sync backup location due to error %w", err)
+	}
+	return nil
+}
+
+// rollback undoes a rotation which had not yet completed the new generation, removing it and forgetting the repos
+// it was adding so they are downloaded again
+func (j *rotationJournal) rollback(location string, storage Storage, encryption *Encryption) error {
+	err := storage.RemoveAll(j.Generation)
+	if err != nil {
+		return fmt.Errorf("failed to remove incomplete backup %s due to error %w", j.Generation, err)
+	}
+	if err := syncStorage(storage); err != nil {
+		return err
+	}
+
+	err = ForgetRepos(location, j.Repos, encryption)
+	if err != nil {
+		return err
+	}
+	return j.finish(location)
+}
+
+// RecoverRotation finishes or undoes a rotation of the generations that was interrupted, such as by a crash
+func RecoverRotation(location string, storage Storage, encryption *Encryption, interval time.Duration) error {
+	journal, err := loadJournal(location)
+	if err != nil {
+		return err
+	}
+	if journal != nil {
+		err = journal.unseal(encryption)
+		if err != nil {
+			return err
+		}
+	}
+	if local, ok := storage.(*LocalStorage); ok {
+		err = local.removeStaging()
+		if err != nil {
+			return err
+		}
+	}
+	err = migrateLegacyGenerations(storage, interval)
+	if err != nil || journal == nil {
+		return err
+	}
+
+	// the new generation can only be completed while the downloaded repos are still in the temp folder
+	rollForward := journal.Phase != phaseMove || Exists(journal.Temp)
+	if !rollForward {
+		fmt.Printf("Rolling back rotation interrupted during the %s phase\n", journal.Phase)
+		return journal.rollback(location, storage, encryption)
+	}
+
+	fmt.Printf("Rolling forward rotation interrupted during the %s phase\n", journal.Phase)
+	// a thin bundle being written when the rotation was interrupted is written again
+	if local, ok := storage.(*LocalStorage); ok {
+		generations, err := listGenerations(storage)
+		if err != nil {
+			return err
+		}
+		if len(generations) > 1 {
+			_ = filepath.WalkDir(local.path(generations[1]), func(path string, entry os.DirEntry, err error) error {
+				if err == nil && !entry.IsDir() && strings.HasSuffix(path, ".bundle.thin") {
+					_ = os.Remove(path)
+				}
+				return nil
+			})
+		}
+	}
+	return journal.run(location, storage, encryption)
+}
+
+// repoFiles returns the suffixes of every file backed up for a repo, next to its <name>.bundle
+var repoFiles = []string{".bundle", ".wiki.bundle", ".metadata.json", ".releases"}
+
+// pruneRepos removes each repo of retentions from the generations older than the oldest its retention keeps
+func pruneRepos(storage Storage, retentions map[string]Retention) error {
+	if len(retentions) == 0 {
+		return nil
+	}
+	generations, err := listGenerations(storage)
+	if err != nil {
+		return err
+	}
+	for fullName, retention := range retentions {
+		oldest := 0
+		for k, plan := range retention.Plan(generations) {
+			if plan.Keep() {
+				oldest = k
+			}
+		}
+		for _, generation := range generations[oldest+1:] {
+			for _, suffix := range repoFiles {
+				name := generation + "/" + fullName + suffix
+				exists, err := storage.Exists(name)
+				if err != nil {
+					return fmt.Errorf("failed to check %s due to error %w", name, err)
+				}
+				if !exists {
+					continue
+				}
+				fmt.Println("Pruning:", name)
+				err = storage.RemoveAll(name)
+				if err != nil {
+					return fmt.Errorf("failed to prune %s due to error %w", name, err)
+				}
+				err = forgetManifestFiles(storage, generation, fullName+suffix)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return syncStorage(storage)
+}
+
+// promotionUnit returns the path of the file or folder that is promoted as a whole to promote the file at rel
+func promotionUnit(rel string) string {
+	parts := strings.Split(rel, "/")
+	for i, part := range parts[:len(parts)-1] {
+		if strings.HasSuffix(part, ".releases") {
+			return strings.Join(parts[:i+1], "/")
+		}
+	}
+	return rel
+}
+
+// promoteGenerations moves every file of an older generation missing from the next newer one into the newer one
+func promoteGenerations(storage Storage) error {
+	generations, err := listGenerations(storage)
+	if err != nil {
+		return err
+	}
+	// if a file exists in the older backup, but not the newer backup, move it to the newer backup
+	for i := len(generations) - 1; i >= 1; i-- {
+		older, err := listFiles(storage, generations[i])
+		if err != nil {
+			return err
+		}
+		if len(older) == 0 {
+			continue
+		}
+		newer, err := listFiles(storage, generations[i-1])
+		if err != nil {
+			return err
+		}
+		present := make(map[string]bool, len(newer))
+		for _, rel := range newer {
+			present[promotionUnit(rel)] = true
+		}
+
+		for _, rel := range older {
+			unit := promotionUnit(rel)
+			if rel == ManifestFile || present[unit] {
+				continue
+			}
+			err = storage.Rename(generations[i]+"/"+unit, generations[i-1]+"/"+unit)
+			if err != nil {
+				return fmt.Errorf("failed to move files from backup %s to backup %s due to error %w", generations[i], generations[i-1], err)
+			}
+			present[unit] = true
+		}
+	}
+	return nil
+}
+
+// thinCandidates returns the bundles of the second newest generation which are also in the newest, relative to their
+// generation
+func thinCandidates(storage Storage) ([]string, error) {
+	generations, err := listGenerations(storage)
+	if err != nil || len(generations) < 2 {
+		return nil, err
+	}
+	older, err := listFiles(storage, generations[1])
+	if err != nil {
+		return nil, err
+	}
+	newer, err := listFiles(storage, generations[0])
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[string]bool, len(newer))
+	for _, rel := range newer {
+		present[rel] = true
+	}
+
+	candidates := make([]string, 0)
+	for _, rel := range older {
+		if strings.HasSuffix(rel, ".bundle") && present[rel] {
+			candidates = append(candidates, rel)
+		}
+	}
+	return candidates, nil
+}
+
+// thinGeneration replaces the bundles of the older generation with thin bundles, recording their checksums
+func thinGeneration(ctx context.Context, storage Storage, encryption *Encryption, bundles []string) error {
+	if len(bundles) == 0 {
+		return nil
+	}
+	generations, err := listGenerations(storage)
+	if err != nil {
+		return err
+	}
+	if len(generations) < 2 {
+		return fmt.Errorf("expected at least 2 generations to thin, found %d", len(generations))
+	}
+	olderName, newerName := generations[1], generations[0]
+	manifest, err := loadManifest(storage, olderName)
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		manifest = &Manifest{Files: make(map[string]ManifestEntry)}
+	}
+
+	scratch, err := os.MkdirTemp("", "gubber-thin-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(scratch) }()
+
+	for _, rel := range bundles {
+		older, err := fetchFile(storage, olderName+"/"+rel, scratch)
+		if err != nil {
+			return err
+		}
+		newer, err := fetchFile(storage, newerName+"/"+rel, scratch)
+		if err != nil {
+			return err
+		}
+
+		encrypted, err := isEncryptedFile(older)
+		if err != nil {
+			return err
+		}
+		if encrypted && !encryption.Encrypts() {
+			fmt.Println("Keeping full bundle:", olderName+"/"+rel, "as it is encrypted and there are no recipients to encrypt it again")
+			continue
+		}
+		thinned, err := encryption.decryptTo(older, scratch)
+		if err == nil {
+			newer, err = encryption.decryptTo(newer, scratch)
+		}
+		if err == nil {
+			err = ThinBundle(ctx, thinned, newer)
+		}
+		if err != nil {
+			fmt.Println("Keeping full bundle:", olderName+"/"+rel, "as it could not be stored incrementally due to error:", err)
+			continue
+		}
+		if thin, err := IsThinBundle(thinned); err != nil || !thin {
+			continue
+		}
+		if encrypted {
+			err = encryption.encryptFile(thinned)
+			if err != nil {
+				return err
+			}
+		}
+		if _, ok := storage.(*LocalStorage); !ok || thinned != older {
+			err = storage.Put(thinned, olderName+"/"+rel)
+			if err != nil {
+				return fmt.Errorf("failed to upload thin bundle %s due to error %w", rel, err)
+			}
+		}
+		manifest.Files[rel], err = hashFile(thinned)
+		if err != nil {
+			return fmt.Errorf("failed to hash %s due to error %w", rel, err)
+		}
+	}
+	return manifest.save(storage, olderName)
+}
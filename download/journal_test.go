@@ -0,0 +1,278 @@
+package download
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testInterval is the interval the test generations were backed up at
+const testInterval = 24 * time.Hour
+
+// testGeneration returns the name of a generation backed up n days before the newest generation of the tests
+func testGeneration(n int) string {
+	return GenerationName(time.Date(2024, 1, 31, 2, 0, 0, 0, time.UTC).AddDate(0, 0, -n))
+}
+
+// generationAt returns the name of the nth newest generation in location, or an empty string when there are fewer
+func generationAt(location string, n int) string {
+	generations, _ := ListGenerations(location)
+	if n >= len(generations) {
+		return ""
+	}
+	return generations[n]
+}
+
+// writeGenerations creates a generation for each of contents, newest first, holding org/repo.bundle with that content
+func writeGenerations(t *testing.T, location string, contents ...string) {
+	t.Helper()
+	for n, content := range contents {
+		path := BundlePath(location, "org/repo", testGeneration(n))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readGeneration returns the content of org/repo.bundle in the nth newest generation, or an empty string when it is
+// missing
+func readGeneration(location string, n int) string {
+	generation := generationAt(location, n)
+	if generation == "" {
+		return ""
+	}
+	data, _ := os.ReadFile(BundlePath(location, "org/repo", generation))
+	return string(data)
+}
+
+func TestMigrateRepos_RemovesJournal(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "backups")
+	tmpDir := t.TempDir()
+	writeGenerations(t, location, "old")
+
+	err := MigrateReposWithDownloader(&mockDownloader{}, []*Repository{makeRepo("org", "repo")}, &location, Retention{Last: 3}, &tmpDir)
+	if err != nil {
+		t.Fatalf("MigrateRepos() error: %v", err)
+	}
+	if Exists(journalPath(location)) {
+		t.Error("journal was left behind by a completed rotation")
+	}
+	if readGeneration(location, 0) != "fake-bundle-org/repo" || readGeneration(location, 1) != "old" {
+		t.Errorf("generations = %q, %q", readGeneration(location, 0), readGeneration(location, 1))
+	}
+	if newest, _ := GenerationTime(generationAt(location, 0)); time.Since(newest) > time.Minute {
+		t.Errorf("new generation %s is not named after the time it was backed up", generationAt(location, 0))
+	}
+}
+
+func TestNewGenerationName(t *testing.T) {
+	now := time.Date(2024, 1, 31, 2, 0, 0, 0, time.UTC)
+	if got := newGenerationName(nil, now); got != "2024-01-31T020000Z" {
+		t.Errorf("newGenerationName() = %q", got)
+	}
+	// a clock which went backwards still names the new generation after the newest one
+	if got := newGenerationName([]string{"2024-02-01T000000Z"}, now); got != "2024-02-01T000001Z" {
+		t.Errorf("newGenerationName() behind the newest generation = %q", got)
+	}
+}
+
+func TestRecoverRotation_RollsBackMoveWithoutTemp(t *testing.T) {
+	location := t.TempDir()
+	writeGenerations(t, location, "gen0")
+	if err := saveJsonRepos(location, JsonRepos{Repos: map[string]RepoRefs{"org/repo": {"refs/heads/main": "abc"}}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	journal := &rotationJournal{Phase: phaseMove, Generation: testGeneration(-1), Retention: Retention{Last: 5}, Temp: filepath.Join(t.TempDir(), "missing"), Repos: []string{"org/repo"}}
+	if err := journal.save(location); err != nil {
+		t.Fatal(err)
+	}
+	// the temp folder was lost along with the container, leaving a partial new generation
+	path := BundlePath(location, "org/repo", testGeneration(-1))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RecoverRotation(location, NewLocalStorage(location), nil, testInterval); err != nil {
+		t.Fatalf("RecoverRotation() error: %v", err)
+	}
+	if got := readGeneration(location, 0); got != "gen0" || generationAt(location, 1) != "" {
+		t.Errorf("newest generation = %q, want only the generation from before the rotation", got)
+	}
+	if Exists(journalPath(location)) {
+		t.Error("rollback left the journal behind")
+	}
+	// the repo was never backed up, so it is downloaded again on the next run
+	if _, ok := loadJsonRepos(location, nil).Repos["org/repo"]; ok {
+		t.Error("repo of the rolled back rotation is still recorded in repos.json")
+	}
+}
+
+func TestRecoverRotation_RollsBackSealedJournal(t *testing.T) {
+	encryption, _ := newTestEncryption(t)
+	location := t.TempDir()
+	writeGenerations(t, location, "gen0")
+	if err := saveJsonRepos(location, JsonRepos{Repos: map[string]RepoRefs{"org/secret": {"refs/heads/main": "abc"}}}, encryption); err != nil {
+		t.Fatal(err)
+	}
+
+	journal := &rotationJournal{Phase: phaseMove, Generation: testGeneration(-1), Retention: Retention{Repos: map[string]Retention{"org/quiet": {Last: 1}}}, Temp: filepath.Join(t.TempDir(), "missing"), Repos: []string{"org/secret"}, encryption: encryption}
+	if err := journal.save(location); err != nil {
+		t.Fatal(err)
+	}
+	// the journal names no repos, while still recording the phase of the rotation
+	data, err := os.ReadFile(journalPath(location))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "org/secret") || strings.Contains(string(data), "org/quiet") || !strings.Contains(string(data), `"phase":"move"`) {
+		t.Errorf("journal = %s, want the repos sealed", data)
+	}
+
+	if err := RecoverRotation(location, NewLocalStorage(location), encryption, testInterval); err != nil {
+		t.Fatalf("RecoverRotation() error: %v", err)
+	}
+	if _, ok := loadJsonRepos(location, encryption).Repos["org/secret"]; ok {
+		t.Error("repo of the sealed journal is still recorded in repos.json")
+	}
+}
+
+func TestRecoverRotation_RollsForwardMove(t *testing.T) {
+	location := t.TempDir()
+	writeGenerations(t, location, "gen0", "gen1")
+	temp := filepath.Join(t.TempDir(), "temp")
+	if err := os.MkdirAll(filepath.Join(temp, "org"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(temp, "org", "new.bundle"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	journal := &rotationJournal{Phase: phaseMove, Generation: testGeneration(-1), Retention: Retention{Last: 2}, Temp: temp}
+	if err := journal.save(location); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RecoverRotation(location, NewLocalStorage(location), nil, testInterval); err != nil {
+		t.Fatalf("RecoverRotation() error: %v", err)
+	}
+	if generationAt(location, 0) != testGeneration(-1) || !Exists(BundlePath(location, "org/new", testGeneration(-1))) {
+		t.Error("new repo was not copied to the new generation")
+	}
+	// org/repo is missing from the new generation, so the newest copy of it is promoted
+	if got := readGeneration(location, 0); got != "gen0" {
+		t.Errorf("newest org/repo = %q, want the promoted gen0", got)
+	}
+	if generationAt(location, 2) != "" {
+		t.Error("generations beyond the 2 backups were not pruned")
+	}
+	if Exists(journalPath(location)) || Exists(temp) {
+		t.Error("journal or temp folder left behind")
+	}
+}
+
+func TestRecoverRotation_RollsForwardPromote(t *testing.T) {
+	location := t.TempDir()
+	// the crash happened while promoting, after the new generation was complete
+	writeGenerations(t, location, "", "gen1")
+	if err := os.Remove(BundlePath(location, "org/repo", testGeneration(0))); err != nil {
+		t.Fatal(err)
+	}
+	journal := &rotationJournal{Phase: phasePromote, Generation: testGeneration(0), Retention: Retention{Last: 3}, Temp: filepath.Join(t.TempDir(), "gone")}
+	if err := journal.save(location); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RecoverRotation(location, NewLocalStorage(location), nil, testInterval); err != nil {
+		t.Fatalf("RecoverRotation() error: %v", err)
+	}
+	if got := readGeneration(location, 0); got != "gen1" {
+		t.Errorf("newest generation = %q, want the promoted bundle", got)
+	}
+	if Exists(journalPath(location)) {
+		t.Error("journal left behind")
+	}
+
+	// without a journal there is nothing to recover
+	if err := RecoverRotation(location, NewLocalStorage(location), nil, testInterval); err != nil {
+		t.Errorf("RecoverRotation() without a journal error: %v", err)
+	}
+}
+
+func TestRecoverRotation_RollsForwardPruneOfRepoRetentions(t *testing.T) {
+	location := t.TempDir()
+	// the crash happened while pruning the repo kept in a single generation from the older ones
+	writeGenerations(t, location, "gen0", "gen1", "gen2")
+	retention := Retention{Last: 5, Repos: map[string]Retention{"org/repo": {Last: 1}}}
+	journal := &rotationJournal{Phase: phasePrune, Generation: testGeneration(0), Retention: retention, Temp: filepath.Join(t.TempDir(), "gone")}
+	if err := journal.save(location); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RecoverRotation(location, NewLocalStorage(location), nil, testInterval); err != nil {
+		t.Fatalf("RecoverRotation() error: %v", err)
+	}
+	if readGeneration(location, 0) != "gen0" || readGeneration(location, 1) != "" || readGeneration(location, 2) != "" {
+		t.Errorf("generations = %q, %q, %q, want org/repo only in the newest generation", readGeneration(location, 0), readGeneration(location, 1), readGeneration(location, 2))
+	}
+}
+
+func TestMigrateRepos_PrunesRepoRetentions(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "backups")
+	tmpDir := t.TempDir()
+	retention := Retention{Last: 5, Repos: map[string]Retention{"org/repo": {Last: 1}}}
+
+	for i := 0; i < 2; i++ {
+		repos := []*Repository{makeRepo("org", "repo"), makeRepo("org", "other")}
+		if err := MigrateReposWithDownloader(&mockDownloader{}, repos, &location, retention, &tmpDir); err != nil {
+			t.Fatalf("MigrateRepos() run %d error: %v", i, err)
+		}
+	}
+	if generationAt(location, 1) == "" || Exists(BundlePath(location, "org/repo", generationAt(location, 1))) {
+		t.Error("org/repo was not pruned from the older generation by its own retention")
+	}
+	if !Exists(BundlePath(location, "org/other", generationAt(location, 1))) {
+		t.Error("org/other was pruned without a retention of its own")
+	}
+	verifyClean(t, location)
+}
+
+func TestRecoverRotation_RemovesInterruptedWrites(t *testing.T) {
+	location := t.TempDir()
+	writeGenerations(t, location, "gen0")
+	storage := NewLocalStorage(location)
+
+	// files are written outside of the generations, so a crash never leaves one inside a generation
+	src := filepath.Join(t.TempDir(), "new.bundle")
+	if err := os.WriteFile(src, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(src, testGeneration(0)+"/org/new.bundle"); err != nil {
+		t.Fatalf("Put() error: %v", err)
+	}
+	if files, _ := listFiles(storage, testGeneration(0)); strings.Join(files, " ") != "org/new.bundle org/repo.bundle" {
+		t.Errorf("generation holds %v, want only the bundles", files)
+	}
+
+	leftover := filepath.Join(location, stagingFolder, "put-123")
+	if err := os.WriteFile(leftover, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecoverRotation(location, storage, nil, testInterval); err != nil {
+		t.Fatalf("RecoverRotation() error: %v", err)
+	}
+	if Exists(filepath.Join(location, stagingFolder)) {
+		t.Error("interrupted write was left in the staging folder")
+	}
+	if generations, _ := ListGenerations(location); len(generations) != 1 {
+		t.Errorf("generations = %v, want the staging folder not taken for one", generations)
+	}
+}
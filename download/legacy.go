@@ -0,0 +1,103 @@
+package download
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LegacyGenerationPrefix is the prefix of the generation folders of older versions of gubber, which numbered them
+// T-0 for the newest and shifted each of them to the next number before adding a new one
+const LegacyGenerationPrefix = "T-"
+
+// legacyGenerationName returns the name of legacy generation n
+func legacyGenerationName(n int) string {
+	return LegacyGenerationPrefix + strconv.Itoa(n)
+}
+
+// listLegacyGenerations returns the numbers of the legacy generations present in the storage, newest first
+func listLegacyGenerations(storage Storage) ([]int, error) {
+	folders, err := storage.Folders("")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list generations due to error %w", err)
+	}
+	generations := make([]int, 0)
+	for _, folder := range folders {
+		if !strings.HasPrefix(folder, LegacyGenerationPrefix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(folder, LegacyGenerationPrefix))
+		if err != nil || n < 0 {
+			continue
+		}
+		generations = append(generations, n)
+	}
+	sort.Ints(generations)
+	return generations, nil
+}
+
+// legacyNewestTime returns the time the newest file of the legacy generation T-0 was written, when it is recorded
+func legacyNewestTime(storage Storage) (time.Time, bool) {
+	local, ok := storage.(*LocalStorage)
+	if !ok {
+		return time.Time{}, false
+	}
+	var newest time.Time
+	_ = filepath.WalkDir(local.path(legacyGenerationName(0)), func(path string, entry os.DirEntry, err error) error {
+		// the manifest is written again by every rotation
+		if err != nil || !entry.Type().IsRegular() || entry.Name() == ManifestFile {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil && info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		return nil
+	})
+	return newest, !newest.IsZero()
+}
+
+// migrateLegacyGenerations renames the legacy generations in storage to the time they were backed up
+func migrateLegacyGenerations(storage Storage, interval time.Duration) error {
+	legacy, err := listLegacyGenerations(storage)
+	if err != nil || len(legacy) == 0 {
+		return err
+	}
+	generations, err := listGenerations(storage)
+	if err != nil {
+		return err
+	}
+	if interval <= 0 {
+		interval = 24 * time.Hour
+	}
+
+	// T-anchor is dated at the time of anchor, and T-n (n-anchor) intervals before it
+	bound := time.Now()
+	anchor, anchorN := bound, 0
+	if len(generations) > 0 {
+		bound, _ = GenerationTime(generations[len(generations)-1])
+		anchor, anchorN = bound, legacy[0]-1
+	} else if at, ok := legacyNewestTime(storage); ok {
+		anchor = at
+	} else {
+		fmt.Println("Dating generation:", legacyGenerationName(0), "now as the storage does not record when it was backed up")
+	}
+	for _, n := range legacy {
+		at := anchor.Add(-time.Duration(n-anchorN) * interval)
+		if !at.Before(bound) {
+			at = bound.Add(-time.Second)
+		}
+
+		name := GenerationName(at)
+		fmt.Println("Renaming generation:", legacyGenerationName(n), "to", name)
+		err = storage.Rename(legacyGenerationName(n), name)
+		if err != nil {
+			return fmt.Errorf("failed to rename generation %s due to error %w", legacyGenerationName(n), err)
+		}
+		bound, _ = GenerationTime(name)
+	}
+	return syncStorage(storage)
+}
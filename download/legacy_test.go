@@ -0,0 +1,88 @@
+package download
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeLegacyGenerations creates a legacy generation T-n for each of contents, holding org/repo.bundle with that
+// content and written at the time of testGeneration(n)
+func writeLegacyGenerations(t *testing.T, location string, contents ...string) {
+	t.Helper()
+	for n, content := range contents {
+		path := BundlePath(location, "org/repo", legacyGenerationName(n))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		at, _ := GenerationTime(testGeneration(n))
+		if err := os.Chtimes(path, at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMigrateLegacyGenerations(t *testing.T) {
+	location := t.TempDir()
+	writeLegacyGenerations(t, location, "gen0", "gen1", "gen2")
+	storage := NewLocalStorage(location)
+
+	// the manifest is rewritten by every rotation, so does not date its generation
+	now := time.Now()
+	manifest := filepath.Join(GenerationPath(location, legacyGenerationName(0)), ManifestFile)
+	if err := os.WriteFile(manifest, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the files of older generations were promoted and rewritten since, so do not date them either
+	if err := os.Chtimes(BundlePath(location, "org/repo", legacyGenerationName(2)), now, now); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateLegacyGenerations(storage, 12*time.Hour); err != nil {
+		t.Fatalf("migrateLegacyGenerations() error: %v", err)
+	}
+	want := []string{testGeneration(0), testGenerationHour(0, -12), testGeneration(1)}
+	generations, err := ListGenerations(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(generations) != len(want) {
+		t.Fatalf("generations = %v, want %v", generations, want)
+	}
+	for n, name := range want {
+		if generations[n] != name {
+			t.Errorf("generation %d = %s, want %s", n, generations[n], name)
+		}
+		if got := readGeneration(location, n); got != []string{"gen0", "gen1", "gen2"}[n] {
+			t.Errorf("generation %d holds %q", n, got)
+		}
+	}
+	if legacy, _ := listLegacyGenerations(storage); len(legacy) != 0 {
+		t.Errorf("legacy generations %v were left behind", legacy)
+	}
+}
+
+func TestMigrateLegacyGenerations_Resumes(t *testing.T) {
+	location := t.TempDir()
+	writeLegacyGenerations(t, location, "gen0", "gen1", "gen2")
+	// the migration was interrupted after renaming T-0
+	if err := os.Rename(GenerationPath(location, legacyGenerationName(0)), GenerationPath(location, testGeneration(0))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateLegacyGenerations(NewLocalStorage(location), testInterval); err != nil {
+		t.Fatalf("migrateLegacyGenerations() error: %v", err)
+	}
+	generations, _ := ListGenerations(location)
+	if want := []string{testGeneration(0), testGeneration(1), testGeneration(2)}; strings.Join(generations, " ") != strings.Join(want, " ") {
+		t.Errorf("generations = %v, want %v", generations, want)
+	}
+	if readGeneration(location, 1) != "gen1" || readGeneration(location, 2) != "gen2" {
+		t.Errorf("generations = %q, %q, want T-1 and T-2 renamed to before the renamed T-0", readGeneration(location, 1), readGeneration(location, 2))
+	}
+}
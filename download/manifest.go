@@ -0,0 +1,365 @@
+package download
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ManifestFile is the file at the root of each generation recording the size and checksum of every file in it
+const ManifestFile = "manifest.json"
+
+// ManifestEntry records the content of a file when it was backed up
+type ManifestEntry struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Manifest maps the slash separated path of each file below its generation to the entry recorded for it
+type Manifest struct {
+	Files map[string]ManifestEntry `json:"files"`
+}
+
+// manifestPath returns the path of the manifest of the generation folder
+func manifestPath(generation string) string {
+	return filepath.Join(generation, ManifestFile)
+}
+
+// isManifest reports whether the path relative to a generation is its manifest
+func isManifest(rel string) bool {
+	return rel == ManifestFile
+}
+
+// loadManifest reads the manifest of the generation in storage, returning nil when it has none
+func loadManifest(storage Storage, generation string) (*Manifest, error) {
+	reader, err := storage.Open(generation + "/" + ManifestFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest of %s due to error %w", generation, err)
+	}
+	defer func() { _ = reader.Close() }()
+
+	manifest := &Manifest{}
+	err = json.NewDecoder(reader).Decode(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifest of %s due to error %w", generation, err)
+	}
+	if manifest.Files == nil {
+		manifest.Files = make(map[string]ManifestEntry)
+	}
+	return manifest, nil
+}
+
+// save writes the manifest to the generation in storage
+func (m *Manifest) save(storage Storage, generation string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest due to error %w", err)
+	}
+	tmp, err := os.CreateTemp("", "gubber-manifest-")
+	if err != nil {
+		return fmt.Errorf("failed to write manifest of %s due to error %w", generation, err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = storage.Put(tmp.Name(), generation+"/"+ManifestFile)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write manifest of %s due to error %w", generation, err)
+	}
+	return nil
+}
+
+// hashReader returns the size and sha256 checksum of the content of reader
+func hashReader(reader io.Reader) (ManifestEntry, error) {
+	hash := sha256.New()
+	size, err := io.Copy(hash, reader)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	return ManifestEntry{Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// hashStored returns the size and sha256 checksum of the file at name in storage
+func hashStored(storage Storage, name string) (ManifestEntry, error) {
+	reader, err := storage.Open(name)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	defer func() { _ = reader.Close() }()
+	return hashReader(reader)
+}
+
+// verifyStored returns the size and checksum of the file at name in storage, and whether it can be read
+func verifyStored(storage Storage, name string, encryption *Encryption) (ManifestEntry, bool, error) {
+	reader, err := storage.Open(name)
+	if err != nil {
+		return ManifestEntry{}, false, err
+	}
+	defer func() { _ = reader.Close() }()
+
+	hash := sha256.New()
+	counter := &countingWriter{}
+	content := bufio.NewReader(io.TeeReader(reader, io.MultiWriter(hash, counter)))
+	decrypts := true
+	if encryption.Decrypts() && isEncrypted(content) {
+		decrypts = encryption.checkDecrypts(content) == nil
+	}
+	// hash whatever decryption did not read, or all of it when there was nothing to decrypt
+	if _, err := io.Copy(io.Discard, content); err != nil {
+		return ManifestEntry{}, false, err
+	}
+	return ManifestEntry{Size: counter.n, SHA256: hex.EncodeToString(hash.Sum(nil))}, decrypts, nil
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// hashFile returns the size and sha256 checksum of the file at path
+func hashFile(path string) (ManifestEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	defer func() { _ = file.Close() }()
+	return hashReader(file)
+}
+
+// manifestFiles returns the slash separated paths of every regular file below the folder, other than its manifest
+func manifestFiles(folder string) ([]string, error) {
+	files := make([]string, 0)
+	err := filepath.WalkDir(folder, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(folder, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if isManifest(rel) {
+			return nil
+		}
+		files = append(files, rel)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// hashFolder returns a manifest of every file below the folder
+func hashFolder(folder string) (*Manifest, error) {
+	files, err := manifestFiles(folder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files of %s due to error %w", folder, err)
+	}
+	manifest := &Manifest{Files: make(map[string]ManifestEntry, len(files))}
+	for _, rel := range files {
+		entry, err := hashFile(filepath.Join(folder, filepath.FromSlash(rel)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash %s due to error %w", rel, err)
+		}
+		manifest.Files[rel] = entry
+	}
+	return manifest, nil
+}
+
+// updateManifests brings the manifest of every generation up to date after files were promoted
+func updateManifests(storage Storage) error {
+	generations, err := listGenerations(storage)
+	if err != nil {
+		return err
+	}
+
+	previous := make(map[string]*Manifest, len(generations))
+	present := make(map[string]map[string]bool, len(generations))
+	for _, generation := range generations {
+		manifest, err := loadManifest(storage, generation)
+		if err != nil {
+			return err
+		}
+		if manifest == nil {
+			manifest = &Manifest{Files: make(map[string]ManifestEntry)}
+		}
+		previous[generation] = manifest
+
+		files, err := listFiles(storage, generation)
+		if err != nil {
+			return err
+		}
+		present[generation] = make(map[string]bool, len(files))
+		for _, rel := range files {
+			if !isManifest(rel) {
+				present[generation][rel] = true
+			}
+		}
+	}
+
+	for k, generation := range generations {
+		updated := &Manifest{Files: make(map[string]ManifestEntry, len(present[generation]))}
+		for rel := range present[generation] {
+			// files are only ever promoted from older generations, so the newest entry recorded for the path is its own
+			found := false
+			for _, m := range generations[k:] {
+				if entry, ok := previous[m].Files[rel]; ok {
+					updated.Files[rel] = entry
+					found = true
+					break
+				}
+			}
+			if found {
+				continue
+			}
+			entry, err := hashStored(storage, generation+"/"+rel)
+			if err != nil {
+				return fmt.Errorf("failed to hash %s due to error %w", rel, err)
+			}
+			updated.Files[rel] = entry
+		}
+
+		for rel, entry := range previous[generation].Files {
+			if _, ok := updated.Files[rel]; ok || promotedTo(present, generations[:k], rel) {
+				continue
+			}
+			updated.Files[rel] = entry
+		}
+
+		err = updated.save(storage, generation)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// promotedTo reports whether the file at rel exists in any of the newer generations
+func promotedTo(present map[string]map[string]bool, newer []string, rel string) bool {
+	for _, generation := range newer {
+		if present[generation][rel] {
+			return true
+		}
+	}
+	return false
+}
+
+// forgetManifestFiles removes the entries of the file or folder at rel, and every file below it, from the manifest
+// of the generation in storage
+func forgetManifestFiles(storage Storage, generation string, rel string) error {
+	manifest, err := loadManifest(storage, generation)
+	if err != nil || manifest == nil {
+		return err
+	}
+	for path := range manifest.Files {
+		if path == rel || strings.HasPrefix(path, rel+"/") {
+			delete(manifest.Files, path)
+		}
+	}
+	return manifest.save(storage, generation)
+}
+
+// VerifyReport lists the files of a backup location which no longer match the manifests of their generations
+type VerifyReport struct {
+	// Checked is the number of files whose checksum was checked
+	Checked int
+	// Corrupt are the files whose size or checksum differs from their manifest
+	Corrupt []string
+	// Missing are the files recorded in a manifest which no longer exist
+	Missing []string
+	// Unrecorded are the files which are not in the manifest of their generation, and the generations which have no
+	// manifest at all, which are recorded by the next rotation
+	Unrecorded []string
+
+	// Undecryptable are the encrypted files which match their manifest but cannot be decrypted with the identities
+	// provided, and are only checked when there are identities
+	Undecryptable []string
+}
+
+// OK reports whether every file matched its manifest
+func (r *VerifyReport) OK() bool {
+	return len(r.Corrupt) == 0 && len(r.Missing) == 0 && len(r.Unrecorded) == 0 && len(r.Undecryptable) == 0
+}
+
+// Verify checks the size and checksum of every file in every generation against the manifest of its generation
+func Verify(storage Storage, encryption *Encryption) (*VerifyReport, error) {
+	generations, err := listGenerations(storage)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &VerifyReport{Corrupt: []string{}, Missing: []string{}, Unrecorded: []string{}, Undecryptable: []string{}}
+	for _, generation := range generations {
+		manifest, err := loadManifest(storage, generation)
+		if err != nil {
+			return nil, err
+		}
+		if manifest == nil {
+			report.Unrecorded = append(report.Unrecorded, generation)
+			continue
+		}
+
+		files, err := listFiles(storage, generation)
+		if err != nil {
+			return nil, err
+		}
+		present := make(map[string]bool, len(files))
+		for _, rel := range files {
+			if isManifest(rel) {
+				continue
+			}
+			present[rel] = true
+			recorded, ok := manifest.Files[rel]
+			if !ok {
+				report.Unrecorded = append(report.Unrecorded, generation+"/"+rel)
+				continue
+			}
+			report.Checked++
+			entry, decrypts, err := verifyStored(storage, generation+"/"+rel, encryption)
+			if err != nil || entry != recorded {
+				report.Corrupt = append(report.Corrupt, generation+"/"+rel)
+			} else if !decrypts {
+				report.Undecryptable = append(report.Undecryptable, generation+"/"+rel)
+			}
+		}
+
+		missing := make([]string, 0)
+		for rel := range manifest.Files {
+			if !present[rel] {
+				missing = append(missing, generation+"/"+rel)
+			}
+		}
+		sort.Strings(missing)
+		report.Missing = append(report.Missing, missing...)
+	}
+	return report, nil
+}
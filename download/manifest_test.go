@@ -0,0 +1,141 @@
+package download
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// verifyClean fails the test unless every file of the backup location matches its manifest
+func verifyClean(t *testing.T, location string) *VerifyReport {
+	t.Helper()
+	report, err := Verify(NewLocalStorage(location), nil)
+	if err != nil {
+		t.Fatalf("Verify() error: %v", err)
+	}
+	if !report.OK() {
+		t.Errorf("Verify() = %+v, want every file to match its manifest", report)
+	}
+	return report
+}
+
+func TestMigrateRepos_RecordsManifests(t *testing.T) {
+	location := newFsckLocation(t)
+
+	report := verifyClean(t, location)
+	// the bundles of org/repo and org/other in both generations
+	if report.Checked != 4 {
+		t.Errorf("Checked = %d, want 4", report.Checked)
+	}
+
+	// the older generation was thinned after the newest was copied, and records the checksum of the thin bundle
+	manifest, err := loadManifest(NewLocalStorage(location), generationAt(location, 1))
+	if err != nil || manifest == nil {
+		t.Fatalf("loadManifest() = %v, %v", manifest, err)
+	}
+	entry, err := hashFile(BundlePath(location, "org/repo", generationAt(location, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Files["org/repo.bundle"] != entry {
+		t.Errorf("older entry = %+v, want the thin bundle %+v", manifest.Files["org/repo.bundle"], entry)
+	}
+}
+
+func TestVerify_ReportsProblems(t *testing.T) {
+	location := newFsckLocation(t)
+
+	// flip a byte without changing the size, as bit rot would
+	data, err := os.ReadFile(BundlePath(location, "org/repo", generationAt(location, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(BundlePath(location, "org/repo", generationAt(location, 0)), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(BundlePath(location, "org/other", generationAt(location, 1))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(GenerationPath(location, generationAt(location, 0)), "org", "stray.bundle"), []byte("stray"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	unmanifested := BundlePath(location, "org/repo", testGeneration(0))
+	if err := os.MkdirAll(filepath.Dir(unmanifested), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(unmanifested, []byte("unmanifested"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Verify(NewLocalStorage(location), nil)
+	if err != nil {
+		t.Fatalf("Verify() error: %v", err)
+	}
+	// the files of the report are paths in the storage
+	newest, older := generationAt(location, 0), generationAt(location, 1)
+	corrupt, missing, stray := newest+"/org/repo.bundle", older+"/org/other.bundle", newest+"/org/stray.bundle"
+	if len(report.Corrupt) != 1 || report.Corrupt[0] != corrupt {
+		t.Errorf("Corrupt = %v, want %s", report.Corrupt, corrupt)
+	}
+	if len(report.Missing) != 1 || report.Missing[0] != missing {
+		t.Errorf("Missing = %v, want %s", report.Missing, missing)
+	}
+	if len(report.Unrecorded) != 2 || report.Unrecorded[0] != stray || report.Unrecorded[1] != testGeneration(0) {
+		t.Errorf("Unrecorded = %v, want %s and the generation without a manifest", report.Unrecorded, stray)
+	}
+	if report.OK() {
+		t.Error("OK() = true for a location with problems")
+	}
+}
+
+func TestMigrateRepos_ManifestsFollowPromotedFiles(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "backups")
+	tmpDir := t.TempDir()
+	dl := &mockDownloader{}
+
+	// a generation backed up before manifests were kept is hashed by the next rotation
+	writeGenerations(t, location, "legacy")
+	if err := MigrateReposWithDownloader(dl, []*Repository{makeRepo("org", "a"), makeRepo("org", "b")}, &location, Retention{Last: 5}, &tmpDir); err != nil {
+		t.Fatalf("MigrateRepos() error: %v", err)
+	}
+	verifyClean(t, location)
+
+	// a file lost from an older generation is still reported after the next rotation
+	if err := os.Remove(BundlePath(location, "org/a", generationAt(location, 0))); err != nil {
+		t.Fatal(err)
+	}
+	// org/b and org/repo are unchanged, so are promoted into the new generation along with their entries
+	if err := MigrateReposWithDownloader(dl, []*Repository{makeRepo("org", "c")}, &location, Retention{Last: 5}, &tmpDir); err != nil {
+		t.Fatalf("MigrateRepos() error: %v", err)
+	}
+	report, err := Verify(NewLocalStorage(location), nil)
+	if err != nil {
+		t.Fatalf("Verify() error: %v", err)
+	}
+	lost := generationAt(location, 1) + "/org/a.bundle"
+	if len(report.Missing) != 1 || report.Missing[0] != lost || len(report.Corrupt) != 0 || len(report.Unrecorded) != 0 {
+		t.Errorf("Verify() = %+v, want only %s missing", report, lost)
+	}
+	manifest, err := loadManifest(NewLocalStorage(location), generationAt(location, 0))
+	if err != nil || manifest == nil {
+		t.Fatalf("loadManifest() = %v, %v", manifest, err)
+	}
+	for _, rel := range []string{"org/b.bundle", "org/c.bundle", "org/repo.bundle"} {
+		if _, ok := manifest.Files[rel]; !ok {
+			t.Errorf("newest manifest is missing %s", rel)
+		}
+	}
+}
+
+func TestPruneRepos_UpdatesManifests(t *testing.T) {
+	location := newFsckLocation(t)
+
+	if err := pruneRepos(NewLocalStorage(location), map[string]Retention{"org/other": {Last: 1}}); err != nil {
+		t.Fatalf("pruneRepos() error: %v", err)
+	}
+	if Exists(BundlePath(location, "org/other", generationAt(location, 1))) {
+		t.Fatal("org/other was not pruned from the older generation")
+	}
+	verifyClean(t, location)
+}
@@ -0,0 +1,124 @@
+package download
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/google/go-github/github"
+)
+
+// RepoMetadata is everything about a repo that lives on GitHub rather than in its git history
+type RepoMetadata struct {
+	Issues         []*github.Issue              `json:"issues"`
+	IssueComments  []*github.IssueComment       `json:"issue_comments"`
+	PullRequests   []*github.PullRequest        `json:"pull_requests"`
+	ReviewComments []*github.PullRequestComment `json:"review_comments"`
+	Labels         []*github.Label              `json:"labels"`
+	Milestones     []*github.Milestone          `json:"milestones"`
+}
+
+// MetadataExporter writes the issues, pull requests, comments, labels and milestones of a repo to
+// <repo>.metadata.json next to its bundle
+type MetadataExporter struct{}
+
+func NewMetadataExporter() *MetadataExporter {
+	return &MetadataExporter{}
+}
+
+func (m *MetadataExporter) Name() string {
+	return "metadata"
+}
+
+// ExportVersion returns the etag of the most recently updated issue or pull request, which changes with any activity on them
+func (m *MetadataExporter) ExportVersion(repo *Repository, previous string) (string, error) {
+	if repo.Forge != ForgeGitHub || repo.github == nil {
+		return "", nil
+	}
+	url := fmt.Sprintf("repos/%s/%s/issues?state=all&sort=updated&direction=desc&per_page=1", repo.Owner, repo.Name)
+	version, err := repo.github.etag(url, previous)
+	if err != nil {
+		return "", fmt.Errorf("failed to check metadata of repo %s due to error %w", repo.FullName(), err)
+	}
+	return version, nil
+}
+
+// GetRepoMetadata fetches the metadata of a repo from the GitHub api which listed it
+func (m *MetadataExporter) GetRepoMetadata(repo *Repository) (*RepoMetadata, error) {
+	g := repo.github
+	owner := repo.Owner
+	name := repo.Name
+	metadata := &RepoMetadata{}
+	var err error
+
+	// the issues endpoint also returns pull requests, so it is queried even when issues are disabled
+	metadata.Issues, err = listAll(func(opts github.ListOptions) ([]*github.Issue, *github.Response, error) {
+		return g.client.Issues.ListByRepo(g.ctx, owner, name, &github.IssueListByRepoOptions{State: "all", ListOptions: opts})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get issues: %w", err)
+	}
+
+	// issue number 0 lists the comments of every issue in the repo
+	metadata.IssueComments, err = listAll(func(opts github.ListOptions) ([]*github.IssueComment, *github.Response, error) {
+		return g.client.Issues.ListComments(g.ctx, owner, name, 0, &github.IssueListCommentsOptions{ListOptions: opts})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get issue comments: %w", err)
+	}
+
+	metadata.PullRequests, err = listAll(func(opts github.ListOptions) ([]*github.PullRequest, *github.Response, error) {
+		return g.client.PullRequests.List(g.ctx, owner, name, &github.PullRequestListOptions{State: "all", ListOptions: opts})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pull requests: %w", err)
+	}
+
+	// pull request number 0 lists the review comments of every pull request in the repo
+	metadata.ReviewComments, err = listAll(func(opts github.ListOptions) ([]*github.PullRequestComment, *github.Response, error) {
+		return g.client.PullRequests.ListComments(g.ctx, owner, name, 0, &github.PullRequestListCommentsOptions{ListOptions: opts})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get review comments: %w", err)
+	}
+
+	metadata.Labels, err = listAll(func(opts github.ListOptions) ([]*github.Label, *github.Response, error) {
+		return g.client.Issues.ListLabels(g.ctx, owner, name, &opts)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get labels: %w", err)
+	}
+
+	metadata.Milestones, err = listAll(func(opts github.ListOptions) ([]*github.Milestone, *github.Response, error) {
+		return g.client.Issues.ListMilestones(g.ctx, owner, name, &github.MilestoneListOptions{State: "all", ListOptions: opts})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get milestones: %w", err)
+	}
+
+	return metadata, nil
+}
+
+// ExportRepo writes the metadata of a GitHub repo to <repo>.metadata.json in the org folder
+func (m *MetadataExporter) ExportRepo(repo *Repository, orgFolder string) error {
+	if repo.Forge != ForgeGitHub || repo.github == nil {
+		return nil
+	}
+	fmt.Println("Exporting metadata:", repo.FullName())
+	metadata, err := m.GetRepoMetadata(repo)
+	if err != nil {
+		return fmt.Errorf("failed to export metadata of repo %s due to error %w", repo.FullName(), err)
+	}
+
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata due to error %w", err)
+	}
+
+	err = os.WriteFile(filepath.Join(orgFolder, repo.Name+".metadata.json"), data, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write metadata due to error %w", err)
+	}
+	return nil
+}
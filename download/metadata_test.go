@@ -0,0 +1,140 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+// newTestGitHubAPI returns a GitHubAPI talking to a test server serving mux
+func newTestGitHubAPI(t *testing.T, mux *http.ServeMux) *GitHubAPI {
+	t.Helper()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	client := github.NewClient(nil)
+	client.BaseURL, _ = client.BaseURL.Parse(server.URL + "/")
+	return &GitHubAPI{ctx: context.Background(), client: client}
+}
+
+func TestMetadataExporter_ExportRepo(t *testing.T) {
+	mux := http.NewServeMux()
+	respond := func(path string, body string) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = fmt.Fprint(w, body)
+		})
+	}
+	mux.HandleFunc("/repos/org/repo/issues", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("state") != "all" {
+			t.Errorf("issues state = %q, want all", r.URL.Query().Get("state"))
+		}
+		// second page of issues, to check pagination is followed
+		if r.URL.Query().Get("page") == "2" {
+			_, _ = fmt.Fprint(w, `[{"number": 2, "title": "second"}]`)
+			return
+		}
+		w.Header().Set("Link", `<`+"http://"+r.Host+`/repos/org/repo/issues?page=2>; rel="next"`)
+		_, _ = fmt.Fprint(w, `[{"number": 1, "title": "first"}]`)
+	})
+	respond("/repos/org/repo/issues/comments", `[{"id": 10, "body": "a comment"}]`)
+	respond("/repos/org/repo/pulls", `[{"number": 3, "title": "a pr"}]`)
+	respond("/repos/org/repo/pulls/comments", `[{"id": 20, "body": "a review comment"}]`)
+	respond("/repos/org/repo/labels", `[{"name": "bug"}]`)
+	respond("/repos/org/repo/milestones", `[{"number": 1, "title": "v1"}]`)
+
+	repo := makeRepo("org", "repo")
+	repo.github = newTestGitHubAPI(t, mux)
+	exporter := NewMetadataExporter()
+	orgFolder := t.TempDir()
+	if err := exporter.ExportRepo(repo, orgFolder); err != nil {
+		t.Fatalf("ExportRepo() error: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(orgFolder, "repo.metadata.json"))
+	if err != nil {
+		t.Fatalf("metadata not written: %v", err)
+	}
+	var metadata RepoMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		t.Fatalf("metadata is not valid JSON: %v", err)
+	}
+
+	if len(metadata.Issues) != 2 {
+		t.Errorf("expected 2 issues across both pages, got %d", len(metadata.Issues))
+	}
+	if len(metadata.IssueComments) != 1 || metadata.IssueComments[0].GetBody() != "a comment" {
+		t.Errorf("unexpected issue comments %v", metadata.IssueComments)
+	}
+	if len(metadata.PullRequests) != 1 || metadata.PullRequests[0].GetTitle() != "a pr" {
+		t.Errorf("unexpected pull requests %v", metadata.PullRequests)
+	}
+	if len(metadata.ReviewComments) != 1 {
+		t.Errorf("expected 1 review comment, got %d", len(metadata.ReviewComments))
+	}
+	if len(metadata.Labels) != 1 || metadata.Labels[0].GetName() != "bug" {
+		t.Errorf("unexpected labels %v", metadata.Labels)
+	}
+	if len(metadata.Milestones) != 1 {
+		t.Errorf("expected 1 milestone, got %d", len(metadata.Milestones))
+	}
+}
+
+func TestMetadataExporter_APIError(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/org/repo/issues", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	repo := makeRepo("org", "repo")
+	repo.github = newTestGitHubAPI(t, mux)
+	exporter := NewMetadataExporter()
+	orgFolder := t.TempDir()
+	if err := exporter.ExportRepo(repo, orgFolder); err == nil {
+		t.Fatal("expected error when the API fails")
+	}
+	if Exists(filepath.Join(orgFolder, "repo.metadata.json")) {
+		t.Error("metadata should not be written when the API fails")
+	}
+}
+
+func TestMetadataExporter_ExportVersion(t *testing.T) {
+	notModified := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/org/repo/issues", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("sort") != "updated" || r.URL.Query().Get("per_page") != "1" {
+			t.Errorf("issues query = %q, want only the most recently updated issue", r.URL.RawQuery)
+		}
+		if r.Header.Get("If-None-Match") == `"abc"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"abc"`)
+		_, _ = fmt.Fprint(w, `[{"number": 1, "title": "first"}]`)
+	})
+
+	repo := makeRepo("org", "repo")
+	repo.github = newTestGitHubAPI(t, mux)
+	exporter := NewMetadataExporter()
+	version, err := exporter.ExportVersion(repo, "")
+	if err != nil || version != `"abc"` {
+		t.Fatalf("ExportVersion() = %q, %v, want the etag of the issues", version, err)
+	}
+
+	// the etag is sent back, and the unchanged issues are answered with a 304
+	version, err = exporter.ExportVersion(repo, version)
+	if err != nil || version != `"abc"` {
+		t.Errorf("ExportVersion() = %q, %v, want the previous etag", version, err)
+	}
+	if notModified != 1 {
+		t.Errorf("304 responses = %d, want 1", notModified)
+	}
+}
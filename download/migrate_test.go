@@ -1,27 +1,26 @@
 package download
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
-
-	"github.com/google/go-github/github"
 )
 
 // mockDownloader creates fake bundle files in the download location to simulate DownloadRepos.
 type mockDownloader struct {
-	repos []*github.Repository
+	repos []*Repository
 }
 
-func (m *mockDownloader) DownloadRepos(repos []*github.Repository, location *string) error {
+func (m *mockDownloader) DownloadRepos(repos []*Repository, location *string) error {
 	m.repos = repos
 	for _, repo := range repos {
-		orgDir := filepath.Join(*location, repo.GetOwner().GetLogin())
+		orgDir := filepath.Join(*location, repo.Owner)
 		if err := os.MkdirAll(orgDir, 0755); err != nil {
 			return err
 		}
-		bundlePath := filepath.Join(orgDir, repo.GetName()+".bundle")
-		if err := os.WriteFile(bundlePath, []byte("fake-bundle-"+repo.GetFullName()), 0644); err != nil {
+		bundlePath := filepath.Join(orgDir, repo.Name+".bundle")
+		if err := os.WriteFile(bundlePath, []byte("fake-bundle-"+repo.FullName()), 0644); err != nil {
 			return err
 		}
 	}
@@ -30,13 +29,15 @@ func (m *mockDownloader) DownloadRepos(repos []*github.Repository, location *str
 
 func strPtr(s string) *string { return &s }
 
-func makeRepo(owner, name string) *github.Repository {
-	fullName := owner + "/" + name
-	return &github.Repository{
-		Name:     &name,
-		FullName: &fullName,
-		Owner:    &github.User{Login: &owner},
-	}
+func makeRepo(owner, name string) *Repository {
+	return &Repository{Forge: ForgeGitHub, Owner: owner, Name: name}
+}
+
+// makeLocalRepo returns a repo cloned from the bare repo srcDir/owner/name.git
+func makeLocalRepo(srcDir, owner, name string) *Repository {
+	repo := makeRepo(owner, name)
+	repo.CloneURL = filepath.Join(srcDir, owner, name+".git")
+	return repo
 }
 
 func TestMigrateRepos_FirstRun(t *testing.T) {
@@ -47,16 +48,16 @@ func TestMigrateRepos_FirstRun(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	repos := []*github.Repository{makeRepo("org1", "repo1")}
+	repos := []*Repository{makeRepo("org1", "repo1")}
 	dl := &mockDownloader{}
 
-	err := MigrateReposWithDownloader(dl, repos, &existingPath, 3, &tmpDir)
+	err := MigrateReposWithDownloader(dl, repos, &existingPath, Retention{Last: 3}, &tmpDir)
 	if err != nil {
 		t.Fatalf("MigrateRepos() error: %v", err)
 	}
 
-	// T-0 should exist with the bundle
-	bundlePath := filepath.Join(existingPath, "T-0", "org1", "repo1.bundle")
+	// the new generation should exist with the bundle
+	bundlePath := filepath.Join(existingPath, generationAt(existingPath, 0), "org1", "repo1.bundle")
 	if !Exists(bundlePath) {
 		t.Errorf("expected bundle at %s", bundlePath)
 	}
@@ -72,8 +73,8 @@ func TestMigrateRepos_RotatesBackups(t *testing.T) {
 	tmpDir := t.TempDir()
 	existingPath := filepath.Join(baseDir, "backups")
 
-	// Pre-create T-0 with an existing bundle
-	t0OrgDir := filepath.Join(existingPath, "T-0", "org1")
+	// Pre-create a generation with an existing bundle
+	t0OrgDir := filepath.Join(existingPath, testGeneration(0), "org1")
 	if err := os.MkdirAll(t0OrgDir, 0755); err != nil {
 		t.Fatal(err)
 	}
@@ -81,24 +82,24 @@ func TestMigrateRepos_RotatesBackups(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	repos := []*github.Repository{makeRepo("org1", "repo1")}
+	repos := []*Repository{makeRepo("org1", "repo1")}
 	dl := &mockDownloader{}
 
-	err := MigrateReposWithDownloader(dl, repos, &existingPath, 3, &tmpDir)
+	err := MigrateReposWithDownloader(dl, repos, &existingPath, Retention{Last: 3}, &tmpDir)
 	if err != nil {
 		t.Fatalf("MigrateRepos() error: %v", err)
 	}
 
-	// New T-0 should have the new bundle
-	newBundle := filepath.Join(existingPath, "T-0", "org1", "repo1.bundle")
+	// The new generation should have the new bundle
+	newBundle := filepath.Join(existingPath, generationAt(existingPath, 0), "org1", "repo1.bundle")
 	if !Exists(newBundle) {
-		t.Error("new bundle not at T-0")
+		t.Error("new bundle not in the new generation")
 	}
 
-	// old.bundle should be promoted from T-1 to T-0 (since it's missing from T-0)
-	promotedBundle := filepath.Join(existingPath, "T-0", "org1", "old.bundle")
+	// old.bundle should be promoted into the new generation (since it's missing from it)
+	promotedBundle := filepath.Join(existingPath, generationAt(existingPath, 0), "org1", "old.bundle")
 	if !Exists(promotedBundle) {
-		t.Error("old.bundle not promoted from T-1 to T-0")
+		t.Error("old.bundle not promoted into the new generation")
 	}
 }
 
@@ -107,8 +108,8 @@ func TestMigrateRepos_PromotesMissingFiles(t *testing.T) {
 	tmpDir := t.TempDir()
 	existingPath := filepath.Join(baseDir, "backups")
 
-	// Pre-create T-0 with repo_old (will become T-1 after rotation)
-	t0OrgDir := filepath.Join(existingPath, "T-0", "org1")
+	// Pre-create a generation with repo_old (will become the older generation after rotation)
+	t0OrgDir := filepath.Join(existingPath, testGeneration(0), "org1")
 	if err := os.MkdirAll(t0OrgDir, 0755); err != nil {
 		t.Fatal(err)
 	}
@@ -116,25 +117,59 @@ func TestMigrateRepos_PromotesMissingFiles(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// New download only has repo_new — repo_old should be promoted from T-1 to T-0
-	repos := []*github.Repository{makeRepo("org1", "repo_new")}
+	// New download only has repo_new — repo_old should be promoted into the new generation
+	repos := []*Repository{makeRepo("org1", "repo_new")}
 	dl := &mockDownloader{}
 
-	err := MigrateReposWithDownloader(dl, repos, &existingPath, 3, &tmpDir)
+	err := MigrateReposWithDownloader(dl, repos, &existingPath, Retention{Last: 3}, &tmpDir)
 	if err != nil {
 		t.Fatalf("MigrateRepos() error: %v", err)
 	}
 
-	// repo_old should be promoted to T-0 from T-1
-	promoted := filepath.Join(existingPath, "T-0", "org1", "repo_old.bundle")
+	// repo_old should be promoted into the new generation
+	promoted := filepath.Join(existingPath, generationAt(existingPath, 0), "org1", "repo_old.bundle")
 	if !Exists(promoted) {
-		t.Error("repo_old.bundle was not promoted from T-1 to T-0")
+		t.Error("repo_old.bundle was not promoted into the new generation")
 	}
 
-	// repo_new should be in T-0
-	newBundle := filepath.Join(existingPath, "T-0", "org1", "repo_new.bundle")
+	// repo_new should be in the new generation
+	newBundle := filepath.Join(existingPath, generationAt(existingPath, 0), "org1", "repo_new.bundle")
 	if !Exists(newBundle) {
-		t.Error("repo_new.bundle not at T-0")
+		t.Error("repo_new.bundle not in the new generation")
+	}
+}
+
+func TestMigrateRepos_PromotesNestedGroups(t *testing.T) {
+	baseDir := t.TempDir()
+	tmpDir := t.TempDir()
+	existingPath := filepath.Join(baseDir, "backups")
+
+	// Pre-create a generation with a project in a subgroup (will become the older generation after rotation)
+	t0SubDir := filepath.Join(existingPath, testGeneration(0), "group", "sub")
+	if err := os.MkdirAll(t0SubDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(t0SubDir, "old.bundle"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// New download has another project in the same subgroup — old should still be promoted
+	repos := []*Repository{makeRepo("group/sub", "new")}
+	dl := &mockDownloader{}
+
+	err := MigrateReposWithDownloader(dl, repos, &existingPath, Retention{Last: 3}, &tmpDir)
+	if err != nil {
+		t.Fatalf("MigrateRepos() error: %v", err)
+	}
+
+	if !Exists(filepath.Join(existingPath, generationAt(existingPath, 0), "group", "sub", "old.bundle")) {
+		t.Error("old.bundle was not promoted into the new generation")
+	}
+	if !Exists(filepath.Join(existingPath, generationAt(existingPath, 0), "group", "sub", "new.bundle")) {
+		t.Error("new.bundle not in the new generation")
+	}
+	if Exists(filepath.Join(existingPath, generationAt(existingPath, 1), "group")) {
+		t.Error("empty group folder left behind in the older generation")
 	}
 }
 
@@ -144,9 +179,9 @@ func TestMigrateRepos_DeletesOldestBackup(t *testing.T) {
 	existingPath := filepath.Join(baseDir, "backups")
 	backupsLimit := 2
 
-	// Pre-create T-0 and T-1 (at limit)
+	// Pre-create two generations (at limit)
 	for i := 0; i < backupsLimit; i++ {
-		dir := filepath.Join(existingPath, "T-"+string(rune('0'+i)), "org1")
+		dir := filepath.Join(existingPath, testGeneration(i), "org1")
 		if err := os.MkdirAll(dir, 0755); err != nil {
 			t.Fatal(err)
 		}
@@ -155,18 +190,20 @@ func TestMigrateRepos_DeletesOldestBackup(t *testing.T) {
 		}
 	}
 
-	repos := []*github.Repository{makeRepo("org1", "repo_new")}
+	repos := []*Repository{makeRepo("org1", "repo_new")}
 	dl := &mockDownloader{}
 
-	err := MigrateReposWithDownloader(dl, repos, &existingPath, backupsLimit, &tmpDir)
+	err := MigrateReposWithDownloader(dl, repos, &existingPath, Retention{Last: backupsLimit}, &tmpDir)
 	if err != nil {
 		t.Fatalf("MigrateRepos() error: %v", err)
 	}
 
-	// T-{backupsLimit} should be deleted
-	oldest := filepath.Join(existingPath, "T-2")
-	if Exists(oldest) {
-		t.Errorf("T-%d should have been deleted", backupsLimit)
+	// the oldest generation should be deleted
+	if Exists(filepath.Join(existingPath, testGeneration(backupsLimit-1))) {
+		t.Errorf("%s should have been deleted", testGeneration(backupsLimit-1))
+	}
+	if generations, _ := ListGenerations(existingPath); len(generations) != backupsLimit {
+		t.Errorf("generations = %v, want %d", generations, backupsLimit)
 	}
 }
 
@@ -175,8 +212,8 @@ func TestMigrateRepos_CleansEmptyOrgDirs(t *testing.T) {
 	tmpDir := t.TempDir()
 	existingPath := filepath.Join(baseDir, "backups")
 
-	// Pre-create T-0 with org_old/only_repo.bundle (will become T-1 after rotation)
-	t0OrgDir := filepath.Join(existingPath, "T-0", "org_old")
+	// Pre-create a generation with org_old/only_repo.bundle (will become the older generation after rotation)
+	t0OrgDir := filepath.Join(existingPath, testGeneration(0), "org_old")
 	if err := os.MkdirAll(t0OrgDir, 0755); err != nil {
 		t.Fatal(err)
 	}
@@ -185,30 +222,104 @@ func TestMigrateRepos_CleansEmptyOrgDirs(t *testing.T) {
 	}
 
 	// Download a repo under a different org — only_repo.bundle will be promoted
-	// from T-1/org_old/ to T-0/org_old/, leaving T-1/org_old/ empty
-	repos := []*github.Repository{makeRepo("org_new", "repo_new")}
+	// from org_old/ in the older generation to the new generation, leaving org_old/ in the older generation empty
+	repos := []*Repository{makeRepo("org_new", "repo_new")}
 	dl := &mockDownloader{}
 
-	err := MigrateReposWithDownloader(dl, repos, &existingPath, 3, &tmpDir)
+	err := MigrateReposWithDownloader(dl, repos, &existingPath, Retention{Last: 3}, &tmpDir)
 	if err != nil {
 		t.Fatalf("MigrateRepos() error: %v", err)
 	}
 
-	// only_repo.bundle should have been promoted from T-1 to T-0
-	promoted := filepath.Join(existingPath, "T-0", "org_old", "only_repo.bundle")
+	// only_repo.bundle should have been promoted into the new generation
+	promoted := filepath.Join(existingPath, generationAt(existingPath, 0), "org_old", "only_repo.bundle")
 	if !Exists(promoted) {
-		t.Error("org_old/only_repo.bundle was not promoted to T-0")
+		t.Error("org_old/only_repo.bundle was not promoted to the new generation")
 	}
 
-	// The newly downloaded repo should be in T-0
-	newBundle := filepath.Join(existingPath, "T-0", "org_new", "repo_new.bundle")
+	// The newly downloaded repo should be in the new generation
+	newBundle := filepath.Join(existingPath, generationAt(existingPath, 0), "org_new", "repo_new.bundle")
 	if !Exists(newBundle) {
-		t.Error("org_new/repo_new.bundle not found in T-0")
+		t.Error("org_new/repo_new.bundle not found in the new generation")
 	}
 
-	// T-1/org_old/ should have been cleaned up because it is now empty
-	t1OrgOld := filepath.Join(existingPath, "T-1", "org_old")
+	// org_old/ in the older generation should have been cleaned up because it is now empty
+	t1OrgOld := filepath.Join(existingPath, generationAt(existingPath, 1), "org_old")
 	if Exists(t1OrgOld) {
-		t.Error("T-1/org_old/ should have been removed after promotion left it empty")
+		t.Error("org_old/ in the older generation should have been removed after promotion left it empty")
+	}
+}
+
+// failingDownloader downloads every repo except those listed in fail, reporting them in a *DownloadError
+type failingDownloader struct {
+	mockDownloader
+	fail map[string]bool
+}
+
+func (f *failingDownloader) DownloadRepos(repos []*Repository, location *string) error {
+	ok := make([]*Repository, 0)
+	failed := make(map[string]error)
+	for _, repo := range repos {
+		if f.fail[repo.FullName()] {
+			failed[repo.FullName()] = errors.New("clone failed")
+		} else {
+			ok = append(ok, repo)
+		}
+	}
+	if err := f.mockDownloader.DownloadRepos(ok, location); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return &DownloadError{Failed: failed}
+	}
+	return nil
+}
+
+func TestMigrateRepos_PartialDownloadFailure(t *testing.T) {
+	existingPath := filepath.Join(t.TempDir(), "backups")
+	tmpDir := t.TempDir()
+
+	if err := os.MkdirAll(existingPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	repos := []*Repository{makeRepo("org1", "bad"), makeRepo("org1", "good")}
+	lister := &mockRefLister{refs: []RepoRefs{mainAt("aaa"), mainAt("bbb")}}
+	changed, err := RemoveUnchangedRepos(lister, existingPath, repos, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl := &failingDownloader{fail: map[string]bool{"org1/bad": true}}
+
+	err = MigrateReposWithDownloader(dl, changed, &existingPath, Retention{Last: 3}, &tmpDir)
+	var downloadErr *DownloadError
+	if !errors.As(err, &downloadErr) {
+		t.Fatalf("expected *DownloadError, got %v", err)
+	}
+
+	if !Exists(filepath.Join(existingPath, generationAt(existingPath, 0), "org1", "good.bundle")) {
+		t.Error("good.bundle was not migrated after another repo failed")
+	}
+
+	// only the refs of the repo which was backed up are recorded, so the failed repo is downloaded again
+	recorded := loadJsonRepos(existingPath, nil).Repos
+	if _, ok := recorded["org1/bad"]; ok || recorded["org1/good"] == nil {
+		t.Errorf("repos.json = %v, want only org1/good", recorded)
+	}
+}
+
+func TestMigrateRepos_AllDownloadsFail(t *testing.T) {
+	existingPath := filepath.Join(t.TempDir(), "backups")
+	tmpDir := t.TempDir()
+
+	repos := []*Repository{makeRepo("org1", "bad")}
+	dl := &failingDownloader{fail: map[string]bool{"org1/bad": true}}
+
+	err := MigrateReposWithDownloader(dl, repos, &existingPath, Retention{Last: 3}, &tmpDir)
+	if err == nil {
+		t.Fatal("expected error when every download fails")
+	}
+	if generationAt(existingPath, 0) != "" {
+		t.Error("no generation should be created when every download fails")
 	}
 }
@@ -0,0 +1,103 @@
+package download
+
+import (
+	"fmt"
+	"path"
+)
+
+// Override changes how the repos whose full name matches a glob are backed up
+type Override struct {
+	// Match is a path.Match glob matched against the owner and name, and the full name, of each repo, such as acme/*
+	Match string
+	// Skip leaves matching repos out of the backup
+	Skip bool
+	// Backups keeps matching repos in at most this many generations, and is 0 to keep them in all of them
+	Backups int
+	// ExportMetadata turns the metadata export on or off for matching repos, and is nil to leave it as configured
+	ExportMetadata *bool
+}
+
+// Overrides are applied in order, so the settings of later overrides take precedence over earlier ones
+type Overrides []Override
+
+// matches reports whether the glob of the override matches repo
+func (o Override) matches(repo *Repository) bool {
+	if matched, _ := path.Match(o.Match, repo.Owner+"/"+repo.Name); matched {
+		return true
+	}
+	matched, _ := path.Match(o.Match, repo.FullName())
+	return matched
+}
+
+// Resolve returns the combined settings of every override matching repo
+func (o Overrides) Resolve(repo *Repository) Override {
+	resolved := Override{Match: repo.FullName()}
+	for _, override := range o {
+		if !override.matches(repo) {
+			continue
+		}
+		if override.Skip {
+			resolved.Skip = true
+		}
+		if override.Backups > 0 {
+			resolved.Backups = override.Backups
+		}
+		if override.ExportMetadata != nil {
+			resolved.ExportMetadata = override.ExportMetadata
+		}
+	}
+	return resolved
+}
+
+// Filter returns the repos which are not skipped by an override
+func (o Overrides) Filter(repos []*Repository) []*Repository {
+	filtered := make([]*Repository, 0, len(repos))
+	for _, repo := range repos {
+		if o.Resolve(repo).Skip {
+			fmt.Println("Skipping:", repo.FullName())
+			continue
+		}
+		filtered = append(filtered, repo)
+	}
+	return filtered
+}
+
+// WithOverrides applies the metadata export setting of overrides to the repos they match
+func WithOverrides(overrides Overrides) DownloaderOption {
+	return func(d *Downloader) {
+		d.overrides = overrides
+	}
+}
+
+// repoExporters returns the exporters to run for repo, adding or removing the metadata exporter as its overrides
+// require
+func (d *Downloader) repoExporters(repo *Repository) []RepoExporter {
+	exportMetadata := d.overrides.Resolve(repo).ExportMetadata
+	if exportMetadata == nil {
+		return d.exporters
+	}
+
+	exporters := make([]RepoExporter, 0, len(d.exporters)+1)
+	for _, exporter := range d.exporters {
+		if _, ok := exporter.(*MetadataExporter); !ok {
+			exporters = append(exporters, exporter)
+		}
+	}
+	if *exportMetadata {
+		exporters = append(exporters, NewMetadataExporter())
+	}
+	return exporters
+}
+
+// RepoRetentions returns the retentions of the repos kept in fewer generations than the others, by full name
+func (o Overrides) RepoRetentions(repos []*Repository, starred Retention) map[string]Retention {
+	retentions := make(map[string]Retention)
+	for _, repo := range repos {
+		if backups := o.Resolve(repo).Backups; backups > 0 {
+			retentions[repo.FullName()] = Retention{Last: backups}
+		} else if IsStarred(repo) && !starred.IsZero() {
+			retentions[repo.FullName()] = starred
+		}
+	}
+	return retentions
+}
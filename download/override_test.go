@@ -0,0 +1,183 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOverrides_Resolve(t *testing.T) {
+	off := false
+	on := true
+	overrides := Overrides{
+		{Match: "acme/*", Backups: 3, ExportMetadata: &on},
+		{Match: "acme/huge", Skip: true, ExportMetadata: &off},
+	}
+
+	huge := overrides.Resolve(makeRepo("acme", "huge"))
+	if !huge.Skip || huge.Backups != 3 || *huge.ExportMetadata {
+		t.Errorf("Resolve(acme/huge) = %+v, want both overrides with the later one winning", huge)
+	}
+	if api := overrides.Resolve(makeRepo("acme", "api")); api.Skip || api.Backups != 3 || !*api.ExportMetadata {
+		t.Errorf("Resolve(acme/api) = %+v", api)
+	}
+	if other := overrides.Resolve(makeRepo("widgets", "api")); other.Skip || other.Backups != 0 || other.ExportMetadata != nil {
+		t.Errorf("Resolve(widgets/api) = %+v, want no overrides", other)
+	}
+
+	repos := overrides.Filter([]*Repository{makeRepo("acme", "huge"), makeRepo("acme", "api")})
+	if len(repos) != 1 || repos[0].FullName() != "acme/api" {
+		t.Errorf("Filter() = %v, want acme/huge skipped", repos)
+	}
+}
+
+func TestOverrides_ResolveHostFolder(t *testing.T) {
+	github := &staticLister{host: "github.com", repos: []*Repository{{Forge: ForgeGitHub, Owner: "acme", Name: "api"}}}
+	gitlab := &staticLister{host: "gitlab.com", repos: []*Repository{{Forge: ForgeGitLab, Owner: "acme", Name: "api"}}}
+	repos, err := ListAllRepos(github, gitlab)
+	if err != nil || len(repos) != 2 || repos[1].FullName() != "gitlab.com/acme/api" {
+		t.Fatalf("ListAllRepos() = %v, %v, want the gitlab repo below its host", repos, err)
+	}
+
+	// the overrides of the owner and name apply to the repos of every host, and the full name singles one out
+	overrides := Overrides{{Match: "acme/*", Backups: 3}, {Match: "gitlab.com/acme/*", Skip: true}}
+	if got := overrides.Resolve(repos[0]); got.Backups != 3 || got.Skip {
+		t.Errorf("Resolve(%s) = %+v", repos[0].FullName(), got)
+	}
+	if got := overrides.Resolve(repos[1]); got.Backups != 3 || !got.Skip {
+		t.Errorf("Resolve(%s) = %+v, want both overrides", repos[1].FullName(), got)
+	}
+	if retentions := overrides.RepoRetentions(repos, Retention{}); retentions["gitlab.com/acme/api"].Last != 3 {
+		t.Errorf("RepoRetentions() = %v, want the gitlab repo kept by its override", retentions)
+	}
+	if filtered := overrides.Filter(repos); len(filtered) != 1 || filtered[0] != repos[0] {
+		t.Errorf("Filter() = %v, want only the gitlab repo skipped", filtered)
+	}
+}
+
+func TestDownloader_RepoExporters(t *testing.T) {
+	off := false
+	on := true
+	releases := NewReleaseExporter(NewLocalStorage(t.TempDir()), nil)
+	d := NewDownloader(context.Background(), WithExporters(NewMetadataExporter(), releases), WithOverrides(Overrides{
+		{Match: "acme/quiet", ExportMetadata: &off},
+	}))
+	if exporters := d.repoExporters(makeRepo("acme", "api")); len(exporters) != 2 {
+		t.Errorf("expected both exporters without an override, got %v", exporters)
+	}
+	if exporters := d.repoExporters(makeRepo("acme", "quiet")); len(exporters) != 1 || exporters[0] != releases {
+		t.Errorf("expected only the release exporter, got %v", exporters)
+	}
+
+	// the metadata export can be turned on for single repos
+	d = NewDownloader(context.Background(), WithOverrides(Overrides{{Match: "acme/*", ExportMetadata: &on}}))
+	exporters := d.repoExporters(makeRepo("acme", "api"))
+	if _, ok := exporters[0].(*MetadataExporter); len(exporters) != 1 || !ok {
+		t.Errorf("expected the metadata exporter, got %v", exporters)
+	}
+}
+
+func TestOverrides_RepoRetentions(t *testing.T) {
+	starred := makeRepo(StarredOwner+"/torvalds", "linux")
+	starred.Forge = ForgeGitHubStarred
+	pinned := makeRepo(StarredOwner+"/golang", "go")
+	pinned.Forge = ForgeGitHubStarred
+	repos := []*Repository{makeRepo("acme", "api"), makeRepo("widgets", "gears"), starred, pinned}
+	overrides := Overrides{{Match: "acme/*", Backups: 2}, {Match: StarredOwner + "/golang/*", Backups: 5}}
+
+	retentions := overrides.RepoRetentions(repos, Retention{Daily: 7})
+	if len(retentions) != 3 {
+		t.Fatalf("RepoRetentions() = %v, want acme/api and both starred repos", retentions)
+	}
+	if got := retentions["acme/api"]; got.Last != 2 {
+		t.Errorf("acme/api retention = %+v, want the backups of its override", got)
+	}
+	if got := retentions[starred.FullName()]; got.Daily != 7 {
+		t.Errorf("starred retention = %+v, want the starred retention", got)
+	}
+	if got := retentions[pinned.FullName()]; got.Last != 5 || got.Daily != 0 {
+		t.Errorf("overridden starred retention = %+v, want the backups of its override", got)
+	}
+
+	// starred repos without a retention of their own are kept in every generation
+	if retentions := (Overrides{}).RepoRetentions(repos, Retention{}); len(retentions) != 0 {
+		t.Errorf("RepoRetentions() = %v, want none", retentions)
+	}
+}
+
+func TestDownloader_WithUnchangedExportsOverrides(t *testing.T) {
+	checked := make(map[string]int)
+	mux := http.NewServeMux()
+	for _, name := range []string{"api", "quiet"} {
+		mux.HandleFunc("/repos/acme/"+name+"/issues", func(w http.ResponseWriter, r *http.Request) {
+			checked[name]++
+			w.Header().Set("ETag", `"v1"`)
+			_, _ = fmt.Fprint(w, `[]`)
+		})
+	}
+	api := newTestGitHubAPI(t, mux)
+	repos := []*Repository{makeRepo("acme", "api"), makeRepo("acme", "quiet")}
+	for _, repo := range repos {
+		repo.github = api
+	}
+
+	location := t.TempDir()
+	backUp(t, &mockRefLister{refs: []RepoRefs{mainAt("abc"), mainAt("def")}}, location, repos, nil)
+
+	off := false
+	d := NewDownloader(context.Background(), WithExporters(NewMetadataExporter()), WithOverrides(Overrides{
+		{Match: "acme/quiet", ExportMetadata: &off},
+	}))
+	exported, err := d.WithUnchangedExports(location, repos, nil)
+	if err != nil || len(exported) != 1 || exported[0].FullName() != "acme/api" {
+		t.Errorf("WithUnchangedExports() = %v, %v, want only the repo with the metadata export", exported, err)
+	}
+	if checked["quiet"] != 0 {
+		t.Errorf("the metadata of acme/quiet was checked %d times, want never", checked["quiet"])
+	}
+}
+
+func TestPruneRepos_Overrides(t *testing.T) {
+	location := t.TempDir()
+	for n := 0; n < 4; n++ {
+		for _, file := range []string{"acme/api.bundle", "acme/api.wiki.bundle", "acme/api.metadata.json", "acme/api.releases/releases.json", "widgets/gears.bundle", "gitlab.com/acme/web.bundle"} {
+			path := filepath.Join(GenerationPath(location, testGeneration(n)), file)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(file), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// the listed repo below the folder of its host is matched by its owner and name
+	web := &Repository{Forge: ForgeGitLab, Folder: "gitlab.com", Owner: "acme", Name: "web"}
+	overrides := Overrides{{Match: "acme/*", Backups: 2}}
+	retentions := overrides.RepoRetentions([]*Repository{makeRepo("acme", "api"), makeRepo("widgets", "gears"), web}, Retention{})
+	if len(retentions) != 2 || retentions["gitlab.com/acme/web"].Last != 2 {
+		t.Fatalf("RepoRetentions() = %v, want acme/api and gitlab.com/acme/web", retentions)
+	}
+	if err := pruneRepos(NewLocalStorage(location), retentions); err != nil {
+		t.Fatalf("pruneRepos() error: %v", err)
+	}
+
+	for n := 0; n < 4; n++ {
+		kept := n < 2
+		if Exists(BundlePath(location, "acme/api", testGeneration(n))) != kept {
+			t.Errorf("acme/api in generation %d exists = %v, want %v", n, !kept, kept)
+		}
+		if Exists(BundlePath(location, "gitlab.com/acme/web", testGeneration(n))) != kept {
+			t.Errorf("gitlab.com/acme/web in generation %d exists = %v, want %v", n, !kept, kept)
+		}
+		if !kept && Exists(filepath.Join(GenerationPath(location, testGeneration(n)), "acme")) {
+			t.Errorf("files of acme/api left behind in generation %d", n)
+		}
+		if !Exists(BundlePath(location, "widgets/gears", testGeneration(n))) {
+			t.Errorf("widgets/gears in generation %d was pruned without an override", n)
+		}
+	}
+}
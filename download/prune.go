@@ -0,0 +1,296 @@
+package download
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PruneGenerations removes the generations in storage which the retention does not keep, unless dryRun is set
+func PruneGenerations(location string, storage Storage, retention Retention, encryption *Encryption, dryRun bool) ([]GenerationPlan, error) {
+	journal, err := loadJournal(location)
+	if err != nil {
+		return nil, err
+	}
+	if journal != nil {
+		return nil, errors.New("a rotation is in progress or was interrupted, run gubber to finish it before pruning")
+	}
+	if dryRun {
+		generations, err := listGenerations(storage)
+		if err != nil {
+			return nil, err
+		}
+		return retention.Plan(generations), nil
+	}
+	return pruneGenerations(storage, retention, encryption)
+}
+
+// pruneGenerations merges each generation the retention does not keep into the next older generation
+func pruneGenerations(storage Storage, retention Retention, encryption *Encryption) ([]GenerationPlan, error) {
+	generations, err := listGenerations(storage)
+	if err != nil {
+		return nil, err
+	}
+	plans := retention.Plan(generations)
+
+	scratch, err := os.MkdirTemp("", "gubber-prune-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = os.RemoveAll(scratch) }()
+
+	// the newest generation is always kept, so every pruned generation has a newer one
+	remaining := append([]string{}, generations...)
+	for k := len(plans) - 1; k >= 1; k-- {
+		if plans[k].Keep() {
+			continue
+		}
+		merged, err := mergeGeneration(context.Background(), storage, remaining, k, encryption, scratch)
+		if err != nil {
+			return nil, err
+		}
+		if !merged {
+			plans[k].Reasons = []string{"encrypted"}
+			continue
+		}
+		remaining = append(remaining[:k], remaining[k+1:]...)
+	}
+	return plans, syncStorage(storage)
+}
+
+// mergeGeneration merges generation k of generations, newest first, into generation k+1 and removes it
+func mergeGeneration(ctx context.Context, storage Storage, generations []string, k int, encryption *Encryption, scratch string) (bool, error) {
+	pruned := generations[k]
+	if k == len(generations)-1 {
+		fmt.Println("Pruning generation:", pruned)
+		err := storage.RemoveAll(pruned)
+		if err != nil {
+			return false, fmt.Errorf("failed to remove backup %s due to error %w", pruned, err)
+		}
+		return true, nil
+	}
+	older := generations[k+1]
+
+	olderFiles, err := listFiles(storage, older)
+	if err != nil {
+		return false, err
+	}
+	prunedFiles, err := listFiles(storage, pruned)
+	if err != nil {
+		return false, err
+	}
+	inPruned := make(map[string]bool, len(prunedFiles))
+	for _, rel := range prunedFiles {
+		inPruned[rel] = true
+	}
+
+	// the bundles of the older generation which may be stored against the pruned generation
+	bundles := make([]string, 0)
+	olderUnits := make(map[string]bool, len(olderFiles))
+	for _, rel := range olderFiles {
+		olderUnits[promotionUnit(rel)] = true
+		if strings.HasSuffix(rel, ".bundle") && inPruned[rel] {
+			bundles = append(bundles, rel)
+		}
+	}
+	if !encryption.Decrypts() || !encryption.Encrypts() {
+		for _, rel := range bundles {
+			for _, name := range []string{older + "/" + rel, pruned + "/" + rel} {
+				encrypted, err := isEncryptedStored(storage, name)
+				if err != nil {
+					return false, err
+				}
+				if encrypted {
+					fmt.Println("Keeping generation:", pruned, "as it holds encrypted bundles, which need both AGE_RECIPIENTS and AGE_IDENTITY_FILE to be pruned")
+					return false, nil
+				}
+			}
+		}
+	}
+
+	fmt.Println("Pruning generation:", pruned, "into", older)
+	manifest, err := loadManifest(storage, older)
+	if err != nil {
+		return false, err
+	}
+	if manifest == nil {
+		manifest = &Manifest{Files: make(map[string]ManifestEntry)}
+	}
+	for _, rel := range bundles {
+		entry, rebased, err := rebaseBundle(ctx, storage, generations, k, rel, encryption, scratch)
+		if err != nil {
+			return false, err
+		}
+		if rebased {
+			manifest.Files[rel] = entry
+		}
+	}
+
+	// the manifest records the moved files before they are moved, so a merge interrupted while moving them still
+	// has their checksums once it is repeated
+	prunedManifest, err := loadManifest(storage, pruned)
+	if err != nil {
+		return false, err
+	}
+	moved := make([]string, 0)
+	for _, rel := range prunedFiles {
+		unit := promotionUnit(rel)
+		if isManifest(rel) || olderUnits[unit] {
+			continue
+		}
+		if len(moved) == 0 || moved[len(moved)-1] != unit {
+			moved = append(moved, unit)
+		}
+		if prunedManifest != nil {
+			if entry, ok := prunedManifest.Files[rel]; ok {
+				manifest.Files[rel] = entry
+			}
+		}
+	}
+	err = manifest.save(storage, older)
+	if err != nil {
+		return false, err
+	}
+	for _, unit := range moved {
+		err = storage.Rename(pruned+"/"+unit, older+"/"+unit)
+		if err != nil {
+			return false, fmt.Errorf("failed to move files from backup %s to backup %s due to error %w", pruned, older, err)
+		}
+	}
+
+	err = storage.RemoveAll(pruned)
+	if err != nil {
+		return false, fmt.Errorf("failed to remove backup %s due to error %w", pruned, err)
+	}
+	return true, nil
+}
+
+// rebaseBundle stores the thin bundle at rel of generation k+1 against generation k-1 instead of generation k
+func rebaseBundle(ctx context.Context, storage Storage, generations []string, k int, rel string, encryption *Encryption, scratch string) (ManifestEntry, bool, error) {
+	name := generations[k+1] + "/" + rel
+	dir, err := os.MkdirTemp(scratch, "rebase-")
+	if err != nil {
+		return ManifestEntry{}, false, err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	stored, err := fetchFile(storage, name, dir)
+	if err != nil {
+		return ManifestEntry{}, false, err
+	}
+	encrypted, err := isEncryptedFile(stored)
+	if err != nil {
+		return ManifestEntry{}, false, err
+	}
+	plain, err := encryption.decryptTo(stored, dir)
+	if err != nil {
+		return ManifestEntry{}, false, err
+	}
+	thin, err := IsThinBundle(plain)
+	if err != nil || !thin {
+		return ManifestEntry{}, false, err
+	}
+	info, err := os.Stat(plain)
+	if err != nil {
+		return ManifestEntry{}, false, err
+	}
+
+	chain, err := storedBundleChain(storage, generations, k+1, rel, encryption, dir)
+	if err != nil {
+		return ManifestEntry{}, false, err
+	}
+	// the bundle may already be stored against generation k-1 when the merge is repeated, so the chain of the newer
+	// bundle is fetched first
+	base, err := storedBundleChain(storage, generations, k-1, rel, encryption, dir)
+	if err == nil {
+		chain = append(base, chain...)
+	}
+	full := filepath.Join(dir, "full.bundle")
+	err = materializeBundle(ctx, chain, full)
+	if err != nil {
+		return ManifestEntry{}, false, fmt.Errorf("failed to rebuild %s due to error %w", name, err)
+	}
+
+	out := full
+	if base != nil {
+		newer := base[len(base)-1]
+		if len(base) > 1 {
+			newer = filepath.Join(dir, "newer.bundle")
+			err = materializeBundle(ctx, base, newer)
+		}
+		if err == nil {
+			err = CreateThinBundle(ctx, full, newer, filepath.Join(dir, "thin.bundle"))
+		}
+		if err == nil {
+			out = filepath.Join(dir, "thin.bundle")
+		} else {
+			fmt.Println("Keeping full bundle:", name, "as it could not be stored incrementally due to error:", err)
+		}
+	}
+
+	err = os.Chtimes(out, info.ModTime(), info.ModTime())
+	if err == nil && encrypted {
+		err = encryption.encryptFile(out)
+	}
+	if err == nil {
+		err = storage.Put(out, name)
+	}
+	if err != nil {
+		return ManifestEntry{}, false, fmt.Errorf("failed to store %s due to error %w", name, err)
+	}
+	entry, err := hashFile(out)
+	if err != nil {
+		return ManifestEntry{}, false, fmt.Errorf("failed to hash %s due to error %w", name, err)
+	}
+	return entry, true, nil
+}
+
+// storedBundleChain returns the bundles needed to restore the bundle at rel of generation k, full bundle first
+func storedBundleChain(storage Storage, generations []string, k int, rel string, encryption *Encryption, dir string) ([]string, error) {
+	chain := make([]string, 0)
+	for i := k; i >= 0; i-- {
+		name := generations[i] + "/" + rel
+		exists, err := storage.Exists(name)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			if i == k {
+				return nil, fmt.Errorf("%w: %s", ErrBundleNotFound, name)
+			}
+			continue
+		}
+
+		bundle, err := fetchFile(storage, name, filepath.Join(dir, "fetched"))
+		if err == nil {
+			bundle, err = encryption.decryptTo(bundle, dir)
+		}
+		if err != nil {
+			return nil, err
+		}
+		chain = append([]string{bundle}, chain...)
+
+		thin, err := IsThinBundle(bundle)
+		if err != nil {
+			return nil, err
+		}
+		if !thin {
+			return chain, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no full bundle found in a newer generation to restore thin bundle %s", ErrBundleNotFound, generations[k]+"/"+rel)
+}
+
+// isEncryptedStored reports whether the file at name in storage is encrypted with age
+func isEncryptedStored(storage Storage, name string) (bool, error) {
+	reader, err := storage.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = reader.Close() }()
+	return isEncrypted(bufio.NewReader(reader)), nil
+}
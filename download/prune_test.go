@@ -0,0 +1,172 @@
+package download
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// redateGenerations renames the generations in location, newest first, to names
+func redateGenerations(t *testing.T, location string, names ...string) {
+	t.Helper()
+	generations, err := ListGenerations(location)
+	if err != nil || len(generations) != len(names) {
+		t.Fatalf("generations = %v, %v, want %d", generations, err, len(names))
+	}
+	for i, name := range names {
+		if err := os.Rename(GenerationPath(location, generations[i]), GenerationPath(location, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// expectRestored fails the test unless fullName restores to the commit want from the nth newest generation
+func expectRestored(t *testing.T, location, fullName string, n int, encryption *Encryption, want string) {
+	t.Helper()
+	bundle, err := FindBundle(NewLocalStorage(location), fullName, n)
+	if err != nil {
+		t.Fatalf("FindBundle(%s, generation %d) error: %v", fullName, n, err)
+	}
+	dest := filepath.Join(t.TempDir(), "restored")
+	if err := RestoreBundle(context.Background(), NewLocalStorage(location), bundle, dest, encryption); err != nil {
+		t.Fatalf("RestoreBundle(%s, generation %d) error: %v", fullName, n, err)
+	}
+	if got := testGit(t, dest, "rev-parse", "HEAD"); got != want {
+		t.Errorf("%s restored from generation %d at %s, want %s", fullName, n, got, want)
+	}
+}
+
+// testGenerationHour returns testGeneration(n) moved by hours
+func testGenerationHour(n, hours int) string {
+	at, _ := GenerationTime(testGeneration(n))
+	return GenerationName(at.Add(time.Duration(hours) * time.Hour))
+}
+
+func TestPruneGenerations(t *testing.T) {
+	useLocation(t, time.UTC)
+	work := newWorkRepo(t)
+	location := filepath.Join(t.TempDir(), "backups")
+	tmpDir := t.TempDir()
+	dl := &gitDownloader{t: t, work: work}
+
+	// org/added is only backed up by the two newest runs
+	heads := make([]string, 0)
+	for i := 0; i < 4; i++ {
+		commitFile(t, work, "file.txt", string(rune('a'+i)))
+		heads = append(heads, testGit(t, work, "rev-parse", "HEAD"))
+		repos := []*Repository{makeRepo("org", "repo")}
+		if i >= 2 {
+			repos = append(repos, makeRepo("org", "added"))
+		}
+		if err := MigrateReposWithDownloader(dl, repos, &location, Retention{Last: 5}, &tmpDir); err != nil {
+			t.Fatalf("MigrateRepos() run %d error: %v", i, err)
+		}
+	}
+	// the two newest generations were backed up on the same day
+	redateGenerations(t, location, testGeneration(0), testGenerationHour(0, -1), testGeneration(1), testGeneration(2))
+	storage := NewLocalStorage(location)
+	retention := Retention{Daily: 3}
+
+	plans, err := PruneGenerations(location, storage, retention, nil, true)
+	if err != nil {
+		t.Fatalf("PruneGenerations() dry run error: %v", err)
+	}
+	if got := planReasons(plans); strings.Join(got, " ") != "daily - daily daily" {
+		t.Errorf("dry run plans = %v, want the second generation pruned", got)
+	}
+	if generations, _ := ListGenerations(location); len(generations) != 4 {
+		t.Errorf("dry run left generations %v, want all 4", generations)
+	}
+
+	if _, err := PruneGenerations(location, storage, retention, nil, false); err != nil {
+		t.Fatalf("PruneGenerations() error: %v", err)
+	}
+	generations, _ := ListGenerations(location)
+	if want := []string{testGeneration(0), testGeneration(1), testGeneration(2)}; strings.Join(generations, " ") != strings.Join(want, " ") {
+		t.Fatalf("generations = %v, want %v", generations, want)
+	}
+	// the pruned org/added was moved into the next older generation, which did not hold it
+	if !Exists(BundlePath(location, "org/added", testGeneration(1))) {
+		t.Error("org/added was not moved into the older generation")
+	}
+	for n, want := range []string{heads[3], heads[1], heads[0]} {
+		expectRestored(t, location, "org/repo", n, nil, want)
+	}
+	expectRestored(t, location, "org/added", 1, nil, heads[2])
+	verifyClean(t, location)
+
+	// pruning the oldest generations removes them
+	if _, err := PruneGenerations(location, storage, Retention{Last: 1}, nil, false); err != nil {
+		t.Fatalf("PruneGenerations() error: %v", err)
+	}
+	if generations, _ := ListGenerations(location); len(generations) != 1 {
+		t.Errorf("generations = %v, want only the newest", generations)
+	}
+	expectRestored(t, location, "org/repo", 0, nil, heads[3])
+}
+
+func TestPruneGenerations_DuringRotation(t *testing.T) {
+	location := t.TempDir()
+	writeGenerations(t, location, "gen0", "gen1")
+	journal := &rotationJournal{Phase: phasePromote, Generation: testGeneration(0), Retention: Retention{Last: 5}}
+	if err := journal.save(location); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := PruneGenerations(location, NewLocalStorage(location), Retention{Last: 1}, nil, false)
+	if err == nil || !strings.Contains(err.Error(), "rotation") {
+		t.Errorf("PruneGenerations() error = %v, want the rotation to be finished first", err)
+	}
+	if readGeneration(location, 1) != "gen1" {
+		t.Error("a generation was pruned during a rotation")
+	}
+}
+
+func TestPruneGenerations_Encrypted(t *testing.T) {
+	useLocation(t, time.UTC)
+	encryption, identityFile := newTestEncryption(t)
+	work := newWorkRepo(t)
+	location := filepath.Join(t.TempDir(), "backups")
+	tmpDir := t.TempDir()
+	storage := NewLocalStorage(location)
+	dl := &gitDownloader{t: t, work: work}
+	repos := []*Repository{makeRepo("org", "repo")}
+
+	heads := make([]string, 0)
+	for i := 0; i < 3; i++ {
+		commitFile(t, work, "file.txt", string(rune('a'+i)))
+		heads = append(heads, testGit(t, work, "rev-parse", "HEAD"))
+		if err := MigrateReposToStorage(dl, storage, encryption, repos, &location, Retention{Last: 5}, &tmpDir); err != nil {
+			t.Fatalf("MigrateReposToStorage() run %d error: %v", i, err)
+		}
+	}
+	redateGenerations(t, location, testGeneration(0), testGenerationHour(0, -1), testGeneration(1))
+	retention := Retention{Daily: 2}
+
+	// the oldest bundle is stored against the pruned generation, so cannot be rebased without the key
+	reader, err := NewEncryption(nil, identityFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plans, err := PruneGenerations(location, storage, retention, reader, false)
+	if err != nil {
+		t.Fatalf("PruneGenerations() without recipients error: %v", err)
+	}
+	if got := planReasons(plans); strings.Join(got, " ") != "daily encrypted daily" {
+		t.Errorf("plans = %v, want the encrypted generation kept", got)
+	}
+
+	if _, err := PruneGenerations(location, storage, retention, encryption, false); err != nil {
+		t.Fatalf("PruneGenerations() error: %v", err)
+	}
+	if generations, _ := ListGenerations(location); len(generations) != 2 {
+		t.Fatalf("generations = %v, want 2", generations)
+	}
+	expectEncrypted(t, BundlePath(location, "org/repo", testGeneration(1)))
+	expectRestored(t, location, "org/repo", 0, reader, heads[2])
+	expectRestored(t, location, "org/repo", 1, reader, heads[0])
+	verifyClean(t, location)
+}
@@ -0,0 +1,84 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// RepoRefs maps every branch and tag of a repo to the object it points at
+type RepoRefs map[string]string
+
+// parseLsRemote parses the output of `git ls-remote`, dropping the peeled ^{} entries of annotated tags
+func parseLsRemote(output string) RepoRefs {
+	refs := make(RepoRefs)
+	for _, line := range strings.Split(output, "\n") {
+		id, name, ok := strings.Cut(strings.TrimSpace(line), "\t")
+		if !ok || strings.HasSuffix(name, "^{}") {
+			continue
+		}
+		refs[name] = id
+	}
+	return refs
+}
+
+// WikiRefPrefix is prepended to the refs of a repo's wiki, so they are tracked alongside the repo's own refs
+const WikiRefPrefix = "wiki/"
+
+// lsRemote lists the branches and tags of the remote without transferring any objects
+func (d *Downloader) lsRemote(remoteURL string, credentials Credentials) (RepoRefs, error) {
+	cmd, err := d.remoteGit(credentials, "ls-remote", "--heads", "--tags", remoteURL)
+	if err != nil {
+		return nil, err
+	}
+	output, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && isHostKeyFailure(exitErr.Stderr) {
+			return nil, ErrHostKeyVerification
+		}
+		if errors.As(err, &exitErr) {
+			if missing := missingRemoteError(exitErr.Stderr); missing != nil {
+				return nil, missing
+			}
+		}
+		return nil, err
+	}
+	return parseLsRemote(string(output)), nil
+}
+
+// ListRefs returns the branches and tags of repo using `git ls-remote`, including those of its wiki prefixed with
+// WikiRefPrefix
+func (d *Downloader) ListRefs(repo *Repository) (RepoRefs, error) {
+	cloneURL, wikiURL := d.cloneURLs(repo)
+	refs, err := d.lsRemote(cloneURL, repo.Credentials)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list refs of repo %s due to error %w", repo.FullName(), err)
+	}
+
+	if wikiURL != "" {
+		wikiRefs, err := d.lsRemote(wikiURL, repo.Credentials)
+		if err != nil && !errors.Is(err, errRemoteMissing) && !errors.Is(err, errRemoteNotFound) {
+			return nil, fmt.Errorf("failed to list refs of wiki %s due to error %w", repo.FullName(), err)
+		}
+		for name, id := range wikiRefs {
+			refs[WikiRefPrefix+name] = id
+		}
+	}
+	return refs, nil
+}
+
+// GetRepoRefs returns the refs of every repo in the same order as repos, nil for a repo whose refs are unknown
+func (d *Downloader) GetRepoRefs(repos []*Repository) ([]RepoRefs, error) {
+	refs := make([]RepoRefs, len(repos))
+	d.parallel(len(repos), func(i int) {
+		repoRefs, err := d.ListRefs(repos[i])
+		if err != nil {
+			fmt.Println("Error listing refs:", repos[i].FullName(), "due to error:", Redact(err.Error()))
+			return
+		}
+		refs[i] = repoRefs
+	})
+	return refs, nil
+}
@@ -0,0 +1,51 @@
+package download
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseLsRemote(t *testing.T) {
+	output := "aaa\trefs/heads/main\n" +
+		"bbb\trefs/tags/v1\n" +
+		"ccc\trefs/tags/v1^{}\n" +
+		"\n"
+
+	refs := parseLsRemote(output)
+	if len(refs) != 2 {
+		t.Fatalf("expected 2 refs, got %v", refs)
+	}
+	if refs["refs/heads/main"] != "aaa" || refs["refs/tags/v1"] != "bbb" {
+		t.Errorf("unexpected refs %v", refs)
+	}
+}
+
+func TestListRefs(t *testing.T) {
+	work := newWorkRepo(t)
+	head := testGit(t, work, "rev-parse", "HEAD")
+	testGit(t, work, "tag", "-a", "v1", "-m", "release")
+	tag := testGit(t, work, "rev-parse", "v1")
+
+	srcDir := t.TempDir()
+	testGit(t, srcDir, "clone", "--bare", work, filepath.Join(srcDir, "org", "repo.git"))
+
+	d := NewDownloader(context.Background())
+
+	refs, err := d.ListRefs(makeLocalRepo(srcDir, "org", "repo"))
+	if err != nil {
+		t.Fatalf("ListRefs() error: %v", err)
+	}
+	want := RepoRefs{"refs/heads/main": head, "refs/tags/v1": tag}
+	if len(refs) != len(want) || refs["refs/heads/main"] != head || refs["refs/tags/v1"] != tag {
+		t.Errorf("ListRefs() = %v, want %v", refs, want)
+	}
+
+	all, err := d.GetRepoRefs([]*Repository{makeLocalRepo(srcDir, "org", "repo"), makeLocalRepo(srcDir, "org", "missing")})
+	if err != nil {
+		t.Fatalf("GetRepoRefs() error: %v", err)
+	}
+	if all[0] == nil || all[1] != nil {
+		t.Errorf("GetRepoRefs() = %v, want refs for org/repo and nil for org/missing", all)
+	}
+}
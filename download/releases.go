@@ -0,0 +1,325 @@
+package download
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// ReleaseAssetsFolder is the folder of the backup location storing each release asset once, named by its checksum
+const ReleaseAssetsFolder = "release-assets"
+
+// ReleaseManifest is written to <repo>.releases/releases.json, recording every release of a repo and the checksums
+// of their assets
+type ReleaseManifest struct {
+	Releases []*BackedUpRelease `json:"releases"`
+}
+
+// BackedUpRelease is a release along with the assets stored for it
+type BackedUpRelease struct {
+	Release *github.RepositoryRelease `json:"release"`
+	Assets  []ReleaseAssetFile        `json:"assets"`
+}
+
+// ReleaseAssetFile records where the content of a release asset is stored
+type ReleaseAssetFile struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	UpdatedAt time.Time `json:"updated_at"`
+	SHA256    string    `json:"sha256"`
+	// Stored is the name of the asset in the asset store when it differs from SHA256, such as when it is encrypted
+	Stored string `json:"stored,omitempty"`
+}
+
+// storedName returns the name of the asset in the asset store
+func (f ReleaseAssetFile) storedName() string {
+	if f.Stored != "" {
+		return f.Stored
+	}
+	return f.SHA256
+}
+
+// ReleaseAssetPath returns where the asset with the provided checksum is stored in a backup location on the local disk
+func ReleaseAssetPath(location, sum string) string {
+	return filepath.Join(location, filepath.FromSlash(releaseAssetName(sum)))
+}
+
+// releaseAssetName returns the path in the storage of the asset with the provided checksum
+func releaseAssetName(sum string) string {
+	return path.Join(ReleaseAssetsFolder, sum[:2], sum)
+}
+
+// isReleaseManifest reports whether the path of a file in a generation is a release manifest
+func isReleaseManifest(name string) bool {
+	return path.Base(name) == "releases.json" && strings.HasSuffix(path.Dir(name), ".releases")
+}
+
+// ReleaseExporter writes the releases of a repo next to its bundle, storing their assets in the ReleaseAssetsFolder
+type ReleaseExporter struct {
+	storage    Storage
+	encryption *Encryption
+}
+
+func NewReleaseExporter(storage Storage, encryption *Encryption) *ReleaseExporter {
+	return &ReleaseExporter{
+		storage:    storage,
+		encryption: encryption,
+	}
+}
+
+// readManifest reads the release manifest at name in the storage, decrypting it when it is encrypted
+func readManifest(storage Storage, encryption *Encryption, name string) (*ReleaseManifest, error) {
+	file, err := storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+	buffered := bufio.NewReader(file)
+	var reader io.Reader = buffered
+	if isEncrypted(buffered) {
+		reader, err = encryption.decrypt(buffered)
+		if err != nil {
+			return nil, err
+		}
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	var manifest ReleaseManifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// previousManifest returns the most recent release manifest of repo in the storage, if any
+func (r *ReleaseExporter) previousManifest(repo *Repository) *ReleaseManifest {
+	generations, err := listGenerations(r.storage)
+	if err != nil {
+		return nil
+	}
+	for _, generation := range generations {
+		manifest, err := readManifest(r.storage, r.encryption, path.Join(generation, repo.FullName()+".releases", "releases.json"))
+		if err == nil {
+			return manifest
+		}
+	}
+	return nil
+}
+
+// assetStored reports whether the asset with the provided name is in the storage
+func (r *ReleaseExporter) assetStored(name string) bool {
+	ok, err := r.storage.Exists(releaseAssetName(name))
+	return err == nil && ok
+}
+
+// storeAsset downloads an asset into the asset store, returning the checksum of its plaintext and the name it is stored
+// under
+func (r *ReleaseExporter) storeAsset(repo *Repository, asset *github.ReleaseAsset) (ReleaseAssetFile, error) {
+	g := repo.github
+	rc, redirectURL, err := g.client.Repositories.DownloadReleaseAsset(g.ctx, repo.Owner, repo.Name, asset.GetID())
+	if err != nil {
+		return ReleaseAssetFile{}, err
+	}
+	if rc == nil {
+		req, err := http.NewRequestWithContext(g.ctx, http.MethodGet, redirectURL, nil)
+		if err != nil {
+			return ReleaseAssetFile{}, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return ReleaseAssetFile{}, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			_ = resp.Body.Close()
+			return ReleaseAssetFile{}, fmt.Errorf("unexpected status %s downloading asset", resp.Status)
+		}
+		rc = resp.Body
+	}
+	defer func() { _ = rc.Close() }()
+
+	tmp, err := os.CreateTemp("", "gubber-asset-")
+	if err != nil {
+		return ReleaseAssetFile{}, err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), rc)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		_ = tmp.Close()
+	}
+	if err != nil {
+		return ReleaseAssetFile{}, err
+	}
+
+	file := ReleaseAssetFile{Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}
+	if r.encryption.Encrypts() {
+		err = r.encryption.encryptFile(tmp.Name())
+		if err != nil {
+			return ReleaseAssetFile{}, err
+		}
+	}
+	name, err := r.encryption.assetName(file.SHA256, tmp.Name())
+	if err != nil {
+		return ReleaseAssetFile{}, err
+	}
+	if name != file.SHA256 {
+		file.Stored = name
+	}
+	if r.assetStored(name) {
+		return file, nil
+	}
+	return file, r.storage.Put(tmp.Name(), releaseAssetName(name))
+}
+
+func (r *ReleaseExporter) Name() string {
+	return "releases"
+}
+
+// ExportVersion returns the etag of the newest releases, which changes when one is published, edited or given an asset
+func (r *ReleaseExporter) ExportVersion(repo *Repository, previous string) (string, error) {
+	if repo.Forge != ForgeGitHub || repo.github == nil {
+		return "", nil
+	}
+	url := fmt.Sprintf("repos/%s/%s/releases?per_page=100", repo.Owner, repo.Name)
+	version, err := repo.github.etag(url, previous)
+	if err != nil {
+		return "", fmt.Errorf("failed to check releases of repo %s due to error %w", repo.FullName(), err)
+	}
+	return version, nil
+}
+
+// ExportRepo writes the releases of a GitHub repo to <repo>.releases/releases.json in the org folder
+func (r *ReleaseExporter) ExportRepo(repo *Repository, orgFolder string) error {
+	if repo.Forge != ForgeGitHub || repo.github == nil {
+		return nil
+	}
+	g := repo.github
+	releases, err := listAll(func(opts github.ListOptions) ([]*github.RepositoryRelease, *github.Response, error) {
+		return g.client.Repositories.ListReleases(g.ctx, repo.Owner, repo.Name, &opts)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get releases of repo %s due to error %w", repo.FullName(), err)
+	}
+	if len(releases) == 0 {
+		return nil
+	}
+
+	known := make(map[int64]ReleaseAssetFile)
+	if previous := r.previousManifest(repo); previous != nil {
+		for _, release := range previous.Releases {
+			for _, asset := range release.Assets {
+				known[asset.ID] = asset
+			}
+		}
+	}
+
+	fmt.Println("Exporting releases:", repo.FullName())
+	manifest := ReleaseManifest{Releases: make([]*BackedUpRelease, 0, len(releases))}
+	for _, release := range releases {
+		backedUp := &BackedUpRelease{Release: release, Assets: make([]ReleaseAssetFile, 0, len(release.Assets))}
+		for _, asset := range release.Assets {
+			file := ReleaseAssetFile{
+				ID:        asset.GetID(),
+				Name:      asset.GetName(),
+				UpdatedAt: asset.GetUpdatedAt().Time,
+			}
+
+			if previous, ok := known[file.ID]; ok && previous.UpdatedAt.Equal(file.UpdatedAt) && r.assetStored(previous.storedName()) {
+				file.SHA256 = previous.SHA256
+				file.Size = previous.Size
+				file.Stored = previous.Stored
+			} else {
+				stored, err := r.storeAsset(repo, &asset)
+				if err != nil {
+					return fmt.Errorf("failed to download asset %s of release %s due to error %w", asset.GetName(), release.GetTagName(), err)
+				}
+				file.SHA256, file.Size, file.Stored = stored.SHA256, stored.Size, stored.Stored
+			}
+			backedUp.Assets = append(backedUp.Assets, file)
+		}
+		manifest.Releases = append(manifest.Releases, backedUp)
+	}
+
+	releasesFolder := filepath.Join(orgFolder, repo.Name+".releases")
+	err = os.MkdirAll(releasesFolder, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create releases folder due to error %w", err)
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal releases due to error %w", err)
+	}
+	err = os.WriteFile(filepath.Join(releasesFolder, "releases.json"), data, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write releases due to error %w", err)
+	}
+	return nil
+}
+
+// PruneReleaseAssets removes every asset which is no longer referenced by a release manifest in any generation
+func PruneReleaseAssets(storage Storage, encryption *Encryption) error {
+	assets, err := storage.List(ReleaseAssetsFolder)
+	if err != nil {
+		return fmt.Errorf("failed to list release assets due to error %w", err)
+	}
+	if len(assets) == 0 {
+		return nil
+	}
+
+	generations, err := listGenerations(storage)
+	if err != nil {
+		return err
+	}
+
+	referenced := make(map[string]bool)
+	for _, generation := range generations {
+		files, err := storage.List(generation)
+		if err != nil {
+			return fmt.Errorf("failed to list files of %s due to error %w", generation, err)
+		}
+		for _, name := range files {
+			if !isReleaseManifest(name) {
+				continue
+			}
+			manifest, err := readManifest(storage, encryption, name)
+			if err != nil {
+				return fmt.Errorf("failed to read release manifest %s due to error %w", name, err)
+			}
+			for _, release := range manifest.Releases {
+				for _, asset := range release.Assets {
+					referenced[asset.storedName()] = true
+				}
+			}
+		}
+	}
+
+	for _, name := range assets {
+		if referenced[path.Base(name)] {
+			continue
+		}
+		fmt.Println("Pruning release asset:", path.Base(name))
+		err = storage.RemoveAll(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package download
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// releaseMux serves a single release with one asset, counting how often the asset is downloaded
+func releaseMux(t *testing.T, content string, downloads *int) *http.ServeMux {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/org/repo/releases", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprint(w, `[{"id": 1, "tag_name": "v1.0.0", "assets": [
+			{"id": 7, "name": "app.tar.gz", "updated_at": "2024-01-01T00:00:00Z"}
+		]}]`)
+	})
+	mux.HandleFunc("/repos/org/repo/releases/assets/7", func(w http.ResponseWriter, r *http.Request) {
+		*downloads++
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = fmt.Fprint(w, content)
+	})
+	return mux
+}
+
+func readReleaseManifest(t *testing.T, path string) ReleaseManifest {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("release manifest not written: %v", err)
+	}
+	var manifest ReleaseManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatalf("release manifest is not valid JSON: %v", err)
+	}
+	return manifest
+}
+
+func TestReleaseExporter_ExportRepo(t *testing.T) {
+	downloads := 0
+	content := "release binary"
+	sum := sha256.Sum256([]byte(content))
+	wantSum := hex.EncodeToString(sum[:])
+
+	location := t.TempDir()
+	exporter := NewReleaseExporter(NewLocalStorage(location), nil)
+	repo := makeRepo("org", "repo")
+	repo.github = newTestGitHubAPI(t, releaseMux(t, content, &downloads))
+
+	orgFolder := filepath.Join(GenerationPath(location, testGeneration(0)), "org")
+	if err := os.MkdirAll(orgFolder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := exporter.ExportRepo(repo, orgFolder); err != nil {
+		t.Fatalf("ExportRepo() error: %v", err)
+	}
+
+	manifest := readReleaseManifest(t, filepath.Join(orgFolder, "repo.releases", "releases.json"))
+	if len(manifest.Releases) != 1 || manifest.Releases[0].Release.GetTagName() != "v1.0.0" {
+		t.Fatalf("unexpected releases %v", manifest.Releases)
+	}
+	assets := manifest.Releases[0].Assets
+	if len(assets) != 1 || assets[0].SHA256 != wantSum || assets[0].Size != int64(len(content)) {
+		t.Fatalf("unexpected assets %+v", assets)
+	}
+
+	stored, err := os.ReadFile(ReleaseAssetPath(location, wantSum))
+	if err != nil || string(stored) != content {
+		t.Errorf("asset store content = %q, %v, want %q", stored, err, content)
+	}
+
+	// exporting again reuses the stored asset since it has not been updated
+	nextFolder := filepath.Join(t.TempDir(), "org")
+	if err := os.MkdirAll(nextFolder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := exporter.ExportRepo(repo, nextFolder); err != nil {
+		t.Fatalf("second ExportRepo() error: %v", err)
+	}
+	if downloads != 1 {
+		t.Errorf("asset downloaded %d times, want 1", downloads)
+	}
+	manifest = readReleaseManifest(t, filepath.Join(nextFolder, "repo.releases", "releases.json"))
+	if manifest.Releases[0].Assets[0].SHA256 != wantSum {
+		t.Errorf("second manifest checksum = %q, want %q", manifest.Releases[0].Assets[0].SHA256, wantSum)
+	}
+}
+
+func TestReleaseExporter_NoReleases(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/org/repo/releases", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `[]`)
+	})
+
+	orgFolder := t.TempDir()
+	repo := makeRepo("org", "repo")
+	repo.github = newTestGitHubAPI(t, mux)
+	exporter := NewReleaseExporter(NewLocalStorage(t.TempDir()), nil)
+	if err := exporter.ExportRepo(repo, orgFolder); err != nil {
+		t.Fatalf("ExportRepo() error: %v", err)
+	}
+	if Exists(filepath.Join(orgFolder, "repo.releases")) {
+		t.Error("releases folder should not be created for a repo without releases")
+	}
+}
+
+func TestReleaseExporter_ExportVersion(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/org/repo/releases", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v2"`)
+		_, _ = fmt.Fprint(w, `[]`)
+	})
+
+	repo := makeRepo("org", "repo")
+	repo.github = newTestGitHubAPI(t, mux)
+	exporter := NewReleaseExporter(NewLocalStorage(t.TempDir()), nil)
+	if version, err := exporter.ExportVersion(repo, `"v1"`); err != nil || version != `"v1"` {
+		t.Errorf("ExportVersion() = %q, %v, want the unchanged etag", version, err)
+	}
+	if version, err := exporter.ExportVersion(repo, `"v0"`); err != nil || version != `"v2"` {
+		t.Errorf("ExportVersion() = %q, %v, want the new etag", version, err)
+	}
+}
+
+func TestPruneReleaseAssets(t *testing.T) {
+	location := t.TempDir()
+	keep := "aa" + "11111111111111111111111111111111111111111111111111111111111111"
+	drop := "bb" + "22222222222222222222222222222222222222222222222222222222222222"
+	for _, sum := range []string{keep, drop} {
+		path := ReleaseAssetPath(location, sum)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(sum), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manifest := ReleaseManifest{Releases: []*BackedUpRelease{{Assets: []ReleaseAssetFile{{ID: 1, SHA256: keep}}}}}
+	data, _ := json.Marshal(manifest)
+	manifestPath := filepath.Join(GenerationPath(location, testGeneration(1)), "org", "repo.releases", "releases.json")
+	if err := os.MkdirAll(filepath.Dir(manifestPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(manifestPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := PruneReleaseAssets(NewLocalStorage(location), nil); err != nil {
+		t.Fatalf("PruneReleaseAssets() error: %v", err)
+	}
+	if !Exists(ReleaseAssetPath(location, keep)) {
+		t.Error("referenced asset was pruned")
+	}
+	if Exists(ReleaseAssetPath(location, drop)) {
+		t.Error("unreferenced asset was not pruned")
+	}
+}
+
+func TestReleaseExporter_S3(t *testing.T) {
+	storage, _ := newTestS3Storage(t, 64)
+	downloads := 0
+	content := "release binary"
+	sum := sha256.Sum256([]byte(content))
+	wantSum := hex.EncodeToString(sum[:])
+
+	exporter := NewReleaseExporter(storage, nil)
+	repo := makeRepo("org", "repo")
+	repo.github = newTestGitHubAPI(t, releaseMux(t, content, &downloads))
+	orgFolder := t.TempDir()
+	if err := exporter.ExportRepo(repo, orgFolder); err != nil {
+		t.Fatalf("ExportRepo() error: %v", err)
+	}
+	if got := readStored(t, storage, releaseAssetName(wantSum)); got != content {
+		t.Errorf("stored asset = %q, want %q", got, content)
+	}
+
+	// the manifest of a repo backed up below its host folder keeps its asset, while other assets are pruned
+	manifest := filepath.Join(orgFolder, "repo.releases", "releases.json")
+	if err := storage.Put(manifest, testGeneration(1)+"/github.com/org/repo.releases/releases.json"); err != nil {
+		t.Fatal(err)
+	}
+	drop := "bb" + "22222222222222222222222222222222222222222222222222222222222222"
+	if err := storage.Put(writeLocalFile(t, drop), releaseAssetName(drop)); err != nil {
+		t.Fatal(err)
+	}
+	if err := PruneReleaseAssets(storage, nil); err != nil {
+		t.Fatalf("PruneReleaseAssets() error: %v", err)
+	}
+	if ok, _ := storage.Exists(releaseAssetName(wantSum)); !ok {
+		t.Error("referenced asset was pruned")
+	}
+	if ok, _ := storage.Exists(releaseAssetName(drop)); ok {
+		t.Error("unreferenced asset was not pruned")
+	}
+}
+
+func TestReleaseExporter_Encrypted(t *testing.T) {
+	encryption, _ := newTestEncryption(t)
+	downloads := 0
+	content := "release binary"
+	sum := sha256.Sum256([]byte(content))
+	wantSum := hex.EncodeToString(sum[:])
+
+	location := t.TempDir()
+	storage := NewLocalStorage(location)
+	exporter := NewReleaseExporter(storage, encryption)
+	repo := makeRepo("org", "repo")
+	repo.github = newTestGitHubAPI(t, releaseMux(t, content, &downloads))
+	orgFolder := filepath.Join(GenerationPath(location, testGeneration(0)), "org")
+	if err := os.MkdirAll(orgFolder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := exporter.ExportRepo(repo, orgFolder); err != nil {
+		t.Fatalf("ExportRepo() error: %v", err)
+	}
+	// the asset is named by a keyed checksum, so its name does not reveal its plaintext
+	manifest := readReleaseManifest(t, filepath.Join(orgFolder, "repo.releases", "releases.json"))
+	asset := manifest.Releases[0].Assets[0]
+	if asset.SHA256 != wantSum || asset.Stored == "" || asset.Stored == wantSum {
+		t.Fatalf("manifest asset = %+v, want checksum %q stored under a keyed name", asset, wantSum)
+	}
+	if Exists(ReleaseAssetPath(location, wantSum)) {
+		t.Error("encrypted asset is stored under the checksum of its plaintext")
+	}
+	expectEncrypted(t, ReleaseAssetPath(location, asset.Stored))
+	// the manifest is encrypted with the rest of the new generation
+	if err := encryption.encryptFolder(orgFolder); err != nil {
+		t.Fatal(err)
+	}
+
+	// the asset is found by its name in the encrypted manifest, so is not downloaded again
+	if err := exporter.ExportRepo(repo, t.TempDir()); err != nil {
+		t.Fatalf("second ExportRepo() error: %v", err)
+	}
+	if downloads != 1 {
+		t.Errorf("asset downloaded %d times, want 1", downloads)
+	}
+	if err := PruneReleaseAssets(storage, encryption); err != nil {
+		t.Fatalf("PruneReleaseAssets() error: %v", err)
+	}
+	if !Exists(ReleaseAssetPath(location, asset.Stored)) {
+		t.Error("asset referenced by an encrypted manifest was pruned")
+	}
+
+	// without the identity the manifests cannot be read, so nothing is pruned
+	if err := PruneReleaseAssets(storage, nil); err == nil || !Exists(ReleaseAssetPath(location, asset.Stored)) {
+		t.Errorf("PruneReleaseAssets() without an identity error = %v, want an error and the asset kept", err)
+	}
+}
@@ -0,0 +1,63 @@
+package download
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// RemoteLister lists plain git remotes which are configured by hand rather than discovered through a forge's api
+type RemoteLister struct {
+	remotes []*Repository
+}
+
+func NewRemoteLister() *RemoteLister {
+	return &RemoteLister{
+		remotes: make([]*Repository, 0),
+	}
+}
+
+// Add adds the remote at remoteURL, backing it up to <fullName>.bundle
+func (l *RemoteLister) Add(fullName string, remoteURL string) error {
+	err := validateFullName(fullName)
+	if err != nil {
+		return err
+	}
+	if remoteURL == "" {
+		return fmt.Errorf("remote %s has no url", fullName)
+	}
+
+	index := strings.LastIndex(fullName, "/")
+	repo := &Repository{
+		Forge:    ForgeGit,
+		Owner:    fullName[:index],
+		Name:     fullName[index+1:],
+		CloneURL: remoteURL,
+	}
+
+	// credentials in an https url are handed to git through the credential helper, rather than on its command line
+	u, err := url.Parse(remoteURL)
+	if err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.User != nil {
+		password, ok := u.User.Password()
+		if ok {
+			repo.Credentials = &StaticCredentials{Username: u.User.Username(), Password: password}
+			u.User = nil
+			repo.CloneURL = u.String()
+		}
+	}
+
+	// the remote is cloned from the url it was configured with in ssh mode too, rather than being rewritten to ssh
+	repo.SSHURL = repo.CloneURL
+
+	l.remotes = append(l.remotes, repo)
+	return nil
+}
+
+// Host returns no host, as remotes are stored under the name they were given
+func (l *RemoteLister) Host() string {
+	return ""
+}
+
+func (l *RemoteLister) ListRepos() ([]*Repository, error) {
+	return l.remotes, nil
+}
@@ -0,0 +1,182 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Forge identifies the kind of server a Repository was listed from
+type Forge string
+
+const (
+	ForgeGitHub     Forge = "github"
+	ForgeGitHubGist Forge = "github-gist"
+	// ForgeGitHubStarred is a GitHub repository starred by the user, backed up below StarredOwner
+	ForgeGitHubStarred Forge = "github-starred"
+	ForgeGitLab        Forge = "gitlab"
+	ForgeGitea         Forge = "gitea"
+	ForgeBitbucket     Forge = "bitbucket"
+	// ForgeGit is a plain git remote without a forge
+	ForgeGit Forge = "git"
+)
+
+// Credentials supplies the username and password used to clone a repository over https
+type Credentials interface {
+	Credentials() (username string, password string, err error)
+}
+
+// StaticCredentials are credentials which never change, such as a personal access token
+type StaticCredentials struct {
+	Username string
+	Password string
+}
+
+func (c *StaticCredentials) Credentials() (string, string, error) {
+	return c.Username, c.Password, nil
+}
+
+// Repository is a git repository to back up, independent of the forge hosting it
+type Repository struct {
+	Forge Forge
+	// Owner is the user, organisation or group owning the repository, nested groups separated by slashes
+	Owner string
+	Name  string
+	// Folder is the host the repository is stored below, and is empty for repositories of the first source
+	Folder string
+	// CloneURL is the url the repository is cloned from, without any credentials
+	CloneURL string
+	// WikiURL is the url the wiki of the repository is cloned from, and is empty when the wiki is disabled
+	WikiURL string
+	// SSHURL is the url the repository is cloned from in ssh mode, and is derived from CloneURL when empty
+	SSHURL string
+	// Credentials authenticate clones of CloneURL and WikiURL, and are nil when no authentication is needed
+	Credentials Credentials
+
+	// Visibility, Topics, Fork, Archived and Size in bytes describe the repository to filters
+	Visibility Visibility
+	Topics     []string
+	Fork       bool
+	Archived   bool
+	Size       int64
+
+	// github is the api which listed a GitHub repository, used by exporters to fetch its metadata and releases
+	github *GitHubAPI
+}
+
+// FullName returns the path of the repository below each generation, without the .bundle extension
+func (r *Repository) FullName() string {
+	if r.Folder != "" {
+		return r.Folder + "/" + r.Owner + "/" + r.Name
+	}
+	return r.Owner + "/" + r.Name
+}
+
+// sshURL converts an http or https clone url into the scp-like ssh url of the same path on the same host
+func sshURL(cloneURL string) string {
+	u, err := url.Parse(cloneURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return cloneURL
+	}
+	return "git@" + u.Hostname() + ":" + strings.TrimPrefix(u.Path, "/")
+}
+
+// credentialHelper is a git credential helper which answers with the credentials in the environment of git, so
+// they are never part of a command line or of the url of a remote
+const credentialHelper = `!f() { test "$1" = get || exit 0; echo "username=${GUBBER_GIT_USERNAME}"; echo "password=${GUBBER_GIT_PASSWORD}"; }; f`
+
+// secretKey returns the key the password of credentials is registered under with registerSecret
+func secretKey(credentials Credentials, password string) any {
+	if tokens, ok := credentials.(*tokenCredentials); ok {
+		return tokens
+	}
+	return password
+}
+
+// gitCredentials returns the arguments, which go before the subcommand, and environment supplying credentials to git
+func gitCredentials(credentials Credentials) ([]string, []string, error) {
+	if credentials == nil {
+		return nil, nil, nil
+	}
+	username, password, err := credentials.Credentials()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get credentials due to error %w", err)
+	}
+	registerSecret(secretKey(credentials, password), password)
+
+	// the empty helper clears the user's own helpers, so they are neither asked for nor told the credentials
+	args := []string{"-c", "credential.helper=", "-c", "credential.helper=" + credentialHelper}
+	env := []string{"GUBBER_GIT_USERNAME=" + username, "GUBBER_GIT_PASSWORD=" + password}
+	return args, env, nil
+}
+
+// namedLister names the source its lister lists the repositories of, so a failure says which source failed
+type namedLister struct {
+	name   string
+	lister RepoLister
+}
+
+// NameLister returns a lister of the same repositories as lister, whose errors name the source it lists
+func NameLister(name string, lister RepoLister) RepoLister {
+	return &namedLister{name: name, lister: lister}
+}
+
+func (l *namedLister) Host() string {
+	return l.lister.Host()
+}
+
+// Filtered returns the repos left out by the lister of the source, when it filters them
+func (l *namedLister) Filtered() []FilteredRepo {
+	if lister, ok := l.lister.(filteringLister); ok {
+		return lister.Filtered()
+	}
+	return nil
+}
+
+func (l *namedLister) ListRepos() ([]*Repository, error) {
+	repos, err := l.lister.ListRepos()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list repos of %s due to error %w", l.name, err)
+	}
+	return repos, nil
+}
+
+// listerFolder returns the folder the repos of lister are stored below, which is its host unless that is the host
+// of first
+func listerFolder(lister RepoLister, first RepoLister) string {
+	if lister.Host() == "" || lister.Host() == first.Host() {
+		return ""
+	}
+	return lister.Host()
+}
+
+// ListAllRepos returns the repositories of every lister, storing those of a lister on another host than the first
+// below a folder named after its host
+func ListAllRepos(listers ...RepoLister) ([]*Repository, error) {
+	repos := make([]*Repository, 0)
+	seen := make(map[string]bool)
+	errs := make([]error, 0)
+	for _, lister := range listers {
+		listed, err := lister.ListRepos()
+		if err != nil {
+			err = RedactError(err)
+			fmt.Println("Error listing repos, backing up the other sources:", err)
+			errs = append(errs, err)
+			continue
+		}
+		folder := listerFolder(lister, listers[0])
+		for _, repo := range listed {
+			repo.Folder = folder
+			if seen[repo.FullName()] {
+				continue
+			}
+			seen[repo.FullName()] = true
+			repos = append(repos, repo)
+		}
+	}
+	if len(errs) > 0 && len(errs) == len(listers) {
+		return nil, errors.Join(errs...)
+	}
+	return repos, nil
+}
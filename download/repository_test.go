@@ -0,0 +1,92 @@
+package download
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// staticLister lists a fixed set of repos from host
+type staticLister struct {
+	host  string
+	repos []*Repository
+	err   error
+}
+
+func (s *staticLister) Host() string {
+	return s.host
+}
+
+func (s *staticLister) ListRepos() ([]*Repository, error) {
+	return s.repos, s.err
+}
+
+func TestListAllRepos(t *testing.T) {
+	github := &staticLister{host: "github.com", repos: []*Repository{makeRepo("org", "repo"), makeRepo("org", "other")}}
+	gists := &staticLister{host: "github.com", repos: []*Repository{makeRepo("org", "repo"), makeRepo(GistOwner, "aaa111")}}
+	gitlab := &staticLister{host: "gitlab.com", repos: []*Repository{{Forge: ForgeGitLab, Owner: "org", Name: "repo"}, {Forge: ForgeGitLab, Owner: "group/sub", Name: "repo"}}}
+
+	repos, err := ListAllRepos(github, gists, gitlab)
+	if err != nil {
+		t.Fatalf("ListAllRepos() error: %v", err)
+	}
+	got := make([]string, 0, len(repos))
+	for _, repo := range repos {
+		got = append(got, repo.FullName())
+	}
+	// repos of the first host are listed once, and those of other hosts below their host even when they do not clash
+	want := []string{"org/repo", "org/other", "gists/aaa111", "gitlab.com/org/repo", "gitlab.com/group/sub/repo"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("ListAllRepos() = %v, want %v", got, want)
+	}
+
+	// the placement depends on the order of the listers, never on what they list
+	repos, err = ListAllRepos(&staticLister{host: "github.com"}, gitlab)
+	if err != nil || repos[0].FullName() != "gitlab.com/org/repo" {
+		t.Errorf("ListAllRepos() = %v, %v, want gitlab repos below their host", repos, err)
+	}
+
+	// a failing lister is left out, and the repos of the others are still backed up
+	gitlab.err = errors.New("unauthorized")
+	repos, err = ListAllRepos(github, NameLister("gitlab source", gitlab))
+	if err != nil || len(repos) != 2 {
+		t.Errorf("ListAllRepos() = %v, %v, want the repos of the other lister", repos, err)
+	}
+	github.err = errors.New("bad credentials")
+	_, err = ListAllRepos(github, NameLister("gitlab source", gitlab))
+	if err == nil || !strings.Contains(err.Error(), "gitlab source") {
+		t.Errorf("ListAllRepos() error = %v, want an error naming the failed source once every lister failed", err)
+	}
+}
+
+func TestListAllRepos_FirstListerFails(t *testing.T) {
+	github := &staticLister{host: "github.com", err: errors.New("bad credentials")}
+	gitlab := &staticLister{host: "gitlab.com", repos: []*Repository{{Forge: ForgeGitLab, Owner: "org", Name: "repo"}}}
+
+	// the repos of other hosts stay below their host while the first source cannot be listed
+	repos, err := ListAllRepos(github, gitlab)
+	if err != nil || len(repos) != 1 || repos[0].FullName() != "gitlab.com/org/repo" {
+		t.Errorf("ListAllRepos() = %v, %v, want gitlab.com/org/repo", repos, err)
+	}
+}
+
+func TestGitCredentials(t *testing.T) {
+	credentials := &StaticCredentials{Username: "oauth2", Password: "glpat-secret"}
+
+	args, env, err := gitCredentials(credentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(strings.Join(args, " "), "glpat-secret") {
+		t.Errorf("git arguments %q contain the password", args)
+	}
+	if !slices.Contains(env, "GUBBER_GIT_USERNAME=oauth2") || !slices.Contains(env, "GUBBER_GIT_PASSWORD=glpat-secret") {
+		t.Errorf("git environment %q does not hold the credentials", env)
+	}
+
+	// repos without credentials are cloned without a helper
+	if args, env, err := gitCredentials(nil); err != nil || args != nil || env != nil {
+		t.Errorf("gitCredentials(nil) = %q, %q, %v, want nothing", args, env, err)
+	}
+}
@@ -0,0 +1,166 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrBundleNotFound is returned when the backup location holds no bundle for the requested repo
+var ErrBundleNotFound = errors.New("bundle not found")
+
+// ErrBundleCorrupt is returned when a bundle fails verification or cannot be cloned
+var ErrBundleCorrupt = errors.New("bundle is corrupt")
+
+// BundlePath returns the path of the bundle for repo (owner/name) in the generation called generation of the backup
+// location
+func BundlePath(location, fullName string, generation string) string {
+	return filepath.Join(GenerationPath(location, generation), fullName+".bundle")
+}
+
+// validateFullName ensures a repo name is of the form owner/name, where the owner may be a nested group such as
+// group/subgroup, and cannot escape the backup location
+func validateFullName(fullName string) error {
+	parts := strings.Split(fullName, "/")
+	if len(parts) < 2 {
+		return fmt.Errorf("repo must be of the form owner/name: %q", fullName)
+	}
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("repo must be of the form owner/name: %q", fullName)
+		}
+	}
+	return nil
+}
+
+// BundleName returns the path in the storage of the bundle for repo (owner/name) in the generation called generation
+func BundleName(fullName string, generation string) string {
+	return generation + "/" + fullName + ".bundle"
+}
+
+// FindBundle returns the bundle holding the state of repo as of generation n, which may be in a newer generation
+func FindBundle(storage Storage, fullName string, generation int) (string, error) {
+	if err := validateFullName(fullName); err != nil {
+		return "", err
+	}
+	if generation < 0 {
+		return "", fmt.Errorf("invalid generation: %d", generation)
+	}
+	generations, err := listGenerations(storage)
+	if err != nil {
+		return "", err
+	}
+	if generation >= len(generations) {
+		return "", fmt.Errorf("%w: generation %d does not exist, as there are %d generations", ErrBundleNotFound, generation, len(generations))
+	}
+	return findBundleFrom(storage, fullName, generations, generation)
+}
+
+// FindBundleAt returns the path in the storage of the bundle holding the state of repo as of the most recent
+// generation backed up at or before the provided time
+func FindBundleAt(storage Storage, fullName string, at time.Time) (string, error) {
+	if err := validateFullName(fullName); err != nil {
+		return "", err
+	}
+
+	generations, err := listGenerations(storage)
+	if err != nil {
+		return "", err
+	}
+	for k, generation := range generations {
+		if t, _ := GenerationTime(generation); !t.After(at) {
+			return findBundleFrom(storage, fullName, generations, k)
+		}
+	}
+	return "", fmt.Errorf("%w: no generation backed up on or before %s", ErrBundleNotFound, at.Format(time.RFC3339))
+}
+
+// findBundleFrom returns the bundle of repo in generation k of generations, newest first, or in the nearest newer
+// generation holding it
+func findBundleFrom(storage Storage, fullName string, generations []string, k int) (string, error) {
+	for i := k; i >= 0; i-- {
+		name := BundleName(fullName, generations[i])
+		exists, err := storage.Exists(name)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("%w: no bundle for %s in generation %s or any newer generation", ErrBundleNotFound, fullName, generations[k])
+}
+
+// bundleChain returns the bundles needed to restore the bundle at name, from the full bundle it is based on down
+func bundleChain(storage Storage, name string, encryption *Encryption, dir string) ([]string, error) {
+	generation, file, ok := strings.Cut(name, "/")
+	generations, err := listGenerations(storage)
+	if err != nil {
+		return nil, err
+	}
+	k := slices.Index(generations, generation)
+	if !ok || k < 0 {
+		return nil, fmt.Errorf("%w: %s is not inside a generation", ErrBundleCorrupt, name)
+	}
+	return storedBundleChain(storage, generations, k, file, encryption, dir)
+}
+
+// RestoreBundle verifies the bundle and clones it into dest, which must not already exist
+func RestoreBundle(ctx context.Context, storage Storage, bundle string, dest string, encryption *Encryption) error {
+	exists, err := storage.Exists(bundle)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrBundleNotFound, bundle)
+	}
+	if Exists(dest) {
+		return fmt.Errorf("destination already exists: %s", dest)
+	}
+
+	scratch, err := newScratchRepo(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(scratch) }()
+
+	chain, err := bundleChain(storage, bundle, encryption, scratch)
+	if err != nil {
+		return err
+	}
+
+	absBundle, err := filepath.Abs(chain[len(chain)-1])
+	if err != nil {
+		return fmt.Errorf("failed to resolve bundle path due to error %w", err)
+	}
+	if len(chain) == 1 {
+		// git will only verify a bundle from inside a repository, so use the scratch repo
+		_, err = runGit(ctx, scratch, nil, "bundle", "verify", "--quiet", absBundle)
+		if err != nil {
+			return fmt.Errorf("%w: %s failed verification due to error %v", ErrBundleCorrupt, displayPath(storage, bundle), err)
+		}
+	} else {
+		// fetching each bundle of the chain verifies its prerequisites and pack
+		fmt.Printf("Rebuilding: %s from %d incremental bundles\n", displayPath(storage, bundle), len(chain))
+		full := filepath.Join(scratch, "restored.bundle")
+		err = materializeBundle(ctx, chain, full)
+		if err != nil {
+			return err
+		}
+		absBundle = full
+	}
+
+	fmt.Println("Restoring:", displayPath(storage, bundle), "to", dest)
+	_, err = runGit(ctx, "", nil, "clone", "--quiet", absBundle, dest)
+	if err != nil {
+		_ = os.RemoveAll(dest)
+		return fmt.Errorf("%w: failed to clone %s due to error %v", ErrBundleCorrupt, displayPath(storage, bundle), err)
+	}
+
+	return nil
+}
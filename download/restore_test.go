@@ -0,0 +1,239 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testGit runs a git command in dir, failing the test on error and returning trimmed stdout
+func testGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test",
+		"GIT_AUTHOR_EMAIL=test@test.com",
+		"GIT_COMMITTER_NAME=test",
+		"GIT_COMMITTER_EMAIL=test@test.com",
+	)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git %v failed: %v\n%s", args, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// newWorkRepo creates a git repo on branch main with a single commit containing README.md
+func newWorkRepo(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+
+	dir := filepath.Join(t.TempDir(), "work")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	testGit(t, dir, "init")
+	testGit(t, dir, "checkout", "-b", "main")
+	commitFile(t, dir, "README.md", "# test")
+	return dir
+}
+
+// commitFile writes a file into the work repo and commits it, returning the new commit id
+func commitFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	testGit(t, dir, "add", ".")
+	testGit(t, dir, "commit", "-m", "update "+name)
+	return testGit(t, dir, "rev-parse", "HEAD")
+}
+
+// writeBundle bundles every ref of the work repo into path
+func writeBundle(t *testing.T, dir, path string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	testGit(t, dir, "bundle", "create", path, "--all")
+}
+
+func TestFindBundle_ExactGeneration(t *testing.T) {
+	location := t.TempDir()
+	for _, gen := range []int{0, 1} {
+		path := BundlePath(location, "org/repo", testGeneration(gen))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("bundle"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := FindBundle(NewLocalStorage(location), "org/repo", 1)
+	if err != nil {
+		t.Fatalf("FindBundle() error: %v", err)
+	}
+	if got != BundleName("org/repo", testGeneration(1)) {
+		t.Errorf("FindBundle() = %q, want the bundle of generation 1", got)
+	}
+}
+
+func TestFindBundle_FallsBackToNewerGeneration(t *testing.T) {
+	location := t.TempDir()
+	path := BundlePath(location, "org/repo", testGeneration(0))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("bundle"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the older generation exists but the repo was promoted out of it because it did not change
+	if err := os.MkdirAll(GenerationPath(location, testGeneration(2)), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := FindBundle(NewLocalStorage(location), "org/repo", 1)
+	if err != nil {
+		t.Fatalf("FindBundle() error: %v", err)
+	}
+	if want := BundleName("org/repo", testGeneration(0)); got != want {
+		t.Errorf("FindBundle() = %q, want %q", got, want)
+	}
+}
+
+func TestFindBundle_Missing(t *testing.T) {
+	location := t.TempDir()
+	if err := os.MkdirAll(GenerationPath(location, testGeneration(0)), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := FindBundle(NewLocalStorage(location), "org/repo", 0)
+	if !errors.Is(err, ErrBundleNotFound) {
+		t.Errorf("expected ErrBundleNotFound, got %v", err)
+	}
+
+	_, err = FindBundle(NewLocalStorage(location), "org/repo", 5)
+	if !errors.Is(err, ErrBundleNotFound) {
+		t.Errorf("expected ErrBundleNotFound for missing generation, got %v", err)
+	}
+}
+
+func TestFindBundle_InvalidName(t *testing.T) {
+	location := t.TempDir()
+	for _, name := range []string{"repo", "../etc/passwd", "org/..", "/repo", "a/b/c"} {
+		if _, err := FindBundle(NewLocalStorage(location), name, 0); err == nil {
+			t.Errorf("expected error for repo name %q", name)
+		}
+	}
+}
+
+func TestFindBundleAt(t *testing.T) {
+	location := t.TempDir()
+	for _, gen := range []int{0, 2, 4} {
+		path := BundlePath(location, "org/repo", testGeneration(gen))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("bundle"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the repo was promoted out of the generation backed up 3 days before the newest
+	if err := os.MkdirAll(GenerationPath(location, testGeneration(3)), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	at := func(gen int) time.Time {
+		when, _ := GenerationTime(testGeneration(gen))
+		return when
+	}
+	got, err := FindBundleAt(NewLocalStorage(location), "org/repo", at(1))
+	if err != nil {
+		t.Fatalf("FindBundleAt() error: %v", err)
+	}
+	if got != BundleName("org/repo", testGeneration(2)) {
+		t.Errorf("FindBundleAt() = %q, want the bundle of the generation backed up before", got)
+	}
+	got, err = FindBundleAt(NewLocalStorage(location), "org/repo", at(3).Add(time.Hour))
+	if err != nil || got != BundleName("org/repo", testGeneration(2)) {
+		t.Errorf("FindBundleAt() = %q, %v, want the bundle promoted into the newer generation", got, err)
+	}
+
+	_, err = FindBundleAt(NewLocalStorage(location), "org/repo", at(5))
+	if !errors.Is(err, ErrBundleNotFound) {
+		t.Errorf("expected ErrBundleNotFound before first backup, got %v", err)
+	}
+}
+
+func TestRestoreBundle_Success(t *testing.T) {
+	work := newWorkRepo(t)
+	head := testGit(t, work, "rev-parse", "HEAD")
+	location := t.TempDir()
+	bundle := BundlePath(location, "org/repo", testGeneration(0))
+	writeBundle(t, work, bundle)
+
+	dest := filepath.Join(t.TempDir(), "restored")
+	if err := RestoreBundle(context.Background(), NewLocalStorage(location), BundleName("org/repo", testGeneration(0)), dest, nil); err != nil {
+		t.Fatalf("RestoreBundle() error: %v", err)
+	}
+
+	if got := testGit(t, dest, "rev-parse", "HEAD"); got != head {
+		t.Errorf("restored HEAD = %s, want %s", got, head)
+	}
+	if !Exists(filepath.Join(dest, "README.md")) {
+		t.Error("restored clone has no working tree")
+	}
+}
+
+func TestRestoreBundle_Missing(t *testing.T) {
+	location := t.TempDir()
+	dest := filepath.Join(t.TempDir(), "restored")
+	err := RestoreBundle(context.Background(), NewLocalStorage(location), BundleName("org/nope", testGeneration(0)), dest, nil)
+	if !errors.Is(err, ErrBundleNotFound) {
+		t.Errorf("expected ErrBundleNotFound, got %v", err)
+	}
+}
+
+func TestRestoreBundle_Corrupt(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	location := t.TempDir()
+	bundle := BundlePath(location, "org/repo", testGeneration(0))
+	if err := os.MkdirAll(filepath.Dir(bundle), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bundle, []byte("not a bundle"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(t.TempDir(), "restored")
+	err := RestoreBundle(context.Background(), NewLocalStorage(location), BundleName("org/repo", testGeneration(0)), dest, nil)
+	if !errors.Is(err, ErrBundleCorrupt) {
+		t.Errorf("expected ErrBundleCorrupt, got %v", err)
+	}
+	if Exists(dest) {
+		t.Error("destination should not exist after a failed restore")
+	}
+}
+
+func TestRestoreBundle_DestinationExists(t *testing.T) {
+	work := newWorkRepo(t)
+	location := t.TempDir()
+	bundle := BundlePath(location, "org/repo", testGeneration(0))
+	writeBundle(t, work, bundle)
+
+	err := RestoreBundle(context.Background(), NewLocalStorage(location), BundleName("org/repo", testGeneration(0)), t.TempDir(), nil)
+	if err == nil {
+		t.Error("expected error when destination already exists")
+	}
+}
@@ -0,0 +1,86 @@
+package download
+
+import (
+	"fmt"
+	"time"
+)
+
+// Retention decides which generations are kept, each rule keeping the newest generation of its most recent periods
+type Retention struct {
+	// Last keeps the most recent generations
+	Last    int `json:"last"`
+	Daily   int `json:"daily"`
+	Weekly  int `json:"weekly"`
+	Monthly int `json:"monthly"`
+	Yearly  int `json:"yearly"`
+	// Repos are the retentions of the repos kept in fewer generations than the others, such as starred repos
+	Repos map[string]Retention `json:"repos,omitempty"`
+}
+
+// IsZero reports whether the retention has no rules, so only keeps the newest generation
+func (r Retention) IsZero() bool {
+	return r.Last == 0 && r.Daily == 0 && r.Weekly == 0 && r.Monthly == 0 && r.Yearly == 0
+}
+
+// GenerationPlan is what a retention decided for a generation
+type GenerationPlan struct {
+	Name string
+	// Reasons are the rules keeping the generation, such as daily or monthly, and are empty when it is pruned
+	Reasons []string
+}
+
+// Keep reports whether the generation is kept
+func (p GenerationPlan) Keep() bool {
+	return len(p.Reasons) > 0
+}
+
+// retentionRule keeps the newest generation of each of the most recent count periods
+type retentionRule struct {
+	reason string
+	count  int
+	// period returns the period t falls in, generations of the same period sharing it
+	period func(t time.Time) string
+}
+
+// rules returns the rules of the retention, periods being computed in local time
+func (r Retention) rules() []retentionRule {
+	return []retentionRule{
+		{"last", r.Last, func(t time.Time) string { return t.String() }},
+		{"daily", r.Daily, func(t time.Time) string { return t.Local().Format("2006-01-02") }},
+		{"weekly", r.Weekly, func(t time.Time) string {
+			year, week := t.Local().ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"monthly", r.Monthly, func(t time.Time) string { return t.Local().Format("2006-01") }},
+		{"yearly", r.Yearly, func(t time.Time) string { return t.Local().Format("2006") }},
+	}
+}
+
+// Plan decides which of the generations, named and ordered as by ListGenerations, are kept
+func (r Retention) Plan(generations []string) []GenerationPlan {
+	plans := make([]GenerationPlan, len(generations))
+	for i, name := range generations {
+		plans[i].Name = name
+	}
+
+	for _, rule := range r.rules() {
+		seen := make(map[string]bool)
+		for i, name := range generations {
+			if len(seen) >= rule.count {
+				break
+			}
+			t, _ := GenerationTime(name)
+			period := rule.period(t)
+			if seen[period] {
+				continue
+			}
+			seen[period] = true
+			plans[i].Reasons = append(plans[i].Reasons, rule.reason)
+		}
+	}
+
+	if len(plans) > 0 && !plans[0].Keep() {
+		plans[0].Reasons = []string{"newest"}
+	}
+	return plans
+}
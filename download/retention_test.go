@@ -0,0 +1,70 @@
+package download
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// useLocation sets the local time zone, which the retention periods are computed in, for the rest of the test
+func useLocation(t *testing.T, location *time.Location) {
+	t.Helper()
+	local := time.Local
+	time.Local = location
+	t.Cleanup(func() { time.Local = local })
+}
+
+// planReasons returns the reasons of each plan joined by commas, with pruned generations as "-"
+func planReasons(plans []GenerationPlan) []string {
+	reasons := make([]string, len(plans))
+	for i, plan := range plans {
+		reasons[i] = "-"
+		if plan.Keep() {
+			reasons[i] = strings.Join(plan.Reasons, ",")
+		}
+	}
+	return reasons
+}
+
+func TestRetention_Plan(t *testing.T) {
+	useLocation(t, time.UTC)
+	generations := []string{
+		"2024-03-04T120000Z", // Monday
+		"2024-03-04T060000Z",
+		"2024-03-03T120000Z", // Sunday, so the week before
+		"2024-02-26T120000Z",
+		"2024-01-15T120000Z",
+		"2023-06-01T120000Z",
+	}
+	retention := Retention{Last: 1, Daily: 2, Weekly: 2, Monthly: 3, Yearly: 2}
+
+	plans := retention.Plan(generations)
+	want := []string{"last,daily,weekly,monthly,yearly", "-", "daily,weekly", "monthly", "monthly", "yearly"}
+	got := planReasons(plans)
+	for i, name := range generations {
+		if plans[i].Name != name || got[i] != want[i] {
+			t.Errorf("plan %d = %s %s, want %s %s", i, plans[i].Name, got[i], name, want[i])
+		}
+	}
+}
+
+func TestRetention_Plan_KeepsNewest(t *testing.T) {
+	plans := Retention{}.Plan([]string{testGeneration(0), testGeneration(1)})
+	if got := planReasons(plans); got[0] != "newest" || got[1] != "-" {
+		t.Errorf("Plan() = %v, want only the newest generation kept", got)
+	}
+	if plans := (Retention{Last: 3}).Plan(nil); len(plans) != 0 {
+		t.Errorf("Plan(nil) = %v, want no plans", plans)
+	}
+}
+
+func TestRetention_Plan_LocalTime(t *testing.T) {
+	// 20:00 UTC is already the next day ten hours east
+	useLocation(t, time.FixedZone("AEST", 10*60*60))
+	generations := []string{"2024-03-04T200000Z", "2024-03-04T100000Z", "2024-03-03T200000Z"}
+
+	got := planReasons(Retention{Daily: 3}.Plan(generations))
+	if want := []string{"daily", "daily", "-"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Plan() = %v, want %v", got, want)
+	}
+}
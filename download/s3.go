@@ -0,0 +1,704 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3DefaultPartSize is the size of each part of a multipart upload when S3Options.PartSize is unset
+const s3DefaultPartSize = 64 << 20
+
+// s3MaxCopySize is the largest object S3 copies in a single request, larger objects are copied in parts
+const s3MaxCopySize = 5 << 30
+
+// s3MaxDeleteKeys is the most objects S3 deletes in a single request
+const s3MaxDeleteKeys = 1000
+
+// s3MaxRetries is how many times a request which failed transiently is retried, with the delay doubling each time
+const s3MaxRetries = 5
+
+// s3IdleTimeout fails a request whose connection sent and received nothing for that long, so a stalled connection
+// is retried rather than hanging the rotation while it holds the journal
+const s3IdleTimeout = 2 * time.Minute
+
+// S3Options configures an S3Storage
+type S3Options struct {
+	// Endpoint is the address of the S3 compatible service, such as https://s3.us-east-1.amazonaws.com or
+	// http://localhost:9000 for MinIO
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is the key below which the generations are kept, and is empty to keep them at the root of the bucket
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// PathStyle addresses the bucket as Endpoint/Bucket rather than as Bucket.Endpoint, as MinIO expects
+	PathStyle bool
+	// PartSize is the size of each part of a multipart upload, and files no larger than it are uploaded whole
+	PartSize int64
+}
+
+// S3Storage keeps the generations in a bucket of an S3 compatible object store
+type S3Storage struct {
+	ctx      context.Context
+	client   *http.Client
+	endpoint *url.URL
+	opts     S3Options
+	root     string
+	// copyPartSize is the largest object copied in a single request, and the size of each part of larger copies
+	copyPartSize int64
+	// pageSize is the number of keys requested per page of a listing, and is 0 for the default of the service
+	pageSize int
+	// retryDelay is how long to wait before the first retry of a failed request
+	retryDelay time.Duration
+}
+
+// idleTimeoutConn is a connection which fails any read or write once it has been idle for timeout
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	_ = c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+	_ = c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+// newS3Client returns the http client of an S3Storage, which times out stalled connections
+func newS3Client() *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &idleTimeoutConn{Conn: conn, timeout: s3IdleTimeout}, nil
+	}
+	transport.TLSHandshakeTimeout = 30 * time.Second
+	return &http.Client{Transport: transport}
+}
+
+func NewS3Storage(ctx context.Context, opts S3Options) (*S3Storage, error) {
+	endpoint, err := url.Parse(strings.TrimSuffix(opts.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", opts.Endpoint)
+	}
+	if opts.Bucket == "" {
+		return nil, fmt.Errorf("no s3 bucket provided")
+	}
+	if opts.PartSize <= 0 {
+		opts.PartSize = s3DefaultPartSize
+	}
+	registerSecret(opts.SecretAccessKey, opts.SecretAccessKey)
+
+	root := strings.Trim(opts.Prefix, "/")
+	if root != "" {
+		root += "/"
+	}
+	return &S3Storage{
+		ctx:          ctx,
+		client:       newS3Client(),
+		endpoint:     endpoint,
+		opts:         opts,
+		root:         root,
+		copyPartSize: s3MaxCopySize,
+		retryDelay:   time.Second,
+	}, nil
+}
+
+// key returns the key of the object holding the file at name
+func (s *S3Storage) key(name string) string {
+	return s.root + name
+}
+
+// folderKey returns the prefix of the keys of every file below the folder at dir
+func (s *S3Storage) folderKey(dir string) string {
+	if dir == "" {
+		return s.root
+	}
+	return s.root + dir + "/"
+}
+
+// s3Escape percent encodes s as S3 expects in a signed request, leaving slashes unencoded when keepSlash is set
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// s3Query encodes the query sorted by key, as it is signed
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3Error is the body of a failed S3 request
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// do sends a signed request for the object at key, returning the response when it has the status want
+func (s *S3Storage) do(method string, key string, query url.Values, header http.Header, body []byte, want int) (*http.Response, error) {
+	idempotent := method != http.MethodPost || query.Has("delete")
+	for attempt := 0; ; attempt++ {
+		resp, retry, err := s.send(method, key, query, header, body, want)
+		if err == nil || !retry || !idempotent || attempt >= s3MaxRetries {
+			return resp, err
+		}
+		delay := s.retryDelay << attempt
+		fmt.Printf("Retrying %s of %s in %v due to error %v\n", method, key, delay, err)
+		select {
+		case <-s.ctx.Done():
+			return nil, s.ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// send sends a signed request for the object at key once, returning the response when it has the status want, and
+// whether a failed request may succeed when it is retried
+func (s *S3Storage) send(method string, key string, query url.Values, header http.Header, body []byte, want int) (*http.Response, bool, error) {
+	u := *s.endpoint
+	objectPath := "/" + key
+	if s.opts.PathStyle {
+		objectPath = "/" + s.opts.Bucket + "/" + key
+	} else {
+		u.Host = s.opts.Bucket + "." + u.Host
+	}
+	u.Path = objectPath
+	u.RawPath = s3Escape(objectPath, true)
+	u.RawQuery = s3Query(query)
+
+	req, err := http.NewRequestWithContext(s.ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.ContentLength = int64(len(body))
+	if len(body) > 0 {
+		sum := md5.Sum(body)
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	s.sign(req, body, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		// connections which were reset or timed out are retried, but not requests which were cancelled
+		return nil, s.ctx.Err() == nil, err
+	}
+	if resp.StatusCode != want {
+		defer func() { _ = resp.Body.Close() }()
+		err, code := s3ResponseError(resp, key)
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || code == "SlowDown" || code == "RequestTimeout"
+		return nil, retry, err
+	}
+	return resp, false, nil
+}
+
+// s3ResponseError returns the error of a failed request for key, wrapping fs.ErrNotExist when it does not exist,
+// along with the S3 error code of the response
+func s3ResponseError(resp *http.Response, key string) (error, string) {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	s3Err := s3Error{}
+	_ = xml.Unmarshal(data, &s3Err)
+	if resp.StatusCode == http.StatusNotFound && s3Err.Code != "NoSuchBucket" {
+		return fmt.Errorf("%s does not exist: %w", key, fs.ErrNotExist), s3Err.Code
+	}
+	if s3Err.Code == "" {
+		return fmt.Errorf("unexpected status %s for %s", resp.Status, key), s3Err.Code
+	}
+	return fmt.Errorf("unexpected status %s for %s: %s: %s", resp.Status, key, s3Err.Code, s3Err.Message), s3Err.Code
+}
+
+// decodeResponse decodes the xml body of resp into v, returning the errors S3 reports in successful responses
+func decodeResponse(resp *http.Response, key string, v any) error {
+	defer func() { _ = resp.Body.Close() }()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		s3Err := s3Error{}
+		_ = xml.Unmarshal(data, &s3Err)
+		return fmt.Errorf("failed to write %s: %s: %s", key, s3Err.Code, s3Err.Message)
+	}
+	if v == nil {
+		return nil
+	}
+	err = xml.Unmarshal(data, v)
+	if err != nil {
+		return fmt.Errorf("failed to decode response for %s due to error %w", key, err)
+	}
+	return nil
+}
+
+// signingKey derives the key signing the requests of a day to service in region, as described by AWS signature
+// version 4
+func signingKey(secret string, date string, region string, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalRequest returns the request as it is signed, covering the headers named by signed
+func canonicalRequest(req *http.Request, signed []string, payloadHash string) string {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := make([]string, 0, len(signed))
+	for _, name := range signed {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = host
+		}
+		headers = append(headers, name+":"+strings.TrimSpace(value)+"\n")
+	}
+	return strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3Query(req.URL.Query()),
+		strings.Join(headers, ""),
+		strings.Join(signed, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+// requestSignature returns the signature of the canonical request made at amzDate
+func requestSignature(secret string, region string, amzDate string, canonical string) string {
+	scope := amzDate[:8] + "/" + region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	return hex.EncodeToString(hmacSHA256(signingKey(secret, amzDate[:8], region, "s3"), toSign))
+}
+
+// sign adds the headers authenticating req with AWS signature version 4
+func (s *S3Storage) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	hash := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(hash[:])
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signed := []string{"host"}
+	for name := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "content-md5" {
+			signed = append(signed, name)
+		}
+	}
+	sort.Strings(signed)
+
+	signature := requestSignature(s.opts.SecretAccessKey, s.opts.Region, amzDate, canonicalRequest(req, signed, payloadHash))
+	scope := amzDate[:8] + "/" + s.opts.Region + "/s3/aws4_request"
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.opts.AccessKeyID, scope, strings.Join(signed, ";"), signature))
+}
+
+// s3Object is an object of a listing
+type s3Object struct {
+	Key  string `xml:"Key"`
+	Size int64  `xml:"Size"`
+}
+
+// s3ListResult is a page of the objects below a prefix
+type s3ListResult struct {
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+	Contents              []s3Object `xml:"Contents"`
+	CommonPrefixes        []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+// list returns every object whose key starts with prefix, and with a delimiter the prefixes of the keys up to the
+// next delimiter after prefix instead of the objects below them
+func (s *S3Storage) list(prefix string, delimiter string) ([]s3Object, []string, error) {
+	objects := make([]s3Object, 0)
+	prefixes := make([]string, 0)
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		if s.pageSize > 0 {
+			query.Set("max-keys", strconv.Itoa(s.pageSize))
+		}
+		resp, err := s.do(http.MethodGet, "", query, nil, nil, http.StatusOK)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to list %s due to error %w", prefix, err)
+		}
+		page := s3ListResult{}
+		err = decodeResponse(resp, prefix, &page)
+		if err != nil {
+			return nil, nil, err
+		}
+		objects = append(objects, page.Contents...)
+		for _, common := range page.CommonPrefixes {
+			prefixes = append(prefixes, common.Prefix)
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return objects, prefixes, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (s *S3Storage) List(dir string) ([]string, error) {
+	objects, _, err := s.list(s.folderKey(dir), "")
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(objects))
+	for _, object := range objects {
+		files = append(files, strings.TrimPrefix(object.Key, s.root))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (s *S3Storage) Folders(dir string) ([]string, error) {
+	prefix := s.folderKey(dir)
+	_, prefixes, err := s.list(prefix, "/")
+	if err != nil {
+		return nil, err
+	}
+	folders := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		folders = append(folders, strings.TrimSuffix(strings.TrimPrefix(p, prefix), "/"))
+	}
+	sort.Strings(folders)
+	return folders, nil
+}
+
+// head returns the size of the object at key, and whether it exists
+func (s *S3Storage) head(key string) (int64, bool, error) {
+	resp, err := s.do(http.MethodHead, key, nil, nil, nil, http.StatusOK)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	_ = resp.Body.Close()
+	return resp.ContentLength, true, nil
+}
+
+func (s *S3Storage) Exists(name string) (bool, error) {
+	_, ok, err := s.head(s.key(name))
+	if err != nil || ok {
+		return ok, err
+	}
+	// folders are not objects, so exist while any object has a key below them
+	objects, _, err := s.list(s.folderKey(name), "")
+	if err != nil {
+		return false, err
+	}
+	return len(objects) > 0, nil
+}
+
+func (s *S3Storage) Open(name string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, s.key(name), nil, nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3Storage) Put(src string, name string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	key := s.key(name)
+	if info.Size() <= s.opts.PartSize {
+		body, err := io.ReadAll(file)
+		if err != nil {
+			return err
+		}
+		resp, err := s.do(http.MethodPut, key, nil, nil, body, http.StatusOK)
+		if err != nil {
+			return fmt.Errorf("failed to upload %s due to error %w", name, err)
+		}
+		_ = resp.Body.Close()
+		return nil
+	}
+
+	return s.multipart(key, func(part int) (url.Values, http.Header, []byte, bool, error) {
+		body := make([]byte, s.opts.PartSize)
+		n, err := io.ReadFull(file, body)
+		if err == io.EOF {
+			return nil, nil, nil, false, nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, nil, nil, false, err
+		}
+		return nil, nil, body[:n], true, nil
+	})
+}
+
+// s3CompletedPart is a part of a multipart upload, identified by its ETag once uploaded
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// multipart writes the object at key in the parts returned by next, aborting the upload when any part fails
+func (s *S3Storage) multipart(key string, next func(part int) (url.Values, http.Header, []byte, bool, error)) error {
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil, http.StatusOK)
+	if err != nil {
+		return fmt.Errorf("failed to start upload of %s due to error %w", key, err)
+	}
+	initiated := struct {
+		UploadID string `xml:"UploadId"`
+	}{}
+	err = decodeResponse(resp, key, &initiated)
+	if err != nil {
+		return err
+	}
+
+	err = s.uploadParts(key, initiated.UploadID, next)
+	if err != nil {
+		resp, aerr := s.do(http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadID}}, nil, nil, http.StatusNoContent)
+		if aerr == nil {
+			_ = resp.Body.Close()
+		}
+		return fmt.Errorf("failed to upload %s due to error %w", key, err)
+	}
+	return nil
+}
+
+// uploadParts writes every part of the multipart upload, then completes it
+func (s *S3Storage) uploadParts(key string, uploadID string, next func(part int) (url.Values, http.Header, []byte, bool, error)) error {
+	parts := make([]s3CompletedPart, 0)
+	for part := 1; ; part++ {
+		query, header, body, ok, err := next(part)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if query == nil {
+			query = url.Values{}
+		}
+		query.Set("partNumber", strconv.Itoa(part))
+		query.Set("uploadId", uploadID)
+		resp, err := s.do(http.MethodPut, key, query, header, body, http.StatusOK)
+		if err != nil {
+			return err
+		}
+		etag := resp.Header.Get("ETag")
+		// a copied part reports its etag in the body rather than in a header
+		if header.Get("X-Amz-Copy-Source") != "" {
+			copied := struct {
+				ETag string `xml:"ETag"`
+			}{}
+			err = decodeResponse(resp, key, &copied)
+			if err != nil {
+				return err
+			}
+			etag = copied.ETag
+		} else {
+			_ = resp.Body.Close()
+		}
+		parts = append(parts, s3CompletedPart{PartNumber: part, ETag: etag})
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(resp, key, nil)
+}
+
+// copyObject copies the object within the bucket to dstKey
+func (s *S3Storage) copyObject(object s3Object, dstKey string) error {
+	source := http.Header{}
+	source.Set("X-Amz-Copy-Source", s3Escape("/"+s.opts.Bucket+"/"+object.Key, true))
+	if object.Size <= s.copyPartSize {
+		resp, err := s.do(http.MethodPut, dstKey, nil, source, nil, http.StatusOK)
+		if err != nil {
+			return fmt.Errorf("failed to copy %s due to error %w", object.Key, err)
+		}
+		return decodeResponse(resp, dstKey, nil)
+	}
+
+	return s.multipart(dstKey, func(part int) (url.Values, http.Header, []byte, bool, error) {
+		start := int64(part-1) * s.copyPartSize
+		if start >= object.Size {
+			return nil, nil, nil, false, nil
+		}
+		end := min(start+s.copyPartSize, object.Size) - 1
+		header := source.Clone()
+		header.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", start, end))
+		return nil, header, nil, true, nil
+	})
+}
+
+// objects returns the object at name, or every object below the folder at name
+func (s *S3Storage) objects(name string) ([]s3Object, error) {
+	objects, _, err := s.list(s.folderKey(name), "")
+	if err != nil || len(objects) > 0 {
+		return objects, err
+	}
+	size, ok, err := s.head(s.key(name))
+	if err != nil || !ok {
+		return objects, err
+	}
+	return []s3Object{{Key: s.key(name), Size: size}}, nil
+}
+
+func (s *S3Storage) Rename(src string, dst string) error {
+	objects, err := s.objects(src)
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return fmt.Errorf("%s does not exist: %w", src, fs.ErrNotExist)
+	}
+
+	// every object is copied before any is deleted, so an interrupted rename leaves a complete copy of src behind
+	keys := make([]string, 0, len(objects))
+	for _, object := range objects {
+		err = s.copyObject(object, s.key(dst)+strings.TrimPrefix(object.Key, s.key(src)))
+		if err != nil {
+			return err
+		}
+		keys = append(keys, object.Key)
+	}
+	return s.deleteObjects(keys)
+}
+
+func (s *S3Storage) RemoveAll(name string) error {
+	objects, err := s.objects(name)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(objects))
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	return s.deleteObjects(keys)
+}
+
+// s3DeleteResult is the response to a request deleting several objects, listing those which failed
+type s3DeleteResult struct {
+	Errors []struct {
+		Key     string `xml:"Key"`
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	} `xml:"Error"`
+}
+
+// deleteObjects deletes the objects at keys, in as few requests as possible
+func (s *S3Storage) deleteObjects(keys []string) error {
+	for len(keys) > 0 {
+		batch := keys[:min(len(keys), s3MaxDeleteKeys)]
+		keys = keys[len(batch):]
+
+		request := struct {
+			XMLName xml.Name `xml:"Delete"`
+			Quiet   bool     `xml:"Quiet"`
+			Objects []struct {
+				Key string `xml:"Key"`
+			} `xml:"Object"`
+		}{Quiet: true}
+		for _, key := range batch {
+			request.Objects = append(request.Objects, struct {
+				Key string `xml:"Key"`
+			}{Key: key})
+		}
+		body, err := xml.Marshal(request)
+		if err != nil {
+			return err
+		}
+		resp, err := s.do(http.MethodPost, "", url.Values{"delete": {""}}, nil, body, http.StatusOK)
+		if err != nil {
+			return fmt.Errorf("failed to delete objects due to error %w", err)
+		}
+		result := s3DeleteResult{}
+		data, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err == nil {
+			err = xml.Unmarshal(data, &result)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to decode response deleting objects due to error %w", err)
+		}
+		if len(result.Errors) > 0 {
+			failed := result.Errors[0]
+			return fmt.Errorf("failed to delete %d objects, such as %s: %s: %s", len(result.Errors), failed.Key, failed.Code, failed.Message)
+		}
+	}
+	return nil
+}
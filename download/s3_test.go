@@ -0,0 +1,575 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-process S3 compatible service holding a single bucket, which rejects requests whose signature
+// does not match
+type fakeS3 struct {
+	t       *testing.T
+	bucket  string
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	// calls counts the requests of each operation, such as copy or upload-part
+	calls map[string]int
+	// failComplete fails every multipart upload when it is completed
+	failComplete bool
+	// failNext fails that many of the next requests with SlowDown
+	failNext int
+}
+
+// newTestS3Storage returns an S3Storage of a fake service below the prefix backups/, listing two keys per page
+func newTestS3Storage(t *testing.T, partSize int64) (*S3Storage, *fakeS3) {
+	t.Helper()
+	fake := &fakeS3{
+		t:       t,
+		bucket:  "gubber",
+		objects: make(map[string][]byte),
+		uploads: make(map[string]map[int][]byte),
+		calls:   make(map[string]int),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	storage, err := NewS3Storage(context.Background(), S3Options{
+		Endpoint:        server.URL,
+		Region:          "eu-west-2",
+		Bucket:          fake.bucket,
+		Prefix:          "/backups/",
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "s3-secret-access-key",
+		PathStyle:       true,
+		PartSize:        partSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.pageSize = 2
+	storage.retryDelay = time.Millisecond
+	return storage, fake
+}
+
+// fail writes an S3 error response
+func (f *fakeS3) fail(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+// checkSignature reports whether the request was signed with the secret of the test storage
+func (f *fakeS3) checkSignature(r *http.Request, body []byte) bool {
+	hash := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(hash[:]) {
+		return false
+	}
+	if md5sum := r.Header.Get("Content-MD5"); md5sum != "" {
+		sum := md5.Sum(body)
+		if md5sum != base64.StdEncoding.EncodeToString(sum[:]) {
+			return false
+		}
+	}
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+	fields := make(map[string]string)
+	for _, field := range strings.Split(auth, ", ") {
+		name, value, _ := strings.Cut(field, "=")
+		fields[name] = value
+	}
+	amzDate := r.Header.Get("X-Amz-Date")
+	if len(amzDate) < 8 || fields["Credential"] != "AKIDEXAMPLE/"+amzDate[:8]+"/eu-west-2/s3/aws4_request" {
+		return false
+	}
+	canonical := canonicalRequest(r, strings.Split(fields["SignedHeaders"], ";"), r.Header.Get("X-Amz-Content-Sha256"))
+	return fields["Signature"] == requestSignature("s3-secret-access-key", "eu-west-2", amzDate, canonical)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		f.t.Error(err)
+		return
+	}
+	if !f.checkSignature(r, body) {
+		f.t.Errorf("%s %s has an invalid signature", r.Method, r.URL)
+		f.fail(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/"+f.bucket+"/") {
+		f.fail(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/"+f.bucket+"/")
+	query := r.URL.Query()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failNext > 0 {
+		f.failNext--
+		f.calls["failed"]++
+		f.fail(w, http.StatusServiceUnavailable, "SlowDown")
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && query.Get("list-type") == "2":
+		f.calls["list"]++
+		f.list(w, query)
+	case r.Method == http.MethodPost && query.Has("delete"):
+		f.calls["delete"]++
+		request := struct {
+			Objects []struct {
+				Key string `xml:"Key"`
+			} `xml:"Object"`
+		}{}
+		if err := xml.Unmarshal(body, &request); err != nil {
+			f.fail(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		for _, object := range request.Objects {
+			delete(f.objects, object.Key)
+		}
+		_, _ = fmt.Fprint(w, "<DeleteResult></DeleteResult>")
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.calls["create-upload"]++
+		id := strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[id] = make(map[int][]byte)
+		_, _ = fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		part, _ := strconv.Atoi(query.Get("partNumber"))
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			f.calls["upload-part-copy"]++
+			data, ok := f.copySource(source)
+			var start, end int
+			if _, err := fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &start, &end); !ok || err != nil || end >= len(data) {
+				f.fail(w, http.StatusBadRequest, "InvalidRange")
+				return
+			}
+			parts[part] = data[start : end+1]
+			_, _ = fmt.Fprintf(w, "<CopyPartResult><ETag>%s</ETag></CopyPartResult>", etag(parts[part]))
+			return
+		}
+		f.calls["upload-part"]++
+		parts[part] = body
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		f.calls["complete-upload"]++
+		parts, ok := f.uploads[query.Get("uploadId")]
+		request := struct {
+			Parts []s3CompletedPart `xml:"Part"`
+		}{}
+		if !ok || xml.Unmarshal(body, &request) != nil || len(request.Parts) == 0 {
+			f.fail(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		data := make([]byte, 0)
+		for i, part := range request.Parts {
+			if f.failComplete || part.PartNumber != i+1 || part.ETag != etag(parts[part.PartNumber]) {
+				// a failed completion is reported in the body of a successful response
+				_, _ = fmt.Fprint(w, "<Error><Code>InvalidPart</Code><Message>InvalidPart</Message></Error>")
+				return
+			}
+			data = append(data, parts[part.PartNumber]...)
+		}
+		delete(f.uploads, query.Get("uploadId"))
+		f.objects[key] = data
+		_, _ = fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		f.calls["abort-upload"]++
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		f.calls["copy"]++
+		data, ok := f.copySource(r.Header.Get("X-Amz-Copy-Source"))
+		if !ok {
+			f.fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		f.objects[key] = data
+		_, _ = fmt.Fprintf(w, "<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>", etag(data))
+	case r.Method == http.MethodPut:
+		f.calls["put"]++
+		f.objects[key] = body
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		_, _ = w.Write(data)
+	default:
+		f.fail(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// copySource returns the object named by the x-amz-copy-source header
+func (f *fakeS3) copySource(source string) ([]byte, bool) {
+	key, ok := strings.CutPrefix(source, "/"+f.bucket+"/")
+	if !ok {
+		return nil, false
+	}
+	data, ok := f.objects[key]
+	return data, ok
+}
+
+// list writes a page of a ListObjectsV2 response
+func (f *fakeS3) list(w http.ResponseWriter, query map[string][]string) {
+	get := func(name string) string {
+		if len(query[name]) == 0 {
+			return ""
+		}
+		return query[name][0]
+	}
+	prefix, delimiter := get("prefix"), get("delimiter")
+	maxKeys, err := strconv.Atoi(get("max-keys"))
+	if err != nil {
+		maxKeys = 1000
+	}
+
+	// the entries of the listing are keys, or the common prefixes of keys with a delimiter after prefix
+	entries := make(map[string]bool)
+	for key := range f.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			entries[key[:len(prefix)+i+1]] = true
+			continue
+		}
+		entries[key] = false
+	}
+	sorted := make([]string, 0, len(entries))
+	for entry := range entries {
+		if entry > get("continuation-token") {
+			sorted = append(sorted, entry)
+		}
+	}
+	sort.Strings(sorted)
+
+	result := "<ListBucketResult>"
+	for i, entry := range sorted {
+		if i == maxKeys {
+			result += fmt.Sprintf("<IsTruncated>true</IsTruncated><NextContinuationToken>%s</NextContinuationToken>", sorted[i-1])
+			break
+		}
+		if entries[entry] {
+			result += fmt.Sprintf("<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>", entry)
+		} else {
+			result += fmt.Sprintf("<Contents><Key>%s</Key><Size>%d</Size></Contents>", entry, len(f.objects[entry]))
+		}
+	}
+	_, _ = fmt.Fprint(w, result+"</ListBucketResult>")
+}
+
+// etag returns the quoted md5 checksum S3 gives as the etag of data
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// writeLocalFile writes content to a file in a temp folder, returning its path
+func writeLocalFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readStored returns the content of the file at name in storage
+func readStored(t *testing.T, storage Storage, name string) string {
+	t.Helper()
+	reader, err := storage.Open(name)
+	if err != nil {
+		t.Fatalf("Open(%s) error: %v", name, err)
+	}
+	defer func() { _ = reader.Close() }()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSigningKey(t *testing.T) {
+	// the example of deriving a signing key from the AWS signature version 4 documentation
+	key := signingKey("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20120215", "us-east-1", "iam")
+	want := "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d"
+	if got := hex.EncodeToString(key); got != want {
+		t.Errorf("signingKey() = %s, want %s", got, want)
+	}
+}
+
+func TestS3Storage_PutAndList(t *testing.T) {
+	storage, fake := newTestS3Storage(t, 16)
+
+	small := "a small bundle"
+	large := strings.Repeat("0123456789", 5)
+	files := map[string]string{
+		"T-0/org/small.bundle":                  small,
+		"T-0/org/large.bundle":                  large,
+		"T-0/org/repo+wiki.bundle":              small,
+		"T-0/group/sub/proj.bundle":             small,
+		testGeneration(1) + "/org/small.bundle": small,
+		testGeneration(10) + "/org/repo.bundle": small,
+		"T-0/org/repo.releases/r.js":            small,
+	}
+	for name, content := range files {
+		if err := storage.Put(writeLocalFile(t, content), name); err != nil {
+			t.Fatalf("Put(%s) error: %v", name, err)
+		}
+	}
+	if fake.calls["put"] != 6 {
+		t.Errorf("%d files were uploaded whole, want 6", fake.calls["put"])
+	}
+	// the 50 byte bundle is uploaded in four parts of at most 16 bytes
+	if fake.calls["create-upload"] != 1 || fake.calls["upload-part"] != 4 || fake.calls["complete-upload"] != 1 {
+		t.Errorf("multipart calls = %v, want one upload of 4 parts", fake.calls)
+	}
+	if _, ok := fake.objects["backups/T-0/org/large.bundle"]; !ok {
+		t.Errorf("objects = %v, want keys below the prefix", fake.objects)
+	}
+	for name, content := range files {
+		if got := readStored(t, storage, name); got != content {
+			t.Errorf("Open(%s) = %q, want %q", name, got, content)
+		}
+	}
+
+	listed, err := storage.List("T-0/org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"T-0/org/large.bundle", "T-0/org/repo+wiki.bundle", "T-0/org/repo.releases/r.js", "T-0/org/small.bundle"}
+	if strings.Join(listed, ",") != strings.Join(want, ",") {
+		t.Errorf("List(T-0/org) = %v, want %v", listed, want)
+	}
+	generations, err := listGenerations(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// T-0 is not named by its time, so is not a generation
+	if want := []string{testGeneration(1), testGeneration(10)}; fmt.Sprint(generations) != fmt.Sprint(want) {
+		t.Errorf("listGenerations() = %v, want %v", generations, want)
+	}
+	folders, err := storage.Folders("T-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(folders, ",") != "group,org" {
+		t.Errorf("Folders(T-0) = %v, want group and org", folders)
+	}
+
+	for name, want := range map[string]bool{"T-0/org/small.bundle": true, "T-0/group": true, "T-0/gro": false, "T-2": false} {
+		if got, err := storage.Exists(name); err != nil || got != want {
+			t.Errorf("Exists(%s) = %v, %v, want %v", name, got, err, want)
+		}
+	}
+	if _, err := storage.Open("T-0/org/missing.bundle"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Open() of a missing file error = %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestS3Storage_RenameAndRemoveAll(t *testing.T) {
+	storage, fake := newTestS3Storage(t, 1024)
+	storage.copyPartSize = 16
+
+	large := strings.Repeat("abcdefghij", 4)
+	for name, content := range map[string]string{
+		"T-0/org/large.bundle": large,
+		"T-0/org/small.bundle": "small",
+		"T-1/org/old.bundle":   "old",
+		"T-1/org/small.bundle": "stale",
+	} {
+		if err := storage.Put(writeLocalFile(t, content), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// renaming into an existing folder merges the two, replacing the files already there
+	if err := storage.Rename("T-0", "T-1"); err != nil {
+		t.Fatalf("Rename() error: %v", err)
+	}
+	if exists, _ := storage.Exists("T-0"); exists {
+		t.Error("T-0 still exists after it was renamed")
+	}
+	for name, want := range map[string]string{"T-1/org/large.bundle": large, "T-1/org/small.bundle": "small", "T-1/org/old.bundle": "old"} {
+		if got := readStored(t, storage, name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	// the 40 byte bundle is copied in three parts of at most 16 bytes, and the small one in a single request
+	if fake.calls["upload-part-copy"] != 3 || fake.calls["copy"] != 1 {
+		t.Errorf("copy calls = %v, want 3 part copies and 1 copy", fake.calls)
+	}
+
+	// a single file is renamed too
+	if err := storage.Rename("T-1/org/old.bundle", "T-2/org/old.bundle"); err != nil {
+		t.Fatalf("Rename() of a file error: %v", err)
+	}
+	if got := readStored(t, storage, "T-2/org/old.bundle"); got != "old" {
+		t.Errorf("T-2/org/old.bundle = %q, want old", got)
+	}
+	if err := storage.Rename("T-5", "T-6"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Rename() of a missing folder error = %v, want fs.ErrNotExist", err)
+	}
+
+	if err := storage.RemoveAll("T-1"); err != nil {
+		t.Fatalf("RemoveAll() error: %v", err)
+	}
+	if err := storage.RemoveAll("T-2/org/old.bundle"); err != nil {
+		t.Fatalf("RemoveAll() of a file error: %v", err)
+	}
+	if err := storage.RemoveAll("T-9"); err != nil {
+		t.Errorf("RemoveAll() of a missing folder error: %v", err)
+	}
+	if len(fake.objects) != 0 {
+		t.Errorf("objects = %v, want none left", fake.objects)
+	}
+}
+
+func TestS3Storage_ReportsErrors(t *testing.T) {
+	storage, fake := newTestS3Storage(t, 16)
+
+	// a missing bucket is an error rather than an empty backup location
+	storage.opts.Bucket = "missing"
+	if _, err := storage.Folders(""); err == nil || !strings.Contains(err.Error(), "NoSuchBucket") || errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Folders() of a missing bucket error = %v, want NoSuchBucket", err)
+	}
+	storage.opts.Bucket = fake.bucket
+
+	// an upload whose completion fails is aborted, so its parts are not left in the bucket
+	fake.failComplete = true
+	if err := storage.Put(writeLocalFile(t, strings.Repeat("x", 40)), "T-0/org/repo.bundle"); err == nil || !strings.Contains(err.Error(), "InvalidPart") {
+		t.Errorf("Put() error = %v, want InvalidPart", err)
+	}
+	if fake.calls["abort-upload"] != 1 || len(fake.uploads) != 0 || len(fake.objects) != 0 {
+		t.Errorf("calls = %v, uploads = %v, want the upload aborted", fake.calls, fake.uploads)
+	}
+}
+
+func TestS3Storage_RetriesTransientErrors(t *testing.T) {
+	storage, fake := newTestS3Storage(t, 16)
+
+	fake.failNext = 2
+	if err := storage.Put(writeLocalFile(t, "small"), "T-0/org/repo.bundle"); err != nil {
+		t.Fatalf("Put() error: %v", err)
+	}
+	fake.failNext = 1
+	if got := readStored(t, storage, "T-0/org/repo.bundle"); got != "small" {
+		t.Errorf("Open() = %q, want small", got)
+	}
+	if fake.calls["failed"] != 3 || fake.calls["put"] != 1 {
+		t.Errorf("calls = %v, want each request retried until it succeeded", fake.calls)
+	}
+
+	// starting a multipart upload is not idempotent, so is not retried
+	fake.failNext = 1
+	if err := storage.Put(writeLocalFile(t, strings.Repeat("x", 40)), "T-0/org/big.bundle"); err == nil || !strings.Contains(err.Error(), "SlowDown") {
+		t.Errorf("Put() error = %v, want SlowDown", err)
+	}
+	if fake.calls["failed"] != 4 || fake.calls["create-upload"] != 0 {
+		t.Errorf("calls = %v, want the upload not retried", fake.calls)
+	}
+
+	// a request which keeps failing gives up
+	fake.failNext = s3MaxRetries + 1
+	if _, err := storage.Exists("T-0/org/repo.bundle"); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("Exists() error = %v, want the last failure", err)
+	}
+}
+
+func TestMigrateReposToStorage_S3(t *testing.T) {
+	storage, fake := newTestS3Storage(t, 64)
+	work := newWorkRepo(t)
+	location := filepath.Join(t.TempDir(), "state")
+	tmpDir := t.TempDir()
+	dl := &gitDownloader{t: t, work: work}
+	repos := []*Repository{makeRepo("org", "repo"), makeRepo("org", "other")}
+
+	for i := 0; i < 3; i++ {
+		commitFile(t, work, "file.txt", string(rune('a'+i)))
+		if err := MigrateReposToStorage(dl, storage, nil, repos, &location, Retention{Last: 5}, &tmpDir); err != nil {
+			t.Fatalf("MigrateReposToStorage() run %d error: %v", i, err)
+		}
+	}
+
+	generations, err := listGenerations(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(generations) != 3 {
+		t.Fatalf("generations = %v, want 3", generations)
+	}
+	// the generations only pass through the local disk while the older generation is thinned
+	if Exists(GenerationPath(location, generations[0])) || Exists(journalPath(location)) {
+		t.Error("the generations or the journal were left in the backup location")
+	}
+	// every repo changed, so nothing was promoted, and the generations are named by their time so are never renamed
+	if fake.calls["upload-part"] == 0 || fake.calls["copy"] != 0 {
+		t.Errorf("calls = %v, want multipart uploads and no copies within the bucket", fake.calls)
+	}
+
+	// the older generations hold thin bundles, which depend on the newer generation
+	thin := readStored(t, storage, generations[1]+"/org/repo.bundle")
+	if !strings.Contains(thin, "\n-") {
+		t.Errorf("%s/org/repo.bundle has no prerequisites, want a thin bundle", generations[1])
+	}
+
+	// the oldest thin bundle is restored from the bucket by rebuilding it from the newer generations
+	bundle, err := FindBundle(storage, "org/repo", 2)
+	if err != nil {
+		t.Fatalf("FindBundle() error: %v", err)
+	}
+	dest := filepath.Join(t.TempDir(), "restored")
+	if err := RestoreBundle(context.Background(), storage, bundle, dest, nil); err != nil {
+		t.Fatalf("RestoreBundle() error: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, "file.txt")); err != nil || string(data) != "a" {
+		t.Errorf("restored file.txt = %q, %v, want the content of the first backup", data, err)
+	}
+	if problems, err := Fsck("", storage, &Retention{Last: 5}, nil); err != nil || len(problems) != 0 {
+		t.Errorf("Fsck() = %v, %v, want no problems", problems, err)
+	}
+
+	report, err := Verify(storage, nil)
+	if err != nil {
+		t.Fatalf("Verify() error: %v", err)
+	}
+	if !report.OK() || report.Checked != 6 {
+		t.Errorf("Verify() = %+v, want 6 files matching their manifests", report)
+	}
+	corrupt := generations[2] + "/org/other.bundle"
+	fake.objects["backups/"+corrupt] = bytes.ToUpper(fake.objects["backups/"+corrupt])
+	report, err = Verify(storage, nil)
+	if err != nil {
+		t.Fatalf("Verify() error: %v", err)
+	}
+	if len(report.Corrupt) != 1 || report.Corrupt[0] != corrupt {
+		t.Errorf("Corrupt = %v, want %s", report.Corrupt, corrupt)
+	}
+}
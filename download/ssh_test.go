@@ -0,0 +1,134 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSSH puts an ssh command on the PATH which serves the repos below root and logs its arguments to the returned file
+func fakeSSH(t *testing.T, root string) string {
+	t.Helper()
+	bin := t.TempDir()
+	log := filepath.Join(t.TempDir(), "ssh.log")
+	script := `#!/bin/sh
+echo "$@" >> "` + log + `"
+if [ -n "$FAKE_SSH_HOST_KEY" ]; then
+	echo "Host key verification failed." >&2
+	exit 255
+fi
+for command; do :; done
+cd "` + root + `" && exec sh -c "$command"
+`
+	if err := os.WriteFile(filepath.Join(bin, "ssh"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return log
+}
+
+func TestDownloadRepo_SSH(t *testing.T) {
+	work := newWorkRepo(t)
+	root := t.TempDir()
+	testGit(t, root, "clone", "--bare", work, filepath.Join(root, "org", "repo.git"))
+	log := fakeSSH(t, root)
+
+	d := NewDownloader(context.Background(), WithSSH("/keys/deploy key", "/keys/known_hosts"))
+	repo := &Repository{
+		Forge:       ForgeGitHub,
+		Owner:       "org",
+		Name:        "repo",
+		CloneURL:    "https://github.example.com/org/repo.git",
+		Credentials: &StaticCredentials{Username: "x-access-token", Password: "ghp_unusedunusedunusedunused"},
+	}
+	destDir := t.TempDir()
+	if err := d.DownloadRepo(repo, &destDir); err != nil {
+		t.Fatalf("DownloadRepo() error: %v", err)
+	}
+	if !Exists(filepath.Join(destDir, "org", "repo.bundle")) {
+		t.Error("bundle was not created over ssh")
+	}
+
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := string(data)
+	for _, want := range []string{"-i /keys/deploy key", "UserKnownHostsFile=/keys/known_hosts", "StrictHostKeyChecking=yes", "git@github.example.com", "org/repo.git"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("ssh arguments %q do not contain %q", args, want)
+		}
+	}
+}
+
+func TestDownloadRepos_SSHHostKeyFailure(t *testing.T) {
+	log := fakeSSH(t, t.TempDir())
+	t.Setenv("FAKE_SSH_HOST_KEY", "1")
+
+	d := NewDownloader(context.Background(), WithSSH("", ""), WithRetries(3, time.Millisecond))
+	repo := &Repository{Forge: ForgeGitHub, Owner: "org", Name: "repo", CloneURL: "https://github.com/org/repo.git"}
+	destDir := t.TempDir()
+	err := d.DownloadRepos([]*Repository{repo}, &destDir)
+	if !errors.Is(err, ErrHostKeyVerification) {
+		t.Fatalf("DownloadRepos() error = %v, want ErrHostKeyVerification", err)
+	}
+
+	// host key failures are not retried
+	data, _ := os.ReadFile(log)
+	if attempts := strings.Count(string(data), "\n"); attempts != 1 {
+		t.Errorf("ssh ran %d times, want 1", attempts)
+	}
+
+	if _, err := d.ListRefs(repo); !errors.Is(err, ErrHostKeyVerification) {
+		t.Errorf("ListRefs() error = %v, want ErrHostKeyVerification", err)
+	}
+}
+
+func TestDownloader_CloneURLs(t *testing.T) {
+	repo := &Repository{
+		CloneURL: "https://gitlab.example.com/group/sub/repo.git",
+		WikiURL:  "https://gitlab.example.com/group/sub/repo.wiki.git",
+	}
+
+	cloneURL, wikiURL := NewDownloader(context.Background()).cloneURLs(repo)
+	if cloneURL != repo.CloneURL || wikiURL != repo.WikiURL {
+		t.Errorf("https clone urls = %q, %q", cloneURL, wikiURL)
+	}
+
+	d := NewDownloader(context.Background(), WithSSH("", ""))
+	cloneURL, wikiURL = d.cloneURLs(repo)
+	if cloneURL != "git@gitlab.example.com:group/sub/repo.git" || wikiURL != "git@gitlab.example.com:group/sub/repo.wiki.git" {
+		t.Errorf("ssh clone urls = %q, %q", cloneURL, wikiURL)
+	}
+
+	// ssh urls from the forge's api are used as is, along with the user and port they give for the wiki, and local
+	// paths are never rewritten
+	repo.SSHURL = "ssh://gitlab@gitlab.example.com:2222/group/sub/repo.git"
+	if cloneURL, wikiURL = d.cloneURLs(repo); cloneURL != repo.SSHURL || wikiURL != "ssh://gitlab@gitlab.example.com:2222/group/sub/repo.wiki.git" {
+		t.Errorf("ssh clone urls = %q, %q, want the forge's", cloneURL, wikiURL)
+	}
+	bitbucket := &Repository{
+		CloneURL: "https://bitbucket.org/team/repo.git",
+		WikiURL:  "https://bitbucket.org/team/repo.git/wiki",
+		SSHURL:   "git@bitbucket.org:team/repo.git",
+	}
+	if _, wikiURL = d.cloneURLs(bitbucket); wikiURL != "git@bitbucket.org:team/repo.git/wiki" {
+		t.Errorf("ssh wiki url = %q, want the wiki next to the forge's ssh url", wikiURL)
+	}
+
+	// plain git remotes are cloned from the url they were configured with
+	remotes := NewRemoteLister()
+	if err := remotes.Add("kernel/linux", "https://git.kernel.org/pub/scm/linux/kernel/git/torvalds/linux.git"); err != nil {
+		t.Fatal(err)
+	}
+	if cloneURL, _ = d.cloneURLs(remotes.remotes[0]); cloneURL != "https://git.kernel.org/pub/scm/linux/kernel/git/torvalds/linux.git" {
+		t.Errorf("remote clone url = %q, want it unchanged", cloneURL)
+	}
+	if cloneURL, _ = d.cloneURLs(&Repository{CloneURL: "/srv/git/repo.git"}); cloneURL != "/srv/git/repo.git" {
+		t.Errorf("local clone url = %q, want it unchanged", cloneURL)
+	}
+}
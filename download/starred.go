@@ -0,0 +1,80 @@
+package download
+
+import (
+	"fmt"
+
+	"github.com/google/go-github/github"
+)
+
+// StarredOwner is the folder of each generation holding the bundles of starred repos, below the folder of their owner
+const StarredOwner = "starred"
+
+// IsStarred reports whether repo was created by GetStarredRepos
+func IsStarred(repo *Repository) bool {
+	return repo.Forge == ForgeGitHubStarred
+}
+
+// starredRepository represents a starred repo as a repository under StarredOwner, so it is kept apart from the repos
+// of the user and their orgs
+func (g *GitHubAPI) starredRepository(repo *github.Repository) *Repository {
+	r := g.repository(repo)
+	r.Forge = ForgeGitHubStarred
+	r.Owner = StarredOwner + "/" + r.Owner
+	return r
+}
+
+// StarredLister lists the repositories starred by the authenticated user, so the upstream projects they depend on
+// are backed up alongside their own repositories
+type StarredLister struct {
+	api *GitHubAPI
+}
+
+// NewStarredLister returns a StarredLister for the user of api
+func NewStarredLister(api *GitHubAPI) *StarredLister {
+	return &StarredLister{
+		api: api,
+	}
+}
+
+func (l *StarredLister) Host() string {
+	return l.api.Host()
+}
+
+func (l *StarredLister) ListRepos() ([]*Repository, error) {
+	fmt.Println("Loading starred repositories")
+	starred, err := l.api.GetStarredRepos()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Found %d starred repositories\n", len(starred))
+
+	fmt.Println("Removing empty starred repositories")
+	starred, err = l.api.RemoveEmptyRepos(starred)
+	if err != nil {
+		return nil, err
+	}
+
+	repos := make([]*Repository, 0, len(starred))
+	for _, repo := range starred {
+		repos = append(repos, l.api.starredRepository(repo))
+	}
+	return repos, nil
+}
+
+// GetStarredRepos returns the repositories that the authenticated user has starred
+func (g *GitHubAPI) GetStarredRepos() ([]*github.Repository, error) {
+	starred, err := listAll(func(opts github.ListOptions) ([]*github.StarredRepository, *github.Response, error) {
+		return g.client.Activity.ListStarred(g.ctx, "", &github.ActivityListStarredOptions{ListOptions: opts})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get starred repos: %w", err)
+	}
+
+	repos := make([]*github.Repository, 0, len(starred))
+	for _, star := range starred {
+		if star.Repository != nil {
+			repos = append(repos, star.Repository)
+		}
+	}
+	return repos, nil
+}
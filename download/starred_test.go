@@ -0,0 +1,83 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestStarredLister_ListRepos(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/user/starred", func(w http.ResponseWriter, r *http.Request) {
+		// the starred repos are split over two pages
+		if r.URL.Query().Get("page") == "" {
+			w.Header().Set("Link", `<`+r.URL.Path+`?page=2>; rel="next"`)
+			_, _ = fmt.Fprint(w, `[{"starred_at": "2024-01-01T00:00:00Z", "repo": {"name": "linux", "full_name": "torvalds/linux", "owner": {"login": "torvalds"}}}]`)
+			return
+		}
+		_, _ = fmt.Fprint(w, `[{"starred_at": "2024-01-02T00:00:00Z", "repo": {"name": "empty", "full_name": "someone/empty", "owner": {"login": "someone"}}}]`)
+	})
+	mux.HandleFunc("/repos/torvalds/linux/contents/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `[]`)
+	})
+	mux.HandleFunc("/repos/someone/empty/contents/", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message": "This repository is empty."}`, http.StatusNotFound)
+	})
+	api := newTestGitHubAPI(t, mux)
+	api.webURL = "https://github.com"
+
+	repos, err := NewStarredLister(api).ListRepos()
+	if err != nil {
+		t.Fatalf("ListRepos() error: %v", err)
+	}
+	if len(repos) != 1 {
+		t.Fatalf("expected the starred repo without the empty one, got %v", repos)
+	}
+	repo := repos[0]
+	if repo.FullName() != "starred/torvalds/linux" || !IsStarred(repo) {
+		t.Errorf("unexpected starred repository %+v", repo)
+	}
+	if repo.CloneURL != "https://github.com/torvalds/linux.git" {
+		t.Errorf("CloneURL = %q, want the upstream repo", repo.CloneURL)
+	}
+}
+
+func TestDownloadRepo_Starred(t *testing.T) {
+	work := newWorkRepo(t)
+	srcDir := t.TempDir()
+	testGit(t, srcDir, "clone", "--bare", work, filepath.Join(srcDir, "torvalds", "linux.git"))
+
+	// the metadata exporter fails the download if it calls the api for the starred repo
+	d := NewDownloader(context.Background(), WithExporters(NewMetadataExporter()))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/user/starred", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `[{"repo": {"name": "linux", "full_name": "torvalds/linux", "owner": {"login": "torvalds"}}}]`)
+	})
+	mux.HandleFunc("/repos/torvalds/linux/contents/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `[]`)
+	})
+	api := newTestGitHubAPI(t, mux)
+	repos, err := NewStarredLister(api).ListRepos()
+	if err != nil || len(repos) != 1 {
+		t.Fatalf("ListRepos() = %v, %v", repos, err)
+	}
+	repos[0].CloneURL = filepath.Join(srcDir, "torvalds", "linux.git")
+
+	location := t.TempDir()
+	tmp := t.TempDir()
+	if err := d.MigrateRepos(repos, &location, Retention{Last: 3}, &tmp); err != nil {
+		t.Fatalf("MigrateRepos() error: %v", err)
+	}
+	if !Exists(BundlePath(location, "starred/torvalds/linux", generationAt(location, 0))) {
+		t.Error("starred bundle was not created under the starred folder")
+	}
+
+	// starred repos keep their own retention
+	retentions := Overrides{}.RepoRetentions(append(repos, makeRepo("torvalds", "linux")), Retention{Last: 1})
+	if len(retentions) != 1 || retentions[repos[0].FullName()].Last != 1 {
+		t.Errorf("RepoRetentions() = %v, want only the starred repo kept in 1 generation", retentions)
+	}
+}
@@ -0,0 +1,265 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Storage holds the generations of a backup location at slash separated paths relative to its root
+type Storage interface {
+	// List returns the paths of every file below the folder at dir, sorted
+	List(dir string) ([]string, error)
+	// Folders returns the names of the folders directly below the folder at dir, sorted
+	Folders(dir string) ([]string, error)
+	// Exists reports whether a file, or a folder holding any file, exists at name
+	Exists(name string) (bool, error)
+	// Open returns the content of the file at name
+	Open(name string) (io.ReadCloser, error)
+	// Put writes the local file src to name, replacing any file already there
+	Put(src string, name string) error
+	// Rename moves the file, or every file below the folder, at src to dst, replacing the files already there
+	Rename(src string, dst string) error
+	// RemoveAll removes the file, or the folder and every file below it, at name
+	RemoveAll(name string) error
+}
+
+// listGenerations returns the names of the generations present in the storage, newest first
+func listGenerations(storage Storage) ([]string, error) {
+	folders, err := storage.Folders("")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list generations due to error %w", err)
+	}
+	return sortGenerations(folders), nil
+}
+
+// listFiles returns the paths of every file below the folder at dir, relative to it
+func listFiles(storage Storage, dir string) ([]string, error) {
+	files, err := storage.List(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files of %s due to error %w", dir, err)
+	}
+	for i, file := range files {
+		files[i] = strings.TrimPrefix(file, dir+"/")
+	}
+	return files, nil
+}
+
+// displayPath returns how the file at name is shown in the log, which is its path on the local disk for a
+// LocalStorage
+func displayPath(storage Storage, name string) string {
+	if local, ok := storage.(*LocalStorage); ok {
+		return local.path(name)
+	}
+	return name
+}
+
+// fetchFile returns a path on the local disk holding the file at name, downloading it into dir when needed
+func fetchFile(storage Storage, name string, dir string) (string, error) {
+	if local, ok := storage.(*LocalStorage); ok {
+		return local.path(name), nil
+	}
+
+	reader, err := storage.Open(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to download %s due to error %w", name, err)
+	}
+	defer func() { _ = reader.Close() }()
+
+	dst := filepath.Join(dir, filepath.FromSlash(name))
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return "", err
+	}
+	file, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(file, reader)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to download %s due to error %w", name, err)
+	}
+	return dst, nil
+}
+
+// stagingFolder is the folder of a LocalStorage holding the files being written, outside of every generation so a file
+// left behind by a crash is never taken for part of a backup
+const stagingFolder = ".staging"
+
+// LocalStorage keeps the generations in a folder on the local disk
+type LocalStorage struct {
+	root string
+}
+
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{
+		root: root,
+	}
+}
+
+// path returns the location of name on the local disk
+func (s *LocalStorage) path(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+func (s *LocalStorage) List(dir string) ([]string, error) {
+	files := make([]string, 0)
+	err := filepath.WalkDir(s.path(dir), func(file string, entry os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, file)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (s *LocalStorage) Folders(dir string) ([]string, error) {
+	entries, err := os.ReadDir(s.path(dir))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	folders := make([]string, 0)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			folders = append(folders, entry.Name())
+		}
+	}
+	return folders, nil
+}
+
+func (s *LocalStorage) Exists(name string) (bool, error) {
+	_, err := os.Stat(s.path(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *LocalStorage) Open(name string) (io.ReadCloser, error) {
+	return os.Open(s.path(name))
+}
+
+func (s *LocalStorage) Put(src string, name string) error {
+	dst := s.path(name)
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	// the file is staged on the same disk first, so it is never left half written, and keeps its modification time
+	staging := s.path(stagingFolder)
+	err = os.MkdirAll(staging, 0755)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(staging, "put-")
+	if err != nil {
+		return err
+	}
+	tmp := file.Name()
+	err = file.Close()
+	if err == nil {
+		err = Copy(src, tmp)
+	}
+	if err == nil {
+		err = os.Chmod(tmp, info.Mode())
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// removeStaging removes the files left in the staging folder by writes which were interrupted
+func (s *LocalStorage) removeStaging() error {
+	err := os.RemoveAll(s.path(stagingFolder))
+	if err != nil {
+		return fmt.Errorf("failed to remove interrupted writes due to error %w", err)
+	}
+	return nil
+}
+
+func (s *LocalStorage) Rename(src string, dst string) error {
+	err := os.MkdirAll(filepath.Dir(s.path(dst)), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(s.path(src), s.path(dst))
+	// a folder is merged into one which already exists, such as when an interrupted rename is undone
+	if errors.Is(err, os.ErrExist) {
+		files, lerr := s.List(src)
+		if lerr != nil {
+			return lerr
+		}
+		for _, file := range files {
+			target := path.Join(dst, strings.TrimPrefix(file, src+"/"))
+			if merr := os.MkdirAll(filepath.Dir(s.path(target)), 0755); merr != nil {
+				return merr
+			}
+			if merr := os.Rename(s.path(file), s.path(target)); merr != nil {
+				return merr
+			}
+		}
+		err = os.RemoveAll(s.path(src))
+	}
+	if err != nil {
+		return err
+	}
+	s.removeEmptyParents(src)
+	return nil
+}
+
+func (s *LocalStorage) RemoveAll(name string) error {
+	err := os.RemoveAll(s.path(name))
+	if err != nil {
+		return err
+	}
+	s.removeEmptyParents(name)
+	return nil
+}
+
+// removeEmptyParents removes the folders holding name which are left empty, below the generation holding it
+func (s *LocalStorage) removeEmptyParents(name string) {
+	for dir := path.Dir(name); strings.Contains(dir, "/"); dir = path.Dir(dir) {
+		if os.Remove(s.path(dir)) != nil {
+			return
+		}
+	}
+}
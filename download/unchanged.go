@@ -3,74 +3,146 @@ package download
 import (
 	"encoding/json"
 	"fmt"
-	"io"
 	"os"
-
-	"github.com/google/go-github/github"
+	"strings"
 )
 
+// JsonRepos is the content of repos.json, recording the refs of every repo as of its last download
 type JsonRepos struct {
-	Repos map[string]string `json:"repos"`
+	Repos map[string]RepoRefs `json:"repos"`
+	// Pending holds the refs listed for changed repos, which are moved to Repos once the repos are backed up
+	Pending map[string]RepoRefs `json:"pending,omitempty"`
 }
 
-func RemoveUnchangedRepos(lister RepoLister, location string, repos []*github.Repository) ([]*github.Repository, error) {
-	commits, err := lister.GetLastCommits(repos)
+// loadJsonRepos reads repos.json from location, ignoring a file or entries it cannot read
+func loadJsonRepos(location string, encryption *Encryption) JsonRepos {
+	jsonRepos := JsonRepos{
+		Repos:   make(map[string]RepoRefs),
+		Pending: make(map[string]RepoRefs),
+	}
+
+	byteValue, err := encryption.readFile(location + "/repos.json")
 	if err != nil {
-		return nil, fmt.Errorf("failed to get last commits due to error %w", err)
+		if !os.IsNotExist(err) {
+			fmt.Printf("failed to read repos.json due to error %v\n", err)
+		}
+		return jsonRepos
 	}
 
-	file, err := os.Open(location + "/repos.json")
+	var raw struct {
+		Repos   map[string]json.RawMessage `json:"repos"`
+		Pending map[string]RepoRefs        `json:"pending"`
+	}
+	err = json.Unmarshal(byteValue, &raw)
+	if err != nil {
+		fmt.Printf("failed to unmarshal repos.json due to error %v\n", err)
+		return jsonRepos
+	}
 
-	if os.IsNotExist(err) {
-		file, err = os.Create(location + "/repos.json")
-		if err != nil {
-			return nil, fmt.Errorf("failed to create repos.json due to error %w", err)
+	for name, value := range raw.Repos {
+		var refs RepoRefs
+		if json.Unmarshal(value, &refs) == nil && refs != nil {
+			jsonRepos.Repos[name] = refs
 		}
-		_, err := file.Write([]byte("{}"))
-		if err != nil {
-			return nil, fmt.Errorf("failed to write to repos.json due to error %w", err)
+	}
+	for name, refs := range raw.Pending {
+		if refs != nil {
+			jsonRepos.Pending[name] = refs
 		}
 	}
+	return jsonRepos
+}
 
+// saveJsonRepos writes repos.json to location, encrypted when encryption has recipients
+func saveJsonRepos(location string, jsonRepos JsonRepos, encryption *Encryption) error {
+	jsonReposBytes, err := json.Marshal(jsonRepos)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open repos.json due to error %w", err)
+		return fmt.Errorf("failed to marshal jsonRepos due to error %w", err)
 	}
 
-	byteValue, err := io.ReadAll(file)
+	err = encryption.writeFile(location+"/repos.json", jsonReposBytes, 0644)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read repos.json due to error %w", err)
+		return fmt.Errorf("failed to write to repos.json due to error %w", err)
 	}
+	return nil
+}
 
-	var jsonRepos JsonRepos
-	err = json.Unmarshal(byteValue, &jsonRepos)
-	if err != nil {
-		fmt.Printf("failed to unmarshal repos.json due to error %v\n", err)
-		jsonRepos = JsonRepos{
-			Repos: make(map[string]string),
+// exportKey is the key under which the version of an exporter is recorded next to the refs of a repo
+func exportKey(exporter RepoExporter) string {
+	return "export/" + exporter.Name()
+}
+
+// sameRefs reports whether the recorded refs of a repo match its current refs, ignoring the recorded export versions
+func sameRefs(recorded RepoRefs, current RepoRefs) bool {
+	count := 0
+	for name, id := range recorded {
+		if strings.HasPrefix(name, "export/") {
+			continue
+		}
+		if current[name] != id {
+			return false
 		}
+		count++
 	}
+	return count == len(current)
+}
 
-	newRepos := make([]*github.Repository, 0)
+// RemoveUnchangedRepos returns the repos whose branches or tags changed since they were last downloaded
+func RemoveUnchangedRepos(lister RefLister, location string, repos []*Repository, encryption *Encryption) ([]*Repository, error) {
+	refs, err := lister.GetRepoRefs(repos)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get repo refs due to error %w", err)
+	}
+	if len(refs) != len(repos) {
+		return nil, fmt.Errorf("got refs for %d repos, expected %d", len(refs), len(repos))
+	}
+
+	jsonRepos := loadJsonRepos(location, encryption)
+	jsonRepos.Pending = make(map[string]RepoRefs)
+
+	newRepos := make([]*Repository, 0)
 	for i, repo := range repos {
-		if commit, ok := jsonRepos.Repos[repo.GetFullName()]; ok {
-			if commit != *commits[i] {
-				newRepos = append(newRepos, repo)
-			}
-		} else {
+		// refs could not be listed, so download the repo and check it again next time
+		if refs[i] == nil {
 			newRepos = append(newRepos, repo)
+			continue
 		}
-		jsonRepos.Repos[repo.GetFullName()] = *commits[i]
-	}
 
-	jsonReposBytes, err := json.Marshal(jsonRepos)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal jsonRepos due to error %w", err)
+		if previous, ok := jsonRepos.Repos[repo.FullName()]; !ok || !sameRefs(previous, refs[i]) {
+			newRepos = append(newRepos, repo)
+			jsonRepos.Pending[repo.FullName()] = refs[i]
+		}
 	}
 
-	err = os.WriteFile(location+"/repos.json", jsonReposBytes, 0644)
+	err = saveJsonRepos(location, jsonRepos, encryption)
 	if err != nil {
-		return nil, fmt.Errorf("failed to write to repos.json due to error %w", err)
+		return nil, err
 	}
 
 	return newRepos, nil
 }
+
+// recordRepos moves the pending refs of the repos in repos.json, so they are not downloaded again until their refs change
+func recordRepos(location string, repos []*Repository, encryption *Encryption) error {
+	jsonRepos := loadJsonRepos(location, encryption)
+	for _, repo := range repos {
+		if refs, ok := jsonRepos.Pending[repo.FullName()]; ok {
+			jsonRepos.Repos[repo.FullName()] = refs
+			delete(jsonRepos.Pending, repo.FullName())
+		}
+	}
+	return saveJsonRepos(location, jsonRepos, encryption)
+}
+
+// ForgetRepos removes the provided repos from repos.json, so they are downloaded again on the next run
+func ForgetRepos(location string, names []string, encryption *Encryption) error {
+	if !Exists(location + "/repos.json") {
+		return nil
+	}
+
+	jsonRepos := loadJsonRepos(location, encryption)
+	for _, name := range names {
+		delete(jsonRepos.Repos, name)
+	}
+	return saveJsonRepos(location, jsonRepos, encryption)
+}
@@ -5,39 +5,46 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
-
-	"github.com/google/go-github/github"
 )
 
-type mockLister struct {
-	commits []*string
-	err     error
+type mockRefLister struct {
+	refs []RepoRefs
+	err  error
 }
 
-func (m *mockLister) GetOrgs() ([]*github.Organization, error) { return nil, nil }
-func (m *mockLister) GetRepos() ([]*github.Repository, error)  { return nil, nil }
-func (m *mockLister) GetOrgRepos(_ *github.Organization) ([]*github.Repository, error) {
-	return nil, nil
+func (m *mockRefLister) GetRepoRefs(_ []*Repository) ([]RepoRefs, error) {
+	return m.refs, m.err
 }
-func (m *mockLister) RemoveEmptyRepos(repos []*github.Repository) ([]*github.Repository, error) {
-	return repos, nil
+
+// mainAt returns the refs of a repo whose only branch is main, pointing at commit
+func mainAt(commit string) RepoRefs {
+	return RepoRefs{"refs/heads/main": commit}
 }
-func (m *mockLister) GetLastCommits(_ []*github.Repository) ([]*string, error) {
-	return m.commits, m.err
+
+// backUp records the refs of the changed repos, as MigrateRepos does once they are in a generation
+func backUp(t *testing.T, lister RefLister, location string, repos []*Repository, encryption *Encryption) {
+	t.Helper()
+	changed, err := RemoveUnchangedRepos(lister, location, repos, encryption)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := recordRepos(location, changed, encryption); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestRemoveUnchangedRepos_AllNew(t *testing.T) {
 	dir := t.TempDir()
 
-	repos := []*github.Repository{
+	repos := []*Repository{
 		makeRepo("org1", "repo1"),
 		makeRepo("org1", "repo2"),
 	}
 
 	commit1, commit2 := "abc123", "def456"
-	lister := &mockLister{commits: []*string{&commit1, &commit2}}
+	lister := &mockRefLister{refs: []RepoRefs{mainAt(commit1), mainAt(commit2)}}
 
-	result, err := RemoveUnchangedRepos(lister, dir, repos)
+	result, err := RemoveUnchangedRepos(lister, dir, repos, nil)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -50,18 +57,15 @@ func TestRemoveUnchangedRepos_AllNew(t *testing.T) {
 func TestRemoveUnchangedRepos_NoneChanged(t *testing.T) {
 	dir := t.TempDir()
 
-	repos := []*github.Repository{makeRepo("org1", "repo1")}
+	repos := []*Repository{makeRepo("org1", "repo1")}
 	commit := "abc123"
-	lister := &mockLister{commits: []*string{&commit}}
+	lister := &mockRefLister{refs: []RepoRefs{mainAt(commit)}}
 
 	// First call — seeds repos.json
-	_, err := RemoveUnchangedRepos(lister, dir, repos)
-	if err != nil {
-		t.Fatalf("first call error: %v", err)
-	}
+	backUp(t, lister, dir, repos, nil)
 
 	// Second call with same commit — should return empty
-	result, err := RemoveUnchangedRepos(lister, dir, repos)
+	result, err := RemoveUnchangedRepos(lister, dir, repos, nil)
 	if err != nil {
 		t.Fatalf("second call error: %v", err)
 	}
@@ -74,25 +78,22 @@ func TestRemoveUnchangedRepos_NoneChanged(t *testing.T) {
 func TestRemoveUnchangedRepos_SomeChanged(t *testing.T) {
 	dir := t.TempDir()
 
-	repos := []*github.Repository{
+	repos := []*Repository{
 		makeRepo("org1", "repo1"),
 		makeRepo("org1", "repo2"),
 	}
 
 	commit1, commit2 := "aaa", "bbb"
-	lister := &mockLister{commits: []*string{&commit1, &commit2}}
+	lister := &mockRefLister{refs: []RepoRefs{mainAt(commit1), mainAt(commit2)}}
 
 	// Seed
-	_, err := RemoveUnchangedRepos(lister, dir, repos)
-	if err != nil {
-		t.Fatal(err)
-	}
+	backUp(t, lister, dir, repos, nil)
 
 	// Change only repo2's commit
 	newCommit2 := "ccc"
-	lister.commits = []*string{&commit1, &newCommit2}
+	lister.refs = []RepoRefs{mainAt(commit1), mainAt(newCommit2)}
 
-	result, err := RemoveUnchangedRepos(lister, dir, repos)
+	result, err := RemoveUnchangedRepos(lister, dir, repos, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -100,8 +101,8 @@ func TestRemoveUnchangedRepos_SomeChanged(t *testing.T) {
 	if len(result) != 1 {
 		t.Fatalf("expected 1 changed repo, got %d", len(result))
 	}
-	if result[0].GetFullName() != "org1/repo2" {
-		t.Errorf("changed repo = %q, want %q", result[0].GetFullName(), "org1/repo2")
+	if result[0].FullName() != "org1/repo2" {
+		t.Errorf("changed repo = %q, want %q", result[0].FullName(), "org1/repo2")
 	}
 }
 
@@ -113,11 +114,11 @@ func TestRemoveUnchangedRepos_CorruptJSON(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	repos := []*github.Repository{makeRepo("org1", "repo1")}
+	repos := []*Repository{makeRepo("org1", "repo1")}
 	commit := "abc"
-	lister := &mockLister{commits: []*string{&commit}}
+	lister := &mockRefLister{refs: []RepoRefs{mainAt(commit)}}
 
-	result, err := RemoveUnchangedRepos(lister, dir, repos)
+	result, err := RemoveUnchangedRepos(lister, dir, repos, nil)
 	if err != nil {
 		t.Fatalf("should recover from corrupt JSON, got error: %v", err)
 	}
@@ -128,17 +129,14 @@ func TestRemoveUnchangedRepos_CorruptJSON(t *testing.T) {
 	}
 }
 
-func TestRemoveUnchangedRepos_WritesJSON(t *testing.T) {
+func TestRecordRepos_WritesJSON(t *testing.T) {
 	dir := t.TempDir()
 
-	repos := []*github.Repository{makeRepo("org1", "repo1")}
+	repos := []*Repository{makeRepo("org1", "repo1")}
 	commit := "abc123"
-	lister := &mockLister{commits: []*string{&commit}}
+	lister := &mockRefLister{refs: []RepoRefs{mainAt(commit)}}
 
-	_, err := RemoveUnchangedRepos(lister, dir, repos)
-	if err != nil {
-		t.Fatal(err)
-	}
+	backUp(t, lister, dir, repos, nil)
 
 	data, err := os.ReadFile(filepath.Join(dir, "repos.json"))
 	if err != nil {
@@ -150,8 +148,8 @@ func TestRemoveUnchangedRepos_WritesJSON(t *testing.T) {
 		t.Fatalf("repos.json invalid JSON: %v", err)
 	}
 
-	if j.Repos["org1/repo1"] != "abc123" {
-		t.Errorf("repos.json commit = %q, want %q", j.Repos["org1/repo1"], "abc123")
+	if j.Repos["org1/repo1"]["refs/heads/main"] != "abc123" {
+		t.Errorf("repos.json refs = %v, want main at %q", j.Repos["org1/repo1"], "abc123")
 	}
 }
 
@@ -159,11 +157,11 @@ func TestRemoveUnchangedRepos_NoReposJSON(t *testing.T) {
 	dir := t.TempDir()
 
 	// Don't create repos.json — should be auto-created
-	repos := []*github.Repository{makeRepo("org1", "repo1")}
+	repos := []*Repository{makeRepo("org1", "repo1")}
 	commit := "abc"
-	lister := &mockLister{commits: []*string{&commit}}
+	lister := &mockRefLister{refs: []RepoRefs{mainAt(commit)}}
 
-	result, err := RemoveUnchangedRepos(lister, dir, repos)
+	result, err := RemoveUnchangedRepos(lister, dir, repos, nil)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -172,7 +170,116 @@ func TestRemoveUnchangedRepos_NoReposJSON(t *testing.T) {
 		t.Errorf("expected 1 repo, got %d", len(result))
 	}
 
-	if !Exists(filepath.Join(dir, "repos.json")) {
-		t.Error("repos.json was not created")
+	// the refs are only recorded once the repo is backed up
+	if recorded := loadJsonRepos(dir, nil).Repos; len(recorded) != 0 {
+		t.Errorf("repos.json = %v, want no refs recorded before the repo was backed up", recorded)
+	}
+}
+
+func TestForgetRepos(t *testing.T) {
+	dir := t.TempDir()
+
+	repos := []*Repository{makeRepo("org1", "repo1"), makeRepo("org1", "repo2")}
+	commit1, commit2 := "abc123", "def456"
+	lister := &mockRefLister{refs: []RepoRefs{mainAt(commit1), mainAt(commit2)}}
+
+	backUp(t, lister, dir, repos, nil)
+	if err := ForgetRepos(dir, []string{"org1/repo1"}, nil); err != nil {
+		t.Fatalf("ForgetRepos() error: %v", err)
+	}
+
+	// repo1 was forgotten, so it is downloaded again even though it is unchanged
+	result, err := RemoveUnchangedRepos(lister, dir, repos, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 1 || result[0].FullName() != "org1/repo1" {
+		t.Errorf("expected only org1/repo1 to be changed, got %v", result)
+	}
+}
+
+func TestForgetRepos_NoReposJson(t *testing.T) {
+	if err := ForgetRepos(t.TempDir(), []string{"org1/repo1"}, nil); err != nil {
+		t.Errorf("ForgetRepos(, nil) error: %v", err)
+	}
+}
+
+func TestRemoveUnchangedRepos_TagMoved(t *testing.T) {
+	dir := t.TempDir()
+
+	repos := []*Repository{makeRepo("org1", "repo1")}
+	lister := &mockRefLister{refs: []RepoRefs{{"refs/heads/main": "aaa", "refs/tags/v1": "bbb"}}}
+	backUp(t, lister, dir, repos, nil)
+
+	// a new tag on an unchanged branch is a change
+	lister.refs = []RepoRefs{{"refs/heads/main": "aaa", "refs/tags/v1": "bbb", "refs/tags/v2": "ccc"}}
+	result, err := RemoveUnchangedRepos(lister, dir, repos, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 1 {
+		t.Errorf("expected new tag to be detected, got %d changed repos", len(result))
+	}
+	if err := recordRepos(dir, result, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// as is deleting a tag
+	lister.refs = []RepoRefs{{"refs/heads/main": "aaa", "refs/tags/v1": "bbb"}}
+	result, err = RemoveUnchangedRepos(lister, dir, repos, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 1 {
+		t.Errorf("expected deleted tag to be detected, got %d changed repos", len(result))
+	}
+}
+
+func TestRemoveUnchangedRepos_RefsUnavailable(t *testing.T) {
+	dir := t.TempDir()
+
+	repos := []*Repository{makeRepo("org1", "repo1")}
+	lister := &mockRefLister{refs: []RepoRefs{nil}}
+
+	for i := 0; i < 2; i++ {
+		result, err := RemoveUnchangedRepos(lister, dir, repos, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result) != 1 {
+			t.Errorf("run %d: expected repo with unknown refs to be downloaded, got %d", i, len(result))
+		}
+	}
+}
+
+func TestRemoveUnchangedRepos_LegacyHashes(t *testing.T) {
+	dir := t.TempDir()
+
+	// repos.json written by versions of gubber which hashed repository events
+	legacy := `{"repos":{"org1/repo1":"5d41402abc4b2a76b9719d911017c592"}}`
+	if err := os.WriteFile(filepath.Join(dir, "repos.json"), []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	repos := []*Repository{makeRepo("org1", "repo1")}
+	lister := &mockRefLister{refs: []RepoRefs{mainAt("abc")}}
+
+	result, err := RemoveUnchangedRepos(lister, dir, repos, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result) != 1 {
+		t.Errorf("expected legacy entry to be treated as changed, got %d repos", len(result))
+	}
+	if err := recordRepos(dir, result, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err = RemoveUnchangedRepos(lister, dir, repos, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 0 {
+		t.Errorf("expected repo to be unchanged once refs are recorded, got %d repos", len(result))
 	}
 }
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/josiahbull/gubber/download"
+)
+
+// identityFlag adds the -identity flag to flags, defaulting to AGE_IDENTITY_FILE
+func identityFlag(flags *flag.FlagSet) *string {
+	return flags.String("identity", os.Getenv("AGE_IDENTITY_FILE"), "age or ssh identity file to decrypt encrypted backups with")
+}
+
+// readEncryption returns the encryption decrypting with the identity file, or nil when there is none, in which case
+// only backups which are not encrypted can be read
+func readEncryption(identityFile string) (*download.Encryption, error) {
+	if identityFile == "" {
+		return nil, nil
+	}
+	return download.NewEncryption(nil, identityFile)
+}
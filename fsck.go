@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/josiahbull/gubber/config"
+	"github.com/josiahbull/gubber/download"
+)
+
+const fsckUsage = `usage: gubber fsck [-location dir] [-backups n] [-identity file]
+
+Checks the backup location, or the S3 bucket set by STORAGE, for interrupted rotations, generations the retention
+policy set by BACKUPS and the KEEP_ settings no longer keeps, and bundles which cannot be restored. Encrypted bundles
+are only checked when they can be decrypted with the identity file.
+`
+
+// errFsckProblems is returned by fsck when the backup location is inconsistent, after the problems were printed
+var errFsckProblems = errors.New("the backup location has problems")
+
+// fsck implements the `gubber fsck` command
+func fsck(args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), fsckUsage)
+		flags.PrintDefaults()
+	}
+	backups, retention, err := config.LoadRetention()
+	// without a retention policy every generation is kept
+	checkRetention := err == nil
+	location := flags.String("location", os.Getenv("LOCATION"), "backup location to check")
+	flags.IntVar(&backups, "backups", backups, "number of most recent generations kept, on top of those kept by the KEEP_ settings")
+	identity := identityFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return errors.New("unexpected arguments")
+	}
+	storage_config, err := config.LoadStorage()
+	if err != nil {
+		return err
+	}
+	if *location == "" && storage_config.Type == "local" {
+		return errors.New("no backup location provided, set LOCATION or pass -location")
+	}
+	storage, err := newStorage(context.Background(), storage_config, *location)
+	if err != nil {
+		return err
+	}
+
+	encryption, err := readEncryption(*identity)
+	if err != nil {
+		return err
+	}
+
+	var policy *download.Retention
+	if checkRetention || backups > 0 {
+		keep := newRetention(backups, retention)
+		policy = &keep
+	}
+	problems, err := download.Fsck(*location, storage, policy, encryption)
+	if err != nil {
+		return err
+	}
+	if len(problems) == 0 {
+		fmt.Println("No problems found in", storageName(storage_config, *location))
+		return nil
+	}
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	fmt.Printf("Found %d problems in %s\n", len(problems), storageName(storage_config, *location))
+	return errFsckProblems
+}
@@ -5,8 +5,15 @@ go 1.24.0
 toolchain go1.26.4
 
 require (
+	filippo.io/age v1.2.1
 	github.com/google/go-github v17.0.0+incompatible
+	golang.org/x/crypto v0.24.0
 	golang.org/x/oauth2 v0.35.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-require github.com/google/go-querystring v1.1.0 // indirect
+require (
+	filippo.io/edwards25519 v1.1.0 // indirect
+	github.com/google/go-querystring v1.1.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+)
@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/josiahbull/gubber/config"
@@ -10,6 +12,45 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		err := restore(os.Args[2:])
+		if err != nil {
+			fmt.Printf("failed to restore due to error %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "fsck" {
+		err := fsck(os.Args[2:])
+		if err != nil {
+			if !errors.Is(err, errFsckProblems) {
+				fmt.Printf("failed to check backup location due to error %v\n", err)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "prune" {
+		err := prune(os.Args[2:])
+		if err != nil {
+			fmt.Printf("failed to prune generations due to error %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		err := verify(os.Args[2:])
+		if err != nil {
+			if !errors.Is(err, errVerifyFailed) {
+				fmt.Printf("failed to verify backup location due to error %v\n", err)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+
 	config, err := config.NewConfig()
 	if err != nil {
 		fmt.Printf("failed to load config due to error %v\n", err)
@@ -18,90 +59,170 @@ func main() {
 
 	ctx := context.Background()
 
-	github := download.NewGitHubAPI(ctx, &config.Token)
-	downloader := download.NewDownloader(ctx, &config.Token)
+	storage, err := newStorage(ctx, config.Storage, config.Location)
+	if err != nil {
+		fmt.Printf("failed to create %s storage due to error %v\n", config.Storage.Type, err)
+		panic(err)
+	}
 
-	first := true
-	for {
-		if !first {
-			fmt.Printf("Sleeping for %d seconds\n", config.Interval)
-			time.Sleep(time.Duration(config.Interval) * time.Second)
+	// encrypt what is written from now on, decrypting what gubber reads back with the identity
+	var encryption *download.Encryption
+	if len(config.AgeRecipients) > 0 {
+		encryption, err = download.NewEncryption(config.AgeRecipients, config.AgeIdentityFile)
+		if err != nil {
+			fmt.Printf("failed to set up encryption due to error %v\n", err)
+			panic(err)
 		}
-		first = false
+	}
 
-		fmt.Println("Loading all repositories")
+	// finish or undo a rotation interrupted by a crash or by the container being stopped
+	err = download.RecoverRotation(config.Location, storage, encryption, time.Duration(config.Interval)*time.Second)
+	if err != nil {
+		fmt.Printf("failed to recover interrupted rotation due to error %v\n", download.Redact(err.Error()))
+		panic(err)
+	}
 
-		orgs, err := github.GetOrgs()
-		if err != nil {
-			fmt.Printf("failed to get orgs due to error %v\n", err)
-			continue
-		}
+	downloaderOpts := []download.DownloaderOption{
+		download.WithConcurrency(config.Concurrency),
+		download.WithRetries(config.MaxRetries, 5*time.Second),
+		download.WithStorage(storage),
+		download.WithEncryption(encryption),
+	}
+	if config.SSHClone {
+		downloaderOpts = append(downloaderOpts, download.WithSSH(config.SSHKeyFile, config.SSHKnownHostsFile))
+	}
+	overrides := make(download.Overrides, 0, len(config.Overrides))
+	for _, override := range config.Overrides {
+		overrides = append(overrides, download.Override{
+			Match:          override.Match,
+			Skip:           override.Skip,
+			Backups:        override.Backups,
+			ExportMetadata: override.ExportMetadata,
+		})
+	}
+	downloaderOpts = append(downloaderOpts, download.WithOverrides(overrides))
+	listers := make([]download.RepoLister, 0)
 
-		repos, err := github.GetRepos()
+	// repos listed by more than one source are backed up once, by the first source to list them
+	for _, source := range config.AllSources() {
+		source_listers, err := sourceListers(ctx, source)
 		if err != nil {
-			fmt.Printf("failed to get repos due to error %v\n", err)
-			continue
+			fmt.Printf("failed to create %s source due to error %v\n", source.Type, err)
+			panic(err)
 		}
+		listers = append(listers, source_listers...)
+	}
 
-		// load all the repos from the orgs
-		for _, org := range orgs {
-			fmt.Printf("Loading repos for org %s\n", org.GetLogin())
-			orgRepos, err := github.GetOrgRepos(org)
+	// the exporters use the api of whichever github token or app installation listed each repo
+	if config.ExportMetadata {
+		downloaderOpts = append(downloaderOpts, download.WithExporters(download.NewMetadataExporter()))
+	}
+	if config.ExportReleases {
+		downloaderOpts = append(downloaderOpts, download.WithExporters(download.NewReleaseExporter(storage, encryption)))
+	}
+
+	if len(config.GitRemotes) > 0 {
+		remotes := download.NewRemoteLister()
+		for _, remote := range config.GitRemotes {
+			err = remotes.Add(remote.FullName, remote.URL)
 			if err != nil {
-				fmt.Printf("failed to get org repos due to error %v for org %s\n", err, org.GetLogin())
-				continue
+				fmt.Printf("failed to add git remote due to error %v\n", err)
+				panic(err)
 			}
+		}
+		listers = append(listers, remotes)
+	}
 
-			// avoid duplicates by only adding repos that are not already in the list
-			for _, orgRepo := range orgRepos {
-				found := false
-				for _, repo := range repos {
-					if repo.GetFullName() == orgRepo.GetFullName() {
-						found = true
-						break
-					}
-				}
-				if !found {
-					repos = append(repos, orgRepo)
-				}
-			}
+	downloader := download.NewDownloader(ctx, downloaderOpts...)
+
+	first := true
+	var lastVerified time.Time
+	for {
+		if !first {
+			fmt.Printf("Sleeping for %d seconds\n", config.Interval)
+			time.Sleep(time.Duration(config.Interval) * time.Second)
 		}
+		first = false
 
-		fmt.Printf("Found %d repositories\n", len(repos))
+		// check the existing backups for bit rot before adding to them
+		if config.VerifyInterval > 0 && time.Since(lastVerified) >= time.Duration(config.VerifyInterval)*time.Second {
+			fmt.Println("Verifying backups")
+			report, err := download.Verify(storage, encryption)
+			if err != nil {
+				fmt.Printf("failed to verify backups due to error %v\n", err)
+			} else {
+				printVerifyReport(storageName(config.Storage, config.Location), report)
+				lastVerified = time.Now()
+			}
+		}
 
-		fmt.Println("Removing empty repositories")
+		fmt.Println("Loading all repositories")
 
-		repos, err = github.RemoveEmptyRepos(repos)
+		// a source which fails is left out of this run, rather than stopping the backups of the others
+		repos, err := download.ListAllRepos(listers...)
 		if err != nil {
-			fmt.Printf("failed to remove empty repos due to error %v\n", err)
+			fmt.Printf("failed to list repos due to error %v\n", download.Redact(err.Error()))
 			continue
 		}
-
-		fmt.Printf("Found %d repositories\n", len(repos))
+		summary := runSummary{filtered: download.FilteredRepos(repos, listers...)}
+		summary.listed = len(repos) + len(summary.filtered)
+		repos = overrides.Filter(repos)
+		// starred repos keep their own retention, which the backups of the overrides can still change
+		retention := newRetention(config.Backups, config.Retention)
+		retention.Repos = overrides.RepoRetentions(repos, newRetention(config.StarredBackups, config.StarredRetention))
+		summary.skipped = summary.listed - len(summary.filtered) - len(repos)
 
 		fmt.Println("Removing unchanged repositories")
-		repos, err = download.RemoveUnchangedRepos(github, config.Location, repos)
+		changed, err := download.RemoveUnchangedRepos(downloader, config.Location, repos, encryption)
 		if err != nil {
 			fmt.Printf("failed to remove unchanged repos due to error %v\n", err)
 			continue
 		}
+		summary.unchanged = len(repos) - len(changed)
+		summary.downloaded = len(changed)
+
+		// issues and pull requests change without a push, so unchanged repos whose exports changed are exported too
+		repos, err = downloader.WithUnchangedExports(config.Location, repos, changed)
+		if err != nil {
+			fmt.Printf("failed to check exports of unchanged repos due to error %v\n", err)
+			continue
+		}
+		summary.exported = len(repos) - len(changed)
 
 		// download all the repos that we have not downloaded yet
 		if len(repos) == 0 {
 			fmt.Println("No repos to download")
+			summary.print()
 			continue
 		}
 
-		fmt.Printf("Downloading %d repos\n", len(repos))
-
-		fmt.Printf("Downloading all %d repositories, and migrating old ones\n", len(repos))
+		fmt.Printf("Downloading %d repos, and exporting %d unchanged repos\n", len(changed), summary.exported)
 
-		err = downloader.MigrateRepos(repos, &config.Location, config.Backups, &config.TempLocation)
+		err = downloader.MigrateRepos(repos, &config.Location, retention, &config.TempLocation)
+		var downloadErr *download.DownloadError
+		isDownloadErr := errors.As(err, &downloadErr)
 		if err != nil {
-			fmt.Printf("failed to migrate repos due to error %v\n", err)
+			// the refs of repos which were not backed up are not recorded, so they are downloaded again next run
+			for _, repo := range changed {
+				if !isDownloadErr || downloadErr.Failed[repo.FullName()] != nil {
+					summary.failed++
+				}
+			}
+			fmt.Printf("failed to migrate repos due to error %v\n", download.Redact(err.Error()))
+		}
+		if err != nil && !isDownloadErr {
+			summary.print()
 			continue
 		}
 
+		if config.ExportReleases {
+			err = download.PruneReleaseAssets(storage, encryption)
+			if err != nil {
+				fmt.Printf("failed to prune release assets due to error %v\n", err)
+			}
+		}
+
+		summary.print()
 		fmt.Println("Done")
 	}
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/josiahbull/gubber/config"
+	"github.com/josiahbull/gubber/download"
+)
+
+const pruneUsage = `usage: gubber prune [-location dir] [-dry-run] [-identity file]
+
+Prunes the generations the retention policy set by BACKUPS and the KEEP_ settings no longer keeps, listing every
+generation with the rules keeping it. Generations are also pruned after every backup, so this is only needed to
+apply a changed policy straight away, or with -dry-run to preview it. Encrypted bundles are decrypted with the
+identity file and encrypted again to AGE_RECIPIENTS.
+`
+
+// newRetention returns the retention keeping the last backups generations along with those kept by retention
+func newRetention(backups int, retention config.Retention) download.Retention {
+	return download.Retention{
+		Last:    backups,
+		Daily:   retention.Daily,
+		Weekly:  retention.Weekly,
+		Monthly: retention.Monthly,
+		Yearly:  retention.Yearly,
+	}
+}
+
+// prune implements the `gubber prune` command
+func prune(args []string) error {
+	flags := flag.NewFlagSet("prune", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), pruneUsage)
+		flags.PrintDefaults()
+	}
+	location := flags.String("location", os.Getenv("LOCATION"), "backup location to prune")
+	dryRun := flags.Bool("dry-run", false, "list what would be pruned without removing anything")
+	identity := identityFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return errors.New("unexpected arguments")
+	}
+	if *location == "" {
+		return errors.New("no backup location provided, set LOCATION or pass -location")
+	}
+
+	backups, retention, err := config.LoadRetention()
+	if err != nil {
+		return err
+	}
+	storage_config, err := config.LoadStorage()
+	if err != nil {
+		return err
+	}
+	storage, err := newStorage(context.Background(), storage_config, *location)
+	if err != nil {
+		return err
+	}
+	recipients, err := config.LoadAgeRecipients()
+	if err != nil {
+		return err
+	}
+	var encryption *download.Encryption
+	if len(recipients) > 0 || *identity != "" {
+		encryption, err = download.NewEncryption(recipients, *identity)
+		if err != nil {
+			return err
+		}
+	}
+
+	plans, err := download.PruneGenerations(*location, storage, newRetention(backups, retention), encryption, *dryRun)
+	if err != nil {
+		return err
+	}
+	pruned := 0
+	for _, plan := range plans {
+		if plan.Keep() {
+			fmt.Printf("Keep:  %s (%s)\n", plan.Name, strings.Join(plan.Reasons, ", "))
+		} else {
+			fmt.Printf("Prune: %s\n", plan.Name)
+			pruned++
+		}
+	}
+	if *dryRun {
+		fmt.Printf("Would prune %d of %d generations in %s\n", pruned, len(plans), storageName(storage_config, *location))
+	} else {
+		fmt.Printf("Pruned %d of %d generations in %s\n", pruned, len(plans), storageName(storage_config, *location))
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/josiahbull/gubber/config"
+	"github.com/josiahbull/gubber/download"
+)
+
+const restoreUsage = `usage: gubber restore [-location dir] [-identity file] [-generation n | -date YYYY-MM-DD] owner/repo [dest]
+
+Restores owner/repo from the backup location, or the S3 bucket set by STORAGE, into dest (defaults to ./repo).
+Encrypted backups are decrypted with the identity file.
+`
+
+// parseRestoreDate accepts either a plain date, meaning the end of that day, or a full RFC3339 timestamp
+func parseRestoreDate(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	day, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q, expected YYYY-MM-DD or RFC3339", value)
+	}
+	return day.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+}
+
+// restore implements the `gubber restore` command
+func restore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), restoreUsage)
+		flags.PrintDefaults()
+	}
+	location := flags.String("location", os.Getenv("LOCATION"), "backup location to restore from")
+	generation := flags.Int("generation", 0, "generation to restore, 0 being the most recent backup")
+	date := flags.String("date", "", "restore the most recent backup taken on or before this date")
+	identity := identityFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		return errors.New("expected owner/repo and an optional destination")
+	}
+	storage_config, err := config.LoadStorage()
+	if err != nil {
+		return err
+	}
+	if *location == "" && storage_config.Type == "local" {
+		return errors.New("no backup location provided, set LOCATION or pass -location")
+	}
+	storage, err := newStorage(context.Background(), storage_config, *location)
+	if err != nil {
+		return err
+	}
+
+	fullName := flags.Arg(0)
+	dest := flags.Arg(1)
+	if dest == "" {
+		dest = filepath.Base(strings.TrimSuffix(fullName, "/"))
+	}
+
+	generationSet := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "generation" {
+			generationSet = true
+		}
+	})
+	if generationSet && *date != "" {
+		return errors.New("only one of -generation and -date may be provided")
+	}
+
+	encryption, err := readEncryption(*identity)
+	if err != nil {
+		return err
+	}
+
+	var bundle string
+	if *date != "" {
+		at, perr := parseRestoreDate(*date)
+		if perr != nil {
+			return perr
+		}
+		bundle, err = download.FindBundleAt(storage, fullName, at)
+	} else {
+		bundle, err = download.FindBundle(storage, fullName, *generation)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = download.RestoreBundle(context.Background(), storage, bundle, dest, encryption)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored %s from %s/%s into %s\n", fullName, storageName(storage_config, *location), bundle, dest)
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/josiahbull/gubber/config"
+	"github.com/josiahbull/gubber/download"
+)
+
+// sourceListers returns the listers which discover the repositories of a source, limited to its owners and filter
+func sourceListers(ctx context.Context, source config.Source) ([]download.RepoLister, error) {
+	listers := make([]download.RepoLister, 0)
+	starred := make([]download.RepoLister, 0)
+
+	switch source.Type {
+	case config.SourceGitHub:
+		github := download.NewGitHubAPI(ctx, &source.Token)
+		if source.URL != "" {
+			var err error
+			github, err = download.NewEnterpriseGitHubAPI(ctx, &source.Token, source.APIURL, source.URL)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create github client due to error %w", err)
+			}
+		}
+		listers = append(listers, github)
+
+		// gists are never empty, so are listed separately from repositories
+		if source.Gists {
+			listers = append(listers, download.NewGistLister(github, source.StarredGists))
+		}
+		if source.Starred {
+			starred = append(starred, download.NewStarredLister(github))
+		}
+	case config.SourceGitHubApp:
+		privateKey, err := os.ReadFile(source.PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read github app private key due to error %w", err)
+		}
+		app, err := download.NewGitHubApp(ctx, source.AppID, privateKey, source.APIURL, source.URL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create github app client due to error %w", err)
+		}
+		listers = append(listers, app)
+	case config.SourceGitLab:
+		gitlab, err := download.NewGitLabAPI(ctx, &source.Token, source.URL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create gitlab client due to error %w", err)
+		}
+		listers = append(listers, gitlab)
+	case config.SourceGitea:
+		gitea, err := download.NewGiteaAPI(ctx, &source.Token, source.URL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create gitea client due to error %w", err)
+		}
+		listers = append(listers, gitea)
+	case config.SourceBitbucket:
+		if source.URL == "" {
+			listers = append(listers, download.NewBitbucketCloudAPI(ctx, source.Username, &source.Token))
+			break
+		}
+		bitbucket, err := download.NewBitbucketServerAPI(ctx, source.Username, &source.Token, source.URL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create bitbucket client due to error %w", err)
+		}
+		listers = append(listers, bitbucket)
+	default:
+		return nil, fmt.Errorf("unknown source type %q", source.Type)
+	}
+
+	name := sourceName(source)
+	rules := filterRules(source)
+	for i, lister := range listers {
+		listers[i] = download.NameLister(name, download.NewFilter(lister, rules))
+	}
+	// starred repos belong to other people, so the filters of the source are not applied to them
+	for _, lister := range starred {
+		listers = append(listers, download.NameLister(name, lister))
+	}
+	return listers, nil
+}
+
+// sourceName describes a source in the log without any of its credentials, such as "gitlab source at
+// https://gitlab.example.com"
+func sourceName(source config.Source) string {
+	name := string(source.Type) + " source"
+	if source.URL != "" {
+		name += " at " + source.URL
+	}
+	if len(source.Owners) > 0 {
+		name += " for " + strings.Join(source.Owners, ", ")
+	}
+	return name
+}
+
+// filterRules returns the rules which select the repositories of source to back up
+func filterRules(source config.Source) download.FilterRules {
+	rules := download.FilterRules{
+		Owners:   source.Owners,
+		Include:  source.Include,
+		Exclude:  source.Exclude,
+		Topics:   source.Topics,
+		Forks:    source.Forks,
+		Archived: source.Archived,
+		MaxSize:  source.MaxSizeMB * 1024 * 1024,
+	}
+	for _, visibility := range source.Visibility {
+		rules.Visibility = append(rules.Visibility, download.Visibility(visibility))
+	}
+	return rules
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/josiahbull/gubber/config"
+	"github.com/josiahbull/gubber/download"
+)
+
+// newStorage returns the storage holding the generations, which is the backup location at location unless they are
+// kept in S3
+func newStorage(ctx context.Context, storage config.Storage, location string) (download.Storage, error) {
+	if storage.Type != "s3" {
+		return download.NewLocalStorage(location), nil
+	}
+	return download.NewS3Storage(ctx, download.S3Options{
+		Endpoint:        storage.S3.Endpoint,
+		Region:          storage.S3.Region,
+		Bucket:          storage.S3.Bucket,
+		Prefix:          storage.S3.Prefix,
+		AccessKeyID:     storage.S3.AccessKeyID,
+		SecretAccessKey: storage.S3.SecretAccessKey,
+		PathStyle:       storage.S3.PathStyle,
+		PartSize:        int64(storage.S3.PartSizeMB) << 20,
+	})
+}
+
+// storageName describes where the generations are kept, for the log
+func storageName(storage config.Storage, location string) string {
+	if storage.Type != "s3" {
+		return location
+	}
+	return strings.TrimSuffix("s3://"+storage.S3.Bucket+"/"+strings.Trim(storage.S3.Prefix, "/"), "/")
+}
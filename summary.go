@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/josiahbull/gubber/download"
+)
+
+// runSummary counts what happened to the repositories of one run, so it can be reported once the run is done
+type runSummary struct {
+	listed int
+	// filtered are the repos left out by the filters of their source, and skipped those left out by an override
+	filtered  []download.FilteredRepo
+	skipped   int
+	unchanged int
+	// exported is how many of the unchanged repos were exported without being downloaded
+	exported int
+	// downloaded is how many repos were downloaded, of which failed could not be
+	downloaded int
+	failed     int
+}
+
+// print reports the summary, listing every repo that was filtered out and why
+func (s *runSummary) print() {
+	fmt.Printf("Run summary: %d listed, %d filtered out, %d skipped, %d unchanged (%d exported), %d downloaded, %d failed\n",
+		s.listed, len(s.filtered), s.skipped, s.unchanged, s.exported, s.downloaded-s.failed, s.failed)
+	for _, repo := range s.filtered {
+		fmt.Printf("Filtered out: %s (%s)\n", repo.FullName, repo.Reason)
+	}
+}
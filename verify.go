@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/josiahbull/gubber/config"
+	"github.com/josiahbull/gubber/download"
+)
+
+const verifyUsage = `usage: gubber verify [-location dir] [-identity file]
+
+Checks the size and sha256 checksum of every file in every generation against the manifest of its generation,
+reporting the files which are corrupt, missing or not recorded. When STORAGE is s3 the generations in the bucket are
+checked instead of those in the backup location. The checksums of encrypted files are checked without decrypting
+them, and with an identity file the files are also checked to decrypt.
+`
+
+// errVerifyFailed is returned by verify when files do not match their manifests, after the report was printed
+var errVerifyFailed = errors.New("the backup location failed verification")
+
+// verify implements the `gubber verify` command
+func verify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), verifyUsage)
+		flags.PrintDefaults()
+	}
+	location := flags.String("location", os.Getenv("LOCATION"), "backup location to verify")
+	identity := identityFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return errors.New("unexpected arguments")
+	}
+	storage_config, err := config.LoadStorage()
+	if err != nil {
+		return err
+	}
+	if *location == "" && storage_config.Type == "local" {
+		return errors.New("no backup location provided, set LOCATION or pass -location")
+	}
+	storage, err := newStorage(context.Background(), storage_config, *location)
+	if err != nil {
+		return err
+	}
+	encryption, err := readEncryption(*identity)
+	if err != nil {
+		return err
+	}
+
+	report, err := download.Verify(storage, encryption)
+	if err != nil {
+		return err
+	}
+	printVerifyReport(storageName(storage_config, *location), report)
+	if !report.OK() {
+		return errVerifyFailed
+	}
+	return nil
+}
+
+// printVerifyReport prints every file of the report, followed by a count of each kind of problem
+func printVerifyReport(location string, report *download.VerifyReport) {
+	for _, path := range report.Corrupt {
+		fmt.Println("Corrupt:", path)
+	}
+	for _, path := range report.Missing {
+		fmt.Println("Missing:", path)
+	}
+	for _, path := range report.Unrecorded {
+		fmt.Println("Not in manifest:", path)
+	}
+	for _, path := range report.Undecryptable {
+		fmt.Println("Cannot decrypt:", path)
+	}
+	fmt.Printf("Verified %d files in %s: %d corrupt, %d missing, %d not in manifest, %d cannot be decrypted\n", report.Checked, location, len(report.Corrupt), len(report.Missing), len(report.Unrecorded), len(report.Undecryptable))
+}